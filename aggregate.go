@@ -0,0 +1,77 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type aggKey struct {
+	pid  int
+	path string
+}
+
+type aggRun struct {
+	ev    *event
+	count int
+	start time.Time
+}
+
+// dupAggregator collapses runs of identical eventMessages from the same
+// process into a single event carrying a repeat_count, much like syslog's
+// "last message repeated N times".  The first event of a run is held until
+// a different message arrives from the process or the window expires.
+type dupAggregator struct {
+	sync.Mutex
+	window time.Duration
+	runs   map[aggKey]*aggRun
+}
+
+func newDupAggregator(window time.Duration) *dupAggregator {
+	return &dupAggregator{
+		window: window,
+		runs:   map[aggKey]*aggRun{},
+	}
+}
+
+func (da *dupAggregator) add(ev *event) (out []*event) {
+	key := aggKey{pid: ev.ProcessID, path: ev.ProcessImagePath}
+	now := time.Now()
+	da.Lock()
+	defer da.Unlock()
+	if r, ok := da.runs[key]; ok {
+		if r.ev.EventMessage == ev.EventMessage && now.Sub(r.start) < da.window {
+			r.count++
+			return nil
+		}
+		out = append(out, r.release())
+	}
+	da.runs[key] = &aggRun{ev: ev, count: 1, start: now}
+	return
+}
+
+func (da *dupAggregator) flush(now time.Time, force bool) (out []*event) {
+	da.Lock()
+	defer da.Unlock()
+	for k, r := range da.runs {
+		if force || now.Sub(r.start) >= da.window {
+			out = append(out, r.release())
+			delete(da.runs, k)
+		}
+	}
+	return
+}
+
+func (r *aggRun) release() *event {
+	if r.count > 1 {
+		r.ev.Set("repeat_count", r.count)
+	}
+	return r.ev
+}
@@ -0,0 +1,150 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	anomalyBucket = 10 * time.Second
+	// weight of each bucket in the baseline, roughly an 8 minute memory
+	anomalyAlpha = 0.02
+	// buckets a subsystem must be observed for before it can alert
+	anomalyWarmup = 30
+
+	defaultAnomalyMinRate = 5
+	maxAnomalySubsystems  = 4096
+)
+
+type rateBaseline struct {
+	baseline float64 // entries per second
+	count    int     // entries in the current bucket
+	buckets  int     // buckets observed
+	spiking  bool
+}
+
+type rateAnomaly struct {
+	Type      string  `json:"type"`
+	Subsystem string  `json:"subsystem"`
+	Rate      float64 `json:"rate"`
+	Baseline  float64 `json:"baseline"`
+	Factor    float64 `json:"factor"`
+	Window    string  `json:"window"`
+}
+
+// rateAnomalies keeps a rolling baseline of the entries per second from
+// each subsystem and emits an anomaly entry when a subsystem's rate goes
+// over a multiple of its baseline.  A subsystem only alerts once per spike.
+type rateAnomalies struct {
+	sync.Mutex
+	factor  float64
+	minRate float64
+	subs    map[string]*rateBaseline
+	start   time.Time
+	tmpl    *entry.Entry
+	tag     entry.EntryTag
+	hasTag  bool
+}
+
+func newRateAnomalies(factor, minRate int) *rateAnomalies {
+	if factor <= 1 {
+		return nil
+	}
+	if minRate <= 0 {
+		minRate = defaultAnomalyMinRate
+	}
+	return &rateAnomalies{
+		factor:  float64(factor),
+		minRate: float64(minRate),
+		subs:    map[string]*rateBaseline{},
+		start:   time.Now(),
+	}
+}
+
+func (ra *rateAnomalies) setTag(tag entry.EntryTag) {
+	ra.tag = tag
+	ra.hasTag = true
+}
+
+func (ra *rateAnomalies) add(ev *event) []*event {
+	ra.Lock()
+	defer ra.Unlock()
+	ra.tmpl = ev.ent
+	rb, ok := ra.subs[ev.Subsystem]
+	if !ok {
+		if len(ra.subs) >= maxAnomalySubsystems {
+			return []*event{ev}
+		}
+		rb = &rateBaseline{}
+		ra.subs[ev.Subsystem] = rb
+	}
+	rb.count++
+	return []*event{ev}
+}
+
+// flush closes out a bucket once it has elapsed, checking every subsystem
+// against its baseline before folding the bucket into it.
+func (ra *rateAnomalies) flush(now time.Time, force bool) (out []*event) {
+	ra.Lock()
+	defer ra.Unlock()
+	elapsed := now.Sub(ra.start)
+	if elapsed < anomalyBucket {
+		return
+	}
+	secs := elapsed.Seconds()
+	for sub, rb := range ra.subs {
+		rate := float64(rb.count) / secs
+		if rb.buckets >= anomalyWarmup && rate >= ra.minRate && rate > rb.baseline*ra.factor {
+			if !rb.spiking && ra.tmpl != nil {
+				rb.spiking = true
+				if ev := ra.anomaly(sub, rate, rb.baseline, elapsed); ev != nil {
+					out = append(out, ev)
+				}
+			}
+		} else {
+			rb.spiking = false
+		}
+		if rb.buckets == 0 {
+			rb.baseline = rate
+		} else {
+			rb.baseline += anomalyAlpha * (rate - rb.baseline)
+		}
+		rb.buckets++
+		rb.count = 0
+		// forget subsystems that have gone completely quiet
+		if rb.baseline < 0.001 && rb.buckets > anomalyWarmup {
+			delete(ra.subs, sub)
+		}
+	}
+	ra.start = now
+	return
+}
+
+func (ra *rateAnomalies) anomaly(sub string, rate, baseline float64, window time.Duration) *event {
+	factor := 0.0
+	if baseline > 0 {
+		factor = rate / baseline
+	}
+	ev := newSyntheticEvent(ra.tmpl, rateAnomaly{
+		Type:      `rateAnomaly`,
+		Subsystem: sub,
+		Rate:      rate,
+		Baseline:  baseline,
+		Factor:    factor,
+		Window:    window.String(),
+	})
+	if ev != nil && ra.hasTag {
+		ev.ent.Tag = ra.tag
+	}
+	return ev
+}
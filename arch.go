@@ -0,0 +1,95 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"debug/macho"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	archARM64   = `arm64`
+	archX86     = `x86_64`
+	archRosetta = `x86_64-rosetta`
+	archUniv    = `universal`
+
+	maxArchCache = 4096
+)
+
+// archTagger annotates events with the architecture the emitting process is
+// built for.  On Apple Silicon an x86_64-only image must be running under
+// Rosetta so it is reported as such.  Results are cached by image path.
+type archTagger struct {
+	sync.Mutex
+	appleSilicon bool
+	cache        map[string]string
+}
+
+func newArchTagger() *archTagger {
+	return &archTagger{
+		appleSilicon: isAppleSilicon(),
+		cache:        map[string]string{},
+	}
+}
+
+func (a *archTagger) enrich(ev *event) {
+	if ev.ProcessImagePath == `` {
+		return
+	}
+	if arch := a.lookup(ev.ProcessImagePath); arch != `` {
+		ev.Set("arch", arch)
+	}
+}
+
+func (a *archTagger) lookup(path string) string {
+	a.Lock()
+	defer a.Unlock()
+	arch, ok := a.cache[path]
+	if !ok {
+		arch = a.imageArch(path)
+		if len(a.cache) >= maxArchCache {
+			a.cache = map[string]string{}
+		}
+		a.cache[path] = arch
+	}
+	return arch
+}
+
+// imageArch inspects the Mach-O headers of an image, an empty string is
+// returned if the image can't be read.
+func (a *archTagger) imageArch(path string) string {
+	if ff, err := macho.OpenFat(path); err == nil {
+		ff.Close()
+		return archUniv
+	}
+	f, err := macho.Open(path)
+	if err != nil {
+		return ``
+	}
+	defer f.Close()
+	switch f.Cpu {
+	case macho.CpuArm64:
+		return archARM64
+	case macho.CpuAmd64:
+		if a.appleSilicon {
+			return archRosetta
+		}
+		return archX86
+	}
+	return strings.TrimPrefix(strings.ToLower(f.Cpu.String()), "cpu")
+}
+
+// isAppleSilicon checks the hardware rather than runtime.GOARCH, which would
+// report amd64 if the ingester itself were running under Rosetta.
+func isAppleSilicon() bool {
+	out, err := exec.Command("sysctl", "-n", "hw.optional.arm64").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "1"
+}
@@ -0,0 +1,355 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultASLTag      = `macos-asl`
+	defaultASLInterval = `5m`
+	defaultASLDir      = `/var/log/asl`
+	defaultASLStore    = `/opt/gravwell/etc/macosLog.asl`
+	defaultASLMaxAge   = 24 * time.Hour
+)
+
+// ASL levels by number
+var aslLevels = []string{`Emergency`, `Alert`, `Critical`, `Error`, `Warning`, `Notice`, `Info`, `Debug`}
+
+// aslConfig is the [ASL] block.
+type aslConfig struct {
+	Enable         bool
+	Tag_Name       string
+	Interval       string   // how often the stores are checked for new records
+	Directory      []string // defaults to /var/log/asl
+	Max_Age        string   // store files not written to in this long are left alone
+	Store_Location string   // file the last record read from each store is tracked in
+}
+
+func (ac *aslConfig) verify() error {
+	if !ac.Enable {
+		return nil
+	}
+	if ac.Tag_Name == `` {
+		ac.Tag_Name = defaultASLTag
+	}
+	if ac.Interval == `` {
+		ac.Interval = defaultASLInterval
+	}
+	if _, err := (snapshotConfig{Interval: ac.Interval}).interval(); err != nil {
+		return fmt.Errorf("ASL: %v", err)
+	}
+	if _, err := ac.maxAge(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ac aslConfig) maxAge() (time.Duration, error) {
+	if ac.Max_Age == `` {
+		return defaultASLMaxAge, nil
+	}
+	d, err := time.ParseDuration(ac.Max_Age)
+	if err != nil {
+		return 0, fmt.Errorf("ASL: Invalid Max-Age %q: %v", ac.Max_Age, err)
+	}
+	return d, nil
+}
+
+func (ac aslConfig) directories() []string {
+	if len(ac.Directory) == 0 {
+		return []string{defaultASLDir}
+	}
+	return ac.Directory
+}
+
+func (ac aslConfig) storeLocation() string {
+	if ac.Store_Location == `` {
+		return defaultASLStore
+	}
+	return ac.Store_Location
+}
+
+// aslRecord is the entry written for each ASL record, the well known keys
+// are pulled out and every key is kept under Keys.
+type aslRecord struct {
+	Type     string            `json:"type"`
+	Store    string            `json:"store"`
+	ID       uint64            `json:"id"`
+	Host     string            `json:"host,omitempty"`
+	Sender   string            `json:"sender,omitempty"`
+	Facility string            `json:"facility,omitempty"`
+	PID      int               `json:"pid,omitempty"`
+	UID      *int              `json:"uid,omitempty"`
+	Level    string            `json:"level,omitempty"`
+	Message  string            `json:"message"`
+	Keys     map[string]string `json:"keys"`
+}
+
+// aslPos is how far a store file has been read.
+type aslPos struct {
+	ID uint64 `json:"id"` // the last ASLMessageID ingested
+}
+
+// aslCollector reads the legacy ASL store files with syslog -f, which
+// does the binary decoding, and ingests the records that are new since
+// the last check.
+type aslCollector struct {
+	tag       entry.EntryTag
+	interval  time.Duration
+	maxAge    time.Duration
+	dirs      []string
+	src       *sourceTracker
+	store     string
+	ephemeral bool
+	pos       map[string]aslPos
+	dirty     bool
+}
+
+func startASLCollector(ctx context.Context, wg *sync.WaitGroup, cfg aslConfig, src *sourceTracker, ephemeral bool) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve ASL tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	maxAge, err := cfg.maxAge()
+	if err != nil {
+		return err
+	}
+	ac := &aslCollector{
+		tag:       tag,
+		interval:  interval,
+		maxAge:    maxAge,
+		dirs:      cfg.directories(),
+		src:       src,
+		store:     cfg.storeLocation(),
+		ephemeral: ephemeral,
+		pos:       map[string]aslPos{},
+	}
+	if b, err := os.ReadFile(ac.store); err == nil {
+		if err = json.Unmarshal(b, &ac.pos); err != nil {
+			lg.Warn("Ignoring unreadable ASL store %s: %v\n", ac.store, err)
+		}
+	}
+	wg.Add(1)
+	go ac.run(ctx, wg)
+	return nil
+}
+
+func (ac *aslCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(ac.interval)
+	defer tckr.Stop()
+	for {
+		if err := ac.scan(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to ingest ASL records: %v\n", err)
+		}
+		ac.persist()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (ac *aslCollector) persist() {
+	if !ac.dirty || ac.ephemeral {
+		return
+	}
+	b, err := json.Marshal(ac.pos)
+	if err == nil {
+		err = writeFileAtomic(ac.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save ASL positions: %v\n", err)
+		return
+	}
+	ac.dirty = false
+}
+
+func (ac *aslCollector) scan(ctx context.Context) error {
+	now := time.Now()
+	present := map[string]bool{}
+	for _, dir := range ac.dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				lg.Debug("Failed to read %s: %v\n", dir, err)
+			}
+			continue
+		}
+		for _, fi := range fis {
+			if filepath.Ext(fi.Name()) != `.asl` || !fi.Mode().IsRegular() {
+				continue
+			}
+			p := filepath.Join(dir, fi.Name())
+			present[p] = true
+			if ac.maxAge > 0 && now.Sub(fi.ModTime()) > ac.maxAge {
+				continue
+			}
+			if err := ac.read(ctx, p); err != nil {
+				if ctx.Err() != nil {
+					return context.Canceled
+				}
+				lg.Warn("Failed to read ASL store %s: %v\n", p, err)
+			}
+		}
+	}
+	for p := range ac.pos {
+		if !present[p] {
+			delete(ac.pos, p)
+			ac.dirty = true
+		}
+	}
+	return nil
+}
+
+// read ingests the records of a store file past the last one seen.
+func (ac *aslCollector) read(ctx context.Context, p string) error {
+	last := ac.pos[p].ID
+	cmd := exec.CommandContext(ctx, "syslog", "-F", "raw", "-f", p, "-k", "ASLMessageID", "Ngt", strconv.FormatUint(last, 10))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	err = parseASLRaw(out, func(keys map[string]string) error {
+		rec, ts := newASLRecord(p, keys)
+		if rec.ID <= last {
+			return nil
+		}
+		if err := emitJSON(ctx, ac.tag, ac.src, ts, rec); err != nil {
+			return err
+		}
+		ac.pos[p] = aslPos{ID: rec.ID}
+		ac.dirty = true
+		return nil
+	})
+	if err != nil {
+		// stop the child rather than leave it blocked on a full pipe
+		cmd.Process.Kill()
+		io.Copy(ioutil.Discard, out)
+	}
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func newASLRecord(store string, keys map[string]string) (rec aslRecord, ts time.Time) {
+	rec = aslRecord{
+		Type:     `asl`,
+		Store:    store,
+		Host:     keys[`Host`],
+		Sender:   keys[`Sender`],
+		Facility: keys[`Facility`],
+		Message:  keys[`Message`],
+		Keys:     keys,
+	}
+	rec.ID, _ = strconv.ParseUint(keys[`ASLMessageID`], 10, 64)
+	rec.PID, _ = strconv.Atoi(keys[`PID`])
+	if uid, err := strconv.Atoi(keys[`UID`]); err == nil {
+		rec.UID = &uid
+	}
+	if lvl, err := strconv.Atoi(keys[`Level`]); err == nil && lvl >= 0 && lvl < len(aslLevels) {
+		rec.Level = aslLevels[lvl]
+	}
+	if sec, err := strconv.ParseInt(keys[`Time`], 10, 64); err == nil {
+		nsec, _ := strconv.ParseInt(keys[`TimeNanoSec`], 10, 64)
+		ts = time.Unix(sec, nsec)
+	} else {
+		ts = time.Now()
+	}
+	return
+}
+
+// parseASLRaw reads syslog -F raw output, a line of "[Key Value]" groups
+// per record.  Brackets and backslashes inside values are backslash
+// escaped, a value may span lines.
+func parseASLRaw(r io.Reader, fn func(map[string]string) error) error {
+	br := bufio.NewReader(r)
+	var keys map[string]string
+	var group strings.Builder
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if c == '\n' && len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+			keys = nil
+		}
+		if c != '[' {
+			continue
+		}
+		group.Reset()
+		for {
+			if c, err = br.ReadByte(); err != nil {
+				break
+			} else if c == '\\' {
+				if c, err = br.ReadByte(); err != nil {
+					break
+				}
+			} else if c == ']' {
+				break
+			}
+			group.WriteByte(c)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		kv := group.String()
+		key, val := kv, ``
+		if i := strings.IndexByte(kv, ' '); i >= 0 {
+			key, val = kv[:i], kv[i+1:]
+		}
+		if _, dup := keys[key]; dup {
+			if err := fn(keys); err != nil {
+				return err
+			}
+			keys = nil
+		}
+		if keys == nil {
+			keys = map[string]string{}
+		}
+		keys[key] = val
+	}
+	if len(keys) > 0 {
+		return fn(keys)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+var (
+	globalSectionRegex = regexp.MustCompile(`(?m)^\s*\[[Gg]lobal\]\s*$`)
+	uuidLineRegex      = regexp.MustCompile(`(?mi)^\s*Ingester-UUID\s*=.*$`)
+)
+
+// writeFileAtomic replaces path with data such that a crash leaves either
+// the old or the new contents, never a mix.  The data is written to a
+// temporary file in the same directory, synced, and renamed over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// setIngesterUUID writes a new ingester UUID into the Global section of the
+// config file atomically, the library version rewrites the file in place
+// and a crash part way through leaves a corrupt config.
+func setIngesterUUID(g *global, id uuid.UUID, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if b, err = putUUIDLine(b, []byte(fmt.Sprintf(`Ingester-UUID="%s"`, id.String()))); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(path, b, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	g.Ingester_UUID = id.String()
+	return nil
+}
+
+// putUUIDLine replaces the Ingester-UUID line in a config, or adds it to
+// the Global section if there isn't one.
+func putUUIDLine(b, line []byte) ([]byte, error) {
+	if loc := uuidLineRegex.FindIndex(b); loc != nil {
+		return append(b[:loc[0]:loc[0]], append(line, b[loc[1]:]...)...), nil
+	}
+	loc := globalSectionRegex.FindIndex(b)
+	if loc == nil {
+		return nil, errors.New("Failed to find the Global section to add an ingester UUID to")
+	}
+	var nb bytes.Buffer
+	nb.Write(b[:loc[1]])
+	nb.WriteByte('\n')
+	nb.Write(line)
+	nb.Write(b[loc[1]:])
+	return nb.Bytes(), nil
+}
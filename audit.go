@@ -0,0 +1,470 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultAuditTag   = `macos-audit`
+	defaultAuditDir   = `/var/audit`
+	defaultAuditStore = `/opt/gravwell/etc/macosLog.audit`
+	auditPoll         = time.Second
+	maxAuditBatch     = 4 * 1024 * 1024 // bytes of records handed to each praudit run
+	maxAuditRecord    = 1024 * 1024     // anything claiming to be larger is corruption
+
+	auditTimeFormat = `Mon Jan _2 15:04:05 2006`
+)
+
+// BSM token ids a record or trail can start with, from bsm/audit_record.h
+const (
+	autOtherFile32 = 0x11
+	autHeader32    = 0x14
+	autHeader32Ex  = 0x15
+	autHeader64    = 0x74
+	autHeader64Ex  = 0x79
+)
+
+// auditConfig is the [Audit] block.
+type auditConfig struct {
+	Enable         bool
+	Tag_Name       string
+	Directory      string // the audit trail directory, defaults to /var/audit
+	Read_Existing  bool   // a first run reads the current trail from the start rather than the end
+	Store_Location string // file the trail position is tracked in
+}
+
+func (ac *auditConfig) verify() error {
+	if !ac.Enable {
+		return nil
+	}
+	if ac.Tag_Name == `` {
+		ac.Tag_Name = defaultAuditTag
+	}
+	if ac.Directory == `` {
+		ac.Directory = defaultAuditDir
+	}
+	return nil
+}
+
+func (ac auditConfig) storeLocation() string {
+	if ac.Store_Location == `` {
+		return defaultAuditStore
+	}
+	return ac.Store_Location
+}
+
+// auditRecord is the entry written for each BSM record.  The subject,
+// return, path, text, and exec arguments are pulled out, every token is
+// kept in order under Tokens.
+type auditRecord struct {
+	Type     string            `json:"type"`
+	Event    string            `json:"event"`
+	Modifier string            `json:"modifier,omitempty"`
+	Subject  map[string]string `json:"subject,omitempty"`
+	Return   map[string]string `json:"return,omitempty"`
+	Paths    []string          `json:"paths,omitempty"`
+	Text     []string          `json:"text,omitempty"`
+	ExecArgs []string          `json:"exec_args,omitempty"`
+	Tokens   []auditToken      `json:"tokens"`
+}
+
+type auditToken struct {
+	Token  string            `json:"token"`
+	Attrs  map[string]string `json:"attrs,omitempty"`
+	Text   string            `json:"text,omitempty"`
+	Values []string          `json:"values,omitempty"` // nested elements, e.g. exec args
+}
+
+// xmlNode is any praudit -x element.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+func (n xmlNode) attrs() map[string]string {
+	if len(n.Attrs) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(n.Attrs))
+	for _, a := range n.Attrs {
+		m[a.Name.Local] = strings.TrimSpace(a.Value)
+	}
+	return m
+}
+
+// auditCollector follows the audit trail auditd is writing, the current
+// symlink, across rotations.  Complete records are split out natively so
+// the position always falls between records, then converted by praudit.
+type auditCollector struct {
+	tag       entry.EntryTag
+	dir       string
+	src       *sourceTracker
+	store     string
+	ephemeral bool
+	fromEnd   bool
+	f         *os.File
+	pos       followPos
+	saved     followPos
+	pending   []byte // a partial record at the end of the trail
+}
+
+func startAuditCollector(ctx context.Context, wg *sync.WaitGroup, cfg auditConfig, src *sourceTracker, ephemeral bool) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve audit tag %q: %v", cfg.Tag_Name, err)
+	}
+	if _, err := exec.LookPath("praudit"); err != nil {
+		return fmt.Errorf("Audit collector needs praudit: %v", err)
+	}
+	ac := &auditCollector{
+		tag:       tag,
+		dir:       cfg.Directory,
+		src:       src,
+		store:     cfg.storeLocation(),
+		ephemeral: ephemeral,
+		fromEnd:   !cfg.Read_Existing,
+	}
+	if b, err := os.ReadFile(ac.store); err == nil {
+		if err = json.Unmarshal(b, &ac.pos); err != nil {
+			lg.Warn("Ignoring unreadable audit store %s: %v\n", ac.store, err)
+		}
+	}
+	ac.saved = ac.pos
+	wg.Add(1)
+	go ac.run(ctx, wg)
+	return nil
+}
+
+func (ac *auditCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer ac.persist()
+	defer ac.close()
+	tckr := time.NewTicker(auditPoll)
+	defer tckr.Stop()
+	save := time.NewTicker(filesPersist)
+	defer save.Stop()
+	for {
+		if err := ac.poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			lg.Warn("Failed to read the audit trail: %v\n", err)
+			// picked up again at the saved position
+			ac.close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		case <-save.C:
+			ac.persist()
+		}
+	}
+}
+
+func (ac *auditCollector) persist() {
+	if ac.ephemeral || ac.pos == ac.saved {
+		return
+	}
+	b, err := json.Marshal(ac.pos)
+	if err == nil {
+		err = writeFileAtomic(ac.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save the audit trail position: %v\n", err)
+		return
+	}
+	ac.saved = ac.pos
+}
+
+func (ac *auditCollector) close() {
+	if ac.f != nil {
+		ac.f.Close()
+		ac.f = nil
+	}
+	ac.pending = nil
+}
+
+// open opens the current trail.  When the trail was rotated since the
+// position was saved, the rest of the old trail is found by its inode and
+// read first.
+func (ac *auditCollector) open() error {
+	cur := filepath.Join(ac.dir, `current`)
+	fi, err := os.Stat(cur)
+	if err != nil {
+		return err
+	}
+	p, ino := cur, fileInode(fi)
+	if ac.pos.Inode != 0 && ac.pos.Inode != ino {
+		if old := findByInode(ac.dir, ac.pos.Inode); old != `` {
+			lg.Info("Reading the rest of rotated audit trail %s\n", old)
+			p, ino = old, ac.pos.Inode
+		}
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	if fi, err = f.Stat(); err != nil {
+		f.Close()
+		return err
+	}
+	switch {
+	case ac.pos.Inode == ino && ac.pos.Offset <= fi.Size():
+	case ac.pos.Inode == 0 && ac.fromEnd:
+		ac.pos.Offset = fi.Size()
+	default:
+		ac.pos.Offset = 0
+	}
+	if _, err = f.Seek(ac.pos.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	ac.f, ac.pos.Inode, ac.pending = f, ino, nil
+	return nil
+}
+
+// findByInode looks for the file in dir that is inode, a rotated trail is
+// renamed rather than copied.
+func findByInode(dir string, inode uint64) string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ``
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && fileInode(fi) == inode {
+			return filepath.Join(dir, fi.Name())
+		}
+	}
+	return ``
+}
+
+// poll ingests the records written since the last poll and moves on to the
+// new trail after a rotation.
+func (ac *auditCollector) poll(ctx context.Context) error {
+	if ac.f == nil {
+		if err := ac.open(); err != nil {
+			if os.IsNotExist(err) {
+				// auditd isn't running or hasn't started a trail
+				return nil
+			}
+			return err
+		}
+	}
+	if err := ac.drain(ctx); err != nil {
+		return err
+	}
+	fi, err := os.Stat(filepath.Join(ac.dir, `current`))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// between trails
+			return nil
+		}
+		return err
+	}
+	if fileInode(fi) == ac.pos.Inode {
+		return nil
+	}
+	lg.Debug("Audit trail rotated, following the new trail\n")
+	ac.close()
+	ac.pos, ac.fromEnd = followPos{}, false
+	if err := ac.open(); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ac.drain(ctx)
+}
+
+// drain reads the open trail to its end, ingesting complete records.
+func (ac *auditCollector) drain(ctx context.Context) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := ac.f.Read(buf)
+		ac.pending = append(ac.pending, buf[:n]...)
+		for len(ac.pending) >= maxAuditBatch || (n == 0 && len(ac.pending) > 0) {
+			used, skipped := splitAuditRecords(ac.pending, maxAuditBatch)
+			if skipped > 0 {
+				lg.Warn("Skipped %d bytes of unrecognized audit data at offset %d\n", skipped, ac.pos.Offset)
+			}
+			if used > skipped {
+				if perr := ac.ingest(ctx, ac.pending[skipped:used]); perr != nil {
+					return perr
+				}
+			}
+			ac.pos.Offset += int64(used)
+			ac.pending = append(ac.pending[:0], ac.pending[used:]...)
+			if used == 0 {
+				// only a partial record left
+				break
+			}
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// splitAuditRecords returns how many leading bytes of b are complete
+// records, up to about max, and how many leading bytes of those were not
+// records at all.
+func splitAuditRecords(b []byte, max int) (used, skipped int) {
+	for used < len(b) && used < max {
+		n := auditTokenLen(b[used:])
+		if n < 0 {
+			if used == skipped {
+				// resync by skipping to the next plausible record
+				used++
+				skipped++
+				continue
+			}
+			break
+		} else if n == 0 || used+n > len(b) {
+			break
+		}
+		used += n
+	}
+	return
+}
+
+// auditTokenLen returns the length of the record or file token that
+// starts b, 0 if b is too short to tell, -1 if it isn't one.
+func auditTokenLen(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	switch b[0] {
+	case autHeader32, autHeader32Ex, autHeader64, autHeader64Ex:
+		if len(b) < 5 {
+			return 0
+		}
+		n := int(binary.BigEndian.Uint32(b[1:5]))
+		if n < 5 || n > maxAuditRecord {
+			return -1
+		}
+		return n
+	case autOtherFile32:
+		// id, seconds, milliseconds, name length, name
+		if len(b) < 11 {
+			return 0
+		}
+		return 11 + int(binary.BigEndian.Uint16(b[9:11]))
+	}
+	return -1
+}
+
+// ingest converts a run of complete records with praudit and writes them.
+func (ac *auditCollector) ingest(ctx context.Context, records []byte) error {
+	cmd := exec.CommandContext(ctx, "praudit", "-x", "-l")
+	cmd.Stdin = bytes.NewReader(records)
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// retrying the same records would fail the same way
+		lg.Warn("praudit failed, skipping %d bytes of audit records: %v\n", len(records), err)
+		return nil
+	}
+	return parseAuditXML(out, func(ar auditRecord, ts time.Time) error {
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		return emitJSON(ctx, ac.tag, ac.src, ts, ar)
+	})
+}
+
+// parseAuditXML reads praudit -x output, every record element is one
+// record.
+func parseAuditXML(out []byte, fn func(auditRecord, time.Time) error) error {
+	dec := xml.NewDecoder(bytes.NewReader(out))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != `record` {
+			continue
+		}
+		var n xmlNode
+		if err := dec.DecodeElement(&n, &se); err != nil {
+			return err
+		}
+		ar, ts := newAuditRecord(n)
+		if err := fn(ar, ts); err != nil {
+			return err
+		}
+	}
+}
+
+func newAuditRecord(n xmlNode) (ar auditRecord, ts time.Time) {
+	attrs := n.attrs()
+	ar = auditRecord{
+		Type:     `bsm`,
+		Event:    attrs[`event`],
+		Modifier: attrs[`modifier`],
+		Tokens:   make([]auditToken, 0, len(n.Nodes)),
+	}
+	if t, err := time.ParseInLocation(auditTimeFormat, attrs[`time`], time.Local); err == nil {
+		// msec=" + 345 msec"
+		ms, _ := strconv.Atoi(strings.Trim(attrs[`msec`], " +msec"))
+		ts = t.Add(time.Duration(ms) * time.Millisecond)
+	}
+	for _, c := range n.Nodes {
+		tok := auditToken{
+			Token: c.XMLName.Local,
+			Attrs: c.attrs(),
+			Text:  strings.TrimSpace(c.Text),
+		}
+		for _, v := range c.Nodes {
+			tok.Values = append(tok.Values, strings.TrimSpace(v.Text))
+		}
+		switch tok.Token {
+		case `subject`:
+			ar.Subject = tok.Attrs
+		case `return`:
+			ar.Return = tok.Attrs
+		case `path`:
+			ar.Paths = append(ar.Paths, tok.Text)
+		case `text`:
+			ar.Text = append(ar.Text, tok.Text)
+		case `exec_args`:
+			ar.ExecArgs = tok.Values
+		}
+		ar.Tokens = append(ar.Tokens, tok)
+	}
+	return
+}
@@ -0,0 +1,340 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultAuthTag      = `macos-auth`
+	defaultAuthInterval = `30s`
+	authStreamName      = `auth`
+)
+
+// the records of sudo and su, and the authentication and session records
+// of opendirectoryd and loginwindow
+const authPredicate = `process == "sudo" OR process == "su" OR ` +
+	`(process == "opendirectoryd" AND (category == "auth" OR eventMessage CONTAINS[c] "authentication")) OR ` +
+	`(process == "loginwindow" AND (eventMessage CONTAINS[c] "login" OR eventMessage CONTAINS[c] "logout" OR eventMessage CONTAINS[c] "screenIs"))`
+
+var (
+	// "Authentication failed for user 'bob'", "authentication succeeded"
+	authResultRegex = regexp.MustCompile(`(?i)auth(?:entication)? (succeeded|success|successful|failed|failure|denied)`)
+	authUserRegex   = regexp.MustCompile(`(?i)\b(?:for user|user|username|record)[:= ]+['"<]?([A-Za-z0-9._@-]+)`)
+
+	// "su: BAD SU bob to root on /dev/ttys000", "bob to root on /dev/ttys000"
+	suRegex = regexp.MustCompile(`(BAD SU )?([A-Za-z0-9._-]+) to ([A-Za-z0-9._-]+) on (\S+)`)
+)
+
+// authConfig is the [Auth-Events] block, it turns on a stream of the
+// authentication records and polls utmpx for login sessions.
+type authConfig struct {
+	Enable   bool
+	Tag_Name string
+	Interval string // how often utmpx is checked for sessions that started or ended
+}
+
+func (ac *authConfig) verify() error {
+	if !ac.Enable {
+		return nil
+	}
+	if ac.Tag_Name == `` {
+		ac.Tag_Name = defaultAuthTag
+	}
+	if ac.Interval == `` {
+		ac.Interval = defaultAuthInterval
+	}
+	if _, err := (snapshotConfig{Interval: ac.Interval}).interval(); err != nil {
+		return fmt.Errorf("Auth-Events: %v", err)
+	}
+	return nil
+}
+
+// authFields are the normalized fields, the auth field of the streamed
+// records and the body of the utmpx session entries.
+type authFields struct {
+	Event      string `json:"event"` // login, logout, sudo, su, authentication, screen_lock, screen_unlock
+	Result     string `json:"result,omitempty"`
+	User       string `json:"user,omitempty"`
+	TargetUser string `json:"target_user,omitempty"`
+	TTY        string `json:"tty,omitempty"`
+	RemoteHost string `json:"remote_host,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// identities lets a Scrub-Profile or the pseudonymizer reach the account
+// names, remote host, and command.
+func (af *authFields) identities(fn func(name string, kind int, v *string)) {
+	fn(`user`, identityUser, &af.User)
+	fn(`target_user`, identityUser, &af.TargetUser)
+	fn(`remote_host`, identityHost, &af.RemoteHost)
+	fn(`command`, identityPath, &af.Command)
+}
+
+// authSession is the entry written when a utmpx session starts or ends.
+type authSession struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	authFields
+	LoginTime string `json:"login_time,omitempty"`
+}
+
+// authNormalizer pulls the user, tty, remote host, and result out of the
+// authentication records into an auth field.
+type authNormalizer struct{}
+
+func (authNormalizer) enrich(ev *event) {
+	var af authFields
+	var ok bool
+	switch filepath.Base(ev.ProcessImagePath) {
+	case `sudo`:
+		af, ok = parseSudoMessage(ev.EventMessage)
+	case `su`:
+		af, ok = parseSuMessage(ev.EventMessage)
+	case `opendirectoryd`:
+		af, ok = parseODAuthMessage(ev.EventMessage)
+	case `loginwindow`:
+		af, ok = parseLoginwindowMessage(ev.EventMessage)
+	}
+	if ok {
+		ev.Set("auth", &af)
+	}
+}
+
+// parseSudoMessage handles sudo's log line,
+// "bob : TTY=ttys000 ; PWD=/Users/bob ; USER=root ; COMMAND=/usr/bin/id".
+// Anything that isn't KEY=value, "3 incorrect password attempts" or
+// "user NOT in sudoers", is a failure.
+func parseSudoMessage(msg string) (af authFields, ok bool) {
+	i := strings.Index(msg, ` : `)
+	if i <= 0 {
+		return
+	}
+	af = authFields{Event: `sudo`, Result: `success`, User: strings.TrimSpace(msg[:i])}
+	for _, part := range strings.Split(msg[i+3:], ` ; `) {
+		part = strings.TrimSpace(part)
+		eq := strings.IndexByte(part, '=')
+		if eq <= 0 || strings.ToUpper(part[:eq]) != part[:eq] {
+			af.Result, af.Reason = `failure`, part
+			continue
+		}
+		switch part[:eq] {
+		case `TTY`:
+			af.TTY = part[eq+1:]
+		case `USER`:
+			af.TargetUser = part[eq+1:]
+		case `COMMAND`:
+			af.Command = part[eq+1:]
+		}
+	}
+	return af, true
+}
+
+func parseSuMessage(msg string) (af authFields, ok bool) {
+	m := suRegex.FindStringSubmatch(msg)
+	if m == nil {
+		return
+	}
+	af = authFields{Event: `su`, Result: `success`, User: m[2], TargetUser: m[3], TTY: strings.TrimPrefix(m[4], `/dev/`)}
+	if m[1] != `` {
+		af.Result = `failure`
+	}
+	return af, true
+}
+
+func parseODAuthMessage(msg string) (af authFields, ok bool) {
+	m := authResultRegex.FindStringSubmatch(msg)
+	if m == nil {
+		return
+	}
+	af = authFields{Event: `authentication`, Result: `success`}
+	switch strings.ToLower(m[1]) {
+	case `failed`, `failure`, `denied`:
+		af.Result = `failure`
+	}
+	if u := authUserRegex.FindStringSubmatch(msg); u != nil {
+		af.User = u[1]
+	}
+	return af, true
+}
+
+func parseLoginwindowMessage(msg string) (af authFields, ok bool) {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, `screenIsLocked`):
+		af.Event = `screen_lock`
+	case strings.Contains(msg, `screenIsUnlocked`):
+		af.Event = `screen_unlock`
+	case strings.Contains(lower, `logout`):
+		af.Event = `logout`
+	case strings.Contains(lower, `login`):
+		af.Event = `login`
+	default:
+		return
+	}
+	if m := authResultRegex.FindStringSubmatch(msg); m != nil {
+		af.Result = `success`
+		switch strings.ToLower(m[1]) {
+		case `failed`, `failure`, `denied`:
+			af.Result = `failure`
+		}
+	}
+	if u := authUserRegex.FindStringSubmatch(msg); u != nil {
+		af.User = u[1]
+	}
+	return af, true
+}
+
+// utmpxSession is a line of who output, one of the sessions in utmpx.
+type utmpxSession struct {
+	user, tty, host, since string
+}
+
+func (s utmpxSession) key() string {
+	return s.user + "\x00" + s.tty + "\x00" + s.since
+}
+
+// authCollector polls utmpx with who, writing a login entry for each new
+// session and a logout entry for each that ended.  The sessions open at
+// the first poll are the baseline.
+type authCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	src      *sourceTracker
+	pl       *pipeline // scrubs and pseudonymizes the session fields
+	last     map[string]utmpxSession
+}
+
+func startAuthCollector(ctx context.Context, wg *sync.WaitGroup, cfg authConfig, src *sourceTracker, pl *pipeline) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve auth tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	ac := &authCollector{
+		tag:      tag,
+		interval: interval,
+		src:      src,
+		pl:       pl,
+	}
+	wg.Add(1)
+	go ac.run(ctx, wg)
+	return nil
+}
+
+func (ac *authCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(ac.interval)
+	defer tckr.Stop()
+	for {
+		if err := ac.poll(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to check login sessions: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (ac *authCollector) poll(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "who").Output()
+	if ctx.Err() != nil {
+		return context.Canceled
+	} else if err != nil {
+		return err
+	}
+	cur := map[string]utmpxSession{}
+	for _, s := range parseWho(string(out)) {
+		cur[s.key()] = s
+	}
+	if ac.last != nil {
+		now := time.Now()
+		for _, as := range diffSessions(ac.last, cur) {
+			// the same field names as the stream's auth field
+			ac.pl.protect(`auth`, &as.authFields)
+			if err := emitJSON(ctx, ac.tag, ac.src, now, as); err != nil {
+				return err
+			}
+		}
+	}
+	ac.last = cur
+	return nil
+}
+
+// diffSessions returns a login for each session that started and a logout
+// for each that ended.
+func diffSessions(prev, cur map[string]utmpxSession) (out []authSession) {
+	session := func(s utmpxSession, event string) authSession {
+		return authSession{
+			Type:       `auth`,
+			Source:     `utmpx`,
+			authFields: authFields{Event: event, Result: `success`, User: s.user, TTY: s.tty, RemoteHost: s.host},
+			LoginTime:  s.since,
+		}
+	}
+	for _, k := range sortedSessionKeys(prev) {
+		if _, ok := cur[k]; !ok {
+			out = append(out, session(prev[k], `logout`))
+		}
+	}
+	for _, k := range sortedSessionKeys(cur) {
+		if _, ok := prev[k]; !ok {
+			out = append(out, session(cur[k], `login`))
+		}
+	}
+	return
+}
+
+func sortedSessionKeys(m map[string]utmpxSession) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseWho reads who output, "bob  ttys000  Jun  5 10:00  (192.168.1.5)",
+// the remote host is only there for remote sessions.
+func parseWho(out string) (sessions []utmpxSession) {
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 5 {
+			continue
+		}
+		s := utmpxSession{user: f[0], tty: f[1], since: strings.Join(f[2:5], ` `)}
+		if last := f[len(f)-1]; len(f) > 5 && strings.HasPrefix(last, `(`) && strings.HasSuffix(last, `)`) {
+			s.host = strings.Trim(last, `()`)
+		}
+		sessions = append(sessions, s)
+	}
+	return
+}
@@ -0,0 +1,94 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBackfill = 24 * time.Hour
+
+	// log show wants local time without a zone
+	logShowTimeFormat = `2006-01-02 15:04:05`
+)
+
+// backfill ingests the records logged between the last checkpoint and the
+// time the live stream started using log show.  It runs alongside the live
+// stream, any overlap with records ingested before the restart is handled
+// by deduplication when enabled.
+func backfill(ctx context.Context, wg *sync.WaitGroup, start, end time.Time, ls *logStream, src *sourceTracker, pl *pipeline, sc *stderrCapture) {
+	defer wg.Done()
+	rc := ls.ctl.config()
+	rc.backlog = true
+	lg.Info("Backfilling stream %s from %v to %v\n", ls.name, start, end)
+	cmd := logCommand(ctx, rc.backfillQoS, logArgs("show", rc.predicate,
+		"--start", start.Local().Format(logShowTimeFormat),
+		"--end", end.Local().Format(logShowTimeFormat))...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		lg.Error("Failed to get backfill stdoutpipe: %v\n", err)
+		return
+	}
+	errOut, err := cmd.StderrPipe()
+	if err != nil {
+		lg.Error("Failed to get backfill stderrpipe: %v\n", err)
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		lg.Error("Failed to start backfill: %v\n", err)
+		return
+	}
+	reniceChild(cmd.Process, rc.backfillNice)
+	stderrDone := make(chan struct{})
+	go func() {
+		sc.consume(ctx, "log show", errOut)
+		close(stderrDone)
+	}()
+	dec := newDecoder(out, rc)
+	dec.workers = rc.parseWorkers
+	if err = ingestEntries(ctx, dec, rc, ls, src, pl); err != nil && err != io.EOF {
+		if err != context.Canceled {
+			lg.Error("Backfill failed: %v\n", err)
+		}
+		cmd.Process.Kill()
+	}
+	<-stderrDone
+	if err = cmd.Wait(); err != nil && ctx.Err() == nil {
+		lg.Warn("log show exited with %v\n", err)
+	}
+	lg.Info("Backfill complete\n")
+}
+
+// logArgs builds the arguments for a log subcommand producing JSON.
+func logArgs(sub, predicate string, extra ...string) []string {
+	args := []string{sub, "--style=json"}
+	if predicate != `` {
+		args = append(args, "--predicate", predicate)
+	}
+	return append(args, extra...)
+}
+
+// backfillWindow works out where a backfill should start, the start is
+// clamped so a long outage doesn't trigger an enormous replay.
+func backfillWindow(ckpt, now time.Time, max time.Duration) (start time.Time, ok bool) {
+	if ckpt.IsZero() || !ckpt.Before(now) {
+		return
+	}
+	start = ckpt
+	if max > 0 && now.Sub(start) > max {
+		lg.Warn("Checkpoint %v is older than Max-Backfill, only backfilling %v\n", ckpt, max)
+		start = now.Add(-max)
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,106 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBacklogRamp = time.Minute
+	backlogRampFloor   = 0.1              // fraction of the rate a ramp starts at
+	backlogIdle        = 30 * time.Second // a backlog that stopped flowing this long ramps up again
+)
+
+// backlogPacer paces the catch up traffic that follows a start or an
+// outage, backfills, retry queue replays, and spool forwarding, so a
+// backlog reaches the indexers as a steady stream rather than all at once
+// and live entries aren't stuck behind it.  After each interruption, or
+// when a new backlog starts, the rate ramps up from a tenth of the limit
+// over the ramp period.
+type backlogPacer struct {
+	eps  float64
+	ramp time.Duration
+	rl   *rateLimiter
+
+	sync.Mutex
+	since time.Time // when the current ramp began, zero until a backlog flows
+	last  time.Time // the last backlog write
+}
+
+// newBacklogPacer returns nil when eps is zero.
+func newBacklogPacer(eps int, ramp time.Duration) (*backlogPacer, error) {
+	if eps < 0 {
+		return nil, fmt.Errorf("Invalid Backlog-Rate-EPS %d", eps)
+	} else if ramp < 0 {
+		return nil, fmt.Errorf("Invalid Backlog-Ramp %v", ramp)
+	} else if eps == 0 {
+		return nil, nil
+	}
+	rl, err := newRateLimiter(eps, 0)
+	if err != nil {
+		return nil, err
+	}
+	rl.waited = stats.paced
+	return &backlogPacer{
+		eps:  float64(eps),
+		ramp: ramp,
+		rl:   rl,
+	}, nil
+}
+
+// wait paces n backlog entries.
+func (bp *backlogPacer) wait(ctx context.Context, n int) error {
+	if bp == nil {
+		return nil
+	}
+	now := time.Now()
+	bp.Lock()
+	fresh := bp.since.IsZero() || now.Sub(bp.last) > backlogIdle
+	if fresh {
+		bp.since = now
+		if bp.ramp > 0 {
+			lg.Info("Flushing backlog, ramping up to %.0f entries per second over %v\n", bp.eps, bp.ramp)
+		}
+	}
+	bp.last = now
+	frac := 1.0
+	if bp.ramp > 0 {
+		if frac = float64(now.Sub(bp.since)) / float64(bp.ramp); frac < backlogRampFloor {
+			frac = backlogRampFloor
+		} else if frac > 1 {
+			frac = 1
+		}
+	}
+	bp.Unlock()
+	if fresh {
+		// whatever the bucket saved up while idle would defeat the ramp
+		bp.rl.drain()
+	}
+	bp.rl.setRate(bp.eps * frac)
+	stats.setBacklogRate(bp.eps * frac)
+	return bp.rl.wait(ctx, n)
+}
+
+// interrupted restarts the ramp, called when writes fail.
+func (bp *backlogPacer) interrupted() {
+	if bp == nil {
+		return
+	}
+	bp.Lock()
+	restart := !bp.since.IsZero()
+	bp.since = time.Time{}
+	bp.Unlock()
+	if restart {
+		bp.rl.drain()
+	}
+}
@@ -0,0 +1,115 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffMin = PERIOD
+	defaultBackoffMax = time.Minute
+	// a child that stays up this long is considered healthy again
+	backoffResetAfter = time.Minute
+)
+
+// backoff hands out exponentially growing delays with jitter, used when
+// the log child keeps failing so a broken host doesn't spin.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+	attempts int
+	rnd      *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if max < min {
+		max = min
+	}
+	return &backoff{
+		min: min,
+		max: max,
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay before the next attempt, somewhere between half
+// and all of the current backoff period.
+func (b *backoff) next() time.Duration {
+	b.attempts++
+	if b.cur == 0 {
+		b.cur = b.min
+	} else if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	half := int64(b.cur / 2)
+	return time.Duration(half + b.rnd.Int63n(half+1))
+}
+
+// wait sleeps for the next delay, returning false if the context was
+// cancelled first.
+func (b *backoff) wait(ctx context.Context) bool {
+	tmr := time.NewTimer(b.next())
+	defer tmr.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-tmr.C:
+		return true
+	}
+}
+
+// setMax changes the longest delay, the current period is clamped to it.
+func (b *backoff) setMax(max time.Duration) {
+	if max < b.min {
+		max = b.min
+	}
+	b.max = max
+	if b.cur > max {
+		b.cur = max
+	}
+}
+
+func (b *backoff) reset() {
+	b.cur = 0
+	b.attempts = 0
+}
+
+// restartBudget counts log stream failures, it is exhausted once there have
+// been max failures within the window.  Without a window the failures must
+// be consecutive, a healthy run resets the count.
+type restartBudget struct {
+	max    int
+	window time.Duration
+	fails  []time.Time
+}
+
+// fail records a failure, returning true if the budget is exhausted.
+func (rb *restartBudget) fail(now time.Time) bool {
+	if rb.max <= 0 {
+		return false
+	}
+	rb.fails = append(rb.fails, now)
+	if rb.window > 0 {
+		cutoff := now.Add(-rb.window)
+		for len(rb.fails) > 0 && rb.fails[0].Before(cutoff) {
+			rb.fails = rb.fails[1:]
+		}
+	}
+	return len(rb.fails) >= rb.max
+}
+
+// healthy is called after a run long enough to count as a success.
+func (rb *restartBudget) healthy() {
+	if rb.window == 0 {
+		rb.fails = nil
+	}
+}
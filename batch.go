@@ -0,0 +1,84 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultBatchSize     = 1024
+	defaultBatchInterval = 100 * time.Millisecond
+	minBatchTarget       = 32
+)
+
+// batcher gathers processed entries into writes.  A write happens once the
+// target size is reached or the interval has passed since the first entry
+// arrived.  The target doubles every time it fills before the interval, up
+// to the configured size, and halves when the interval catches a batch less
+// than half full, so a busy host makes few large writes and a quiet one
+// doesn't hold entries back waiting for company.
+type batcher struct {
+	min, max int
+	target   int
+	interval time.Duration
+	pending  []*entry.Entry
+	size     int // bytes of data pending, counted in the memory usage
+}
+
+func newBatcher(max int, interval time.Duration) *batcher {
+	if max <= 0 {
+		max = defaultBatchSize
+	}
+	min := minBatchTarget
+	if min > max {
+		min = max
+	}
+	return &batcher{
+		min:      min,
+		max:      max,
+		target:   min,
+		interval: interval,
+	}
+}
+
+// add appends entries, returning true if the batch should be written now.
+func (b *batcher) add(ents []*entry.Entry) bool {
+	b.pending = append(b.pending, ents...)
+	n := batchSize(ents)
+	b.size += n
+	stats.batched(n)
+	return b.interval <= 0 || len(b.pending) >= b.target
+}
+
+// take returns the pending entries and adjusts the target, full is set when
+// the batch reached the target rather than timing out.
+func (b *batcher) take(full bool) []*entry.Entry {
+	if full {
+		if b.target *= 2; b.target > b.max {
+			b.target = b.max
+		}
+	} else if len(b.pending) < b.target/2 {
+		if b.target /= 2; b.target < b.min {
+			b.target = b.min
+		}
+	}
+	out := b.pending
+	stats.batched(-b.size)
+	b.size = 0
+	// the muxer may still hold the old array, start a fresh one
+	b.pending = make([]*entry.Entry, 0, b.target)
+	return out
+}
+
+func (b *batcher) empty() bool {
+	return len(b.pending) == 0
+}
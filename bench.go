@@ -0,0 +1,118 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// benchMuxer counts what would have been ingested and throws it away.
+type benchMuxer struct {
+	*dryRunMuxer
+	ents  uint64
+	bytes uint64
+}
+
+func (b *benchMuxer) WriteBatchContext(ctx context.Context, ents []*entry.Entry) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, ent := range ents {
+		b.ents++
+		b.bytes += uint64(len(ent.Data))
+	}
+	return nil
+}
+
+func (b *benchMuxer) WriteEntryContext(ctx context.Context, ent *entry.Entry) error {
+	return b.WriteBatchContext(ctx, []*entry.Entry{ent})
+}
+
+// runBench replays a captured log stream file through the decoder and the
+// configured pipeline as fast as it will go, then reports throughput,
+// allocations, and CPU time.  The file is read into memory first so disk
+// speed doesn't skew the numbers, nothing is persisted or ingested.
+func runBench(w io.Writer, cfg *cfgType, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bm := &benchMuxer{dryRunMuxer: newDryRunMuxer(ioutil.Discard)}
+	igst = bm
+	cfg.Global.Spool_Location = ``
+	pl, err := newPipeline(cfg)
+	if err != nil {
+		return err
+	}
+	pl.ephemeral = true
+	tag, err := igst.GetTag(cfg.Global.Tag_Name)
+	if err != nil {
+		return err
+	}
+	src, err := newSourceTracker(`127.0.0.1`, ``)
+	if err != nil {
+		return err
+	}
+	rc, err := cfg.Global.streamConfig()
+	if err != nil {
+		return err
+	}
+	dec := newDecoder(bytes.NewReader(data), rc)
+	// replayed like a backfill, the whole capture is available at once
+	dec.workers = rc.parseWorkers
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	cpuBefore := cpuTime()
+	start := time.Now()
+	if err = ingestEntries(ctx, dec, rc, &logStream{name: `bench`, tag: tag}, src, pl); err != nil && err != io.EOF {
+		return err
+	}
+	if err = pl.write(ctx, pl.flush(time.Now(), true)); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	cpu := cpuTime() - cpuBefore
+	runtime.ReadMemStats(&after)
+
+	read := stats.snapshot().EntriesRead
+	secs := elapsed.Seconds()
+	fmt.Fprintf(w, "%s: %s in %v\n", path, humanBytes(int64(len(data))), elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "  records decoded  %d (%.0f/s, %.1f MB/s)\n", read, float64(read)/secs, float64(len(data))/secs/(1024*1024))
+	fmt.Fprintf(w, "  entries written  %d (%s)\n", bm.ents, humanBytes(int64(bm.bytes)))
+	fmt.Fprintf(w, "  CPU              %v (%.0f%% of one core)\n", cpu.Round(time.Millisecond), 100*cpu.Seconds()/secs)
+	mallocs := after.Mallocs - before.Mallocs
+	alloc := after.TotalAlloc - before.TotalAlloc
+	if read > 0 {
+		fmt.Fprintf(w, "  allocations      %d (%.1f/record), %s (%s/record)\n", mallocs, float64(mallocs)/float64(read),
+			humanBytes(int64(alloc)), humanBytes(int64(alloc/read)))
+	}
+	fmt.Fprintf(w, "  GC cycles        %d\n", after.NumGC-before.NumGC)
+	return nil
+}
+
+// cpuTime returns the user and system time used by the process so far.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
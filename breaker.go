@@ -0,0 +1,279 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	breakerModeDrop   = `drop`
+	breakerModeSample = `sample`
+
+	defaultBreakerSampleRate = 100
+	// how many consecutive quiet seconds before the breaker resets
+	breakerCooldown = 5
+)
+
+// breakerNotice is the entry emitted when the breaker changes state.
+type breakerNotice struct {
+	Type      string `json:"type"`
+	Stream    string `json:"stream,omitempty"`
+	State     string `json:"state"`
+	Threshold int    `json:"threshold"`
+	Rate      int    `json:"rate,omitempty"`
+	Mode      string `json:"mode"`
+	Dropped   uint64 `json:"dropped,omitempty"`
+}
+
+// circuitBreaker watches the entries per second flowing through the
+// pipeline, when the ceiling is exceeded it engages and either samples or
+// drops everything over the ceiling until the rate has stayed under it for
+// a few seconds.  State changes are announced with explicit entries so
+// analysts know the data was shaped.
+type circuitBreaker struct {
+	sync.Mutex
+	stream     string // the streams the breaker watches, for notices
+	ceiling    int
+	mode       string
+	sampleRate int
+
+	sec     int64 // current second
+	count   int   // entries seen in the current second
+	passed  int   // entries passed in the current second
+	engaged bool
+	quiet   int // consecutive seconds under the ceiling while engaged
+	dropped uint64
+	seq     uint64
+	tmpl    *entry.Entry // source of the tag and SRC for notices
+	tally   *dropTally
+}
+
+func newCircuitBreaker(ceiling int, mode string, sampleRate int) (*circuitBreaker, error) {
+	if ceiling <= 0 {
+		return nil, nil
+	}
+	mode = strings.ToLower(mode)
+	switch mode {
+	case ``:
+		mode = breakerModeSample
+	case breakerModeSample, breakerModeDrop:
+	default:
+		return nil, fmt.Errorf("Invalid Circuit-Breaker-Mode %q, expected sample or drop", mode)
+	}
+	if sampleRate <= 0 {
+		sampleRate = defaultBreakerSampleRate
+	}
+	return &circuitBreaker{
+		ceiling:    ceiling,
+		mode:       mode,
+		sampleRate: sampleRate,
+	}, nil
+}
+
+func (cb *circuitBreaker) add(ev *event) (out []*event) {
+	cb.Lock()
+	defer cb.Unlock()
+	cb.tmpl = ev.ent
+	out = cb.tick(time.Now())
+	cb.count++
+	if !cb.engaged && cb.count > cb.ceiling {
+		cb.engaged = true
+		cb.quiet = 0
+		out = append(out, cb.notice(`engaged`, cb.count))
+	}
+	if !cb.engaged {
+		cb.passed++
+		return append(out, ev)
+	}
+	switch cb.mode {
+	case breakerModeDrop:
+		if cb.passed < cb.ceiling {
+			cb.passed++
+			return append(out, ev)
+		}
+	case breakerModeSample:
+		cb.seq++
+		if cb.seq%uint64(cb.sampleRate) == 0 {
+			ev.Set("sampled", true)
+			ev.Set("rate", cb.sampleRate)
+			return append(out, ev)
+		}
+	}
+	cb.dropped++
+	cb.tally.dropped(ev)
+	return
+}
+
+// flush never holds events, it just lets the breaker reset when the stream
+// goes quiet.
+func (cb *circuitBreaker) flush(now time.Time, force bool) []*event {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.tick(now)
+}
+
+// tick rolls the per second counters, checking whether an engaged breaker
+// can reset.  The caller must hold the lock.
+func (cb *circuitBreaker) tick(now time.Time) (out []*event) {
+	sec := now.Unix()
+	if sec == cb.sec {
+		return
+	}
+	if cb.engaged {
+		if cb.count <= cb.ceiling {
+			cb.quiet++
+		} else {
+			cb.quiet = 0
+		}
+		// any seconds skipped entirely had no traffic at all
+		cb.quiet += int(sec-cb.sec) - 1
+		if cb.quiet >= breakerCooldown {
+			cb.engaged = false
+			out = append(out, cb.notice(`disengaged`, 0))
+			cb.dropped = 0
+		}
+	}
+	cb.sec = sec
+	cb.count = 0
+	cb.passed = 0
+	return
+}
+
+func (cb *circuitBreaker) notice(state string, rate int) *event {
+	if cb.tmpl == nil {
+		return nil
+	}
+	n := breakerNotice{
+		Type:      `circuitBreaker`,
+		Stream:    cb.stream,
+		State:     state,
+		Threshold: cb.ceiling,
+		Rate:      rate,
+		Mode:      cb.mode,
+		Dropped:   cb.dropped,
+	}
+	if state == `engaged` {
+		lg.Warn("Circuit breaker for %s engaged at %d entries/s, ceiling is %d\n", cb.stream, rate, cb.ceiling)
+	} else {
+		lg.Info("Circuit breaker for %s disengaged after dropping %d entries\n", cb.stream, cb.dropped)
+	}
+	return newSyntheticEvent(cb.tmpl, n)
+}
+
+// streamBreakers keeps a circuit breaker per stream, keyed by the stream's
+// tag, so a storm in one stream doesn't sample or drop the others.
+// Streams sharing a tag share a breaker, entries under any other tag go
+// through the breaker built from the Global settings.
+type streamBreakers struct {
+	byTag    map[entry.EntryTag]*circuitBreaker
+	other    *circuitBreaker
+	breakers []*circuitBreaker // in stream order, for flushing
+}
+
+// newStreamBreakers builds the breakers, nil if no stream has a ceiling.
+// A Stream block's Circuit-Breaker-EPS overrides the Global one, streams
+// that share a tag share a breaker with the strictest of their ceilings.
+func newStreamBreakers(cfg *cfgType, tally *dropTally) (*streamBreakers, error) {
+	g := cfg.Global
+	sb := &streamBreakers{byTag: map[entry.EntryTag]*circuitBreaker{}}
+	add := func(name string, ceiling int) (*circuitBreaker, error) {
+		cb, err := newCircuitBreaker(ceiling, g.Circuit_Breaker_Mode, g.Circuit_Breaker_Sample_Rate)
+		if err != nil || cb == nil {
+			return nil, err
+		}
+		cb.stream, cb.tally = name, tally
+		sb.breakers = append(sb.breakers, cb)
+		return cb, nil
+	}
+	type tagCeiling struct {
+		tag     entry.EntryTag
+		names   []string
+		ceiling int
+	}
+	var tags []*tagCeiling
+	byTag := map[entry.EntryTag]*tagCeiling{}
+	for _, def := range cfg.streamDefs() {
+		tag, err := igst.GetTag(def.tagName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve tag %q for stream %s: %v", def.tagName, def.name, err)
+		}
+		ceiling := g.Circuit_Breaker_EPS
+		if blk, ok := cfg.Stream[def.name]; ok && blk.Circuit_Breaker_EPS > 0 {
+			ceiling = blk.Circuit_Breaker_EPS
+		}
+		tc, ok := byTag[tag]
+		if !ok {
+			tc = &tagCeiling{tag: tag}
+			byTag[tag] = tc
+			tags = append(tags, tc)
+		}
+		tc.names = append(tc.names, def.name)
+		if ceiling > 0 && (tc.ceiling <= 0 || ceiling < tc.ceiling) {
+			tc.ceiling = ceiling
+		}
+	}
+	for _, tc := range tags {
+		cb, err := add(strings.Join(tc.names, `,`), tc.ceiling)
+		if err != nil {
+			return nil, err
+		}
+		sb.byTag[tc.tag] = cb
+	}
+	var err error
+	if sb.other, err = add(`other`, g.Circuit_Breaker_EPS); err != nil {
+		return nil, err
+	}
+	if len(sb.breakers) == 0 {
+		return nil, nil
+	}
+	return sb, nil
+}
+
+func (sb *streamBreakers) add(ev *event) []*event {
+	cb, ok := sb.byTag[ev.ent.Tag]
+	if !ok {
+		cb = sb.other
+	}
+	if cb == nil {
+		return []*event{ev}
+	}
+	return cb.add(ev)
+}
+
+func (sb *streamBreakers) flush(now time.Time, force bool) (out []*event) {
+	for _, cb := range sb.breakers {
+		out = append(out, cb.flush(now, force)...)
+	}
+	return
+}
+
+// newSyntheticEvent builds an event generated by the ingester itself, using
+// the tag and SRC of an existing entry.
+func newSyntheticEvent(tmpl *entry.Entry, obj interface{}) *event {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		lg.Error("Failed to encode synthetic entry: %v\n", err)
+		return nil
+	}
+	return &event{
+		ent: &entry.Entry{
+			TS:   entry.Now(),
+			SRC:  tmpl.SRC,
+			Tag:  tmpl.Tag,
+			Data: b,
+		},
+	}
+}
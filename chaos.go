@@ -0,0 +1,104 @@
+//go:build chaos
+// +build chaos
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+// Failure injection for exercising the reliability machinery, only built
+// with the chaos tag.  Each failure is enabled by setting its environment
+// variable to a probability between 0 and 1:
+//
+//	MACOSLOG_CHAOS_EOF        probability a read ends the stream with EOF
+//	MACOSLOG_CHAOS_MALFORMED  probability a read is followed by a burst of garbage records
+//	MACOSLOG_CHAOS_WRITE      probability a batch write fails
+//
+// go test -tags chaos runs the tests that check the retry queue and the
+// spool recover from injected write failures.
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errChaosWrite = errors.New("chaos: injected write failure")
+
+	chaosEOF       = chaosRate(`MACOSLOG_CHAOS_EOF`)
+	chaosMalformed = chaosRate(`MACOSLOG_CHAOS_MALFORMED`)
+	chaosWrite     = chaosRate(`MACOSLOG_CHAOS_WRITE`)
+
+	chaosMtx  sync.Mutex
+	chaosOnce sync.Once
+	chaosRnd  = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// a record boundary followed by records that aren't JSON
+	chaosGarbage = []byte("\n},{\n\"broken\": \n},{\n{{{{\n},{\n\x00\x01\x02")
+)
+
+func chaosRate(name string) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
+
+func chaosHit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	chaosMtx.Lock()
+	defer chaosMtx.Unlock()
+	return chaosRnd.Float64() < rate
+}
+
+type chaosRdr struct {
+	r       io.Reader
+	pending []byte
+}
+
+// chaosReader wraps a log child's output with injected EOFs and garbage.
+func chaosReader(r io.Reader) io.Reader {
+	chaosOnce.Do(func() {
+		lg.Warn("Chaos build, injecting EOF %v, malformed %v, write failures %v\n", chaosEOF, chaosMalformed, chaosWrite)
+	})
+	return &chaosRdr{r: r}
+}
+
+func (cr *chaosRdr) Read(b []byte) (int, error) {
+	if len(cr.pending) > 0 {
+		n := copy(b, cr.pending)
+		cr.pending = cr.pending[n:]
+		return n, nil
+	}
+	if chaosHit(chaosEOF) {
+		lg.Warn("Chaos: injecting EOF\n")
+		return 0, io.EOF
+	}
+	n, err := cr.r.Read(b)
+	if n > 0 && chaosHit(chaosMalformed) {
+		lg.Warn("Chaos: injecting malformed records\n")
+		cr.pending = append(cr.pending, chaosGarbage...)
+	}
+	return n, err
+}
+
+// chaosWriteFailure returns an error when a write failure is injected.
+func chaosWriteFailure() error {
+	if chaosHit(chaosWrite) {
+		return errChaosWrite
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !chaos
+// +build !chaos
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io"
+)
+
+func chaosReader(r io.Reader) io.Reader {
+	return r
+}
+
+func chaosWriteFailure() error {
+	return nil
+}
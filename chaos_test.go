@@ -0,0 +1,145 @@
+//go:build chaos
+// +build chaos
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const chaosTestBatches = 20
+
+// chaosSetup points the muxer at a buffer and fails writes at rate,
+// seeded so a failure is reproducible, the globals it replaces are put
+// back when the test ends.
+func chaosSetup(t *testing.T, rate float64) (*bytes.Buffer, entry.EntryTag) {
+	t.Helper()
+	var buf bytes.Buffer
+	prevIgst, prevLg, prevRate := igst, lg, chaosWrite
+	t.Cleanup(func() { igst, lg, chaosWrite = prevIgst, prevLg, prevRate })
+	igst = newDryRunMuxer(&buf)
+	// main never ran so there is no logger, the injected failures are
+	// only worth seeing with -v
+	lg = log.NewDiscardLogger()
+	if testing.Verbose() {
+		lg = log.New(stderrWriter{})
+	}
+	chaosMtx.Lock()
+	chaosRnd = rand.New(rand.NewSource(1))
+	chaosMtx.Unlock()
+	chaosWrite = rate
+	tag, err := igst.GetTag(`chaos`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &buf, tag
+}
+
+// writeChaosBatches writes one entry per batch numbered from zero and
+// waits for all of them to make it through the muxer.
+func writeChaosBatches(t *testing.T, w *batchWriter, tag entry.EntryTag, written *counter) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go w.run(ctx, &wg)
+	for i := 0; i < chaosTestBatches; i++ {
+		ent := &entry.Entry{Tag: tag, TS: entry.Now(), Data: []byte(strconv.Itoa(i))}
+		if err := w.write(ctx, []*entry.Entry{ent}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Minute)
+	for written.get() < chaosTestBatches && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	cctx, ccancel := context.WithTimeout(context.Background(), 5*time.Second)
+	w.close(cctx)
+	ccancel()
+	cancel()
+	wg.Wait()
+	if n := written.get(); n != chaosTestBatches {
+		t.Fatalf("wrote %d entries, want %d", n, chaosTestBatches)
+	}
+}
+
+// checkChaosOutput verifies every entry was written exactly once and in
+// order.
+func checkChaosOutput(t *testing.T, buf *bytes.Buffer) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != chaosTestBatches {
+		t.Fatalf("muxer got %d entries, want %d:\n%s", len(lines), chaosTestBatches, buf.String())
+	}
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if got := fields[len(fields)-1]; got != strconv.Itoa(i) {
+			t.Fatalf("entry %d is %q, want %d", i, got, i)
+		}
+	}
+}
+
+type counter struct {
+	sync.Mutex
+	n int
+}
+
+func (c *counter) add(ents []*entry.Entry) {
+	c.Lock()
+	c.n += len(ents)
+	c.Unlock()
+}
+
+func (c *counter) get() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.n
+}
+
+func TestChaosRetryRecovers(t *testing.T) {
+	buf, tag := chaosSetup(t, 0.25)
+	failures := stats.snapshot().BatchFailures
+	var written counter
+	w := newBatchWriter(1<<20, written.add)
+	writeChaosBatches(t, w, tag, &written)
+	if stats.snapshot().BatchFailures == failures {
+		t.Fatal("no write failures were injected")
+	}
+	checkChaosOutput(t, buf)
+}
+
+func TestChaosSpoolRecovers(t *testing.T) {
+	// the spool forwards everything in one batch, fail it more often
+	buf, tag := chaosSetup(t, 0.75)
+	failures := stats.snapshot().BatchFailures
+	var written counter
+	w := newBatchWriter(1<<20, written.add)
+	sp, err := newSpool(t.TempDir(), 1<<20, 0, `chaos`, written.add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.spool = sp
+	writeChaosBatches(t, w, tag, &written)
+	if stats.snapshot().BatchFailures == failures {
+		t.Fatal("no write failures were injected")
+	}
+	checkChaosOutput(t, buf)
+}
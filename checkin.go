@@ -0,0 +1,111 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/version"
+)
+
+// checkin is the one time entry written at startup so a fleet dashboard
+// can see which hosts report and what they run.
+type checkin struct {
+	Type       string   `json:"type"`
+	Hostname   string   `json:"hostname"`
+	Serial     string   `json:"serial,omitempty"`
+	OSName     string   `json:"osName,omitempty"`
+	OSVersion  string   `json:"osVersion,omitempty"`
+	OSBuild    string   `json:"osBuild,omitempty"`
+	Arch       string   `json:"arch"`
+	Version    string   `json:"version"`
+	UUID       string   `json:"uuid,omitempty"`
+	ConfigHash string   `json:"configHash,omitempty"`
+	Streams    []string `json:"streams"`
+	Remote     bool     `json:"remoteConfig"`
+}
+
+// emitCheckin writes the check-in entry if a Fleet-Tag-Name is configured.
+func emitCheckin(ctx context.Context, cfg *cfgType, confPath string, remote bool, src *sourceTracker) {
+	if cfg.Global.Fleet_Tag_Name == `` {
+		return
+	}
+	tag, err := igst.GetTag(cfg.Global.Fleet_Tag_Name)
+	if err != nil {
+		lg.Error("Failed to resolve fleet tag %q: %v\n", cfg.Global.Fleet_Tag_Name, err)
+		return
+	}
+	ci := checkin{
+		Type:    `checkin`,
+		Arch:    runtime.GOARCH,
+		Version: version.GetVersion(),
+		Remote:  remote,
+	}
+	ci.Hostname, _ = os.Hostname()
+	if ci.Serial, err = hostSerial(); err != nil {
+		lg.Warn("Failed to get hardware serial number: %v\n", err)
+	}
+	if ci.OSName, ci.OSVersion, ci.OSBuild, err = osVersion(); err != nil {
+		lg.Warn("Failed to get the OS version: %v\n", err)
+	}
+	if id, ok := cfg.Global.IngesterUUID(); ok {
+		ci.UUID = id.String()
+	}
+	if ci.ConfigHash, err = configHash(confPath); err != nil {
+		lg.Warn("Failed to hash %s: %v\n", confPath, err)
+	}
+	for _, def := range cfg.streamDefs() {
+		ci.Streams = append(ci.Streams, def.name)
+	}
+	if err = emitJSON(ctx, tag, src, time.Now(), ci); err != nil && err != context.Canceled {
+		lg.Error("Failed to emit check-in entry: %v\n", err)
+	}
+}
+
+// osVersion returns the product name, version, and build from sw_vers.
+func osVersion() (name, ver, build string, err error) {
+	out, err := exec.Command("sw_vers").Output()
+	if err != nil {
+		return
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		k, v := splitKV(sc.Text(), ":")
+		switch k {
+		case `ProductName`:
+			name = v
+		case `ProductVersion`:
+			ver = v
+		case `BuildVersion`:
+			build = v
+		}
+	}
+	return
+}
+
+// configHash hashes the config file without its Ingester-UUID line so every
+// host running the same config reports the same hash.
+func configHash(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ``, err
+	}
+	b = uuidLineRegex.ReplaceAll(b, nil)
+	sum := sha256.Sum256([]byte(strings.TrimSpace(string(b))))
+	return hex.EncodeToString(sum[:]), nil
+}
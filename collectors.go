@@ -0,0 +1,164 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// startCollectors fires up any enabled auxiliary collectors, each runs until
+// the context is cancelled.
+func startCollectors(ctx context.Context, wg *sync.WaitGroup, cfg *cfgType, src *sourceTracker, pl *pipeline) error {
+	if cfg.Network_Snapshot.Enable {
+		if err := startSnapshotter(ctx, wg, `network`, cfg.Network_Snapshot, src, networkSnapshot); err != nil {
+			return err
+		}
+	}
+	if cfg.Security_Posture.Enable {
+		if err := startSnapshotter(ctx, wg, `security posture`, cfg.Security_Posture, src, postureSnapshotFunc); err != nil {
+			return err
+		}
+	}
+	if cfg.Diagnostic_Reports.Enable {
+		if err := startReportCollector(ctx, wg, cfg.Diagnostic_Reports, src, pl); err != nil {
+			return err
+		}
+	}
+	if cfg.Kernel_Panics.Enable {
+		if err := startPanicCollector(ctx, wg, cfg.Kernel_Panics, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.Periodic.Enable {
+		if err := startPeriodicCollector(ctx, wg, cfg.Periodic, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.Install_Log.Enable {
+		if err := startInstallCollector(ctx, wg, cfg.Install_Log, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.ASL.Enable {
+		if err := startASLCollector(ctx, wg, cfg.ASL, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.Audit.Enable {
+		if err := startAuditCollector(ctx, wg, cfg.Audit, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.Endpoint_Security.Enable {
+		sc, err := newStderrCapture(cfg, src)
+		if err != nil {
+			return err
+		}
+		if err := startESCollector(ctx, wg, cfg.Endpoint_Security, src, sc); err != nil {
+			return err
+		}
+	}
+	if cfg.XProtect.Enable {
+		if err := startXProtectCollector(ctx, wg, cfg.XProtect, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.Quarantine_Events.Enable {
+		if err := startQuarantineCollector(ctx, wg, cfg.Quarantine_Events, src, pl); err != nil {
+			return err
+		}
+	}
+	if cfg.Persistence.Enable {
+		if err := startPersistenceCollector(ctx, wg, cfg.Persistence, src, pl); err != nil {
+			return err
+		}
+	}
+	if cfg.Extensions.Enable {
+		if err := startExtensionsCollector(ctx, wg, cfg.Extensions, src); err != nil {
+			return err
+		}
+	}
+	if cfg.Auth_Events.Enable {
+		if err := startAuthCollector(ctx, wg, cfg.Auth_Events, src, pl); err != nil {
+			return err
+		}
+	}
+	if cfg.MDM.Enable {
+		if err := startMDMCollector(ctx, wg, cfg.MDM, src); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Files) > 0 {
+		if err := startFilesCollectors(ctx, wg, cfg.Files, src, pl.ephemeral); err != nil {
+			return err
+		}
+	}
+	if cfg.Global.Metrics_Listen != `` || cfg.Global.Health_Socket != `` {
+		rc, err := cfg.Global.streamConfig()
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler(pl))
+		mux.Handle("/healthz", healthzHandler(rc.idleTimeout))
+		if cfg.Global.Metrics_Listen != `` {
+			if err := startHTTPServer(ctx, wg, "tcp", cfg.Global.Metrics_Listen, mux); err != nil {
+				return fmt.Errorf("Failed to start metrics listener: %v", err)
+			}
+		}
+		if cfg.Global.Health_Socket != `` {
+			// a stale socket from a previous run would block the listen
+			os.Remove(cfg.Global.Health_Socket)
+			if err := startHTTPServer(ctx, wg, "unix", cfg.Global.Health_Socket, mux); err != nil {
+				return fmt.Errorf("Failed to start health socket: %v", err)
+			}
+		}
+	}
+	if !cfg.Global.Disable_Control_Socket {
+		if err := startControlSocket(ctx, wg, cfg.Global.controlSocket(), pl); err != nil {
+			return fmt.Errorf("Failed to start control socket: %v", err)
+		}
+	}
+	if cfg.Global.Enable_Pprof {
+		if err := startPprof(ctx, wg, cfg.Global.Pprof_Listen); err != nil {
+			return err
+		}
+	}
+	if cfg.Self_Health.Enable {
+		if err := startSnapshotter(ctx, wg, `health`, cfg.Self_Health, src, healthSnapshot(pl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startSnapshotter(ctx context.Context, wg *sync.WaitGroup, name string, sc snapshotConfig, src *sourceTracker, fn snapshotFunc) error {
+	tag, err := igst.GetTag(sc.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve %s tag %q: %v", name, sc.Tag_Name, err)
+	}
+	interval, err := sc.interval()
+	if err != nil {
+		return err
+	}
+	s := &snapshotter{
+		name:     name,
+		tag:      tag,
+		interval: interval,
+		src:      src,
+		fn:       fn,
+	}
+	wg.Add(1)
+	go s.run(ctx, wg)
+	return nil
+}
@@ -0,0 +1,88 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const defaultCompressionSample = 16
+
+// compressionSampler measures how well batches compress by deflating one
+// in every so many at the fastest level.  The muxer uses its own stream
+// compression when Enable-Compression is set, so the ratio is an estimate,
+// but it shows what compression saves on the wire or would save if it were
+// turned on.
+type compressionSampler struct {
+	every   uint64 // batches per sample
+	batches uint64
+	enabled bool // Enable-Compression is set
+	writers sync.Pool
+}
+
+func newCompressionSampler(every int, enabled bool) (*compressionSampler, error) {
+	if every < 0 {
+		return nil, nil
+	} else if every == 0 {
+		every = defaultCompressionSample
+	}
+	return &compressionSampler{
+		every:   uint64(every),
+		enabled: enabled,
+		writers: sync.Pool{
+			New: func() interface{} {
+				fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+				return fw
+			},
+		},
+	}, nil
+}
+
+// byteCounter is a writer that only counts.
+type byteCounter int64
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// sample compresses the batch if its turn has come, the sizes go to the
+// stats.
+func (cs *compressionSampler) sample(ents []*entry.Entry) {
+	if cs == nil || len(ents) == 0 || atomic.AddUint64(&cs.batches, 1)%cs.every != 0 {
+		return
+	}
+	var out byteCounter
+	fw := cs.writers.Get().(*flate.Writer)
+	defer cs.writers.Put(fw)
+	fw.Reset(&out)
+	var raw int
+	for _, ent := range ents {
+		fw.Write(ent.Data)
+		raw += len(ent.Data)
+	}
+	fw.Close()
+	stats.compressed(raw, int(out))
+	if out > 0 {
+		lg.Debug("Batch of %d entries, %d bytes, compresses %.1f:1\n", len(ents), raw, float64(raw)/float64(out))
+	}
+}
+
+// compressionRatio formats the ratio of sampled raw to compressed bytes.
+func compressionRatio(raw, compressed uint64) string {
+	if compressed == 0 {
+		return `-`
+	}
+	return fmt.Sprintf("%.1f:1", float64(raw)/float64(compressed))
+}
@@ -10,6 +10,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gravwell/gravwell/v3/ingest/config"
@@ -17,33 +21,158 @@ import (
 
 type global struct {
 	config.IngestConfig
+	Tag_Name                    string
+	Resolve_UIDs                bool     // resolve numeric uids in records to user names
+	UID_Cache_Timeout           string   // how long resolved uids are cached
+	Source_Interface            string   // interface to take the SRC address from
+	Source_Refresh_Interval     string   // how often the detected SRC address is refreshed
+	Annotate_Architecture       bool     // add the process architecture (arm64, x86_64-rosetta, etc.)
+	Normalize_Severity          bool     // add a normalized severity field based on messageType
+	Severity_Map                []string // messageType:severity overrides for the severity mapping
+	Minimum_Level               string   // drop records below this messageType (Debug, Info, Default, Error, Fault)
+	Allow_Subsystems            []string // only ingest records from matching subsystems
+	Deny_Subsystems             []string // drop records from matching subsystems
+	Allow_Categories            []string // only ingest records with matching categories or subsystem:category pairs
+	Deny_Categories             []string // drop records with matching categories or subsystem:category pairs
+	Allow_Processes             []string // only ingest records from matching process names or image paths
+	Deny_Processes              []string // drop records from matching process names or image paths
+	Drop_Message                []string // drop records whose eventMessage matches the regular expression
+	Sample_Subsystem            []string // subsystem:N keeps roughly 1 in N records from matching subsystems
+	Aggregate_Window            string   // collapse repeated messages from a process within this window
+	State_Store_Location        string   // file the ingester keeps its resume state in
+	Deduplicate_Restarts        bool     // drop records that were already ingested before a restart
+	Scrub_Profile               []string // built in PII scrubbing profiles: gdpr, home-paths, usernames, apple-ids, remote-hosts
+	Capture_Window              []string // "[days ]HH:MM-HH:MM" local time windows to capture in
+	Off_Hours_Minimum_Level     string   // outside the capture windows keep records at or above this level
+	Circuit_Breaker_EPS         int      // entries per second that engages a stream's circuit breaker, each stream has its own
+	Circuit_Breaker_Mode        string   // sample or drop once engaged
+	Circuit_Breaker_Sample_Rate int      // keep 1 in N entries while engaged in sample mode
+	Error_Context               int      // only ingest errors and faults, along with up to N preceding records from the process
+	Drop_Summary_Interval       string   // how often to emit a summary of dropped records
+	Pseudonymize_Field          []string // record fields to replace with salted hashes, parent.name for normalized fields like auth.remote_host
+	Pseudonymize_Hostname       bool     // hash the local hostname in messages
+	Pseudonymize_Usernames      bool     // hash local account names in messages and account names in normalized fields
+	Pseudonymize_Salt           string   `json:"-"` // salt for pseudonymization hashes
+	Alert_Tag_Name              string   // tag for alert entries, empty uses the tag of the triggering entry
+	First_Seen_Alerts           bool     // alert the first time a process image path logs anything
+	First_Seen_Learning_Period  string   // learn silently for this long when there is no history
+	Seen_Store_Location         string   // file the set of seen process image paths is kept in
+	Anomaly_Factor              int      // emit an anomaly when a subsystem exceeds its baseline rate by this multiple
+	Anomaly_Min_Rate            int      // entries per second a subsystem must reach before it can be anomalous
+	Resume_On_Restart           bool     // backfill records logged while the ingester was down
+	Max_Backfill                string   // the longest gap a restart will backfill
+	Max_Restart_Backoff         string   // longest delay between log stream restart attempts
+	Max_Restart_Attempts        int      // log stream failures before exiting with a distinct code
+	Stream_Idle_Timeout         string   // restart a log stream that is silent for this long, 0 disables
+	Diagnostics_Tag_Name        string   // ingest stderr from the log command under this tag
+	Max_Retry_Queue             int      // MB of entries queued before reading pauses
+	Spool_Location              string   // directory entries are spooled to before ingestion, empty disables
+	Max_Spool_Size              int      // MB the spool may grow to
+	Max_Spool_Age               string   // spooled entries older than this are evicted
+	Max_Decode_Buffer           int      // MB buffered looking for a record boundary before resynchronizing
+	Drain_Timeout               string   // how long shutdown waits for buffered entries to be written
+	Restart_Attempt_Window      string   // window Max-Restart-Attempts failures are counted in
+	Lock_File                   string   // pidfile held while running so only one instance ingests
+	Metrics_Listen              string   // address to serve /metrics and /healthz on, empty disables
+	Health_Socket               string   // unix socket to serve /metrics and /healthz on
+	Enable_Pprof                bool     // serve net/http/pprof on a loopback address
+	Pprof_Listen                string   // loopback address for pprof
+	Min_Free_Disk               int      // MB kept free on the filesystems the ingester writes to
+	Detect_Sleep                bool     // flush before the host sleeps, restart and backfill the stream when it wakes
+	Wake_Window                 string   // records this long after a wake are marked
+	Gap_Entries                 bool     // emit entries describing windows that were not captured
+	Predicate                   string   // log predicate applied to log stream and log show
+	Control_Socket              string   // unix socket the running instance answers -status on
+	Disable_Control_Socket      bool     // do not serve the control socket
+	Log_File_Max_Size           int      // MB, rotate the log file once it grows past this
+	Log_File_Max_Age            string   // rotate the log file once it is this old
+	Log_File_Retain             int      // rotated log files kept
+	Log_Format                  string   // text or json, applies to stderr and the log file
+	Exit_After_Idle             string   // exit cleanly once no records have been read for this long
+	Fleet_Tag_Name              string   // tag for the one time startup check-in entry, disabled when empty
+	Read_Buffer_Size            int      // KB read from the log command at a time
+	Decode_Queue_Depth          int      // batches decoded ahead of the writer
+	Parse_Workers               int      // goroutines compacting records during backfills
+	Batch_Size                  int      // most entries gathered into a single write
+	Batch_Interval              string   // longest an entry waits to be batched
+	Rate_Limit_EPS              int      // entries per second written to the indexers, 0 is unlimited
+	Rate_Limit_Burst            int      // entries allowed through above Rate-Limit-EPS in a burst
+	Memory_Soft_Limit           int      // MB of entries held in memory before shedding load, 0 is unlimited
+	Memory_Shed_Mode            string   // drop or pause once over Memory-Soft-Limit
+	Nice                        int      // nice level of the ingester, inherited by its log children
+	QoS_Class                   string   // QoS clamp for log children, background also applies to the ingester
+	Backfill_Nice               int      // nice level of log show backfills, 0 inherits Nice
+	Backfill_QoS_Class          string   // QoS clamp for log show backfills, defaults to QoS-Class
+	Compression_Sample          int      // measure the compression ratio of one batch in this many, negative disables
+	Backlog_Rate_EPS            int      // entries per second backfills, retries, and spool forwarding are flushed at, 0 is unlimited
+	Backlog_Ramp                string   // how long the backlog rate takes to ramp up after an interruption
+}
+
+// snapshotConfig is the common configuration for periodic snapshot collectors.
+type snapshotConfig struct {
+	Enable   bool
 	Tag_Name string
+	Interval string
 }
 
 type cfgType struct {
-	Global global
+	Global             global
+	Network_Snapshot   snapshotConfig
+	Security_Posture   snapshotConfig
+	Self_Health        snapshotConfig
+	Diagnostic_Reports reportsConfig
+	Kernel_Panics      panicConfig
+	Periodic           periodicConfig
+	Install_Log        installConfig
+	ASL                aslConfig
+	Audit              auditConfig
+	Endpoint_Security  esConfig
+	XProtect           xprotectConfig
+	Gatekeeper         gatekeeperConfig
+	Quarantine_Events  quarantineConfig
+	Persistence        persistenceConfig
+	Extensions         extensionsConfig
+	Auth_Events        authConfig
+	Remote_Access      remoteAccessConfig
+	MDM                mdmConfig
+	Stream             map[string]*streamBlock
+	Site               map[string]*siteConfig
+	Redact             map[string]*redactConfig
+	Files              map[string]*filesConfig
 }
 
 func GetConfig(path string) (*cfgType, error) {
-	var c cfgType
-	if err := config.LoadConfigFile(&c, path); err != nil {
-		return nil, err
-	}
-
-	if err := verifyConfig(&c); err != nil {
+	c, err := loadConfig(path)
+	if err != nil {
 		return nil, err
 	}
 
 	// Verify and set UUID
 	if _, ok := c.Global.IngesterUUID(); !ok {
 		id := uuid.New()
-		if err := c.Global.SetIngesterUUID(id, path); err != nil {
+		if err := setIngesterUUID(&c.Global, id, path); err != nil {
 			return nil, err
 		}
 		if id2, ok := c.Global.IngesterUUID(); !ok || id != id2 {
 			return nil, errors.New("Failed to set a new ingester UUID")
 		}
 	}
+	return c, nil
+}
+
+// loadConfig loads and verifies the config without modifying the file.
+func loadConfig(path string) (*cfgType, error) {
+	var c cfgType
+	if err := config.LoadConfigFile(&c, path); err != nil {
+		return nil, err
+	}
+	if err := applyEnvOverrides(&c); err != nil {
+		return nil, err
+	}
+	applyFlagOverrides(&c)
+	if err := verifyConfig(&c); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
 
@@ -56,6 +185,588 @@ func verifyConfig(c *cfgType) error {
 	if c.Global.Tag_Name == "" {
 		c.Global.Tag_Name = "default"
 	}
+	if _, err := c.Global.uidCacheTimeout(); err != nil {
+		return err
+	}
+	if _, err := c.Global.sourceRefreshInterval(); err != nil {
+		return err
+	}
+	if _, err := newSeverityMapper(c.Global.Severity_Map); err != nil {
+		return err
+	}
+	if _, err := newLevelFilter(c.Global.Minimum_Level); err != nil {
+		return err
+	}
+	if _, err := newScheduleFilter(c.Global.Capture_Window, c.Global.Off_Hours_Minimum_Level); err != nil {
+		return err
+	}
+	if _, err := newListFilter(`Subsystems`, c.Global.Allow_Subsystems, c.Global.Deny_Subsystems, nil); err != nil {
+		return err
+	}
+	if _, err := newListFilter(`Categories`, c.Global.Allow_Categories, c.Global.Deny_Categories, nil); err != nil {
+		return err
+	}
+	if _, err := newListFilter(`Processes`, c.Global.Allow_Processes, c.Global.Deny_Processes, nil); err != nil {
+		return err
+	}
+	if _, err := newMessageDropFilter(c.Global.Drop_Message); err != nil {
+		return err
+	}
+	if _, err := newSampler(c.Global.Sample_Subsystem); err != nil {
+		return err
+	}
+	if _, err := c.Global.aggregator(); err != nil {
+		return err
+	}
+	if _, err := c.Global.dropSummaryInterval(); err != nil {
+		return err
+	}
+	if _, err := c.Global.firstSeenLearningPeriod(); err != nil {
+		return err
+	}
+	if _, err := c.Global.maxBackfill(); err != nil {
+		return err
+	}
+	if _, err := c.Global.streamConfig(); err != nil {
+		return err
+	}
+	if _, err := c.Global.retryQueueSize(); err != nil {
+		return err
+	}
+	if _, _, err := c.Global.spoolConfig(); err != nil {
+		return err
+	}
+	if _, err := c.Global.drainTimeout(); err != nil {
+		return err
+	}
+	if _, err := c.Global.wakeWindow(); err != nil {
+		return err
+	}
+	if _, err := c.Global.logRotation(); err != nil {
+		return err
+	}
+	if err := checkLogFormat(c.Global.Log_Format); err != nil {
+		return err
+	}
+	if _, err := c.Global.exitAfterIdle(); err != nil {
+		return err
+	}
+	if c.Global.Enable_Pprof && c.Global.Pprof_Listen != `` {
+		if err := checkLoopback(c.Global.Pprof_Listen); err != nil {
+			return err
+		}
+	}
+	if _, err := newRateLimiter(c.Global.Rate_Limit_EPS, c.Global.Rate_Limit_Burst); err != nil {
+		return err
+	}
+	if _, err := c.Global.backlogPacer(); err != nil {
+		return err
+	}
+	if err := checkNice(`Nice`, c.Global.Nice); err != nil {
+		return err
+	}
+	if _, err := newMemoryGuard(c.Global.Memory_Soft_Limit, c.Global.Memory_Shed_Mode, nil); err != nil {
+		return err
+	}
+	if _, err := newCircuitBreaker(c.Global.Circuit_Breaker_EPS, c.Global.Circuit_Breaker_Mode, c.Global.Circuit_Breaker_Sample_Rate); err != nil {
+		return err
+	}
+	for _, p := range c.Global.Scrub_Profile {
+		if _, ok := scrubProfiles[strings.ToLower(p)]; !ok {
+			return fmt.Errorf("Unknown Scrub-Profile %q", p)
+		}
+	}
+	if len(c.Global.Pseudonymize_Field) > 0 || c.Global.Pseudonymize_Hostname || c.Global.Pseudonymize_Usernames {
+		if c.Global.Pseudonymize_Salt == `` {
+			return errNoSalt
+		}
+	}
+	if _, err := newRedactor(c.Redact); err != nil {
+		return err
+	}
+	for k, v := range c.Stream {
+		if err := v.verify(k, c.Global); err != nil {
+			return err
+		}
+	}
+	for k, v := range c.Site {
+		if err := v.verify(k); err != nil {
+			return err
+		}
+	}
+	for k, v := range c.Files {
+		if err := v.verify(k); err != nil {
+			return err
+		}
+	}
+	if err := c.Network_Snapshot.verify(`Network-Snapshot`, defaultNetworkTag, defaultNetworkInterval); err != nil {
+		return err
+	}
+	if err := c.Security_Posture.verify(`Security-Posture`, defaultPostureTag, defaultPostureInterval); err != nil {
+		return err
+	}
+	if err := c.Self_Health.verify(`Self-Health`, defaultHealthTag, defaultHealthInterval); err != nil {
+		return err
+	}
+	if err := c.Diagnostic_Reports.verify(); err != nil {
+		return err
+	}
+	if err := c.Kernel_Panics.verify(); err != nil {
+		return err
+	}
+	if err := c.Periodic.verify(); err != nil {
+		return err
+	}
+	if err := c.Install_Log.verify(); err != nil {
+		return err
+	}
+	if err := c.ASL.verify(); err != nil {
+		return err
+	}
+	if err := c.Audit.verify(); err != nil {
+		return err
+	}
+	if err := c.Endpoint_Security.verify(); err != nil {
+		return err
+	}
+	if err := c.XProtect.verify(); err != nil {
+		return err
+	}
+	if err := c.Gatekeeper.verify(); err != nil {
+		return err
+	}
+	if err := c.Quarantine_Events.verify(); err != nil {
+		return err
+	}
+	if err := c.Persistence.verify(); err != nil {
+		return err
+	}
+	if err := c.Extensions.verify(); err != nil {
+		return err
+	}
+	if err := c.Auth_Events.verify(); err != nil {
+		return err
+	}
+	if err := c.Remote_Access.verify(); err != nil {
+		return err
+	}
+	if err := c.MDM.verify(); err != nil {
+		return err
+	}
+	if err := c.verifyPresetStreams(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (g global) uidCacheTimeout() (time.Duration, error) {
+	if g.UID_Cache_Timeout == `` {
+		return defaultUIDCacheTimeout, nil
+	}
+	d, err := time.ParseDuration(g.UID_Cache_Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid UID-Cache-Timeout %q: %v", g.UID_Cache_Timeout, err)
+	}
+	return d, nil
+}
+
+func (g global) sourceRefreshInterval() (time.Duration, error) {
+	if g.Source_Refresh_Interval == `` {
+		return defaultSourceRefresh, nil
+	}
+	d, err := time.ParseDuration(g.Source_Refresh_Interval)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Source-Refresh-Interval %q: %v", g.Source_Refresh_Interval, err)
+	}
+	return d, nil
+}
+
+// Tags returns the unique set of tags the ingester may write to.
+func (c *cfgType) Tags() (tags []string) {
+	seen := map[string]bool{}
+	add := func(t string) {
+		if t != `` && !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	add(c.Global.Tag_Name)
+	for _, def := range c.streamDefs() {
+		add(def.tagName)
+	}
+	add(c.Global.Alert_Tag_Name)
+	add(c.Global.Diagnostics_Tag_Name)
+	add(c.Global.Fleet_Tag_Name)
+	if c.Network_Snapshot.Enable {
+		add(c.Network_Snapshot.Tag_Name)
+	}
+	if c.Self_Health.Enable {
+		add(c.Self_Health.Tag_Name)
+	}
+	if c.Security_Posture.Enable {
+		add(c.Security_Posture.Tag_Name)
+	}
+	if c.Diagnostic_Reports.Enable {
+		add(c.Diagnostic_Reports.Tag_Name)
+	}
+	if c.Kernel_Panics.Enable {
+		add(c.Kernel_Panics.Tag_Name)
+	}
+	if c.Periodic.Enable {
+		add(c.Periodic.Tag_Name)
+	}
+	if c.Install_Log.Enable {
+		add(c.Install_Log.Tag_Name)
+	}
+	if c.ASL.Enable {
+		add(c.ASL.Tag_Name)
+	}
+	if c.Audit.Enable {
+		add(c.Audit.Tag_Name)
+	}
+	if c.Endpoint_Security.Enable {
+		add(c.Endpoint_Security.Tag_Name)
+		tags, _ := c.Endpoint_Security.eventTags()
+		names := make([]string, 0, len(tags))
+		for _, t := range tags {
+			names = append(names, t)
+		}
+		sort.Strings(names)
+		for _, t := range names {
+			add(t)
+		}
+	}
+	if c.Quarantine_Events.Enable {
+		add(c.Quarantine_Events.Tag_Name)
+	}
+	if c.Persistence.Enable {
+		add(c.Persistence.Tag_Name)
+	}
+	for _, fc := range c.Files {
+		add(fc.Tag_Name)
+	}
+	return
+}
+
+// filtersRecords reports whether any of the Global filters or
+// Error-Context can drop a record.
+func (g global) filtersRecords() bool {
+	return g.Minimum_Level != `` || len(g.Capture_Window) > 0 ||
+		len(g.Allow_Subsystems) > 0 || len(g.Deny_Subsystems) > 0 ||
+		len(g.Allow_Categories) > 0 || len(g.Deny_Categories) > 0 ||
+		len(g.Allow_Processes) > 0 || len(g.Deny_Processes) > 0 ||
+		len(g.Drop_Message) > 0 || len(g.Sample_Subsystem) > 0 || g.Error_Context > 0
+}
 
+func (sc *snapshotConfig) verify(name, defTag, defInterval string) error {
+	if !sc.Enable {
+		return nil
+	}
+	if sc.Tag_Name == `` {
+		sc.Tag_Name = defTag
+	}
+	if sc.Interval == `` {
+		sc.Interval = defInterval
+	}
+	if _, err := sc.interval(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
 	return nil
 }
+
+func (sc snapshotConfig) interval() (time.Duration, error) {
+	d, err := time.ParseDuration(sc.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Interval %q: %v", sc.Interval, err)
+	} else if d <= 0 {
+		return 0, fmt.Errorf("Invalid Interval %q: must be positive", sc.Interval)
+	}
+	return d, nil
+}
+
+// aggregator returns the duplicate message aggregator, nil if disabled.
+func (g global) aggregator() (*dupAggregator, error) {
+	if g.Aggregate_Window == `` {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(g.Aggregate_Window)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Aggregate-Window %q: %v", g.Aggregate_Window, err)
+	} else if d <= 0 {
+		return nil, nil
+	}
+	return newDupAggregator(d), nil
+}
+
+func (g global) stateStoreLocation() string {
+	if g.State_Store_Location == `` {
+		return defaultStateStoreLocation
+	}
+	return g.State_Store_Location
+}
+
+func (g global) dropSummaryInterval() (time.Duration, error) {
+	if g.Drop_Summary_Interval == `` {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(g.Drop_Summary_Interval)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Drop-Summary-Interval %q: %v", g.Drop_Summary_Interval, err)
+	}
+	return d, nil
+}
+
+func (g global) seenStoreLocation() string {
+	if g.Seen_Store_Location == `` {
+		return defaultSeenStoreLocation
+	}
+	return g.Seen_Store_Location
+}
+
+func (g global) firstSeenLearningPeriod() (time.Duration, error) {
+	if g.First_Seen_Learning_Period == `` {
+		return defaultFirstSeenLearning, nil
+	}
+	d, err := time.ParseDuration(g.First_Seen_Learning_Period)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid First-Seen-Learning-Period %q: %v", g.First_Seen_Learning_Period, err)
+	}
+	return d, nil
+}
+
+func (g global) maxBackfill() (time.Duration, error) {
+	if g.Max_Backfill == `` {
+		return defaultMaxBackfill, nil
+	}
+	d, err := time.ParseDuration(g.Max_Backfill)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Max-Backfill %q: %v", g.Max_Backfill, err)
+	}
+	return d, nil
+}
+
+// streamConfig controls how log children are run and restarted.
+type streamConfig struct {
+	maxBackoff    time.Duration
+	maxAttempts   int           // failures before exiting, zero retries forever
+	attemptWindow time.Duration // failures only count within this window, zero requires consecutive failures
+	idleTimeout   time.Duration // restart a silent stream after this long, zero disables
+	maxBuffer     int           // bytes the decoder may buffer looking for a record boundary
+	readSize      int           // bytes read from the log command at a time
+	queueDepth    int           // batches decoded ahead of the writer
+	parseWorkers  int           // goroutines compacting records during backfills
+	batchSize     int           // most entries gathered into a single write
+	batchInterval time.Duration // longest an entry waits to be batched, zero disables batching
+	gapEntries    bool          // emit an entry describing the window lost to a restart
+	qosClass      string        // taskpolicy clamp for log stream, empty runs it directly
+	backfillQoS   string        // taskpolicy clamp for log show
+	backfillNice  int           // nice level of log show, zero inherits the ingester's
+	backlog       bool          // a backfill, paced by Backlog-Rate-EPS
+	predicate     string        // passed to log with --predicate, set per stream
+}
+
+func (g global) streamConfig() (rc streamConfig, err error) {
+	rc.maxBackoff = defaultBackoffMax
+	rc.maxAttempts = g.Max_Restart_Attempts
+	if g.Max_Restart_Backoff != `` {
+		if rc.maxBackoff, err = time.ParseDuration(g.Max_Restart_Backoff); err != nil {
+			err = fmt.Errorf("Invalid Max-Restart-Backoff %q: %v", g.Max_Restart_Backoff, err)
+			return
+		}
+	}
+	if rc.maxAttempts < 0 {
+		err = fmt.Errorf("Invalid Max-Restart-Attempts %d", rc.maxAttempts)
+		return
+	}
+	if g.Restart_Attempt_Window != `` {
+		if rc.attemptWindow, err = time.ParseDuration(g.Restart_Attempt_Window); err != nil {
+			err = fmt.Errorf("Invalid Restart-Attempt-Window %q: %v", g.Restart_Attempt_Window, err)
+			return
+		}
+	}
+	rc.idleTimeout = defaultStreamIdleTimeout
+	if g.Stream_Idle_Timeout != `` {
+		if rc.idleTimeout, err = time.ParseDuration(g.Stream_Idle_Timeout); err != nil {
+			err = fmt.Errorf("Invalid Stream-Idle-Timeout %q: %v", g.Stream_Idle_Timeout, err)
+			return
+		}
+	}
+	rc.gapEntries = g.Gap_Entries
+	rc.maxBuffer = defaultMaxDecodeBufferMB * 1024 * 1024
+	if g.Max_Decode_Buffer < 0 {
+		err = fmt.Errorf("Invalid Max-Decode-Buffer %d", g.Max_Decode_Buffer)
+		return
+	} else if g.Max_Decode_Buffer > 0 {
+		rc.maxBuffer = g.Max_Decode_Buffer * 1024 * 1024
+	}
+	rc.readSize = defaultReadBufferKB * 1024
+	if g.Read_Buffer_Size < 0 {
+		err = fmt.Errorf("Invalid Read-Buffer-Size %d", g.Read_Buffer_Size)
+		return
+	} else if g.Read_Buffer_Size > 0 {
+		rc.readSize = g.Read_Buffer_Size * 1024
+	}
+	rc.batchSize, rc.batchInterval = defaultBatchSize, defaultBatchInterval
+	if g.Batch_Size < 0 {
+		err = fmt.Errorf("Invalid Batch-Size %d", g.Batch_Size)
+		return
+	} else if g.Batch_Size > 0 {
+		rc.batchSize = g.Batch_Size
+	}
+	if g.Batch_Interval != `` {
+		if rc.batchInterval, err = time.ParseDuration(g.Batch_Interval); err != nil || rc.batchInterval < 0 {
+			err = fmt.Errorf("Invalid Batch-Interval %q", g.Batch_Interval)
+			return
+		}
+	}
+	rc.parseWorkers = 1
+	if g.Parse_Workers < 0 {
+		err = fmt.Errorf("Invalid Parse-Workers %d", g.Parse_Workers)
+		return
+	} else if g.Parse_Workers > 0 {
+		rc.parseWorkers = g.Parse_Workers
+	}
+	rc.queueDepth = defaultDecodeQueueDepth
+	if g.Decode_Queue_Depth < 0 {
+		err = fmt.Errorf("Invalid Decode-Queue-Depth %d", g.Decode_Queue_Depth)
+		return
+	} else if g.Decode_Queue_Depth > 0 {
+		rc.queueDepth = g.Decode_Queue_Depth
+	}
+	if rc.qosClass, err = checkQoSClass(`QoS-Class`, g.QoS_Class); err != nil {
+		return
+	}
+	if rc.backfillQoS, err = checkQoSClass(`Backfill-QoS-Class`, g.Backfill_QoS_Class); err != nil {
+		return
+	} else if rc.backfillQoS == `` {
+		rc.backfillQoS = rc.qosClass
+	}
+	if err = checkNice(`Backfill-Nice`, g.Backfill_Nice); err != nil {
+		return
+	}
+	rc.backfillNice = g.Backfill_Nice
+	return
+}
+
+// retryQueueSize returns the retry queue limit in bytes.
+func (g global) retryQueueSize() (int, error) {
+	if g.Max_Retry_Queue < 0 {
+		return 0, fmt.Errorf("Invalid Max-Retry-Queue %d", g.Max_Retry_Queue)
+	} else if g.Max_Retry_Queue == 0 {
+		return defaultRetryQueueMB * 1024 * 1024, nil
+	}
+	return g.Max_Retry_Queue * 1024 * 1024, nil
+}
+
+type spoolConfig struct {
+	dir    string
+	max    int64
+	maxAge time.Duration
+}
+
+// spoolConfig returns the on disk spool settings, ok is false when the
+// spool is disabled.
+func (g global) spoolConfig() (sc spoolConfig, ok bool, err error) {
+	if g.Spool_Location == `` {
+		return
+	}
+	sc.dir = g.Spool_Location
+	sc.max = defaultSpoolMB * 1024 * 1024
+	sc.maxAge = defaultMaxSpoolAge
+	if g.Max_Spool_Size < 0 {
+		err = fmt.Errorf("Invalid Max-Spool-Size %d", g.Max_Spool_Size)
+		return
+	} else if g.Max_Spool_Size > 0 {
+		sc.max = int64(g.Max_Spool_Size) * 1024 * 1024
+	}
+	if g.Max_Spool_Age != `` {
+		if sc.maxAge, err = time.ParseDuration(g.Max_Spool_Age); err != nil {
+			err = fmt.Errorf("Invalid Max-Spool-Age %q: %v", g.Max_Spool_Age, err)
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// drainTimeout is how long shutdown waits for readers to stop and for
+// buffered entries to be written.
+func (g global) drainTimeout() (time.Duration, error) {
+	if g.Drain_Timeout == `` {
+		return defaultDrainTimeout, nil
+	}
+	d, err := time.ParseDuration(g.Drain_Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid Drain-Timeout %q", g.Drain_Timeout)
+	}
+	return d, nil
+}
+
+// backlogPacer builds the pacer for Backlog-Rate-EPS, nil when unlimited.
+func (g global) backlogPacer() (*backlogPacer, error) {
+	ramp := defaultBacklogRamp
+	if g.Backlog_Ramp != `` {
+		var err error
+		if ramp, err = time.ParseDuration(g.Backlog_Ramp); err != nil {
+			return nil, fmt.Errorf("Invalid Backlog-Ramp %q", g.Backlog_Ramp)
+		}
+	}
+	return newBacklogPacer(g.Backlog_Rate_EPS, ramp)
+}
+
+func (g global) lockFile() string {
+	if g.Lock_File == `` {
+		return defaultLockLoc
+	}
+	return g.Lock_File
+}
+
+func (g global) logRotation() (rot logRotation, err error) {
+	if g.Log_File_Max_Size < 0 {
+		err = fmt.Errorf("Invalid Log-File-Max-Size %d", g.Log_File_Max_Size)
+		return
+	}
+	rot.maxSize = int64(g.Log_File_Max_Size) * 1024 * 1024
+	if g.Log_File_Max_Age != `` {
+		if rot.maxAge, err = time.ParseDuration(g.Log_File_Max_Age); err != nil {
+			err = fmt.Errorf("Invalid Log-File-Max-Age %q: %v", g.Log_File_Max_Age, err)
+			return
+		}
+	}
+	if g.Log_File_Retain < 0 {
+		err = fmt.Errorf("Invalid Log-File-Retain %d", g.Log_File_Retain)
+	} else if rot.retain = g.Log_File_Retain; rot.retain == 0 {
+		rot.retain = defaultLogFileRetain
+	}
+	return
+}
+
+func (g global) exitAfterIdle() (time.Duration, error) {
+	if g.Exit_After_Idle == `` {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(g.Exit_After_Idle)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid Exit-After-Idle %q", g.Exit_After_Idle)
+	}
+	return d, nil
+}
+
+func (g global) controlSocket() string {
+	if g.Control_Socket == `` {
+		return defaultControlSocket
+	}
+	return g.Control_Socket
+}
+
+func (g global) wakeWindow() (time.Duration, error) {
+	if g.Wake_Window == `` {
+		return defaultWakeWindow, nil
+	}
+	d, err := time.ParseDuration(g.Wake_Window)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Wake-Window %q: %v", g.Wake_Window, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,382 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// decoder splits the JSON array written by log stream and log show into
+// individual records.  Each decoder handles a single child process.  Record
+// boundaries are found by an incremental scanner that tracks nesting and
+// strings, so only newly read bytes are examined and the whitespace log
+// puts between records doesn't matter.
+type decoder struct {
+	r     *bufio.Reader
+	chunk []byte
+	buf   []byte
+	done  bool
+	last  int64 // unix nanos of the last read that returned data
+	trace bool  // log boundary decisions at debug level
+	held  int32 // non-zero while the caller isn't reading, e.g. under backpressure
+
+	backlog bool // records are from log show, stamped with their own time rather than now
+
+	depth     int // batches decoded ahead of the writer
+	workers   int // goroutines compacting records, see decodeParallel
+	max       int // most bytes buffered for a single record before resynchronizing
+	consumed  int // leading bytes of buf handed out by the last split
+	pieces    [][]byte
+	resync    bool // discarding input until the next record boundary
+	discards  int
+	accounted int64 // buffer bytes counted in the memory usage
+
+	// scanner state
+	scanned int  // offset in buf of the next byte to scan
+	start   int  // offset in buf of the record being scanned, -1 between records
+	nest    int  // object and array nesting within the record
+	inStr   bool // inside a string
+	esc     bool // the previous byte was a backslash inside a string
+	text    int  // offset in buf of a line of text between records being skipped, -1 when not in one
+}
+
+const (
+	defaultMaxDecodeBufferMB = 16
+	defaultReadBufferKB      = 64
+	defaultDecodeQueueDepth  = 8
+)
+
+// records in the log JSON array are separated by this, the scanner doesn't
+// need it but resynchronizing after an overflow can't trust the scanner
+var recordSep = []byte("\n},{\n")
+
+func newDecoder(r io.Reader, rc streamConfig) *decoder {
+	max, size := rc.maxBuffer, rc.readSize
+	if max <= 0 {
+		max = defaultMaxDecodeBufferMB * 1024 * 1024
+	}
+	if size <= 0 {
+		size = defaultReadBufferKB * 1024
+	}
+	depth := rc.queueDepth
+	if depth <= 0 {
+		depth = defaultDecodeQueueDepth
+	}
+	return &decoder{
+		r:       bufio.NewReaderSize(r, size),
+		chunk:   make([]byte, size),
+		start:   -1,
+		text:    -1,
+		last:    time.Now().UnixNano(),
+		trace:   *traceDecode,
+		max:     max,
+		depth:   depth,
+		workers: 1,
+		backlog: rc.backlog,
+	}
+}
+
+// read appends whatever is available to the buffer, blocking until there is
+// something, and tracks when data last arrived.
+func (d *decoder) read() (int, error) {
+	n, err := d.r.Read(d.chunk)
+	if n > 0 {
+		d.buf = append(d.buf, d.chunk[:n]...)
+		atomic.StoreInt64(&d.last, time.Now().UnixNano())
+	}
+	d.account()
+	return n, err
+}
+
+// account updates the memory usage with the decoder's buffers, they only
+// grow so this is cheap between reallocations.
+func (d *decoder) account() {
+	var n int64
+	if d.buf != nil || d.chunk != nil {
+		n = int64(cap(d.buf) + len(d.chunk) + d.r.Size())
+	}
+	if n != d.accounted {
+		stats.decodeBuffers(n - d.accounted)
+		d.accounted = n
+	}
+}
+
+// free drops the decoder's buffers once it is finished with.
+func (d *decoder) free() {
+	d.buf, d.chunk, d.pieces = nil, nil, nil
+	d.account()
+}
+
+// tracef logs a decode decision when tracing is enabled.
+func (d *decoder) tracef(f string, args ...interface{}) {
+	if d.trace {
+		lg.Debug("decode: "+f, args...)
+	}
+}
+
+// applyTraceLevel drops the log level to debug when decode tracing is on,
+// the traces would be invisible otherwise.
+func applyTraceLevel() {
+	if *traceDecode {
+		lg.SetLevel(log.DEBUG)
+	}
+}
+
+// lastActivity returns when the decoder last received any data, a held
+// decoder is always considered active.
+func (d *decoder) lastActivity() time.Time {
+	if atomic.LoadInt32(&d.held) != 0 {
+		return time.Now()
+	}
+	return time.Unix(0, atomic.LoadInt64(&d.last))
+}
+
+// hold marks the decoder as deliberately not reading so silence isn't
+// mistaken for a wedged stream, release restarts the clock.
+func (d *decoder) hold() {
+	atomic.StoreInt32(&d.held, 1)
+}
+
+func (d *decoder) release() {
+	atomic.StoreInt64(&d.last, time.Now().UnixNano())
+	atomic.StoreInt32(&d.held, 0)
+}
+
+// overflow throws away a record that has grown past the limit without
+// ending, a format change or a runaway record shouldn't take the ingester
+// down with it.  Input is then discarded until the next boundary.
+func (d *decoder) overflow() {
+	lg.Warn("Decode buffer exceeded %d bytes without a record boundary, discarding and resynchronizing\n", d.max)
+	d.resync = true
+	d.skipToBoundary()
+}
+
+// skipToBoundary drops buffered input up to the first record boundary and
+// resets the scanner on the record that follows, returning true if one was
+// found.  The tail of the buffer is kept in case a boundary straddles two
+// reads.
+func (d *decoder) skipToBoundary() bool {
+	d.scanned, d.start, d.nest, d.inStr, d.esc, d.text = 0, -1, 0, false, false, -1
+	if idx := bytes.Index(d.buf, recordSep); idx >= 0 {
+		// keep the opening brace of the next record
+		skip := idx + len(recordSep) - 2
+		d.discards += skip
+		d.buf = append(d.buf[:0], d.buf[skip:]...)
+		d.resync = false
+		lg.Info("Decoder resynchronized after discarding %d bytes\n", d.discards)
+		d.discards = 0
+		return true
+	}
+	if keep := len(recordSep) - 1; len(d.buf) > keep {
+		d.discards += len(d.buf) - keep
+		d.buf = append(d.buf[:0], d.buf[len(d.buf)-keep:]...)
+	}
+	return false
+}
+
+// decode returns the records completed by the next read.
+func (d *decoder) decode() ([]*entry.Entry, error) {
+	pieces, err := d.split()
+	if err != nil {
+		return nil, err
+	}
+	return compactRecords(pieces)
+}
+
+// split reads until at least one record is complete and returns the raw
+// records, they are only valid until the next call.
+func (d *decoder) split() ([][]byte, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	if d.consumed > 0 {
+		// the records handed out last time are done with, any partial
+		// one moves to the front
+		d.buf = append(d.buf[:0], d.buf[d.consumed:]...)
+		d.scanned -= d.consumed
+		if d.start >= 0 {
+			d.start -= d.consumed
+		}
+		if d.text >= 0 {
+			d.text = 0 // only the tail of the line is left
+		}
+		d.consumed = 0
+	}
+
+	pieces := d.pieces[:0]
+	for {
+		n, err := d.read()
+		if err != nil {
+			if err == io.EOF {
+				// log show closes the array and exits
+				d.done = true
+				if d.start >= 0 {
+					lg.Warn("Input closed in the middle of a record, discarding %d bytes\n", len(d.buf)-d.start)
+				}
+				d.tracef("input closed with %d bytes buffered\n", len(d.buf))
+			}
+			return nil, err
+		}
+
+		if d.resync && !d.skipToBoundary() {
+			d.tracef("resynchronizing, no boundary in %d byte buffer\n", len(d.buf))
+			continue
+		}
+
+		if pieces = d.scan(pieces); len(pieces) == 0 {
+			if d.start < 0 {
+				// nothing but the array brackets, separators, and text
+				// so far
+				d.buf = d.buf[:0]
+				d.scanned = 0
+				if d.text >= 0 {
+					d.text = 0
+				}
+			} else if len(d.buf)-d.start > d.max {
+				d.overflow()
+			}
+			d.tracef("read %d bytes, no record complete in %d byte buffer\n", n, len(d.buf))
+			continue
+		}
+
+		// everything before the record in progress can go next time
+		d.consumed = d.start
+		if d.start < 0 {
+			d.consumed = len(d.buf)
+		}
+		d.tracef("read %d bytes, split %d records from %d byte buffer, carrying %d bytes\n", n, len(pieces), len(d.buf), len(d.buf)-d.consumed)
+		break
+	}
+	d.pieces = pieces
+	return pieces, nil
+}
+
+// scan advances the scanner over newly read bytes, appending each record
+// that closes to pieces.  Anything between records, the array brackets,
+// commas, and whitespace, is skipped.  So is any line of text there, log
+// prints a "Filtering the log data using ..." banner ahead of the records
+// and the predicate it quotes may contain braces.
+func (d *decoder) scan(pieces [][]byte) [][]byte {
+	buf := d.buf
+	for i := d.scanned; i < len(buf); i++ {
+		if d.nest == 0 && d.text < 0 && !betweenRecords(buf[i]) {
+			d.text = i
+		}
+		if d.text >= 0 {
+			j := bytes.IndexByte(buf[i:], '\n')
+			if j < 0 {
+				break
+			}
+			i += j
+			d.tracef("skipped text between records: %q\n", buf[d.text:i])
+			d.text = -1
+			continue
+		}
+		if d.inStr {
+			if d.esc {
+				d.esc = false
+				continue
+			}
+			// jump to the next byte that can end the string
+			j := bytes.IndexAny(buf[i:], "\"\\")
+			if j < 0 {
+				break
+			}
+			i += j
+			if buf[i] == '\\' {
+				d.esc = true
+			} else {
+				d.inStr = false
+			}
+			continue
+		}
+		switch buf[i] {
+		case '"':
+			d.inStr = true // only inside a record, text was handled above
+		case '{', '[':
+			if d.nest == 0 {
+				if buf[i] == '[' {
+					continue // the array holding the records
+				}
+				d.start = i
+			}
+			d.nest++
+		case '}', ']':
+			if d.nest == 0 {
+				continue
+			}
+			if d.nest--; d.nest == 0 {
+				pieces = append(pieces, buf[d.start:i+1])
+				d.start = -1
+			}
+		}
+	}
+	d.scanned = len(buf)
+	return pieces
+}
+
+// betweenRecords reports whether c belongs to the JSON around the records.
+func betweenRecords(c byte) bool {
+	switch c {
+	case '[', ']', '{', '}', ',', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+// compactRecords builds an entry for each raw record.
+func compactRecords(pieces [][]byte) ([]*entry.Entry, error) {
+	ents := getBatch(len(pieces))
+	for _, piece := range pieces {
+		ent, err := compactRecord(piece)
+		if err != nil {
+			stats.parseError()
+			for _, ent := range ents {
+				putEntry(ent)
+			}
+			putBatch(ents)
+			return nil, err
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// compactScratch is the buffer compactRecord works in, it is pooled so the
+// only allocation per record is its final data, and not even that when a
+// recycled entry has room.
+type compactScratch struct {
+	out bytes.Buffer
+}
+
+var compactPool = sync.Pool{
+	New: func() interface{} { return new(compactScratch) },
+}
+
+// compactRecord compacts a single record into an entry.
+func compactRecord(piece []byte) (*entry.Entry, error) {
+	cs := compactPool.Get().(*compactScratch)
+	defer compactPool.Put(cs)
+	cs.out.Reset()
+	if err := json.Compact(&cs.out, piece); err != nil {
+		return nil, err
+	}
+	ent := getEntry()
+	ent.Data = append(ent.Data[:0], cs.out.Bytes()...)
+	return ent, nil
+}
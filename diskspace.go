@@ -0,0 +1,116 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMinFreeDiskMB = 512
+	diskCheckInterval    = 30 * time.Second
+)
+
+var (
+	errDiskFull = errors.New("disk is full")
+)
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, errDiskFull)
+}
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// diskMonitor watches free space on the filesystems the ingester writes to
+// and warns before they fill, the spool gives up its oldest entries to keep
+// the disk from filling entirely.
+type diskMonitor struct {
+	paths   []string
+	reserve uint64
+	sp      *spool
+	low     map[string]bool
+}
+
+func newDiskMonitor(cfg *cfgType, pl *pipeline) *diskMonitor {
+	dm := &diskMonitor{
+		reserve: defaultMinFreeDiskMB * 1024 * 1024,
+		sp:      pl.out.spool,
+		low:     map[string]bool{},
+	}
+	if cfg.Global.Min_Free_Disk > 0 {
+		dm.reserve = uint64(cfg.Global.Min_Free_Disk) * 1024 * 1024
+	}
+	seen := map[string]bool{}
+	add := func(p string) {
+		if p != `` && !seen[p] {
+			seen[p] = true
+			dm.paths = append(dm.paths, p)
+		}
+	}
+	if dm.sp != nil {
+		add(dm.sp.dir)
+	}
+	for _, p := range []string{cfg.Global.Ingest_Cache_Path, cfg.Global.stateStoreLocation(), cfg.Global.Log_File} {
+		if p != `` {
+			add(filepath.Dir(p))
+		}
+	}
+	return dm
+}
+
+func (dm *diskMonitor) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(diskCheckInterval)
+	defer tckr.Stop()
+	for {
+		dm.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (dm *diskMonitor) check() {
+	for _, p := range dm.paths {
+		free, err := freeSpace(p)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				lg.Debug("Failed to check free space on %s: %v\n", p, err)
+			}
+			continue
+		}
+		if low := free < dm.reserve; low != dm.low[p] {
+			dm.low[p] = low
+			if low {
+				lg.Warn("Only %d MB free on the filesystem holding %s\n", free/(1024*1024), p)
+			} else {
+				lg.Info("Free space recovered on the filesystem holding %s\n", p)
+			}
+		}
+		if dm.sp != nil && p == dm.sp.dir {
+			dm.sp.pressure(free, dm.reserve)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables that override the config file, MDM tools and
+// deployment systems would rather set these than template the file.  Each
+// may instead be given as NAME_FILE pointing at a file holding the value so
+// secrets can stay out of the environment.
+const (
+	envIngestSecret     = `GRAVWELL_INGEST_SECRET`
+	envCleartextTargets = `GRAVWELL_CLEARTEXT_TARGETS` // comma separated
+	envEncryptedTargets = `GRAVWELL_ENCRYPTED_TARGETS` // comma separated
+	envPipeTargets      = `GRAVWELL_PIPE_TARGETS`      // comma separated
+	envTagName          = `MACOSLOG_TAG_NAME`
+	envPredicate        = `MACOSLOG_PREDICATE`
+)
+
+// applyEnvOverrides replaces config values with any set in the
+// environment.  Setting a target variable replaces every target of that
+// type from the file, an empty value removes them.
+func applyEnvOverrides(c *cfgType) error {
+	if err := envString(envIngestSecret, &c.Global.Ingest_Secret); err != nil {
+		return err
+	}
+	if err := envList(envCleartextTargets, &c.Global.Cleartext_Backend_Target); err != nil {
+		return err
+	}
+	if err := envList(envEncryptedTargets, &c.Global.Encrypted_Backend_Target); err != nil {
+		return err
+	}
+	if err := envList(envPipeTargets, &c.Global.Pipe_Backend_Target); err != nil {
+		return err
+	}
+	if err := envString(envTagName, &c.Global.Tag_Name); err != nil {
+		return err
+	}
+	return envString(envPredicate, &c.Global.Predicate)
+}
+
+// applyFlagOverrides replaces config values with any given on the command
+// line, these win over the environment.  Unlike the environment, any
+// target flag replaces all of the configured targets so an ad hoc run
+// doesn't also try to reach the indexers in the file.
+func applyFlagOverrides(c *cfgType) {
+	if *tagOverride != `` {
+		c.Global.Tag_Name = *tagOverride
+	}
+	if *clearTargets == `` && *tlsTargets == `` && *pipeTargets == `` {
+		return
+	}
+	c.Global.Cleartext_Backend_Target = splitList(*clearTargets)
+	c.Global.Encrypted_Backend_Target = splitList(*tlsTargets)
+	c.Global.Pipe_Backend_Target = splitList(*pipeTargets)
+}
+
+// lookupEnv returns the value of name, or the contents of the file named by
+// name_FILE.
+func lookupEnv(name string) (string, bool, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true, nil
+	}
+	fp, ok := os.LookupEnv(name + `_FILE`)
+	if !ok {
+		return ``, false, nil
+	}
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return ``, false, fmt.Errorf("Failed to read %s_FILE: %v", name, err)
+	}
+	return strings.TrimSpace(string(b)), true, nil
+}
+
+func envString(name string, v *string) error {
+	s, ok, err := lookupEnv(name)
+	if ok {
+		*v = s
+	}
+	return err
+}
+
+func envList(name string, v *[]string) error {
+	s, ok, err := lookupEnv(name)
+	if err != nil || !ok {
+		return err
+	}
+	*v = splitList(s)
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) (l []string) {
+	for _, t := range strings.Split(s, `,`) {
+		if t = strings.TrimSpace(t); t != `` {
+			l = append(l, t)
+		}
+	}
+	return
+}
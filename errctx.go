@@ -0,0 +1,109 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rings for processes that have gone quiet are discarded after this
+	errorContextIdle = 5 * time.Minute
+)
+
+type contextRing struct {
+	evs  []*event
+	idx  int
+	last time.Time
+}
+
+// push adds an event, returning the event it displaced if the ring is full.
+func (cr *contextRing) push(ev *event, size int) (old *event) {
+	if len(cr.evs) < size {
+		cr.evs = append(cr.evs, ev)
+	} else {
+		old = cr.evs[cr.idx]
+		cr.evs[cr.idx] = ev
+		cr.idx = (cr.idx + 1) % size
+	}
+	return
+}
+
+// drain returns the buffered events oldest first and empties the ring.
+func (cr *contextRing) drain() (out []*event) {
+	out = append(out, cr.evs[cr.idx:]...)
+	out = append(out, cr.evs[:cr.idx]...)
+	cr.evs = cr.evs[:0]
+	cr.idx = 0
+	return
+}
+
+// errorContext only passes Error and Fault records, lower level records are
+// kept in a per process ring buffer and released ahead of an error from the
+// same process so the error arrives with the lead up to it.  Released
+// context records are marked with errorContext=true.
+type errorContext struct {
+	sync.Mutex
+	size  int
+	rings map[aggKey]*contextRing
+	tally *dropTally
+}
+
+func newErrorContext(size int) *errorContext {
+	if size <= 0 {
+		return nil
+	}
+	return &errorContext{
+		size:  size,
+		rings: map[aggKey]*contextRing{},
+	}
+}
+
+func (ec *errorContext) add(ev *event) (out []*event) {
+	key := aggKey{pid: ev.ProcessID, path: ev.ProcessImagePath}
+	lvl, ok := messageTypeLevel(ev.MessageType)
+	ec.Lock()
+	defer ec.Unlock()
+	r, have := ec.rings[key]
+	if ok && lvl >= messageTypeLevels[`error`] {
+		if have {
+			for _, cev := range r.drain() {
+				cev.Set("errorContext", true)
+				out = append(out, cev)
+			}
+		}
+		return append(out, ev)
+	}
+	if !have {
+		r = &contextRing{}
+		ec.rings[key] = r
+	}
+	if old := r.push(ev, ec.size); old != nil {
+		ec.tally.dropped(old)
+	}
+	r.last = time.Now()
+	return nil
+}
+
+// flush never releases anything, context that wasn't needed is discarded
+// once its process goes quiet.
+func (ec *errorContext) flush(now time.Time, force bool) []*event {
+	ec.Lock()
+	defer ec.Unlock()
+	for k, r := range ec.rings {
+		if force || now.Sub(r.last) > errorContextIdle {
+			for _, ev := range r.drain() {
+				ec.tally.dropped(ev)
+			}
+			delete(ec.rings, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultESTag = `macos-es`
+	esloggerPath = `/usr/bin/eslogger`
+)
+
+// events subscribed to without an Event list
+var defaultESEvents = []string{`exec`, `mount`, `authentication`}
+
+// events the native client can subscribe to, es_native.c maps them to ES
+// event types in the same order
+var esNativeEvents = []string{
+	`exec`, `fork`, `exit`, `signal`,
+	`open`, `close`, `create`, `unlink`, `rename`, `write`,
+	`mount`, `unmount`, `authentication`,
+	`auth_exec`, `auth_open`,
+}
+
+// esConfig is the [Endpoint-Security] block.
+type esConfig struct {
+	Enable           bool
+	Tag_Name         string
+	Event            []string // eslogger event names, eslogger --list-events shows them all
+	Event_Tag        []string // event:tag sends an event type to its own tag
+	Native           bool     // use the built in ES client rather than eslogger, needs the esclient build and the ES entitlement
+	Mute_Path        []string // native client: executables whose events are muted
+	Mute_Path_Prefix []string // native client: executable path prefixes whose events are muted
+}
+
+func (ec *esConfig) verify() error {
+	if !ec.Enable {
+		return nil
+	}
+	if ec.Tag_Name == `` {
+		ec.Tag_Name = defaultESTag
+	}
+	for _, ev := range ec.Event {
+		if ev == `` || strings.IndexFunc(ev, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_')
+		}) >= 0 {
+			return fmt.Errorf("Endpoint-Security: Invalid Event %q", ev)
+		}
+		if ec.Native && esNativeEvent(ev) < 0 {
+			return fmt.Errorf("Endpoint-Security: the native client has no event %q", ev)
+		}
+	}
+	if _, err := ec.eventTags(); err != nil {
+		return err
+	}
+	if !ec.Native && len(ec.Mute_Path)+len(ec.Mute_Path_Prefix) > 0 {
+		return fmt.Errorf("Endpoint-Security: Mute-Path and Mute-Path-Prefix need Native")
+	}
+	return nil
+}
+
+// eventTags returns the tag names by event.
+func (ec esConfig) eventTags() (map[string]string, error) {
+	m := map[string]string{}
+	for _, et := range ec.Event_Tag {
+		idx := strings.LastIndex(et, ":")
+		if idx <= 0 || strings.TrimSpace(et[idx+1:]) == `` {
+			return nil, fmt.Errorf("Endpoint-Security: Invalid Event-Tag %q, expected event:tag", et)
+		}
+		m[strings.TrimSpace(et[:idx])] = strings.TrimSpace(et[idx+1:])
+	}
+	return m, nil
+}
+
+func esNativeEvent(name string) int {
+	for i, ev := range esNativeEvents {
+		if ev == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ec esConfig) events() []string {
+	if len(ec.Event) == 0 {
+		return defaultESEvents
+	}
+	return ec.Event
+}
+
+// esCollector runs eslogger, or the native client, and ingests each event
+// it reports.  eslogger is restarted with a backoff whenever it exits.
+type esCollector struct {
+	tag    entry.EntryTag
+	tags   map[string]entry.EntryTag // by event, from Event-Tag
+	events []string
+	src    *sourceTracker
+	sc     *stderrCapture
+}
+
+func startESCollector(ctx context.Context, wg *sync.WaitGroup, cfg esConfig, src *sourceTracker, sc *stderrCapture) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve endpoint security tag %q: %v", cfg.Tag_Name, err)
+	}
+	ec := &esCollector{
+		tag:    tag,
+		tags:   map[string]entry.EntryTag{},
+		events: cfg.events(),
+		src:    src,
+		sc:     sc,
+	}
+	names, err := cfg.eventTags()
+	if err != nil {
+		return err
+	}
+	for ev, name := range names {
+		if ec.tags[ev], err = igst.GetTag(name); err != nil {
+			return fmt.Errorf("Failed to resolve endpoint security tag %q: %v", name, err)
+		}
+	}
+	if cfg.Native {
+		return startNativeES(ctx, wg, ec, cfg)
+	}
+	if err := ec.checkEvents(ctx); err != nil {
+		return err
+	}
+	wg.Add(1)
+	go ec.run(ctx, wg)
+	return nil
+}
+
+// tagFor returns the tag an event type goes to.
+func (ec *esCollector) tagFor(event string) entry.EntryTag {
+	if tag, ok := ec.tags[event]; ok {
+		return tag
+	}
+	return ec.tag
+}
+
+// checkEvents makes sure eslogger is there, it needs macOS 13, and knows
+// the configured events.
+func (ec *esCollector) checkEvents(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, esloggerPath, "--list-events").Output()
+	if err != nil {
+		return fmt.Errorf("Endpoint-Security needs eslogger from macOS 13 or later: %v", err)
+	}
+	known := map[string]bool{}
+	for _, ev := range strings.Fields(string(out)) {
+		known[ev] = true
+	}
+	for _, ev := range ec.events {
+		if !known[ev] {
+			return fmt.Errorf("Endpoint-Security: eslogger has no event %q", ev)
+		}
+	}
+	return nil
+}
+
+func (ec *esCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	bo := newBackoff(defaultBackoffMin, defaultBackoffMax)
+	for {
+		start := time.Now()
+		if err := ec.stream(ctx); err != nil && ctx.Err() == nil {
+			lg.Error("eslogger failed: %v\n", err)
+		}
+		if time.Since(start) > backoffResetAfter {
+			bo.reset()
+		}
+		if !bo.wait(ctx) {
+			return
+		}
+		lg.Info("Restarting eslogger\n")
+	}
+}
+
+// stream runs eslogger once, until it exits or the context is cancelled.
+func (ec *esCollector) stream(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, esloggerPath, ec.events...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	errOut, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	lg.Info("Started eslogger for %s\n", strings.Join(ec.events, `, `))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ec.sc.consume(ctx, "eslogger", errOut)
+	}()
+	err = ec.read(ctx, out)
+	if err != nil {
+		cmd.Process.Kill()
+		io.Copy(io.Discard, out)
+	}
+	wg.Wait()
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// read ingests each ndjson event, stamped with the time it happened.
+func (ec *esCollector) read(ctx context.Context, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 256*1024)
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			ts, event := esEventInfo(line)
+			ent := &entry.Entry{
+				TS:   entry.FromStandard(ts),
+				SRC:  ec.src.get(),
+				Tag:  ec.tagFor(event),
+				Data: line,
+			}
+			if werr := igst.WriteEntryContext(ctx, ent); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// esEventInfo returns the event's own time, or now if it has none, and
+// the event type, the single key of its event object.
+func esEventInfo(line []byte) (time.Time, string) {
+	var ev struct {
+		Time  time.Time                  `json:"time"`
+		Event map[string]json.RawMessage `json:"event"`
+	}
+	if err := json.Unmarshal(line, &ev); err != nil {
+		return time.Now(), ``
+	}
+	var name string
+	if len(ev.Event) == 1 {
+		for name = range ev.Event {
+		}
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	return ev.Time, name
+}
@@ -0,0 +1,235 @@
+//go:build darwin && cgo && esclient
+// +build darwin,cgo,esclient
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+#include <EndpointSecurity/EndpointSecurity.h>
+#include <bsm/libbsm.h>
+#include <mach/mach.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "es_native.h"
+#include "_cgo_export.h"
+
+// ES event types in the order of esNativeEvents in es.go
+static const es_event_type_t gw_types[] = {
+	ES_EVENT_TYPE_NOTIFY_EXEC,
+	ES_EVENT_TYPE_NOTIFY_FORK,
+	ES_EVENT_TYPE_NOTIFY_EXIT,
+	ES_EVENT_TYPE_NOTIFY_SIGNAL,
+	ES_EVENT_TYPE_NOTIFY_OPEN,
+	ES_EVENT_TYPE_NOTIFY_CLOSE,
+	ES_EVENT_TYPE_NOTIFY_CREATE,
+	ES_EVENT_TYPE_NOTIFY_UNLINK,
+	ES_EVENT_TYPE_NOTIFY_RENAME,
+	ES_EVENT_TYPE_NOTIFY_WRITE,
+	ES_EVENT_TYPE_NOTIFY_MOUNT,
+	ES_EVENT_TYPE_NOTIFY_UNMOUNT,
+	ES_EVENT_TYPE_NOTIFY_AUTHENTICATION,
+	ES_EVENT_TYPE_AUTH_EXEC,
+	ES_EVENT_TYPE_AUTH_OPEN,
+};
+static const int gw_ntypes = sizeof(gw_types) / sizeof(gw_types[0]);
+
+static es_client_t *gw_client;
+
+static gw_str gw_tok(es_string_token_t t)
+{
+	gw_str s = {t.data, t.length};
+	return s;
+}
+
+static gw_str gw_cstr(const char *c)
+{
+	gw_str s = {c, c ? strlen(c) : 0};
+	return s;
+}
+
+static void gw_process(gw_es_event *ev, const es_process_t *p)
+{
+	ev->pid = audit_token_to_pid(p->audit_token);
+	ev->euid = audit_token_to_euid(p->audit_token);
+	ev->ruid = audit_token_to_ruid(p->audit_token);
+	ev->ppid = p->ppid;
+	ev->platform = p->is_platform_binary;
+	ev->exe = gw_tok(p->executable->path);
+	ev->signing_id = gw_tok(p->signing_id);
+	ev->team_id = gw_tok(p->team_id);
+}
+
+// gw_exec_args copies the exec arguments into one buffer the caller frees.
+static gw_str gw_exec_args(const es_event_exec_t *exec)
+{
+	gw_str s = {NULL, 0};
+	uint32_t n = es_exec_arg_count(exec);
+	size_t total = 0;
+	for (uint32_t i = 0; i < n; i++) {
+		total += es_exec_arg(exec, i).length + 1;
+	}
+	char *buf = malloc(total ? total : 1);
+	if (buf == NULL) {
+		return s;
+	}
+	size_t off = 0;
+	for (uint32_t i = 0; i < n; i++) {
+		es_string_token_t a = es_exec_arg(exec, i);
+		memcpy(buf + off, a.data, a.length);
+		off += a.length;
+		buf[off++] = '\0';
+	}
+	s.data = buf;
+	s.len = total;
+	return s;
+}
+
+static void gw_fill(gw_es_event *ev, const es_message_t *msg)
+{
+	ev->sec = msg->time.tv_sec;
+	ev->nsec = msg->time.tv_nsec;
+	gw_process(ev, msg->process);
+	switch (msg->event_type) {
+	case ES_EVENT_TYPE_NOTIFY_EXEC:
+	case ES_EVENT_TYPE_AUTH_EXEC:
+		ev->target = gw_tok(msg->event.exec.target->executable->path);
+		ev->target_pid = audit_token_to_pid(msg->event.exec.target->audit_token);
+		ev->args = gw_exec_args(&msg->event.exec);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_FORK:
+		ev->child_pid = audit_token_to_pid(msg->event.fork.child->audit_token);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_EXIT:
+		ev->exit_status = msg->event.exit.stat;
+		break;
+	case ES_EVENT_TYPE_NOTIFY_SIGNAL:
+		ev->sig = msg->event.signal.sig;
+		ev->target = gw_tok(msg->event.signal.target->executable->path);
+		ev->target_pid = audit_token_to_pid(msg->event.signal.target->audit_token);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_OPEN:
+	case ES_EVENT_TYPE_AUTH_OPEN:
+		ev->target = gw_tok(msg->event.open.file->path);
+		ev->flags = msg->event.open.fflag;
+		break;
+	case ES_EVENT_TYPE_NOTIFY_CLOSE:
+		ev->target = gw_tok(msg->event.close.target->path);
+		ev->modified = msg->event.close.modified;
+		break;
+	case ES_EVENT_TYPE_NOTIFY_CREATE:
+		if (msg->event.create.destination_type == ES_DESTINATION_TYPE_EXISTING_FILE) {
+			ev->target = gw_tok(msg->event.create.destination.existing_file->path);
+		} else {
+			ev->dest = gw_tok(msg->event.create.destination.new_path.dir->path);
+			ev->dest_name = gw_tok(msg->event.create.destination.new_path.filename);
+		}
+		break;
+	case ES_EVENT_TYPE_NOTIFY_UNLINK:
+		ev->target = gw_tok(msg->event.unlink.target->path);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_RENAME:
+		ev->target = gw_tok(msg->event.rename.source->path);
+		if (msg->event.rename.destination_type == ES_DESTINATION_TYPE_EXISTING_FILE) {
+			ev->dest = gw_tok(msg->event.rename.destination.existing_file->path);
+		} else {
+			ev->dest = gw_tok(msg->event.rename.destination.new_path.dir->path);
+			ev->dest_name = gw_tok(msg->event.rename.destination.new_path.filename);
+		}
+		break;
+	case ES_EVENT_TYPE_NOTIFY_WRITE:
+		ev->target = gw_tok(msg->event.write.target->path);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_MOUNT:
+		ev->target = gw_cstr(msg->event.mount.statfs->f_mntonname);
+		ev->mount_from = gw_cstr(msg->event.mount.statfs->f_mntfromname);
+		ev->fs_type = gw_cstr(msg->event.mount.statfs->f_fstypename);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_UNMOUNT:
+		ev->target = gw_cstr(msg->event.unmount.statfs->f_mntonname);
+		ev->mount_from = gw_cstr(msg->event.unmount.statfs->f_mntfromname);
+		ev->fs_type = gw_cstr(msg->event.unmount.statfs->f_fstypename);
+		break;
+	case ES_EVENT_TYPE_NOTIFY_AUTHENTICATION:
+		ev->success = msg->event.authentication->success;
+		ev->auth_type = msg->event.authentication->type;
+		break;
+	default:
+		break;
+	}
+}
+
+int gw_es_start(const int *events, int nevents, char **mute, int nmute, char **prefix, int nprefix)
+{
+	es_new_client_result_t res = es_new_client(&gw_client, ^(es_client_t *c, const es_message_t *msg) {
+		gw_es_event ev;
+		memset(&ev, 0, sizeof(ev));
+		ev.event = -1;
+		for (int i = 0; i < gw_ntypes; i++) {
+			if (gw_types[i] == msg->event_type) {
+				ev.event = i;
+				break;
+			}
+		}
+		if (msg->action_type == ES_ACTION_TYPE_AUTH) {
+			// only watching, everything is allowed straight away and
+			// never cached so each one is reported
+			if (msg->event_type == ES_EVENT_TYPE_AUTH_OPEN) {
+				es_respond_flags_result(c, msg, UINT32_MAX, false);
+			} else {
+				es_respond_auth_result(c, msg, ES_AUTH_RESULT_ALLOW, false);
+			}
+			ev.auth = 1;
+		}
+		if (ev.event < 0) {
+			return;
+		}
+		gw_fill(&ev, msg);
+		goESEvent(&ev);
+		free((void *)ev.args.data);
+	});
+	if (res != ES_NEW_CLIENT_RESULT_SUCCESS) {
+		gw_client = NULL;
+		return res;
+	}
+
+	// the ingester's own file activity would feed back into itself
+	audit_token_t self;
+	mach_msg_type_number_t count = TASK_AUDIT_TOKEN_COUNT;
+	if (task_info(mach_task_self(), TASK_AUDIT_TOKEN, (task_info_t)&self, &count) == KERN_SUCCESS) {
+		es_mute_process(gw_client, &self);
+	}
+	for (int i = 0; i < nmute; i++) {
+		es_mute_path(gw_client, mute[i], ES_MUTE_PATH_TYPE_LITERAL);
+	}
+	for (int i = 0; i < nprefix; i++) {
+		es_mute_path(gw_client, prefix[i], ES_MUTE_PATH_TYPE_PREFIX);
+	}
+
+	es_event_type_t types[gw_ntypes];
+	int n = 0;
+	for (int i = 0; i < nevents && n < gw_ntypes; i++) {
+		if (events[i] >= 0 && events[i] < gw_ntypes) {
+			types[n++] = gw_types[events[i]];
+		}
+	}
+	if (n == 0 || es_subscribe(gw_client, types, n) != ES_RETURN_SUCCESS) {
+		es_delete_client(gw_client);
+		gw_client = NULL;
+		return -1;
+	}
+	return 0;
+}
+
+void gw_es_stop(void)
+{
+	if (gw_client != NULL) {
+		es_unsubscribe_all(gw_client);
+		es_delete_client(gw_client);
+		gw_client = NULL;
+	}
+}
@@ -0,0 +1,233 @@
+//go:build darwin && cgo && esclient
+// +build darwin,cgo,esclient
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+// The native Endpoint Security client, only built with the esclient tag.
+// The binary must be signed with the com.apple.developer.endpoint-security.client
+// entitlement, run as root, and have Full Disk Access.
+
+// #cgo LDFLAGS: -lEndpointSecurity -lbsm
+// #include <stdlib.h>
+// #include <EndpointSecurity/EndpointSecurity.h>
+// #include "es_native.h"
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	esNativeQueue       = 16384 // messages held between the ES handler and the writer
+	esNativeDropWarning = time.Minute
+)
+
+// the handler has no way to carry state, there is only ever one client
+var (
+	esNativeOnce    sync.Once
+	esNativeOut     chan esNativeMessage
+	esNativeDropped uint64
+)
+
+// esNativeMessage is the entry written for each native client event.
+type esNativeMessage struct {
+	Event       string    `json:"event"`
+	Auth        bool      `json:"auth,omitempty"` // an AUTH event, always allowed
+	Time        time.Time `json:"time"`
+	Process     esProcess `json:"process"`
+	Target      string    `json:"target,omitempty"`
+	TargetPID   int       `json:"target_pid,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Args        []string  `json:"args,omitempty"`
+	ChildPID    int       `json:"child_pid,omitempty"`
+	ExitStatus  *int      `json:"exit_status,omitempty"`
+	Signal      int       `json:"signal,omitempty"`
+	Flags       int       `json:"flags,omitempty"`
+	Modified    bool      `json:"modified,omitempty"`
+	MountFrom   string    `json:"mount_from,omitempty"`
+	FSType      string    `json:"fs_type,omitempty"`
+	Success     *bool     `json:"success,omitempty"`
+	AuthType    *int      `json:"auth_type,omitempty"`
+}
+
+type esProcess struct {
+	PID        int    `json:"pid"`
+	PPID       int    `json:"ppid"`
+	EUID       int    `json:"euid"`
+	RUID       int    `json:"ruid"`
+	Executable string `json:"executable"`
+	SigningID  string `json:"signing_id,omitempty"`
+	TeamID     string `json:"team_id,omitempty"`
+	Platform   bool   `json:"platform_binary,omitempty"`
+}
+
+func goStr(s C.gw_str) string {
+	if s.data == nil || s.len == 0 {
+		return ``
+	}
+	return C.GoStringN(s.data, C.int(s.len))
+}
+
+// goESEvent is called on the ES handler queue, it copies the message out
+// and never blocks, a full queue drops it.
+//
+//export goESEvent
+func goESEvent(ev *C.gw_es_event) {
+	m := esNativeMessage{
+		Event: esNativeEvents[int(ev.event)],
+		Auth:  ev.auth != 0,
+		Time:  time.Unix(int64(ev.sec), int64(ev.nsec)),
+		Process: esProcess{
+			PID:        int(ev.pid),
+			PPID:       int(ev.ppid),
+			EUID:       int(ev.euid),
+			RUID:       int(ev.ruid),
+			Executable: goStr(ev.exe),
+			SigningID:  goStr(ev.signing_id),
+			TeamID:     goStr(ev.team_id),
+			Platform:   ev.platform != 0,
+		},
+		Target:      goStr(ev.target),
+		TargetPID:   int(ev.target_pid),
+		Destination: goStr(ev.dest),
+		ChildPID:    int(ev.child_pid),
+		Signal:      int(ev.sig),
+		Flags:       int(ev.flags),
+		Modified:    ev.modified != 0,
+		MountFrom:   goStr(ev.mount_from),
+		FSType:      goStr(ev.fs_type),
+	}
+	if name := goStr(ev.dest_name); name != `` {
+		m.Destination = strings.TrimSuffix(m.Destination, `/`) + `/` + name
+	}
+	if args := goStr(ev.args); args != `` {
+		m.Args = strings.Split(strings.TrimSuffix(args, "\x00"), "\x00")
+	}
+	switch m.Event {
+	case `exit`:
+		st := int(ev.exit_status)
+		m.ExitStatus = &st
+	case `authentication`:
+		ok, typ := ev.success != 0, int(ev.auth_type)
+		m.Success, m.AuthType = &ok, &typ
+	}
+	select {
+	case esNativeOut <- m:
+	default:
+		atomic.AddUint64(&esNativeDropped, 1)
+	}
+}
+
+// cStrings copies ss to C, the returned function frees the copies.
+func cStrings(ss []string) (**C.char, func()) {
+	if len(ss) == 0 {
+		return nil, func() {}
+	}
+	arr := (*[1 << 20]*C.char)(C.malloc(C.size_t(len(ss)) * C.size_t(unsafe.Sizeof(uintptr(0)))))[:len(ss):len(ss)]
+	for i, s := range ss {
+		arr[i] = C.CString(s)
+	}
+	return &arr[0], func() {
+		for _, p := range arr {
+			C.free(unsafe.Pointer(p))
+		}
+		C.free(unsafe.Pointer(&arr[0]))
+	}
+}
+
+func esNewClientError(res int) error {
+	switch res {
+	case int(C.ES_NEW_CLIENT_RESULT_ERR_NOT_ENTITLED):
+		return errors.New("the binary lacks the endpoint security entitlement")
+	case int(C.ES_NEW_CLIENT_RESULT_ERR_NOT_PERMITTED):
+		return errors.New("the ingester needs Full Disk Access")
+	case int(C.ES_NEW_CLIENT_RESULT_ERR_NOT_PRIVILEGED):
+		return errors.New("the ingester must run as root")
+	case int(C.ES_NEW_CLIENT_RESULT_ERR_TOO_MANY_CLIENTS):
+		return errors.New("too many endpoint security clients")
+	case -1:
+		return errors.New("subscribing to the events failed")
+	}
+	return fmt.Errorf("es_new_client failed with %d", res)
+}
+
+func startNativeES(ctx context.Context, wg *sync.WaitGroup, ec *esCollector, cfg esConfig) (err error) {
+	started := false
+	esNativeOnce.Do(func() {
+		started = true
+		esNativeOut = make(chan esNativeMessage, esNativeQueue)
+		events := make([]C.int, 0, len(ec.events))
+		for _, ev := range ec.events {
+			events = append(events, C.int(esNativeEvent(ev)))
+		}
+		mute, freeMute := cStrings(cfg.Mute_Path)
+		defer freeMute()
+		prefix, freePrefix := cStrings(cfg.Mute_Path_Prefix)
+		defer freePrefix()
+		res := int(C.gw_es_start(&events[0], C.int(len(events)), mute, C.int(len(cfg.Mute_Path)), prefix, C.int(len(cfg.Mute_Path_Prefix))))
+		if res != 0 {
+			err = fmt.Errorf("Failed to start the endpoint security client: %v", esNewClientError(res))
+		}
+	})
+	if !started {
+		return errors.New("The endpoint security client is already running")
+	} else if err != nil {
+		return err
+	}
+	lg.Info("Started the endpoint security client for %s\n", strings.Join(ec.events, `, `))
+	wg.Add(1)
+	go ec.runNative(ctx, wg)
+	return nil
+}
+
+// runNative writes the queued messages until the context is cancelled.
+func (ec *esCollector) runNative(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer C.gw_es_stop()
+	tckr := time.NewTicker(esNativeDropWarning)
+	defer tckr.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+			if d := atomic.LoadUint64(&esNativeDropped); d != reported {
+				lg.Warn("Endpoint security queue overflowed, %d events dropped\n", d-reported)
+				reported = d
+			}
+		case m := <-esNativeOut:
+			b, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			ent := &entry.Entry{
+				TS:   entry.FromStandard(m.Time),
+				SRC:  ec.src.get(),
+				Tag:  ec.tagFor(m.Event),
+				Data: b,
+			}
+			if err := igst.WriteEntryContext(ctx, ent); err != nil {
+				return
+			}
+		}
+	}
+}
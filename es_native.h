@@ -0,0 +1,46 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+#ifndef GW_ES_NATIVE_H
+#define GW_ES_NATIVE_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+// a string owned by the ES message, only valid during the callback
+typedef struct {
+	const char *data;
+	size_t len;
+} gw_str;
+
+// the fields of an ES message the ingester reports, flattened so the Go
+// side never has to walk the ES unions
+typedef struct {
+	int event; // index into esNativeEvents
+	int auth;  // an AUTH message, already allowed
+	int64_t sec, nsec;
+
+	// the process that caused the event
+	int pid, ppid, euid, ruid, platform;
+	gw_str exe, signing_id, team_id;
+
+	gw_str target;    // file, new image, or mount point
+	gw_str dest;      // rename or create destination, a directory when dest_name is set
+	gw_str dest_name;
+	gw_str args;      // exec arguments, each NUL terminated
+	gw_str mount_from, fs_type;
+	int child_pid, target_pid, exit_status, sig, flags, modified, success, auth_type;
+} gw_es_event;
+
+// gw_es_start creates the client, mutes the ingester itself and the given
+// paths, and subscribes.  It returns 0, an es_new_client_result_t, or -1
+// when subscribing failed.
+int gw_es_start(const int *events, int nevents, char **mute, int nmute, char **prefix, int nprefix);
+void gw_es_stop(void);
+
+#endif
@@ -0,0 +1,22 @@
+//go:build !darwin || !cgo || !esclient
+// +build !darwin !cgo !esclient
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+func startNativeES(ctx context.Context, wg *sync.WaitGroup, ec *esCollector, cfg esConfig) error {
+	return errors.New("Endpoint-Security Native needs a macOS build with cgo and the esclient tag")
+}
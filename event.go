@@ -0,0 +1,171 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// logRecord holds the fields of a log stream record that the ingester
+// itself cares about, the rest of the record is passed through untouched.
+type logRecord struct {
+	Timestamp        string `json:"timestamp"`
+	MachTimestamp    uint64 `json:"machTimestamp"`
+	ThreadID         uint64 `json:"threadID"`
+	MessageType      string `json:"messageType"`
+	Subsystem        string `json:"subsystem"`
+	Category         string `json:"category"`
+	UserID           *int   `json:"userID,omitempty"`
+	ProcessImagePath string `json:"processImagePath"`
+	ProcessID        int    `json:"processID"`
+	SenderImagePath  string `json:"senderImagePath"`
+	EventMessage     string `json:"eventMessage"`
+}
+
+// event is a single decoded log record along with the entry that carries it.
+// Fields added by enrichments are held in set and merged back into the
+// entry data when the event is finalized.
+type event struct {
+	logRecord
+	ent *entry.Entry
+	set map[string]interface{}
+	raw map[string]json.RawMessage // lazily decoded, see stringField
+}
+
+func newEvent(ent *entry.Entry) (*event, error) {
+	ev := &event{ent: ent}
+	if err := json.Unmarshal(ent.Data, &ev.logRecord); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// Set adds or replaces a field in the event, the change is applied when the
+// event is finalized.
+func (ev *event) Set(key string, val interface{}) {
+	if ev.set == nil {
+		ev.set = make(map[string]interface{}, 4)
+	}
+	ev.set[key] = val
+}
+
+// stringField returns the current value of a string field, including any
+// pending changes.  Fields the ingester doesn't normally care about are
+// found by decoding the full record on first use.
+func (ev *event) stringField(key string) (string, bool) {
+	if v, ok := ev.set[key]; ok {
+		s, ok := v.(string)
+		return s, ok
+	}
+	if ev.raw == nil {
+		if err := json.Unmarshal(ev.ent.Data, &ev.raw); err != nil {
+			return ``, false
+		}
+	}
+	rm, ok := ev.raw[key]
+	if !ok {
+		return ``, false
+	}
+	var s string
+	if err := json.Unmarshal(rm, &s); err != nil {
+		return ``, false
+	}
+	return s, true
+}
+
+// finalize merges any pending fields into the entry data.  Replaced fields
+// are spliced in where they were and new fields are appended, so the
+// original ordering and formatting are preserved.  Values are encoded
+// without HTML escaping so markers like <private> stay readable.
+func (ev *event) finalize() error {
+	if len(ev.set) == 0 {
+		return nil
+	}
+	d := bytes.TrimRight(ev.ent.Data, " \t\r\n")
+	if len(d) == 0 || d[len(d)-1] != '}' {
+		return errBadRecord
+	}
+	var bb bytes.Buffer
+	done := make(map[string]bool, len(ev.set))
+	// copy the record up to each replaced value, then the new value
+	dec := json.NewDecoder(bytes.NewReader(d))
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errBadRecord
+	}
+	var last int64
+	empty := !dec.More()
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var rm json.RawMessage
+		if err = dec.Decode(&rm); err != nil {
+			return err
+		}
+		k, _ := tok.(string)
+		v, ok := ev.set[k]
+		if !ok {
+			continue
+		}
+		b, err := marshalUnescaped(v)
+		if err != nil {
+			return err
+		}
+		end := dec.InputOffset()
+		bb.Write(d[last : end-int64(len(rm))])
+		bb.Write(b)
+		last = end
+		done[k] = true
+	}
+	bb.Write(d[last : len(d)-1])
+	keys := make([]string, 0, len(ev.set))
+	for k := range ev.set {
+		if !done[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, err := marshalUnescaped(ev.set[k])
+		if err != nil {
+			return err
+		}
+		kb, _ := marshalUnescaped(k)
+		if !empty {
+			bb.WriteByte(',')
+		}
+		empty = false
+		bb.Write(kb)
+		bb.WriteByte(':')
+		bb.Write(b)
+	}
+	bb.WriteByte('}')
+	ev.ent.Data = bb.Bytes()
+	ev.set = nil
+	ev.raw = nil
+	return nil
+}
+
+// marshalUnescaped is json.Marshal without the HTML escaping.
+func marshalUnescaped(v interface{}) ([]byte, error) {
+	var bb bytes.Buffer
+	enc := json.NewEncoder(&bb)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(bb.Bytes(), "\n"), nil
+}
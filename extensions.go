@@ -0,0 +1,338 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultExtensionsTag      = `macos-extensions`
+	defaultExtensionsInterval = `1h`
+	extensionsStreamName      = `extensions`
+)
+
+// the records of the daemons that load kexts and activate system
+// extensions
+const extensionsPredicate = `process == "sysextd" OR process == "kernelmanagerd" OR process == "kextd" OR process == "kmutil" OR subsystem BEGINSWITH "com.apple.sx"`
+
+// the processes whose records are normalized
+var extensionsProcesses = map[string]bool{`sysextd`: true, `kernelmanagerd`: true, `kextd`: true, `kmutil`: true}
+
+var (
+	extTeamRegex    = regexp.MustCompile(`(?i)team ?id[:= ]+"?([A-Z0-9]{10})\b`)
+	extBundleRegex  = regexp.MustCompile(`(?i)(?:identifier|bundle ?id|kext|extension)s?[:= ]+"?([a-z0-9-]+(?:\.[a-z0-9_-]+){2,})`)
+	extVersionRegex = regexp.MustCompile(`(?i)version[:= ]+"?([0-9][0-9a-z.]*(?: ?\([0-9.]+\))?)`)
+	extActionRegex  = regexp.MustCompile(`(?i)\b(activat|deactivat|replac|uninstall|unload|load|approv|reject)(e|ed|ing|s)?\b`)
+
+	// "com.foo.driver (1.2.3)" and "com.foo.ext (1.2/34)"
+	extNameVersionRegex = regexp.MustCompile(`^(\S+) \(([^)]*)\)$`)
+)
+
+// actions by the stems extActionRegex matches
+var extActions = map[string]string{
+	`activat`:   `activate`,
+	`deactivat`: `deactivate`,
+	`replac`:    `replace`,
+	`uninstall`: `uninstall`,
+	`unload`:    `unload`,
+	`load`:      `load`,
+	`approv`:    `approve`,
+	`reject`:    `reject`,
+}
+
+// extensionsConfig is the [Extensions] block, it turns on a stream of the
+// extension daemons' records and takes snapshots of what is loaded.
+type extensionsConfig struct {
+	Enable        bool
+	Tag_Name      string
+	Interval      string // how often the loaded kexts and system extensions are listed
+	Include_Apple bool   // list Apple's own kexts in the snapshots too
+}
+
+func (ec *extensionsConfig) verify() error {
+	if !ec.Enable {
+		return nil
+	}
+	if ec.Tag_Name == `` {
+		ec.Tag_Name = defaultExtensionsTag
+	}
+	if ec.Interval == `` {
+		ec.Interval = defaultExtensionsInterval
+	}
+	if _, err := (snapshotConfig{Interval: ec.Interval}).interval(); err != nil {
+		return fmt.Errorf("Extensions: %v", err)
+	}
+	return nil
+}
+
+// extensionInfo is a loaded kext or installed system extension, the same
+// bundle_id, team_id, and version fields are used in every extension entry.
+type extensionInfo struct {
+	Kind     string `json:"kind"` // kext or system_extension
+	BundleID string `json:"bundle_id"`
+	TeamID   string `json:"team_id,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Category string `json:"category,omitempty"` // system extension type, network_extension etc.
+	State    string `json:"state,omitempty"`    // system extension state, "activated enabled" etc.
+	UUID     string `json:"uuid,omitempty"`
+}
+
+type extensionsSnapshot struct {
+	Type             string          `json:"type"`
+	Kexts            []extensionInfo `json:"kexts"`
+	SystemExtensions []extensionInfo `json:"system_extensions"`
+}
+
+// extensionChange is written when a snapshot differs from the one before.
+type extensionChange struct {
+	Type   string `json:"type"`
+	Change string `json:"change"` // loaded, unloaded, installed, removed, or state_changed
+	extensionInfo
+	Previous string `json:"previous_state,omitempty"`
+}
+
+// extensionFields is the extension field added to the daemons' records.
+type extensionFields struct {
+	Action   string `json:"action,omitempty"`
+	BundleID string `json:"bundle_id,omitempty"`
+	TeamID   string `json:"team_id,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// extensionNormalizer pulls the bundle ID, team ID, and version out of
+// the extension daemons' messages into an extension field.
+type extensionNormalizer struct{}
+
+func (extensionNormalizer) enrich(ev *event) {
+	if !extensionsProcesses[filepath.Base(ev.ProcessImagePath)] && !strings.HasPrefix(ev.Subsystem, `com.apple.sx`) {
+		return
+	}
+	if ef, ok := parseExtensionMessage(ev.EventMessage); ok {
+		ev.Set("extension", ef)
+	}
+}
+
+func parseExtensionMessage(msg string) (ef extensionFields, ok bool) {
+	if m := extBundleRegex.FindStringSubmatch(msg); m != nil {
+		ef.BundleID = m[1]
+	}
+	if m := extTeamRegex.FindStringSubmatch(msg); m != nil {
+		ef.TeamID = m[1]
+	}
+	if m := extVersionRegex.FindStringSubmatch(msg); m != nil {
+		ef.Version = m[1]
+	}
+	if ef.BundleID == `` && ef.TeamID == `` {
+		return ef, false
+	}
+	if m := extActionRegex.FindStringSubmatch(msg); m != nil {
+		ef.Action = extActions[strings.ToLower(m[1])]
+	}
+	return ef, true
+}
+
+// extensionsCollector lists the loaded kexts and system extensions every
+// interval, writing a snapshot and an entry for each change.  The first
+// snapshot after a start is the baseline.
+type extensionsCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	apple    bool
+	src      *sourceTracker
+	last     map[string]extensionInfo // by kind and bundle ID
+}
+
+func startExtensionsCollector(ctx context.Context, wg *sync.WaitGroup, cfg extensionsConfig, src *sourceTracker) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve extensions tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	ec := &extensionsCollector{
+		tag:      tag,
+		interval: interval,
+		apple:    cfg.Include_Apple,
+		src:      src,
+	}
+	wg.Add(1)
+	go ec.run(ctx, wg)
+	return nil
+}
+
+func (ec *extensionsCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(ec.interval)
+	defer tckr.Stop()
+	for {
+		if err := ec.snapshot(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to take extensions snapshot: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (ec *extensionsCollector) snapshot(ctx context.Context) error {
+	snap := extensionsSnapshot{Type: `extensions_snapshot`}
+	// changes are only looked for when both lists were taken
+	complete := true
+	out, err := exec.CommandContext(ctx, "kmutil", "showloaded", "--list-only").Output()
+	if ctx.Err() != nil {
+		return context.Canceled
+	} else if err != nil {
+		lg.Warn("Failed to list loaded kexts: %v\n", err)
+		complete = false
+	} else {
+		snap.Kexts = parseKmutilLoaded(string(out), ec.apple)
+	}
+	if out, err = exec.CommandContext(ctx, "systemextensionsctl", "list").Output(); ctx.Err() != nil {
+		return context.Canceled
+	} else if err != nil {
+		lg.Warn("Failed to list system extensions: %v\n", err)
+		complete = false
+	} else {
+		snap.SystemExtensions = parseSystemExtensions(string(out))
+	}
+	now := time.Now()
+	if !complete {
+		return emitJSON(ctx, ec.tag, ec.src, now, snap)
+	}
+	cur := map[string]extensionInfo{}
+	for _, ei := range append(append([]extensionInfo{}, snap.Kexts...), snap.SystemExtensions...) {
+		cur[ei.Kind+"\x00"+ei.BundleID] = ei
+	}
+	if ec.last != nil {
+		for _, ch := range diffExtensions(ec.last, cur) {
+			if err := emitJSON(ctx, ec.tag, ec.src, now, ch); err != nil {
+				return err
+			}
+		}
+	}
+	ec.last = cur
+	return emitJSON(ctx, ec.tag, ec.src, now, snap)
+}
+
+func diffExtensions(prev, cur map[string]extensionInfo) (changes []extensionChange) {
+	keys := map[string]bool{}
+	for k := range prev {
+		keys[k] = true
+	}
+	for k := range cur {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		old, had := prev[k]
+		now, has := cur[k]
+		added, removed := `loaded`, `unloaded`
+		if now.Kind == `system_extension` || old.Kind == `system_extension` {
+			added, removed = `installed`, `removed`
+		}
+		switch {
+		case !had:
+			changes = append(changes, extensionChange{Type: `extension_change`, Change: added, extensionInfo: now})
+		case !has:
+			changes = append(changes, extensionChange{Type: `extension_change`, Change: removed, extensionInfo: old})
+		case old.Version != now.Version || old.State != now.State:
+			changes = append(changes, extensionChange{Type: `extension_change`, Change: `state_changed`, extensionInfo: now, Previous: strings.TrimSpace(old.Version + ` ` + old.State)})
+		}
+	}
+	return
+}
+
+// parseKmutilLoaded reads kmutil showloaded --list-only output,
+// "Index Refs Address Size Wired Name (Version) UUID <Linked Against>".
+func parseKmutilLoaded(out string, apple bool) (kexts []extensionInfo) {
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 7 || f[0] == `Index` {
+			continue
+		}
+		// the name follows the index, refs, address, size, and wired columns
+		name, ver := f[5], strings.Trim(f[6], `()`)
+		if !apple && strings.HasPrefix(name, `com.apple.`) {
+			continue
+		}
+		ki := extensionInfo{Kind: `kext`, BundleID: name, Version: ver}
+		if len(f) > 7 && !strings.HasPrefix(f[7], `<`) {
+			ki.UUID = f[7]
+		}
+		kexts = append(kexts, ki)
+	}
+	return
+}
+
+// parseSystemExtensions reads systemextensionsctl list output, a "---"
+// line naming each category followed by tab separated rows of
+// "enabled active teamID bundleID (version) name [state]".
+func parseSystemExtensions(out string) (exts []extensionInfo) {
+	var category string
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, `--- `) {
+			category = strings.TrimPrefix(strings.TrimPrefix(line, `--- `), `com.apple.system_extension.`)
+			continue
+		}
+		var f []string
+		for _, c := range strings.Split(line, "\t") {
+			if c = strings.TrimSpace(c); c != `` {
+				f = append(f, c)
+			}
+		}
+		// the enabled and active columns are blank when unset
+		if len(f) < 3 || !strings.HasPrefix(f[len(f)-1], `[`) || f[0] == `enabled` {
+			continue
+		}
+		n := len(f)
+		ei := extensionInfo{
+			Kind:     `system_extension`,
+			Category: category,
+			State:    strings.Trim(f[n-1], `[]`),
+			Name:     f[n-2],
+		}
+		if m := extNameVersionRegex.FindStringSubmatch(f[n-3]); m != nil {
+			ei.BundleID, ei.Version = m[1], m[2]
+		} else {
+			ei.BundleID = f[n-3]
+		}
+		if n >= 4 && f[n-4] != `*` {
+			ei.TeamID = f[n-4]
+		}
+		exts = append(exts, ei)
+	}
+	return
+}
@@ -0,0 +1,131 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filePreset is a ready made Files block for a common agent's logs,
+// selected with Preset.  Its settings only fill in what the block leaves
+// empty.
+type filePreset struct {
+	tag            string
+	paths          []string
+	multilineStart string
+	// timestamp pulls the time out of a message in the agent's own format,
+	// false falls back to the timegrinder
+	timestamp func(msg []byte) (time.Time, bool)
+}
+
+var filePresets = map[string]filePreset{
+	// "Mon Jun 05 10:00:00 mac jamf[123]: Checking for policies..."
+	`jamf`: {
+		tag:            `macos-jamf`,
+		paths:          []string{`/var/log/jamf.log`},
+		multilineStart: `^[A-Z][a-z]{2} [A-Z][a-z]{2} +[0-9]{1,2} [0-9]{2}:[0-9]{2}:[0-9]{2} `,
+		timestamp:      layoutTimestamp(`^[A-Z][a-z]{2} ([A-Z][a-z]{2} +[0-9]{1,2} [0-9]{2}:[0-9]{2}:[0-9]{2}) `, `Jan _2 15:04:05`),
+	},
+	// "Jun 05 2023 10:00:00 -0700 ### Beginning managed software check ###"
+	`munki`: {
+		tag:            `macos-munki`,
+		paths:          []string{`/Library/Managed Installs/Logs/*.log`},
+		multilineStart: `^[A-Z][a-z]{2} [0-9]{2} [0-9]{4} [0-9]{2}:[0-9]{2}:[0-9]{2} [-+][0-9]{4} `,
+		timestamp:      layoutTimestamp(`^([A-Z][a-z]{2} [0-9]{2} [0-9]{4} [0-9]{2}:[0-9]{2}:[0-9]{2} [-+][0-9]{4}) `, `Jan 02 2006 15:04:05 -0700`),
+	},
+	// one JSON result per line, stamped with the time the query ran
+	`osquery`: {
+		tag:       `macos-osquery`,
+		paths:     []string{`/var/log/osquery/osqueryd.results.log`, `/var/log/osquery/osqueryd.snapshots.log`},
+		timestamp: unixTimeTimestamp,
+	},
+}
+
+var osqueryUnixTimeRegex = regexp.MustCompile(`"unixTime":\s*"?([0-9]+)`)
+
+// applyPreset fills in the preset's settings the block left empty.
+func (fc *filesConfig) applyPreset() error {
+	if fc.Preset == `` {
+		return nil
+	}
+	fp, ok := filePresets[strings.ToLower(fc.Preset)]
+	if !ok {
+		return fmt.Errorf("Unknown Preset %q, known presets are %s", fc.Preset, strings.Join(filePresetNames(), `, `))
+	}
+	if len(fc.Path) == 0 {
+		fc.Path = append([]string{}, fp.paths...)
+	}
+	if fc.Tag_Name == `` {
+		fc.Tag_Name = fp.tag
+	}
+	if fc.Multiline_Start == `` {
+		fc.Multiline_Start = fp.multilineStart
+	}
+	return nil
+}
+
+// presetTimestamp returns the preset's timestamp parser, nil when
+// timestamps are ignored or the block names its own format.
+func (fc filesConfig) presetTimestamp() func([]byte) (time.Time, bool) {
+	if fc.Preset == `` || fc.Ignore_Timestamps || fc.Timestamp_Format_Override != `` {
+		return nil
+	}
+	return filePresets[strings.ToLower(fc.Preset)].timestamp
+}
+
+func filePresetNames() []string {
+	names := make([]string, 0, len(filePresets))
+	for name := range filePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// layoutTimestamp parses the first group of re with layout in local time.
+// A layout without a year gets the year that puts the time closest to now.
+func layoutTimestamp(re, layout string) func([]byte) (time.Time, bool) {
+	rx := regexp.MustCompile(re)
+	return func(msg []byte) (time.Time, bool) {
+		m := rx.FindSubmatch(msg)
+		if m == nil {
+			return time.Time{}, false
+		}
+		t, err := time.ParseInLocation(layout, string(m[1]), time.Local)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if t.Year() == 0 {
+			now := time.Now()
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				// last December's lines read in January
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		return t, true
+	}
+}
+
+func unixTimeTimestamp(msg []byte) (time.Time, bool) {
+	m := osqueryUnixTimeRegex.FindSubmatch(msg)
+	if m == nil {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(string(m[1]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
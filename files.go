@@ -0,0 +1,433 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+)
+
+const (
+	defaultFilesTag   = `macos-files`
+	defaultFilesStore = `/opt/gravwell/etc/macosLog.files`
+	filesPoll         = time.Second
+	filesRescan       = 10 * time.Second // how often the patterns are expanded again
+	filesPersist      = 30 * time.Second
+)
+
+// compressed rotations are never followed
+var compressedExts = map[string]bool{
+	`.gz`:  true,
+	`.bz2`: true,
+	`.xz`:  true,
+	`.zip`: true,
+}
+
+// filesConfig is a [Files "name"] section, each follows the plain log files
+// its patterns match and ingests them line by line to its own tag.
+type filesConfig struct {
+	Preset                    string // jamf, munki, or osquery fills in the paths, tag, and message parsing for that agent
+	Tag_Name                  string
+	Path                      []string // glob patterns, a single ** matches any number of directories
+	Exclude                   []string // glob patterns of files to leave alone
+	Multiline_Start           string   // regex matching the first line of a message, other lines are appended to it
+	Read_Existing             bool     // files already there at startup are read from the start rather than the end
+	Ignore_Timestamps         bool
+	Assume_Local_Timezone     bool
+	Timestamp_Format_Override string
+	Store_Location            string // file the read positions are tracked in
+}
+
+func (fc *filesConfig) verify(name string) error {
+	if err := fc.applyPreset(); err != nil {
+		return fmt.Errorf("Files %q: %v", name, err)
+	}
+	if len(fc.Path) == 0 {
+		return fmt.Errorf("Files %q has no Path entries", name)
+	}
+	if fc.Tag_Name == `` {
+		fc.Tag_Name = defaultFilesTag
+	}
+	for _, p := range append(append([]string{}, fc.Path...), fc.Exclude...) {
+		if strings.Count(p, `**`) > 1 {
+			return fmt.Errorf("Files %q has pattern %q with more than one **", name, p)
+		} else if _, err := filepath.Match(strings.Replace(p, `**`, `*`, 1), ``); err != nil {
+			return fmt.Errorf("Files %q has invalid pattern %q: %v", name, p, err)
+		}
+	}
+	if _, err := fc.multilineStart(); err != nil {
+		return fmt.Errorf("Files %q: %v", name, err)
+	}
+	if _, err := fc.timeGrinder(); err != nil {
+		return fmt.Errorf("Files %q: %v", name, err)
+	}
+	return nil
+}
+
+func (fc filesConfig) multilineStart() (*regexp.Regexp, error) {
+	if fc.Multiline_Start == `` {
+		return nil, nil
+	}
+	re, err := regexp.Compile(fc.Multiline_Start)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Multiline-Start %q: %v", fc.Multiline_Start, err)
+	}
+	return re, nil
+}
+
+// timeGrinder returns nil when timestamps are ignored.
+func (fc filesConfig) timeGrinder() (*timegrinder.TimeGrinder, error) {
+	if fc.Ignore_Timestamps {
+		return nil, nil
+	}
+	tg, err := timegrinder.New(timegrinder.Config{
+		EnableLeftMostSeed: true,
+		FormatOverride:     fc.Timestamp_Format_Override,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fc.Assume_Local_Timezone {
+		tg.SetLocalTime()
+	}
+	return tg, nil
+}
+
+// storeLocation defaults to a store per block.
+func (fc filesConfig) storeLocation(name string) string {
+	if fc.Store_Location != `` {
+		return fc.Store_Location
+	}
+	return defaultFilesStore + `.` + strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// expandGlob expands a pattern to the regular files it matches, a ** walks
+// every directory below the part of the pattern ahead of it.
+func expandGlob(pattern string) ([]string, error) {
+	i := strings.Index(pattern, `**`)
+	if i < 0 {
+		return filepath.Glob(pattern)
+	}
+	rest := strings.TrimPrefix(pattern[i+2:], `/`)
+	bases, err := filepath.Glob(filepath.Clean(pattern[:i]))
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, base := range bases {
+		filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				// unreadable directories are skipped
+				return nil
+			}
+			if rel, err := filepath.Rel(base, p); err == nil && matchTrailing(rest, rel) {
+				out = append(out, p)
+			}
+			return nil
+		})
+	}
+	return out, nil
+}
+
+// matchTrailing matches the pattern that followed a ** against as many
+// trailing components of the path.
+func matchTrailing(pattern, rel string) bool {
+	if pattern == `` {
+		return true
+	}
+	n := strings.Count(pattern, `/`) + 1
+	parts := strings.Split(rel, `/`)
+	if len(parts) < n {
+		return false
+	}
+	ok, _ := filepath.Match(pattern, strings.Join(parts[len(parts)-n:], `/`))
+	return ok
+}
+
+// fileTail is a followed file and the message being assembled from it.
+type fileTail struct {
+	ff         *fileFollower
+	pending    []byte
+	pendingPos followPos // where the pending message started
+	lines      int       // lines read by the last poll
+}
+
+// position is where to resume from, a pending message is read again.
+func (ft *fileTail) position() followPos {
+	if len(ft.pending) > 0 {
+		return ft.pendingPos
+	}
+	return ft.ff.position()
+}
+
+// filesCollector follows the files of one Files block.
+type filesCollector struct {
+	name      string
+	tag       entry.EntryTag
+	patterns  []string
+	exclude   []string
+	start     *regexp.Regexp
+	tg        *timegrinder.TimeGrinder
+	stamp     func([]byte) (time.Time, bool) // the preset's timestamp parser, tried ahead of tg
+	src       *sourceTracker
+	existing  bool // Read-Existing
+	store     string
+	ephemeral bool
+	saved     map[string]followPos
+	tails     map[string]*fileTail
+}
+
+func startFilesCollectors(ctx context.Context, wg *sync.WaitGroup, blocks map[string]*filesConfig, src *sourceTracker, ephemeral bool) error {
+	names := make([]string, 0, len(blocks))
+	for name := range blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fc := blocks[name]
+		tag, err := igst.GetTag(fc.Tag_Name)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve Files %q tag %q: %v", name, fc.Tag_Name, err)
+		}
+		start, err := fc.multilineStart()
+		if err != nil {
+			return err
+		}
+		tg, err := fc.timeGrinder()
+		if err != nil {
+			return err
+		}
+		c := &filesCollector{
+			name:      name,
+			tag:       tag,
+			patterns:  fc.Path,
+			exclude:   fc.Exclude,
+			start:     start,
+			tg:        tg,
+			stamp:     fc.presetTimestamp(),
+			src:       src,
+			existing:  fc.Read_Existing,
+			store:     fc.storeLocation(name),
+			ephemeral: ephemeral,
+			saved:     map[string]followPos{},
+			tails:     map[string]*fileTail{},
+		}
+		c.load()
+		wg.Add(1)
+		go c.run(ctx, wg)
+	}
+	return nil
+}
+
+func (c *filesCollector) load() {
+	b, err := os.ReadFile(c.store)
+	if err == nil {
+		err = json.Unmarshal(b, &c.saved)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		lg.Warn("Ignoring unreadable file position store %s: %v\n", c.store, err)
+	}
+}
+
+func (c *filesCollector) persist() {
+	if c.ephemeral {
+		return
+	}
+	pos := make(map[string]followPos, len(c.tails))
+	for p, ft := range c.tails {
+		pos[p] = ft.position()
+	}
+	b, err := json.Marshal(pos)
+	if err == nil {
+		err = writeFileAtomic(c.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save Files %q positions: %v\n", c.name, err)
+	}
+}
+
+func (c *filesCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer c.persist()
+	poll := time.NewTicker(filesPoll)
+	defer poll.Stop()
+	rescan := time.NewTicker(filesRescan)
+	defer rescan.Stop()
+	save := time.NewTicker(filesPersist)
+	defer save.Stop()
+	c.scan(true)
+	for {
+		for p, ft := range c.tails {
+			if err := c.poll(ctx, ft); err == context.Canceled {
+				return
+			} else if err != nil {
+				lg.Warn("Failed to read %s: %v\n", p, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-rescan.C:
+			c.scan(false)
+		case <-save.C:
+			c.persist()
+		}
+	}
+}
+
+// scan picks up files that newly match and drops the ones that no longer
+// do.  A file that is the rotated copy of one already followed is picked
+// up at its end, its follower already read it.
+func (c *filesCollector) scan(first bool) {
+	present := map[string]bool{}
+	for _, pattern := range c.patterns {
+		matches, err := expandGlob(pattern)
+		if err != nil {
+			lg.Warn("Files %q failed to expand %q: %v\n", c.name, pattern, err)
+			continue
+		}
+		for _, p := range matches {
+			if !c.excluded(p) {
+				present[p] = true
+			}
+		}
+	}
+	followed := map[uint64]bool{}
+	for p, ft := range c.tails {
+		if !present[p] {
+			ft.ff.close()
+			delete(c.tails, p)
+			continue
+		}
+		followed[ft.ff.position().Inode] = true
+		followed[ft.ff.rotated] = true
+	}
+	for p := range present {
+		if _, ok := c.tails[p]; ok {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		pos, ok := c.saved[p]
+		fromEnd := first && !c.existing
+		if !ok && followed[fileInode(fi)] {
+			pos, fromEnd = followPos{}, true
+		}
+		lg.Debug("Files %q following %s\n", c.name, p)
+		c.tails[p] = &fileTail{ff: newFileFollower(p, pos, fromEnd)}
+	}
+	// saved positions only matter until the file is seen again
+	c.saved = map[string]followPos{}
+}
+
+func (c *filesCollector) excluded(p string) bool {
+	if compressedExts[filepath.Ext(p)] {
+		return true
+	}
+	for _, x := range c.exclude {
+		if i := strings.Index(x, `**`); i >= 0 {
+			if strings.HasPrefix(p, filepath.Clean(x[:i])) && matchTrailing(strings.TrimPrefix(x[i+2:], `/`), p) {
+				return true
+			}
+		} else if ok, _ := filepath.Match(x, p); ok {
+			return true
+		} else if ok, _ = filepath.Match(x, filepath.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// poll reads the new lines of a file, a pending multi line message is
+// complete once a poll brings nothing more.
+func (c *filesCollector) poll(ctx context.Context, ft *fileTail) error {
+	ft.lines = 0
+	err := ft.ff.poll(func(line []byte) error {
+		ft.lines++
+		return c.line(ctx, ft, line)
+	})
+	if err != nil {
+		return err
+	}
+	if ft.lines == 0 && len(ft.pending) > 0 {
+		return c.flush(ctx, ft)
+	}
+	return nil
+}
+
+func (c *filesCollector) line(ctx context.Context, ft *fileTail, line []byte) error {
+	if c.start == nil {
+		return c.write(ctx, line)
+	}
+	if len(ft.pending) > 0 && (c.start.Match(line) || len(ft.pending)+len(line) > maxFollowLine) {
+		if err := c.flush(ctx, ft); err != nil {
+			return err
+		}
+	}
+	if len(ft.pending) == 0 {
+		// the follower hasn't moved past this line yet
+		ft.pendingPos = ft.ff.position()
+	} else {
+		ft.pending = append(ft.pending, '\n')
+	}
+	ft.pending = append(ft.pending, line...)
+	return nil
+}
+
+func (c *filesCollector) flush(ctx context.Context, ft *fileTail) error {
+	if err := c.write(ctx, ft.pending); err != nil {
+		return err
+	}
+	ft.pending = nil
+	return nil
+}
+
+func (c *filesCollector) presetTime(data []byte) (time.Time, bool) {
+	if c.stamp == nil {
+		return time.Time{}, false
+	}
+	return c.stamp(data)
+}
+
+func (c *filesCollector) write(ctx context.Context, data []byte) error {
+	ts := time.Now()
+	if t, ok := c.presetTime(data); ok {
+		ts = t
+	} else if c.tg != nil {
+		if t, ok, err := c.tg.Extract(data); err == nil && ok {
+			ts = t
+		}
+	}
+	ent := &entry.Entry{
+		TS:   entry.FromStandard(ts),
+		SRC:  c.src.get(),
+		Tag:  c.tag,
+		Data: append([]byte(nil), data...),
+	}
+	return igst.WriteEntryContext(ctx, ent)
+}
@@ -0,0 +1,204 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// globList is a set of shell style patterns, '*' matches any run of
+// characters (including '/' and '.') and '?' matches a single character.
+type globList []*regexp.Regexp
+
+func newGlobList(patterns []string) (gl globList, err error) {
+	for _, p := range patterns {
+		var sb strings.Builder
+		sb.WriteByte('^')
+		for _, r := range p {
+			switch r {
+			case '*':
+				sb.WriteString(`.*`)
+			case '?':
+				sb.WriteByte('.')
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		sb.WriteByte('$')
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(sb.String()); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+		gl = append(gl, re)
+	}
+	return
+}
+
+func (gl globList) match(s string) bool {
+	for _, re := range gl {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any of the values match the list.
+func (gl globList) matchAny(vals []string) bool {
+	for _, v := range vals {
+		if gl.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldFunc extracts the values a list filter matches against, a record
+// matches a pattern list if any of the values do.
+type fieldFunc func(ev *event) []string
+
+// listFilter applies allow and deny pattern lists to a field.  If the allow
+// list is populated the field must match it, anything matching the deny
+// list is dropped.
+type listFilter struct {
+	name  string
+	field fieldFunc
+	allow globList
+	deny  globList
+}
+
+func newListFilter(name string, allow, deny []string, field fieldFunc) (*listFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	lf := &listFilter{
+		name:  name,
+		field: field,
+	}
+	var err error
+	if lf.allow, err = newGlobList(allow); err != nil {
+		return nil, fmt.Errorf("Allow-%s %v", name, err)
+	}
+	if lf.deny, err = newGlobList(deny); err != nil {
+		return nil, fmt.Errorf("Deny-%s %v", name, err)
+	}
+	return lf, nil
+}
+
+func (lf *listFilter) keep(ev *event) bool {
+	v := lf.field(ev)
+	if len(lf.allow) > 0 && !lf.allow.matchAny(v) {
+		return false
+	}
+	return !lf.deny.matchAny(v)
+}
+
+func subsystemField(ev *event) []string {
+	return []string{ev.Subsystem}
+}
+
+// categoryField matches on the bare category or "subsystem:category" so a
+// noisy category can be dropped from a single subsystem.
+func categoryField(ev *event) []string {
+	return []string{ev.Category, ev.Subsystem + ":" + ev.Category}
+}
+
+// processField matches on both the process name and the full image path so
+// patterns like "mDNSResponder" and "/usr/libexec/*" both work.
+func processField(ev *event) []string {
+	return []string{path.Base(ev.ProcessImagePath), ev.ProcessImagePath}
+}
+
+// messageDropFilter drops records whose eventMessage matches any of a set
+// of regular expressions, counting hits per expression.
+type messageDropFilter struct {
+	res  []*regexp.Regexp
+	hits []uint64
+}
+
+func newMessageDropFilter(exprs []string) (*messageDropFilter, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	mdf := &messageDropFilter{
+		hits: make([]uint64, len(exprs)),
+	}
+	for _, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Drop-Message %q: %v", e, err)
+		}
+		mdf.res = append(mdf.res, re)
+	}
+	return mdf, nil
+}
+
+func (mdf *messageDropFilter) keep(ev *event) bool {
+	for i, re := range mdf.res {
+		if re.MatchString(ev.EventMessage) {
+			atomic.AddUint64(&mdf.hits[i], 1)
+			return false
+		}
+	}
+	return true
+}
+
+// report logs and resets the per-expression drop counts.
+func (mdf *messageDropFilter) report() {
+	for i, re := range mdf.res {
+		if n := atomic.SwapUint64(&mdf.hits[i], 0); n > 0 {
+			lg.Info("Drop-Message %q dropped %d records\n", re.String(), n)
+		}
+	}
+}
+
+var (
+	// ordering of Apple's message types, records without a messageType
+	// (activities, signposts, etc.) are treated as Default
+	messageTypeLevels = map[string]int{
+		`debug`:   0,
+		`info`:    1,
+		`default`: 2,
+		`error`:   3,
+		`fault`:   4,
+	}
+)
+
+func messageTypeLevel(mt string) (int, bool) {
+	if mt == `` {
+		return messageTypeLevels[`default`], true
+	}
+	lvl, ok := messageTypeLevels[strings.ToLower(mt)]
+	return lvl, ok
+}
+
+// levelFilter drops records below a minimum message type.
+type levelFilter struct {
+	min int
+}
+
+func newLevelFilter(min string) (*levelFilter, error) {
+	if min == `` {
+		return nil, nil
+	}
+	lvl, ok := messageTypeLevels[strings.ToLower(min)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid Minimum-Level %q, expected Debug, Info, Default, Error, or Fault", min)
+	}
+	return &levelFilter{min: lvl}, nil
+}
+
+func (lf *levelFilter) keep(ev *event) bool {
+	lvl, ok := messageTypeLevel(ev.MessageType)
+	return !ok || lvl >= lf.min
+}
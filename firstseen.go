@@ -0,0 +1,131 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultSeenStoreLocation = `/opt/gravwell/etc/macosLog.seen`
+	defaultFirstSeenLearning = time.Hour
+)
+
+type seenState struct {
+	LearningUntil time.Time
+	Paths         map[string]time.Time
+}
+
+type firstSeenAlert struct {
+	Type             string `json:"type"`
+	ProcessImagePath string `json:"processImagePath"`
+	ProcessImageUUID string `json:"processImageUUID,omitempty"`
+	ProcessID        int    `json:"processID"`
+	Subsystem        string `json:"subsystem,omitempty"`
+	EventMessage     string `json:"eventMessage"`
+}
+
+// firstSeen tracks every process image path that has logged and emits an
+// alert entry the first time a new one appears, a cheap new binary signal.
+// When there is no history yet it learns silently for a while so a fresh
+// install doesn't alert on every binary on the machine.
+type firstSeen struct {
+	sync.Mutex
+	path   string
+	tag    entry.EntryTag
+	hasTag bool
+	st     seenState
+	dirty  bool
+}
+
+func loadFirstSeen(path string, learning time.Duration) (*firstSeen, error) {
+	fs := &firstSeen{
+		path: path,
+	}
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &fs.st)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			lg.Warn("Ignoring unreadable first seen store %s: %v\n", path, err)
+		}
+		fs.st = seenState{
+			LearningUntil: time.Now().Add(learning),
+		}
+		fs.dirty = true
+	}
+	if fs.st.Paths == nil {
+		fs.st.Paths = map[string]time.Time{}
+	}
+	return fs, nil
+}
+
+// setTag sends alerts to a dedicated tag rather than the tag of the entry
+// that triggered them.
+func (fs *firstSeen) setTag(tag entry.EntryTag) {
+	fs.tag = tag
+	fs.hasTag = true
+}
+
+func (fs *firstSeen) add(ev *event) []*event {
+	if ev.ProcessImagePath == `` {
+		return []*event{ev}
+	}
+	now := time.Now()
+	fs.Lock()
+	if _, ok := fs.st.Paths[ev.ProcessImagePath]; ok {
+		fs.Unlock()
+		return []*event{ev}
+	}
+	fs.st.Paths[ev.ProcessImagePath] = now
+	fs.dirty = true
+	learning := now.Before(fs.st.LearningUntil)
+	fs.Unlock()
+	if learning {
+		return []*event{ev}
+	}
+	uuid, _ := ev.stringField("processImageUUID")
+	alert := newSyntheticEvent(ev.ent, firstSeenAlert{
+		Type:             `firstSeenProcess`,
+		ProcessImagePath: ev.ProcessImagePath,
+		ProcessImageUUID: uuid,
+		ProcessID:        ev.ProcessID,
+		Subsystem:        ev.Subsystem,
+		EventMessage:     ev.EventMessage,
+	})
+	if alert != nil && fs.hasTag {
+		alert.ent.Tag = fs.tag
+	}
+	return []*event{alert, ev}
+}
+
+func (fs *firstSeen) flush(now time.Time, force bool) []*event {
+	return nil
+}
+
+func (fs *firstSeen) persist() error {
+	fs.Lock()
+	if !fs.dirty {
+		fs.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(fs.st)
+	fs.dirty = false
+	fs.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.path, b, 0640)
+}
@@ -0,0 +1,203 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	followChunk   = 64 * 1024
+	maxFollowLine = 1024 * 1024 // longer lines are cut here
+)
+
+// followPos is how far a follower has read into a file, the inode tells a
+// file from the one that replaced it at rotation.
+type followPos struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// fileFollower reads the lines appended to a log file, following it across
+// newsyslog style rotation and truncation.  The position only ever covers
+// complete lines so it can be saved and resumed from.  It belongs to a
+// single collector goroutine and isn't locked.
+type fileFollower struct {
+	path    string
+	pos     followPos
+	fromEnd bool   // with no saved position, skip what the file already holds
+	rotated uint64 // inode of the file the last rotation replaced
+	f       *os.File
+	partial []byte
+	buf     []byte
+}
+
+func newFileFollower(path string, pos followPos, fromEnd bool) *fileFollower {
+	return &fileFollower{
+		path:    path,
+		pos:     pos,
+		fromEnd: fromEnd,
+		buf:     make([]byte, followChunk),
+	}
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// open opens the file, resuming at the saved position when it is still
+// the same file.  A file that was replaced while nothing was following it
+// is read from the start.
+func (ff *fileFollower) open() error {
+	f, err := os.Open(ff.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ino := fileInode(fi)
+	switch {
+	case ff.pos.Inode == ino && ff.pos.Offset <= fi.Size():
+	case ff.pos.Inode == 0 && ff.fromEnd:
+		ff.pos.Offset = fi.Size()
+	default:
+		ff.pos.Offset = 0
+	}
+	if _, err = f.Seek(ff.pos.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	ff.f, ff.pos.Inode, ff.partial = f, ino, nil
+	return nil
+}
+
+func (ff *fileFollower) close() {
+	if ff.f != nil {
+		ff.f.Close()
+		ff.f = nil
+	}
+	ff.partial = nil
+}
+
+// position returns where to resume from.
+func (ff *fileFollower) position() followPos {
+	return ff.pos
+}
+
+// poll hands fn every complete line appended since the last poll.  When
+// the file was rotated the rest of the old file is read before moving on
+// to the new one, a file that is missing is simply waited for.
+func (ff *fileFollower) poll(fn func(line []byte) error) error {
+	if ff.f == nil {
+		if err := ff.open(); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := ff.drain(fn); err != nil {
+		// reopened at the last line that made it
+		ff.close()
+		return err
+	}
+	fi, err := os.Stat(ff.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated away and not yet replaced
+			return nil
+		}
+		return err
+	}
+	if fileInode(fi) != ff.pos.Inode {
+		// rotated, the replacement is new so it is read from the start
+		lg.Debug("%s was rotated, following the new file\n", ff.path)
+		ff.close()
+		ff.rotated = ff.pos.Inode
+		ff.pos, ff.fromEnd = followPos{}, false
+		if err := ff.open(); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	} else if fi.Size() < ff.pos.Offset {
+		lg.Debug("%s was truncated, reading from the start\n", ff.path)
+		if _, err := ff.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		ff.pos.Offset, ff.partial = 0, nil
+	} else {
+		return nil
+	}
+	if err := ff.drain(fn); err != nil {
+		ff.close()
+		return err
+	}
+	return nil
+}
+
+// drain reads the open file to its end.
+func (ff *fileFollower) drain(fn func(line []byte) error) error {
+	for {
+		n, err := ff.f.Read(ff.buf)
+		data := ff.buf[:n]
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				ff.partial = append(ff.partial, data...)
+				if len(ff.partial) >= maxFollowLine {
+					if ferr := ff.emit(ff.partial, fn); ferr != nil {
+						return ferr
+					}
+				}
+				break
+			}
+			line := data[:i]
+			if len(ff.partial) > 0 {
+				line = append(ff.partial, line...)
+			}
+			if ferr := ff.emit(line, fn); ferr != nil {
+				return ferr
+			}
+			// the newline is consumed too
+			ff.pos.Offset++
+			data = data[i+1:]
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (ff *fileFollower) emit(line []byte, fn func(line []byte) error) error {
+	n := int64(len(line))
+	if len(line) > maxFollowLine {
+		line = line[:maxFollowLine]
+	}
+	if line = bytes.TrimRight(line, "\r"); len(line) > 0 {
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	ff.pos.Offset += n
+	ff.partial = ff.partial[:0]
+	return nil
+}
@@ -0,0 +1,53 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	gapStartup = `startup`
+	gapRestart = `restart`
+	gapSleep   = `sleep`
+)
+
+// gapEntry records a window in which we were not capturing so that an
+// empty stretch of data can be told apart from an ingester that wasn't
+// running.
+type gapEntry struct {
+	Type       string    `json:"type"`
+	Stream     string    `json:"stream"`
+	Reason     string    `json:"reason"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Duration   string    `json:"duration"`
+	Backfilled bool      `json:"backfilled"`
+}
+
+// emitGap writes a gap entry if gap entries are enabled, the entry is
+// timestamped at the start of the gap so it sorts where the data is missing.
+func emitGap(ctx context.Context, enabled bool, ls *logStream, src *sourceTracker, reason string, start, end time.Time, backfilled bool) {
+	if !enabled || !start.Before(end) {
+		return
+	}
+	g := gapEntry{
+		Type:       `gap`,
+		Stream:     ls.name,
+		Reason:     reason,
+		Start:      start,
+		End:        end,
+		Duration:   end.Sub(start).Round(time.Millisecond).String(),
+		Backfilled: backfilled,
+	}
+	if err := emitJSON(ctx, ls.tag, src, start, g); err != nil && err != context.Canceled {
+		lg.Error("Failed to emit gap entry: %v\n", err)
+	}
+}
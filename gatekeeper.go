@@ -0,0 +1,155 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGatekeeperTag = `macos-gatekeeper`
+	gatekeeperStreamName = `gatekeeper`
+	gatekeeperSubsystem  = `com.apple.syspolicy`
+)
+
+// the records of syspolicyd, which makes the Gatekeeper assessments, and
+// of the syspolicy subsystems
+const gatekeeperPredicate = `process == "syspolicyd" OR subsystem BEGINSWITH "com.apple.syspolicy"`
+
+var (
+	// the "PST: (path: ...), (team: ...), (id: ...), (bundle_id: ...)"
+	// description of the code being assessed
+	gatekeeperPSTRegex = regexp.MustCompile(`\((path|team|id|bundle_id): (\(null\)|[^)]*)\)`)
+
+	// "GK evaluateScanResult: 2, PST: ..."
+	gatekeeperResultRegex = regexp.MustCompile(`evaluateScanResult: (-?[0-9]+)`)
+
+	// a com.apple.quarantine value, "flags;hex time;agent;event id"
+	quarantineRegex = regexp.MustCompile(`\b([0-9a-fA-F]{4});([0-9a-fA-F]{8});([^;\s]*);([0-9A-Fa-f-]*)`)
+)
+
+// words in an assessment message and the decision they mean, checked in
+// order
+var gatekeeperDecisions = []struct {
+	word     string
+	decision string
+}{
+	{`not allowed`, `blocked`},
+	{`denied`, `blocked`},
+	{`rejected`, `blocked`},
+	{`blocked`, `blocked`},
+	{`Prompt shown`, `prompted`},
+	{`granted`, `allowed`},
+	{`allowed`, `allowed`},
+	{`accepted`, `allowed`},
+}
+
+// gatekeeperConfig is the [Gatekeeper] block, it turns on a stream of
+// syspolicyd records with the assessment fields normalized.
+type gatekeeperConfig struct {
+	Enable   bool
+	Tag_Name string
+}
+
+func (gc *gatekeeperConfig) verify() error {
+	if !gc.Enable {
+		return nil
+	}
+	if gc.Tag_Name == `` {
+		gc.Tag_Name = defaultGatekeeperTag
+	}
+	return nil
+}
+
+// gatekeeperQuarantine is the quarantine provenance of the assessed file.
+type gatekeeperQuarantine struct {
+	Flags   string `json:"flags"`
+	Time    string `json:"time,omitempty"`
+	Agent   string `json:"agent,omitempty"` // the app that downloaded the file
+	EventID string `json:"event_id,omitempty"`
+}
+
+// gatekeeperFields is the gatekeeper field added to assessment records.
+type gatekeeperFields struct {
+	Decision   string                `json:"decision,omitempty"` // allowed, blocked, or prompted
+	Result     *int                  `json:"result,omitempty"`   // the evaluateScanResult code
+	Path       string                `json:"path,omitempty"`
+	TeamID     string                `json:"team_id,omitempty"`
+	Identifier string                `json:"identifier,omitempty"`
+	BundleID   string                `json:"bundle_id,omitempty"`
+	Quarantine *gatekeeperQuarantine `json:"quarantine,omitempty"`
+}
+
+// identities lets a Scrub-Profile reach the assessed path.
+func (gf *gatekeeperFields) identities(fn func(name string, kind int, v *string)) {
+	fn(`path`, identityPath, &gf.Path)
+}
+
+// gatekeeperNormalizer pulls the assessment out of syspolicyd messages into
+// a gatekeeper field.
+type gatekeeperNormalizer struct{}
+
+func (gatekeeperNormalizer) enrich(ev *event) {
+	if !strings.HasPrefix(ev.Subsystem, gatekeeperSubsystem) && filepath.Base(ev.ProcessImagePath) != `syspolicyd` {
+		return
+	}
+	if gf, ok := parseGatekeeperMessage(ev.EventMessage); ok {
+		ev.Set("gatekeeper", &gf)
+	}
+}
+
+// parseGatekeeperMessage returns the assessment fields of a message, false
+// if it holds none.
+func parseGatekeeperMessage(msg string) (gf gatekeeperFields, ok bool) {
+	for _, m := range gatekeeperPSTRegex.FindAllStringSubmatch(msg, -1) {
+		v := strings.TrimSpace(m[2])
+		if v == `` || v == `(null)` {
+			continue
+		}
+		switch m[1] {
+		case `path`:
+			gf.Path = v
+		case `team`:
+			gf.TeamID = v
+		case `id`:
+			gf.Identifier = v
+		case `bundle_id`:
+			gf.BundleID = v
+		}
+		ok = true
+	}
+	if m := gatekeeperResultRegex.FindStringSubmatch(msg); m != nil {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			gf.Result, ok = &n, true
+		}
+	}
+	if m := quarantineRegex.FindStringSubmatch(msg); m != nil {
+		q := &gatekeeperQuarantine{Flags: m[1], Agent: m[3], EventID: m[4]}
+		if sec, err := strconv.ParseInt(m[2], 16, 64); err == nil {
+			q.Time = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+		}
+		gf.Quarantine, ok = q, true
+	}
+	lower := strings.ToLower(msg)
+	if !ok && !strings.Contains(lower, `assessment`) {
+		// only assessments carry a decision
+		return
+	}
+	for _, d := range gatekeeperDecisions {
+		if strings.Contains(lower, strings.ToLower(d.word)) {
+			gf.Decision, ok = d.decision, true
+			break
+		}
+	}
+	return
+}
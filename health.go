@@ -0,0 +1,124 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthTag      = `macos-health`
+	defaultHealthInterval = `1m`
+)
+
+type healthEntry struct {
+	Type             string     `json:"type"`
+	Uptime           string     `json:"uptime"`
+	EntriesPerSecond float64    `json:"entries_per_second"`
+	BytesPerSecond   float64    `json:"bytes_per_second"`
+	IngestedPerSec   float64    `json:"ingested_per_second"`
+	EntriesRead      uint64     `json:"entries_read"`
+	EntriesIngested  uint64     `json:"entries_ingested"`
+	ParseErrors      uint64     `json:"parse_errors"`
+	BatchFailures    uint64     `json:"batch_failures"`
+	Restarts         uint64     `json:"restarts"`
+	StreamsDown      []string   `json:"streams_down,omitempty"`
+	HotConnections   int        `json:"hot_connections"`
+	QueuedBytes      int        `json:"queued_bytes"`
+	SpoolBytes       int64      `json:"spool_bytes"`
+	LastEntry        *time.Time `json:"last_entry,omitempty"`
+	LastError        string     `json:"last_error,omitempty"`
+	LastErrorTime    *time.Time `json:"last_error_time,omitempty"`
+}
+
+// healthSnapshot reports on the ingester itself so fleets can be monitored
+// from within Gravwell, rates are over the interval since the previous
+// report.
+func healthSnapshot(pl *pipeline) snapshotFunc {
+	prev := stats.snapshot()
+	prev.TS = prev.Start
+	return func(ctx context.Context) (interface{}, error) {
+		cur := stats.snapshot()
+		secs := cur.TS.Sub(prev.TS).Seconds()
+		if secs <= 0 {
+			secs = 1
+		}
+		he := healthEntry{
+			Type:             `health`,
+			Uptime:           cur.TS.Sub(cur.Start).Round(time.Second).String(),
+			EntriesPerSecond: float64(cur.EntriesRead-prev.EntriesRead) / secs,
+			BytesPerSecond:   float64(cur.BytesRead-prev.BytesRead) / secs,
+			IngestedPerSec:   float64(cur.EntriesIngested-prev.EntriesIngested) / secs,
+			EntriesRead:      cur.EntriesRead,
+			EntriesIngested:  cur.EntriesIngested,
+			ParseErrors:      cur.ParseErrors,
+			BatchFailures:    cur.BatchFailures,
+			Restarts:         cur.Restarts,
+			LastError:        cur.LastError,
+			StreamsDown:      stats.streamsDown(),
+		}
+		if hot, err := igst.Hot(); err == nil {
+			he.HotConnections = hot
+		}
+		he.QueuedBytes, he.SpoolBytes = pl.out.depth()
+		if !cur.LastEntry.IsZero() {
+			he.LastEntry = &cur.LastEntry
+		}
+		if !cur.LastErrorTS.IsZero() {
+			he.LastErrorTime = &cur.LastErrorTS
+		}
+		prev = cur
+		return he, nil
+	}
+}
+
+type healthzStatus struct {
+	Healthy        bool       `json:"healthy"`
+	HotConnections int        `json:"hot_connections"`
+	Streaming      bool       `json:"streaming"`              // every configured stream is running
+	StreamsDown    []string   `json:"streams_down,omitempty"` // the streams that aren't
+	Flowing        bool       `json:"flowing"`
+	LastEntry      *time.Time `json:"last_entry,omitempty"`
+	Uptime         string     `json:"uptime"`
+}
+
+// healthzHandler reports whether the muxer is hot and the streams are
+// flowing, it responds with 503 when either is not the case so a plain
+// curl -f works as a check.  Any stream that is down makes it unhealthy.  A stream counts as flowing if it produced an entry within the
+// idle timeout, without a timeout a running stream is enough.
+func healthzHandler(idle time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ss := stats.snapshot()
+		hs := healthzStatus{
+			Streaming: ss.Streaming,
+			Uptime:    ss.TS.Sub(ss.Start).Round(time.Second).String(),
+		}
+		hs.StreamsDown = stats.streamsDown()
+		hs.Streaming = hs.Streaming && len(hs.StreamsDown) == 0
+		if hot, err := igst.Hot(); err == nil {
+			hs.HotConnections = hot
+		}
+		last := ss.LastEntry
+		if last.IsZero() {
+			last = ss.Start
+		} else {
+			hs.LastEntry = &ss.LastEntry
+		}
+		hs.Flowing = hs.Streaming && (idle <= 0 || ss.TS.Sub(last) < idle)
+		hs.Healthy = hs.HotConnections > 0 && hs.Flowing
+		w.Header().Set("Content-Type", "application/json")
+		if !hs.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(hs)
+	}
+}
@@ -0,0 +1,321 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultInstallTag             = `macos-install`
+	defaultInstallLog             = `/var/log/install.log`
+	defaultInstallHistoryInterval = `1h`
+	defaultInstallStore           = `/opt/gravwell/etc/macosLog.installs`
+	installPoll                   = time.Second
+	installPersist                = 30 * time.Second // how often the log position is saved
+
+	installTimeFormat = `2006-01-02 15:04:05-07`
+	historyTimeFormat = `01/02/2006, 15:04:05`
+)
+
+// `Installed "Safari" (16.3)` in installer and softwareupdated lines
+var installedRegex = regexp.MustCompile(`Installed "([^"]+)" \(([^)]*)\)`)
+
+// installConfig is the [Install-Log] block.
+type installConfig struct {
+	Enable           bool
+	Tag_Name         string
+	Log_File         string // defaults to /var/log/install.log
+	History_Interval string // how often softwareupdate --history is captured, 0 disables
+	Store_Location   string // file the log position and captured history are tracked in
+}
+
+func (ic *installConfig) verify() error {
+	if !ic.Enable {
+		return nil
+	}
+	if ic.Tag_Name == `` {
+		ic.Tag_Name = defaultInstallTag
+	}
+	if _, err := ic.historyInterval(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ic installConfig) historyInterval() (time.Duration, error) {
+	if ic.History_Interval == `` {
+		ic.History_Interval = defaultInstallHistoryInterval
+	}
+	d, err := time.ParseDuration(ic.History_Interval)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Install-Log: Invalid History-Interval %q", ic.History_Interval)
+	}
+	return d, nil
+}
+
+func (ic installConfig) logFile() string {
+	if ic.Log_File == `` {
+		return defaultInstallLog
+	}
+	return ic.Log_File
+}
+
+func (ic installConfig) storeLocation() string {
+	if ic.Store_Location == `` {
+		return defaultInstallStore
+	}
+	return ic.Store_Location
+}
+
+// installLine is the entry written for each install.log line.
+type installLine struct {
+	Type    string `json:"type"`
+	Host    string `json:"host,omitempty"`
+	Process string `json:"process,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+	Message string `json:"message"`
+	Package string `json:"package,omitempty"` // set on lines recording a completed install
+	Version string `json:"version,omitempty"`
+}
+
+// softwareUpdate is the entry written for each softwareupdate --history
+// item.
+type softwareUpdate struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Date    string `json:"date"`
+}
+
+// installState is what the collector saves across restarts.
+type installState struct {
+	Log     followPos        `json:"log"`
+	History map[string]int64 `json:"history"` // unix nanos install date by name and version
+}
+
+// installCollector follows install.log and captures the software update
+// history, each install log line and each newly installed update becomes
+// an entry.
+type installCollector struct {
+	tag       entry.EntryTag
+	history   time.Duration
+	src       *sourceTracker
+	follower  *fileFollower
+	store     string
+	state     installState
+	dirty     bool
+	ephemeral bool
+}
+
+func startInstallCollector(ctx context.Context, wg *sync.WaitGroup, cfg installConfig, src *sourceTracker, ephemeral bool) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve install log tag %q: %v", cfg.Tag_Name, err)
+	}
+	history, err := cfg.historyInterval()
+	if err != nil {
+		return err
+	}
+	ic := &installCollector{
+		tag:       tag,
+		history:   history,
+		src:       src,
+		store:     cfg.storeLocation(),
+		ephemeral: ephemeral,
+	}
+	ic.load()
+	// a first run starts at the end of the log, the history capture covers
+	// what was installed before
+	ic.follower = newFileFollower(cfg.logFile(), ic.state.Log, true)
+	wg.Add(1)
+	go ic.run(ctx, wg)
+	return nil
+}
+
+func (ic *installCollector) load() {
+	b, err := os.ReadFile(ic.store)
+	if err == nil {
+		err = json.Unmarshal(b, &ic.state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		lg.Warn("Ignoring unreadable install log store %s: %v\n", ic.store, err)
+	}
+	if ic.state.History == nil {
+		ic.state.History = map[string]int64{}
+	}
+}
+
+func (ic *installCollector) persist() {
+	if !ic.dirty || ic.ephemeral {
+		return
+	}
+	b, err := json.Marshal(ic.state)
+	if err == nil {
+		err = writeFileAtomic(ic.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save install log position: %v\n", err)
+		return
+	}
+	ic.dirty = false
+}
+
+func (ic *installCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer ic.persist()
+	poll := time.NewTicker(installPoll)
+	defer poll.Stop()
+	save := time.NewTicker(installPersist)
+	defer save.Stop()
+	var historyC <-chan time.Time
+	if ic.history > 0 {
+		t := time.NewTicker(ic.history)
+		defer t.Stop()
+		historyC = t.C
+		ic.captureHistory(ctx)
+	}
+	for {
+		if err := ic.follower.poll(func(line []byte) error {
+			return ic.ingestLine(ctx, line)
+		}); err != nil && err != context.Canceled {
+			lg.Warn("Failed to read %s: %v\n", ic.follower.path, err)
+		}
+		if pos := ic.follower.position(); pos != ic.state.Log {
+			ic.state.Log, ic.dirty = pos, true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-save.C:
+			ic.persist()
+		case <-historyC:
+			ic.captureHistory(ctx)
+		}
+	}
+}
+
+func (ic *installCollector) ingestLine(ctx context.Context, line []byte) error {
+	il, ts := parseInstallLine(string(line))
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return emitJSON(ctx, ic.tag, ic.src, ts, il)
+}
+
+// parseInstallLine splits an install.log line,
+// "2023-01-10 10:11:12-08 host installd[123]: message".  Continuation lines
+// of a multi line message are kept whole as the message.
+func parseInstallLine(line string) (il installLine, ts time.Time) {
+	il = installLine{
+		Type:    `install_log`,
+		Message: line,
+	}
+	if len(line) <= len(installTimeFormat) {
+		return
+	}
+	t, err := time.Parse(installTimeFormat, line[:len(installTimeFormat)])
+	if err != nil {
+		return
+	}
+	ts = t
+	f := strings.SplitN(strings.TrimSpace(line[len(installTimeFormat):]), " ", 3)
+	if len(f) == 3 && strings.HasSuffix(f[1], `:`) {
+		il.Host, il.Message = f[0], f[2]
+		proc := strings.TrimSuffix(f[1], `:`)
+		if i := strings.IndexByte(proc, '['); i > 0 && strings.HasSuffix(proc, `]`) {
+			il.PID, _ = strconv.Atoi(proc[i+1 : len(proc)-1])
+			proc = proc[:i]
+		}
+		il.Process = proc
+	}
+	if m := installedRegex.FindStringSubmatch(il.Message); m != nil {
+		il.Package, il.Version = m[1], m[2]
+	}
+	return
+}
+
+// captureHistory runs softwareupdate --history and ingests the items that
+// weren't captured before.
+func (ic *installCollector) captureHistory(ctx context.Context) {
+	out, err := exec.CommandContext(ctx, "softwareupdate", "--history").Output()
+	if err != nil {
+		if ctx.Err() == nil {
+			lg.Warn("Failed to get the software update history: %v\n", err)
+		}
+		return
+	}
+	for _, su := range parseUpdateHistory(out) {
+		ts, err := time.ParseInLocation(historyTimeFormat, su.Date, time.Local)
+		if err != nil {
+			lg.Debug("Skipping software update %q with unrecognized date %q\n", su.Name, su.Date)
+			continue
+		}
+		key := su.Name + "\x00" + su.Version
+		if n, ok := ic.state.History[key]; ok && n == ts.UnixNano() {
+			continue
+		}
+		if err := emitJSON(ctx, ic.tag, ic.src, ts, su); err != nil {
+			return
+		}
+		ic.state.History[key] = ts.UnixNano()
+		ic.dirty = true
+	}
+}
+
+// parseUpdateHistory reads the softwareupdate --history table, the columns
+// are fixed width and placed by the header.
+//
+//	Display Name                   Version    Date
+//	------------                   -------    ----
+//	Safari                         16.3       01/24/2023, 09:00:00
+func parseUpdateHistory(out []byte) (sus []softwareUpdate) {
+	verCol, dateCol := -1, -1
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if verCol < 0 {
+			if strings.HasPrefix(line, `Display Name`) {
+				verCol, dateCol = strings.Index(line, `Version`), strings.Index(line, `Date`)
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == `` || strings.HasPrefix(line, `---`) || dateCol < 0 || len(line) <= dateCol {
+			continue
+		}
+		su := softwareUpdate{
+			Type: `software_update`,
+			Date: strings.TrimSpace(line[dateCol:]),
+		}
+		if verCol > 0 && verCol < dateCol {
+			su.Name = strings.TrimSpace(line[:verCol])
+			su.Version = strings.TrimSpace(line[verCol:dateCol])
+		} else {
+			su.Name = strings.TrimSpace(line[:dateCol])
+		}
+		if su.Name != `` {
+			sus = append(sus, su)
+		}
+	}
+	return
+}
@@ -0,0 +1,73 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	defaultLockLoc = `/opt/gravwell/etc/macosLog.pid`
+)
+
+// instanceLock is a pidfile held under an exclusive flock, two copies of
+// the ingester would double ingest everything.  The lock is released by the
+// kernel when the process exits so a stale pidfile never blocks a start.
+type instanceLock struct {
+	f *os.File
+}
+
+func acquireInstanceLock(path string) (*instanceLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			if pid := lockHolder(path); pid > 0 {
+				return nil, fmt.Errorf("another instance (pid %d) holds %s, use -force to run anyway", pid, path)
+			}
+			return nil, fmt.Errorf("another instance holds %s, use -force to run anyway", path)
+		}
+		return nil, err
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &instanceLock{f: f}, nil
+}
+
+// lockHolder returns the pid recorded in a pidfile, zero if there isn't one.
+func lockHolder(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(string(bytes.TrimSpace(b)))
+	return pid
+}
+
+// release removes the pidfile and drops the lock.
+func (il *instanceLock) release() {
+	if il == nil {
+		return
+	}
+	os.Remove(il.f.Name())
+	il.f.Close()
+}
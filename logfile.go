@@ -0,0 +1,140 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogFileRetain = 5
+)
+
+// logRotation controls rotation of the ingester's own log file, with
+// neither a size nor an age set the file is never rotated.
+type logRotation struct {
+	maxSize int64
+	maxAge  time.Duration
+	retain  int
+}
+
+// rotatingFile is an append only log file that is rotated once it grows
+// past a size or age.  Rotated files are renamed path.1, path.2, and so on
+// with the oldest beyond the retention count removed.
+type rotatingFile struct {
+	sync.Mutex
+	path   string
+	perm   os.FileMode
+	rot    logRotation
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, perm os.FileMode, rot logRotation) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path: path,
+		perm: perm,
+		rot:  rot,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, rf.perm)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	// the creation time isn't portable, an existing file's age counts from
+	// when we opened it
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.due(len(b)) {
+		if err := rf.rotate(); err != nil {
+			// keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", rf.path, err)
+		}
+	}
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// due returns true if writing n more bytes should rotate first, an empty
+// file is never rotated.
+func (rf *rotatingFile) due(n int) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.rot.maxSize > 0 && rf.size+int64(n) > rf.rot.maxSize {
+		return true
+	}
+	return rf.rot.maxAge > 0 && time.Since(rf.opened) > rf.rot.maxAge
+}
+
+// rotate shifts the rotated files along, dropping the oldest, and starts
+// a new file.  The caller must hold the lock.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	os.Remove(rf.rotated(rf.rot.retain))
+	for i := rf.rot.retain - 1; i >= 1; i-- {
+		if err := os.Rename(rf.rotated(i), rf.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if rf.rot.retain > 0 {
+		if err := os.Rename(rf.path, rf.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
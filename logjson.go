@@ -0,0 +1,136 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = `text`
+	logFormatJSON = `json`
+)
+
+var logLevelRegex = regexp.MustCompile(`\b(DEBUG|INFO|WARN|WARNING|ERROR|CRITICAL|FATAL)\b`)
+
+type jsonLogLine struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level,omitempty"`
+	Ingester string    `json:"ingester"`
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Message  string    `json:"message"`
+}
+
+// jsonLogWriter turns the lines the logger writes into JSON objects, one per
+// line, so the ingester's own logs can be collected and queried like the
+// data it produces.  The level is picked out of the formatted line and
+// everything after it (or after the structured data holding it) is the
+// message.
+type jsonLogWriter struct {
+	sync.Mutex
+	w    io.WriteCloser
+	host string
+	pid  int
+	buf  []byte
+}
+
+func newJSONLogWriter(w io.WriteCloser) *jsonLogWriter {
+	host, _ := os.Hostname()
+	return &jsonLogWriter{
+		w:    w,
+		host: host,
+		pid:  os.Getpid(),
+	}
+}
+
+func (jw *jsonLogWriter) Write(b []byte) (int, error) {
+	jw.Lock()
+	defer jw.Unlock()
+	jw.buf = append(jw.buf, b...)
+	for {
+		idx := bytes.IndexByte(jw.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(bytes.TrimSpace(jw.buf[:idx]))
+		jw.buf = jw.buf[idx+1:]
+		if line == `` {
+			continue
+		}
+		if err := jw.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (jw *jsonLogWriter) writeLine(line string) error {
+	jl := jsonLogLine{
+		Time:     time.Now().UTC(),
+		Ingester: ingesterName,
+		Host:     jw.host,
+		PID:      jw.pid,
+		Message:  line,
+	}
+	if loc := logLevelRegex.FindStringIndex(line); loc != nil {
+		jl.Level = strings.ToLower(line[loc[0]:loc[1]])
+		if jl.Level == `warning` {
+			jl.Level = `warn`
+		}
+		rest := line[loc[1]:]
+		// a level inside RFC 5424 structured data, the message follows it
+		if pre := line[:loc[0]]; strings.LastIndex(pre, `[`) > strings.LastIndex(pre, `]`) {
+			if i := strings.Index(rest, `]`); i >= 0 {
+				rest = rest[i+1:]
+			}
+		}
+		if msg := strings.TrimSpace(rest); msg != `` {
+			jl.Message = msg
+		}
+	}
+	b, err := json.Marshal(jl)
+	if err != nil {
+		return err
+	}
+	_, err = jw.w.Write(append(b, '\n'))
+	return err
+}
+
+func (jw *jsonLogWriter) Close() error {
+	jw.Lock()
+	defer jw.Unlock()
+	if len(jw.buf) > 0 {
+		jw.writeLine(string(bytes.TrimSpace(jw.buf)))
+		jw.buf = nil
+	}
+	return jw.w.Close()
+}
+
+// stderrWriter lets the logger write to stderr without ever closing it.
+type stderrWriter struct{}
+
+func (stderrWriter) Write(b []byte) (int, error) { return os.Stderr.Write(b) }
+func (stderrWriter) Close() error                { return nil }
+
+func checkLogFormat(f string) error {
+	switch strings.ToLower(f) {
+	case ``, logFormatText, logFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("Invalid Log-Format %q, expected text or json", f)
+}
@@ -8,17 +8,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,20 +32,57 @@ const (
 	defaultConfigLoc = `/opt/gravwell/etc/macosLog.conf`
 	ingesterName     = `macosLog`
 
-	PERIOD      = time.Second
-	READ_PERIOD = time.Second
+	PERIOD = time.Second
+
+	defaultDrainTimeout = 5 * time.Second
+
+	// exit codes so launchd, wrappers, and fleet monitoring can tell failure
+	// classes apart, from sysexits(3) where one fits
+	exitStreamFailed = 3  // the log stream keeps failing
+	exitUnavailable  = 69 // EX_UNAVAILABLE, no indexer could be reached
+	exitLocked       = 75 // EX_TEMPFAIL, another instance is running
+	exitAuthFailure  = 77 // EX_NOPERM, the indexers rejected the ingest secret
+	exitConfigError  = 78 // EX_CONFIG
 )
 
 var (
 	confLoc        = flag.String("config-file", defaultConfigLoc, "Location for configuration file")
 	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
 	ver            = flag.Bool("version", false, "Print the version information and exit")
+	force          = flag.Bool("force", false, "Run even if another instance holds the lock file")
+	validate       = flag.Bool("validate", false, "Validate the configuration file and exit")
+	skipConnect    = flag.Bool("skip-connect", false, "Don't check that backend targets are reachable when validating")
+	traceDecode    = flag.Bool("trace-decode", false, "Log record boundary decisions, buffer sizes, and batch timings at debug level")
+	bench          = flag.String("bench", "", "Replay a captured log stream JSON file through the pipeline as fast as possible and report throughput")
+	sysdiag        = flag.Bool("sysdiagnose", false, "Take a sysdiagnose and ingest its unified log, spindumps, and ps and netstat snapshots, then exit")
+	sysdiagArchive = flag.String("sysdiagnose-archive", "", "With -sysdiagnose, ingest this existing sysdiagnose archive or directory rather than taking one")
+	sysdiagLast    = flag.Duration("sysdiagnose-last", defaultSysdiagLast, "With -sysdiagnose, how much of the unified log to ingest, 0 for all of it")
+	dryRun         = flag.Bool("dry-run", false, "Process records but print the resulting entries to stdout rather than ingesting them")
+	installSvc     = flag.Bool("install-service", false, "Install and load a LaunchDaemon for this binary and config file")
+	uninstallSvc   = flag.Bool("uninstall-service", false, "Unload and remove the LaunchDaemon")
+	tagOverride    = flag.String("tag", "", "Override Tag-Name")
+	clearTargets   = flag.String("clear-target", "", "Comma separated cleartext targets, any target flag replaces every target in the config")
+	tlsTargets     = flag.String("tls-target", "", "Comma separated TLS targets, any target flag replaces every target in the config")
+	pipeTargets    = flag.String("pipe-target", "", "Comma separated named pipe targets, any target flag replaces every target in the config")
+	setupWizard    = flag.Bool("setup", false, "Interactively write a config file, test the connection, and optionally install the service")
+	testConn       = flag.Bool("test-connection", false, "Test each backend target with a full ingest handshake and a test entry, then exit")
+	migrate        = flag.Bool("migrate-config", false, "Rewrite a single stream config to use Stream blocks, keeping the original as .bak")
+	status         = flag.Bool("status", false, "Print the status of the running instance and exit")
+	jsonOut        = flag.Bool("json", false, "Print -status output as JSON")
+	uninstallAll   = flag.Bool("uninstall", false, "Stop and remove the service, with -purge also delete the cache, spool, and state files")
+	purge          = flag.Bool("purge", false, "Delete the cache, spool, and state files when uninstalling")
+	configURL      = flag.String("config-url", "", "Fetch the configuration from this HTTPS URL, -config-file is ignored")
+	configPin      = flag.String("config-pin", "", "Comma separated base64 SHA-256 public key pins for the -config-url server")
+	configCache    = flag.String("config-cache", defaultRemoteConfigCache, "Where the configuration fetched from -config-url is cached")
+	configRefresh  = flag.String("config-refresh", "", "How often to check -config-url for changes, by default only at start and on SIGHUP")
 
 	lg   *log.Logger
-	igst *ingest.IngestMuxer
+	igst muxer
 )
 
-func init() {
+// setup parses the flags and opens the stderr logger, it runs from main
+// rather than init so tests can register and parse their own flags.
+func setup() {
 	flag.Parse()
 	if *ver {
 		version.PrintVersion(os.Stdout)
@@ -69,73 +105,185 @@ func init() {
 }
 
 func main() {
+	setup()
 	debug.SetTraceback("all")
 
+	remote, err := newRemoteConfig(*configURL, *configPin, *configCache, *configRefresh)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *status {
+		path := *confLoc
+		if remote != nil {
+			path = remote.cache
+		}
+		if err := printStatus(os.Stdout, controlSocketFor(path), *jsonOut); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *installSvc {
+		if err := installService(*confLoc, remote); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to install service: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Installed and loaded", servicePlistPath)
+		os.Exit(0)
+	}
+	if *uninstallSvc {
+		if err := uninstallService(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to uninstall service: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Unloaded and removed", servicePlistPath)
+		os.Exit(0)
+	}
+	if *uninstallAll {
+		path := *confLoc
+		if remote != nil {
+			path = remote.cache
+		}
+		if err := uninstall(os.Stdout, path, *purge); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to uninstall: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *migrate {
+		if err := migrateConfig(os.Stdout, *confLoc); err == errAlreadyMigrated {
+			fmt.Printf("%s: %v, nothing to do\n", *confLoc, err)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to migrate %s: %v\n", *confLoc, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *setupWizard {
+		if err := runSetup(os.Stdin, os.Stdout, *confLoc); err != nil {
+			fmt.Fprintf(os.Stderr, "Setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if remote != nil {
+		if *confLoc, err = remote.load(); err != nil {
+			lg.FatalCode(exitConfigError, "%v\n", err)
+		}
+	}
+	if *testConn {
+		cfg, err := loadConfig(*confLoc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *confLoc, err)
+			os.Exit(1)
+		}
+		if !testConnections(os.Stdout, cfg) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *validate {
+		if !validateConfig(os.Stdout, *confLoc, !*skipConnect) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *bench != `` {
+		cfg, err := loadConfig(*confLoc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *confLoc, err)
+			os.Exit(exitConfigError)
+		}
+		applyTraceLevel()
+		if err = runBench(os.Stdout, cfg, *bench); err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *sysdiag {
+		cfg, err := loadConfig(*confLoc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *confLoc, err)
+			os.Exit(exitConfigError)
+		}
+		if err = runSysdiagnose(os.Stdout, cfg, *sysdiagArchive, *sysdiagLast, *dryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "Sysdiagnose collection failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// config setup
 
-	cfg, err := GetConfig(*confLoc)
+	var cfg *cfgType
+	if *dryRun {
+		// a dry run must not touch the config, it may not even have a UUID yet
+		cfg, err = loadConfig(*confLoc)
+	} else {
+		cfg, err = GetConfig(*confLoc)
+	}
 	if err != nil {
-		lg.FatalCode(0, "Failed to get configuration: %v\n", err)
+		lg.FatalCode(exitConfigError, "Failed to get configuration: %v\n", err)
 		return
 	}
 
+	jsonLogs := strings.EqualFold(cfg.Global.Log_Format, logFormatJSON)
+	if jsonLogs {
+		// nothing has been started yet so the logger can simply be replaced
+		lg = log.New(newJSONLogWriter(stderrWriter{}))
+	}
 	if len(cfg.Global.Log_File) > 0 {
-		fout, err := os.OpenFile(cfg.Global.Log_File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		rot, _ := cfg.Global.logRotation()
+		var fout io.WriteCloser
+		fout, err := newRotatingFile(cfg.Global.Log_File, 0640, rot)
 		if err != nil {
-			lg.FatalCode(0, "Failed to open log file %s: %v", cfg.Global.Log_File, err)
+			lg.FatalCode(exitConfigError, "Failed to open log file %s: %v", cfg.Global.Log_File, err)
+		}
+		if jsonLogs {
+			fout = newJSONLogWriter(fout)
 		}
 		if err = lg.AddWriter(fout); err != nil {
 			lg.Fatal("Failed to add a writer: %v", err)
 		}
 		if len(cfg.Global.Log_Level) > 0 {
 			if err = lg.SetLevelString(cfg.Global.Log_Level); err != nil {
-				lg.FatalCode(0, "Invalid Log Level \"%s\": %v", cfg.Global.Log_Level, err)
+				lg.FatalCode(exitConfigError, "Invalid Log Level \"%s\": %v", cfg.Global.Log_Level, err)
 			}
 		}
 	}
+	applyTraceLevel()
+
+	if *dryRun {
+		// nothing a dry run does should outlive it
+		cfg.Global.Spool_Location = ``
+		cfg.Global.Disable_Control_Socket = true
+		igst = newDryRunMuxer(os.Stdout)
+	} else {
+		// only one copy may run, it would double ingest everything
+		lock, err := acquireInstanceLock(cfg.Global.lockFile())
+		if err != nil {
+			if !*force {
+				lg.FatalCode(exitLocked, "Failed to acquire instance lock: %v\n", err)
+			}
+			lg.Warn("Running without the instance lock: %v\n", err)
+		}
+		defer lock.release()
 
-	tag := cfg.Global.Tag_Name
-
-	conns, err := cfg.Global.Targets()
-	if err != nil {
-		lg.FatalCode(0, "Failed to get backend targets from configuration: %v\n", err)
-		return
-	}
-	lmt, err := cfg.Global.RateLimit()
-	if err != nil {
-		lg.FatalCode(0, "Failed to get rate limit from configuration: %v\n", err)
-		return
-	}
-
-	// create ingest connection(s)
-
-	id, ok := cfg.Global.IngesterUUID()
-	if !ok {
-		lg.FatalCode(0, "Couldn't read ingester UUID\n")
-	}
-	igCfg := ingest.UniformMuxerConfig{
-		IngestStreamConfig: cfg.Global.IngestStreamConfig,
-		Destinations:       conns,
-		Tags:               []string{tag},
-		Auth:               cfg.Global.Secret(),
-		LogLevel:           cfg.Global.LogLevel(),
-		VerifyCert:         !cfg.Global.InsecureSkipTLSVerification(),
-		IngesterName:       ingesterName,
-		IngesterVersion:    version.GetVersion(),
-		IngesterUUID:       id.String(),
-		IngesterLabel:      cfg.Global.Label,
-		RateLimitBps:       lmt,
-		Logger:             lg,
-		CacheDepth:         cfg.Global.Cache_Depth,
-		CachePath:          cfg.Global.Ingest_Cache_Path,
-		CacheSize:          cfg.Global.Max_Ingest_Cache,
-		CacheMode:          cfg.Global.Cache_Mode,
-		LogSourceOverride:  net.ParseIP(cfg.Global.Log_Source_Override),
+		igCfg, err := muxerConfig(cfg)
+		if err != nil {
+			lg.FatalCode(exitConfigError, "%v\n", err)
+		}
+		if igst, err = ingest.NewUniformMuxer(igCfg); err != nil {
+			lg.Fatal("Failed build our ingest system: %v\n", err)
+			return
+		}
 	}
-	igst, err = ingest.NewUniformMuxer(igCfg)
-	if err != nil {
-		lg.Fatal("Failed build our ingest system: %v\n", err)
-		return
+	if err := applyPriority(cfg.Global); err != nil {
+		lg.Warn("%v\n", err)
 	}
 
 	defer igst.Close()
@@ -146,12 +294,13 @@ func main() {
 	}
 
 	if err := igst.WaitForHot(cfg.Global.Timeout()); err != nil {
-		lg.FatalCode(0, "Timedout waiting for backend connections: %v\n", err)
+		lg.FatalCode(connectExitCode(err), "Timedout waiting for backend connections: %v\n", err)
 		return
 	}
 
-	// prepare the configuration we're going to send upstream
-	err = igst.SetRawConfiguration(cfg)
+	// prepare the configuration we're going to send upstream, stream
+	// status is added once the streams are running
+	err = igst.SetRawConfiguration(ingesterState{Config: cfg})
 	if err != nil {
 		lg.FatalCode(0, "Failed to set configuration for ingester state messages\n")
 	}
@@ -159,29 +308,151 @@ func main() {
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 
-	var src net.IP
-
-	if cfg.Global.Source_Override != `` {
-		// global override
-		src = net.ParseIP(cfg.Global.Source_Override)
-		if src == nil {
-			lg.FatalCode(0, "Global Source-Override is invalid")
-		}
+	// the global override wins, otherwise detect the primary address
+	src, err := newSourceTracker(cfg.Global.Source_Override, cfg.Global.Source_Interface)
+	if err != nil {
+		lg.FatalCode(exitConfigError, "Failed to set up source address: %v\n", err)
 	}
+	srcRefresh, _ := cfg.Global.sourceRefreshInterval()
+	go src.run(ctx, srcRefresh)
 
 	t, err := igst.GetTag(cfg.Global.Tag_Name)
 	if err != nil {
 		lg.Fatal("Failed to resolve tag \"%s\": %v\n", cfg.Global.Tag_Name, err)
 	}
-	go run(t, src, &wg, ctx)
+	pl, err := newPipeline(cfg)
+	if err != nil {
+		lg.FatalCode(exitConfigError, "Failed to build processing pipeline: %v\n", err)
+	}
+	if *dryRun {
+		// leave the resume state and seen processes as they were
+		pl.ephemeral = true
+	}
+	rc, err := cfg.Global.streamConfig()
+	if err != nil {
+		lg.FatalCode(exitConfigError, "Invalid stream configuration: %v\n", err)
+	}
+	streams, err := newStreamSet(cfg, rc)
+	if err != nil {
+		lg.Fatal("%v\n", err)
+	}
+	sc, err := newStderrCapture(cfg, src)
+	if err != nil {
+		lg.Fatal("Failed to resolve diagnostics tag \"%s\": %v\n", cfg.Global.Diagnostics_Tag_Name, err)
+	}
+	drainTimeout, err := cfg.Global.drainTimeout()
+	if err != nil {
+		lg.FatalCode(exitConfigError, "%v\n", err)
+	}
+	exitAfterIdle, err := cfg.Global.exitAfterIdle()
+	if err != nil {
+		lg.FatalCode(exitConfigError, "%v\n", err)
+	}
+	if memGuard, err = newMemoryGuard(cfg.Global.Memory_Soft_Limit, cfg.Global.Memory_Shed_Mode, pl); err != nil {
+		lg.FatalCode(exitConfigError, "%v\n", err)
+	} else if memGuard != nil {
+		wg.Add(1)
+		go memGuard.run(ctx, &wg)
+	}
+	wg.Add(1)
+	go pl.run(ctx, &wg)
+	streamStart := time.Now()
+	for _, ls := range streams {
+		wg.Add(1)
+		go run(ls, src, pl, sc, &wg, ctx)
+	}
 
-	// listen for signals so we can close gracefully
+	if down, ok := pl.downtime(); ok {
+		ckpt, _ := pl.resumePoint()
+		maxBackfill, _ := cfg.Global.maxBackfill()
+		start, ok := backfillWindow(ckpt, streamStart, maxBackfill)
+		ok = ok && cfg.Global.Resume_On_Restart
+		for _, ls := range streams {
+			if ok {
+				wg.Add(1)
+				go backfill(ctx, &wg, start, streamStart, ls, src, pl, sc)
+			}
+			emitGap(ctx, rc.gapEntries, ls, src, gapStartup, down, streamStart, ok && !start.After(down))
+		}
+	}
 
-	utils.WaitForQuit()
+	if cfg.Global.Detect_Sleep {
+		maxBackfill, _ := cfg.Global.maxBackfill()
+		sd := &sleepDetector{
+			// whatever is held or waiting is written and the resume state
+			// saved, the log children are left running
+			onSleep: func() {
+				if err := pl.write(ctx, pl.flush(time.Now(), true)); err != nil && err != context.Canceled {
+					lg.Error("Failed to write flushed entries: %v\n", err)
+				}
+				if err := igst.Sync(drainTimeout); err != nil {
+					lg.Warn("Failed to sync: %v\n", err)
+				}
+				pl.persist()
+			},
+			onWake: func(ev wakeEvent) {
+				pl.wake.mark(ev)
+				if err := emitJSON(ctx, t, src, ev.Wake, ev); err != nil && err != context.Canceled {
+					lg.Error("Failed to emit wake entry: %v\n", err)
+				}
+				// the streams are restarted and whatever was logged while we
+				// were asleep and waking is backfilled
+				now := time.Now()
+				streams.restart()
+				start, ok := backfillWindow(ev.SleepStart, now, maxBackfill)
+				for _, ls := range streams {
+					if ok {
+						wg.Add(1)
+						go backfill(ctx, &wg, start, now, ls, src, pl, sc)
+					}
+					emitGap(ctx, ls.ctl.config().gapEntries, ls, src, gapSleep, ev.SleepStart, ev.Wake, ok && start.Equal(ev.SleepStart))
+				}
+			},
+		}
+		wg.Add(1)
+		go sd.run(ctx, &wg)
+	}
+
+	wg.Add(1)
+	go handleFlushSignal(ctx, &wg, pl, streams, drainTimeout)
+	rl := &reloader{path: *confLoc, remote: remote, cfg: cfg, pl: pl, streams: streams}
+	wg.Add(1)
+	go rl.run(ctx, &wg)
+	wg.Add(1)
+	go publishState(ctx, &wg, rl.config, pl)
+	wg.Add(1)
+	go newDiskMonitor(cfg, pl).run(ctx, &wg)
+
+	if err := startCollectors(ctx, &wg, cfg, src, pl); err != nil {
+		lg.FatalCode(exitConfigError, "Failed to start collectors: %v\n", err)
+	}
+	emitCheckin(ctx, cfg, *confLoc, remote != nil, src)
+
+	// listen for signals so we can close gracefully, batch runs may also
+	// exit once the input dries up
+
+	quit := make(chan struct{})
+	go func() {
+		utils.WaitForQuit()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-idleExit(ctx, exitAfterIdle):
+		lg.Info("No records read for %v, exiting\n", exitAfterIdle)
+	}
 
+	// stop everything feeding the pipeline, then flush whatever is left
+	// within the drain timeout
 	cancel()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer drainCancel()
+	if !waitGroupContext(drainCtx, &wg) {
+		lg.Warn("Timed out waiting for readers to stop\n")
+	}
+	pl.close(drainCtx)
 
-	if err := igst.Sync(time.Second); err != nil {
+	if err := igst.Sync(time.Until(deadline(drainCtx))); err != nil {
 		lg.Error("Failed to sync: %v\n", err)
 	}
 	if err := igst.Close(); err != nil {
@@ -189,103 +460,341 @@ func main() {
 	}
 }
 
-func run(tag entry.EntryTag, src net.IP, wg *sync.WaitGroup, ctx context.Context) {
+// connectExitCode picks the exit code for a failure to connect, the muxer
+// only reports a rejected secret in its error text.
+func connectExitCode(err error) int {
+	if strings.Contains(strings.ToLower(err.Error()), `auth`) {
+		return exitAuthFailure
+	}
+	return exitUnavailable
+}
+
+// idleExit returns a channel that is closed once no records have been read
+// for d, it never closes when d is zero.
+func idleExit(ctx context.Context, d time.Duration) <-chan struct{} {
+	ch := make(chan struct{})
+	if d <= 0 {
+		return ch
+	}
+	go func() {
+		tckr := time.NewTicker(time.Second)
+		defer tckr.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-tckr.C:
+				ss := stats.snapshot()
+				last := ss.LastEntry
+				if last.Before(ss.Start) {
+					last = ss.Start
+				}
+				if now.Sub(last) >= d {
+					close(ch)
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// muxerConfig builds the ingest muxer configuration.
+func muxerConfig(cfg *cfgType) (igCfg ingest.UniformMuxerConfig, err error) {
+	conns, err := cfg.Global.Targets()
+	if err != nil {
+		err = fmt.Errorf("Failed to get backend targets from configuration: %v", err)
+		return
+	}
+	lmt, err := cfg.Global.RateLimit()
+	if err != nil {
+		err = fmt.Errorf("Failed to get rate limit from configuration: %v", err)
+		return
+	}
+	id, ok := cfg.Global.IngesterUUID()
+	if !ok {
+		err = errors.New("Couldn't read ingester UUID")
+		return
+	}
+	igCfg = ingest.UniformMuxerConfig{
+		IngestStreamConfig: cfg.Global.IngestStreamConfig,
+		Destinations:       conns,
+		Tags:               cfg.Tags(),
+		Auth:               cfg.Global.Secret(),
+		LogLevel:           cfg.Global.LogLevel(),
+		VerifyCert:         !cfg.Global.InsecureSkipTLSVerification(),
+		IngesterName:       ingesterName,
+		IngesterVersion:    version.GetVersion(),
+		IngesterUUID:       id.String(),
+		IngesterLabel:      cfg.Global.Label,
+		RateLimitBps:       lmt,
+		Logger:             lg,
+		CacheDepth:         cfg.Global.Cache_Depth,
+		CachePath:          cfg.Global.Ingest_Cache_Path,
+		CacheSize:          cfg.Global.Max_Ingest_Cache,
+		CacheMode:          cfg.Global.Cache_Mode,
+		LogSourceOverride:  net.ParseIP(cfg.Global.Log_Source_Override),
+	}
+	return
+}
+
+func run(ls *logStream, src *sourceTracker, pl *pipeline, sc *stderrCapture, wg *sync.WaitGroup, ctx context.Context) {
+	defer wg.Done()
+	ctl := ls.ctl
+	rc := ctl.config()
+	bo := newBackoff(defaultBackoffMin, rc.maxBackoff)
+	rb := restartBudget{max: rc.maxAttempts, window: rc.attemptWindow}
+	var stopped time.Time // when the previous child went away
 	for {
-		cmd := exec.Command("log", "stream", "--style=json")
+		// pick up any configuration reloaded since the last child
+		rc = ctl.config()
+		bo.setMax(rc.maxBackoff)
+		rb.max, rb.window = rc.maxAttempts, rc.attemptWindow
+		// the child is killed on cancellation which unblocks the decoder
+		cmd := logCommand(ctx, rc.qosClass, logArgs("stream", rc.predicate)...)
 		out, err := cmd.StdoutPipe()
 		if err != nil {
 			lg.Fatal("Failed to get stdoutpipe: %v\n", err)
 		}
-		err = cmd.Start()
+		errOut, err := cmd.StderrPipe()
 		if err != nil {
-			lg.Error("Failed to start log: %v\n", err)
-			time.Sleep(PERIOD)
-			continue
+			lg.Fatal("Failed to get stderrpipe: %v\n", err)
 		}
-		for {
-			ents, err := decode(out)
-			if err != nil {
-				lg.Error("Failed to decode: %v\n", err)
-				break
+		started := time.Now()
+		if err = cmd.Start(); err != nil {
+			lg.Error("Failed to start log stream %s: %v\n", ls.name, err)
+			stats.restart(err)
+			ls.counters.restart(err)
+		} else {
+			stderrDone := make(chan struct{})
+			go func() {
+				sc.consume(ctx, "log stream", errOut)
+				close(stderrDone)
+			}()
+			ctl.set(cmd)
+			stats.setStreaming(true)
+			ls.counters.setRunning(true)
+			if !stopped.IsZero() {
+				emitGap(ctx, rc.gapEntries, ls, src, gapRestart, stopped, started, false)
 			}
-
-			for _, v := range ents {
-				v.SRC = src
-				v.TS = entry.Now()
-				v.Tag = tag
+			dec := newDecoder(chaosReader(out), rc)
+			done := make(chan struct{})
+			if rc.idleTimeout > 0 {
+				go watchStream(ctx, dec, cmd, rc.idleTimeout, done)
 			}
-
-			if err = igst.WriteBatchContext(ctx, ents); err != nil {
-				if err == context.Canceled {
-					return
-				}
-				lg.Error("Sending message: %v", err)
+			err = ingestEntries(ctx, dec, rc, ls, src, pl)
+			close(done)
+			stats.setStreaming(false)
+			ls.counters.setRunning(false)
+			ctl.set(nil)
+			stopped = time.Now()
+			cmd.Process.Kill()
+			<-stderrDone // all reads must finish before Wait closes the pipe
+			cmd.Wait()
+			if ctx.Err() != nil {
+				return
 			}
-
+			if ctl.restartRequested() {
+				lg.Info("Restarting log stream %s\n", ls.name)
+				continue
+			}
+			lg.Error("Failed to decode log stream %s: %v\n", ls.name, err)
+			stats.restart(err)
+			ls.counters.restart(err)
+			if time.Since(started) > backoffResetAfter {
+				bo.reset()
+				rb.healthy()
+			}
+		}
+		if rb.fail(time.Now()) {
+			if rc.attemptWindow > 0 {
+				lg.FatalCode(exitStreamFailed, "log stream %s failed %d times in %v, giving up\n", ls.name, len(rb.fails), rc.attemptWindow)
+			}
+			lg.FatalCode(exitStreamFailed, "log stream %s failed %d consecutive times, giving up\n", ls.name, len(rb.fails))
+		}
+		if !bo.wait(ctx) {
+			return
 		}
-		cmd.Process.Kill()
 	}
 }
 
-var buf []byte
-var first = true
+// ingestEntries decodes entries and sends them through the pipeline to the muxer
+// until decoding fails or the context is cancelled.  Decoding runs in its own
+// goroutine a bounded number of batches ahead so a slow write doesn't stall
+// reads from the pipe and a slow pipe doesn't stall writes.  Processed
+// entries are gathered into writes by a batcher.
+func ingestEntries(ctx context.Context, dec *decoder, rc streamConfig, ls *logStream, src *sourceTracker, pl *pipeline) error {
+	batches := make(chan []*entry.Entry, dec.depth)
+	stop := make(chan struct{})
+	var decErr error
+	var dwg sync.WaitGroup
+	dwg.Add(1)
+	go func() {
+		defer dwg.Done()
+		defer close(batches)
+		decErr = decodeEntries(dec, ls.tag, src, batches, stop)
+		dec.free()
+	}()
+	// batches the writer never got to are released once the decoder is gone
+	defer func() {
+		for ents := range batches {
+			stats.dequeued(ents)
+			for _, ent := range ents {
+				putEntry(ent)
+			}
+			putBatch(ents)
+		}
+	}()
+	// the decoder must be gone before the caller reaps the child, a
+	// failed write only happens on cancellation which kills the child and
+	// unblocks any read
+	defer dwg.Wait()
+	defer close(stop)
+
+	bt := newBatcher(rc.batchSize, rc.batchInterval)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	var timerC <-chan time.Time // set while the timer is armed
+	write := func(full bool) error {
+		if timerC != nil && !timer.Stop() {
+			<-timer.C
+		}
+		timerC = nil
+		if bt.empty() {
+			return nil
+		}
+		start := time.Now()
+		out := bt.take(full)
+		if rc.backlog {
+			pl.out.pacer.wait(ctx, len(out))
+		}
+		err := pl.write(ctx, out)
+		if err == nil {
+			ls.counters.wrote(out)
+		}
+		dec.tracef("wrote %d entries in %v, next batch target %d\n", len(out), time.Since(start), bt.target)
+		return err
+	}
 
-func decode(r io.Reader) ([]*entry.Entry, error) {
-	if first {
-		b := make([]byte, 1024)
-		for {
-			n, err := r.Read(b)
-			if err != nil {
-				return nil, err
+	for {
+		select {
+		case ents, ok := <-batches:
+			if !ok {
+				// anything still pending is written, or parked for
+				// retry if we are shutting down
+				if err := write(false); err != nil {
+					return err
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return decErr
+			}
+			stats.dequeued(ents)
+			ls.counters.readEntries(ents)
+			start := time.Now()
+			out := pl.process(ents)
+			full := bt.add(out)
+			// the batcher has its own copy of the pointers
+			if !sameBatch(out, ents) {
+				putBatch(out)
 			}
-			if n > 0 {
-				buf = append(buf, b[:n]...)
+			putBatch(ents)
+			dec.tracef("batch of %d records: pipeline %v, %d entries out\n", len(ents), time.Since(start), len(out))
+			if full {
+				if err := write(true); err != nil {
+					return err
+				}
+			} else if timerC == nil && !bt.empty() {
+				timer.Reset(bt.interval)
+				timerC = timer.C
 			}
-			if len(buf) >= 3 {
-				// pop off the leading [{\n
-				buf = buf[3:]
-				first = false
-				break
+		case <-timerC:
+			timerC = nil
+			if err := write(false); err != nil {
+				return err
 			}
-			time.Sleep(READ_PERIOD)
 		}
 	}
+}
 
-	var ents []*entry.Entry
-
+// decodeEntries feeds decoded batches to the writer until decoding fails or
+// the writer stops.
+func decodeEntries(dec *decoder, tag entry.EntryTag, src *sourceTracker, batches chan<- []*entry.Entry, stop <-chan struct{}) error {
+	if dec.workers > 1 {
+		return decodeParallel(dec, tag, src, batches, stop)
+	}
 	for {
-		b := make([]byte, 1024)
-		n, err := r.Read(b)
+		if !memGuard.pause(dec, stop) {
+			return nil
+		}
+		start := time.Now()
+		ents, err := dec.decode()
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		buf = append(buf, b[:n]...)
-
-		e := bytes.Split(buf, []byte("\n},{\n"))
-		if len(e) <= 1 {
-			time.Sleep(READ_PERIOD)
-			continue
+		dec.tracef("decoded %d records in %v, %d batches queued\n", len(ents), time.Since(start), len(batches))
+		if !sendBatch(dec, ents, tag, src, batches, stop) {
+			return nil
 		}
+	}
+}
 
-		// consume all but the last piece
-		for i := 0; i < len(e)-1; i++ {
-			d := []byte{'{'}
-			d = append(d, e[i]...)
-			d = append(d, '}')
-			var o bytes.Buffer
-			err := json.Compact(&o, d)
-			if err != nil {
-				return nil, err
+// sendBatch stamps a decoded batch and queues it for the writer, returning
+// false if the writer stopped first.  Time spent waiting on a full queue
+// doesn't count as the stream being idle.  Records are shed here while over
+// Memory-Soft-Limit, before they take up any more room.  Backfilled records
+// were logged while we weren't running so they keep the time they were
+// logged, falling back to now if it doesn't parse.
+func sendBatch(dec *decoder, ents []*entry.Entry, tag entry.EntryTag, src *sourceTracker, batches chan<- []*entry.Entry, stop <-chan struct{}) bool {
+	stats.read(ents)
+	if ents = memGuard.shed(ents); len(ents) == 0 {
+		putBatch(ents)
+		return true
+	}
+	ip := src.get()
+	for _, v := range ents {
+		v.SRC = ip
+		v.TS = entry.Now()
+		if dec.backlog {
+			if ts, ok := recordTime(v.Data); ok {
+				v.TS = entry.FromStandard(ts)
 			}
-			ents = append(ents, &entry.Entry{
-				Data: o.Bytes(),
-			})
 		}
+		v.Tag = tag
+	}
+	stats.queued(ents)
+	dec.hold()
+	defer dec.release()
+	select {
+	case batches <- ents:
+		return true
+	case <-stop:
+		stats.dequeued(ents)
+		return false
+	}
+}
 
-		buf = e[len(e)-1]
-		break
+// waitGroupContext waits for the group, returning false if the context
+// expired first.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	return ents, nil
+// deadline returns the context deadline, or now if it has none.
+func deadline(ctx context.Context) time.Time {
+	if dl, ok := ctx.Deadline(); ok {
+		return dl
+	}
+	return time.Now()
 }
@@ -0,0 +1,333 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultMDMTag      = `macos-mdm`
+	defaultMDMInterval = `1h`
+	mdmStreamName      = `mdm`
+	computerLevelOwner = `_computerlevel`
+)
+
+// the records of mdmclient, the profiles tool, and cloudconfigurationd,
+// which handles DEP enrollment, and of the managed client subsystems
+const mdmPredicate = `process == "mdmclient" OR process == "profiles" OR process == "cloudconfigurationd" OR ` +
+	`subsystem BEGINSWITH "com.apple.ManagedClient" OR subsystem BEGINSWITH "com.apple.ManagedConfiguration"`
+
+var (
+	// "_computerlevel[1] attribute: profileIdentifier: com.acme.wifi"
+	profileAttrRegex = regexp.MustCompile(`^(\S+)\[([0-9]+)\] attribute: (\w+): ?(.*)$`)
+
+	// "_computerlevel[1]      payload[1] type  = com.apple.wifi.managed"
+	profilePayloadRegex = regexp.MustCompile(`^(\S+)\[([0-9]+)\]\s+payload\[([0-9]+)\] (\w+)\s*= ?(.*)$`)
+)
+
+// mdmConfig is the [MDM] block, it turns on a stream of the device
+// management records and takes snapshots of the enrollment and the
+// installed profiles.
+type mdmConfig struct {
+	Enable   bool
+	Tag_Name string
+	Interval string // how often the enrollment and profiles are listed
+}
+
+func (mc *mdmConfig) verify() error {
+	if !mc.Enable {
+		return nil
+	}
+	if mc.Tag_Name == `` {
+		mc.Tag_Name = defaultMDMTag
+	}
+	if mc.Interval == `` {
+		mc.Interval = defaultMDMInterval
+	}
+	if _, err := (snapshotConfig{Interval: mc.Interval}).interval(); err != nil {
+		return fmt.Errorf("MDM: %v", err)
+	}
+	return nil
+}
+
+// mdmEnrollment is the profiles status -type enrollment output.
+type mdmEnrollment struct {
+	DEPEnrolled  bool   `json:"dep_enrolled"`
+	MDMEnrolled  bool   `json:"mdm_enrolled"`
+	UserApproved bool   `json:"user_approved"`
+	Server       string `json:"server,omitempty"`
+}
+
+type profilePayload struct {
+	Type       string `json:"type,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+	Name       string `json:"name,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+}
+
+// profileInfo is an installed configuration profile.
+type profileInfo struct {
+	Scope             string           `json:"scope"`          // computer or user
+	User              string           `json:"user,omitempty"` // the user a user profile is installed for
+	Identifier        string           `json:"identifier"`
+	Name              string           `json:"name,omitempty"`
+	UUID              string           `json:"uuid,omitempty"`
+	Organization      string           `json:"organization,omitempty"`
+	ProfileType       string           `json:"profile_type,omitempty"`
+	Version           string           `json:"version,omitempty"`
+	InstallDate       string           `json:"install_date,omitempty"`
+	RemovalDisallowed bool             `json:"removal_disallowed,omitempty"`
+	Payloads          []profilePayload `json:"payloads,omitempty"`
+}
+
+func (pi profileInfo) key() string {
+	return pi.User + "\x00" + pi.Identifier
+}
+
+type mdmSnapshot struct {
+	Type       string         `json:"type"`
+	Enrollment *mdmEnrollment `json:"enrollment,omitempty"`
+	Profiles   []profileInfo  `json:"profiles"`
+}
+
+// profileChange is written when the installed profiles differ from the
+// last snapshot.
+type profileChange struct {
+	Type   string `json:"type"`
+	Change string `json:"change"` // installed, removed, or updated
+	profileInfo
+	PreviousUUID string `json:"previous_uuid,omitempty"`
+}
+
+// mdmCollector lists the enrollment and installed profiles every
+// interval, writing a snapshot and an entry for each profile change.  The
+// first snapshot after a start is the baseline.
+type mdmCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	src      *sourceTracker
+	last     map[string]profileInfo
+}
+
+func startMDMCollector(ctx context.Context, wg *sync.WaitGroup, cfg mdmConfig, src *sourceTracker) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve MDM tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	mc := &mdmCollector{
+		tag:      tag,
+		interval: interval,
+		src:      src,
+	}
+	wg.Add(1)
+	go mc.run(ctx, wg)
+	return nil
+}
+
+func (mc *mdmCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(mc.interval)
+	defer tckr.Stop()
+	for {
+		if err := mc.snapshot(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to take MDM snapshot: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (mc *mdmCollector) snapshot(ctx context.Context) error {
+	snap := mdmSnapshot{Type: `mdm_snapshot`}
+	out, err := exec.CommandContext(ctx, "profiles", "status", "-type", "enrollment").Output()
+	if ctx.Err() != nil {
+		return context.Canceled
+	} else if err != nil {
+		lg.Warn("Failed to get MDM enrollment status: %v\n", err)
+	} else {
+		en := parseEnrollmentStatus(string(out))
+		snap.Enrollment = &en
+	}
+	if out, err = exec.CommandContext(ctx, "profiles", "show", "-all").Output(); ctx.Err() != nil {
+		return context.Canceled
+	} else if err != nil {
+		// without the profiles there is nothing to compare
+		lg.Warn("Failed to list configuration profiles: %v\n", err)
+		return emitJSON(ctx, mc.tag, mc.src, time.Now(), snap)
+	}
+	snap.Profiles = parseProfilesShow(string(out))
+	now := time.Now()
+	cur := map[string]profileInfo{}
+	for _, pi := range snap.Profiles {
+		cur[pi.key()] = pi
+	}
+	if mc.last != nil {
+		for _, ch := range diffProfiles(mc.last, cur) {
+			if err := emitJSON(ctx, mc.tag, mc.src, now, ch); err != nil {
+				return err
+			}
+		}
+	}
+	mc.last = cur
+	return emitJSON(ctx, mc.tag, mc.src, now, snap)
+}
+
+func diffProfiles(prev, cur map[string]profileInfo) (changes []profileChange) {
+	keys := map[string]bool{}
+	for k := range prev {
+		keys[k] = true
+	}
+	for k := range cur {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		old, had := prev[k]
+		now, has := cur[k]
+		switch {
+		case !had:
+			changes = append(changes, profileChange{Type: `profile_change`, Change: `installed`, profileInfo: now})
+		case !has:
+			changes = append(changes, profileChange{Type: `profile_change`, Change: `removed`, profileInfo: old})
+		case old.UUID != now.UUID || old.Version != now.Version || old.InstallDate != now.InstallDate:
+			changes = append(changes, profileChange{Type: `profile_change`, Change: `updated`, profileInfo: now, PreviousUUID: old.UUID})
+		}
+	}
+	return
+}
+
+// parseEnrollmentStatus reads profiles status -type enrollment output,
+// "Enrolled via DEP: Yes" and "MDM enrollment: Yes (User Approved)".
+func parseEnrollmentStatus(out string) (en mdmEnrollment) {
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		yes := strings.HasPrefix(strings.ToLower(v), `yes`)
+		switch strings.ToLower(k) {
+		case `enrolled via dep`:
+			en.DEPEnrolled = yes
+		case `mdm enrollment`:
+			en.MDMEnrolled = yes
+			en.UserApproved = yes && strings.Contains(strings.ToLower(v), `user approved`)
+		case `mdm server`:
+			en.Server = v
+		}
+	}
+	return
+}
+
+// parseProfilesShow reads profiles show -all output, where every line is
+// prefixed with the owner and the profile's index, _computerlevel for
+// the profiles installed for the whole computer.
+func parseProfilesShow(out string) (profiles []profileInfo) {
+	index := map[string]int{} // owner and index to position in profiles
+	payloads := map[string]map[int]*profilePayload{}
+	get := func(owner, n string) *profileInfo {
+		k := owner + "[" + n + "]"
+		if i, ok := index[k]; ok {
+			return &profiles[i]
+		}
+		pi := profileInfo{Scope: `user`, User: owner}
+		if owner == computerLevelOwner {
+			pi.Scope, pi.User = `computer`, ``
+		}
+		index[k] = len(profiles)
+		profiles = append(profiles, pi)
+		payloads[k] = map[int]*profilePayload{}
+		return &profiles[len(profiles)-1]
+	}
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if m := profileAttrRegex.FindStringSubmatch(line); m != nil {
+			pi, v := get(m[1], m[2]), strings.TrimSpace(m[4])
+			switch m[3] {
+			case `profileIdentifier`:
+				pi.Identifier = v
+			case `name`:
+				pi.Name = v
+			case `profileUUID`:
+				pi.UUID = v
+			case `organization`:
+				pi.Organization = v
+			case `profileType`:
+				pi.ProfileType = v
+			case `version`:
+				pi.Version = v
+			case `installationDate`:
+				pi.InstallDate = v
+			case `removalDisallowed`:
+				pi.RemovalDisallowed = strings.EqualFold(v, `true`)
+			}
+		} else if m := profilePayloadRegex.FindStringSubmatch(line); m != nil {
+			get(m[1], m[2])
+			n, _ := strconv.Atoi(m[3])
+			k := m[1] + "[" + m[2] + "]"
+			pp, ok := payloads[k][n]
+			if !ok {
+				pp = &profilePayload{}
+				payloads[k][n] = pp
+			}
+			v := strings.TrimSpace(m[5])
+			switch m[4] {
+			case `type`:
+				pp.Type = v
+			case `identifier`:
+				pp.Identifier = v
+			case `name`:
+				pp.Name = v
+			case `uuid`:
+				pp.UUID = v
+			}
+		}
+	}
+	// payloads in the order they were numbered
+	for k, i := range index {
+		nums := make([]int, 0, len(payloads[k]))
+		for n := range payloads[k] {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		for _, n := range nums {
+			profiles[i].Payloads = append(profiles[i].Payloads, *payloads[k][n])
+		}
+	}
+	return
+}
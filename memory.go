@@ -0,0 +1,197 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	memoryCheckInterval = time.Second
+	memoryShedDrop      = `drop`
+	memoryShedPause     = `pause`
+)
+
+var (
+	// memGuard enforces Memory-Soft-Limit, nil when there is no limit
+	memGuard *memoryGuard
+
+	// compacted records that are kept while shedding
+	shedKeep = [][]byte{
+		[]byte(`"messageType":"Error"`),
+		[]byte(`"messageType":"Fault"`),
+	}
+)
+
+// memoryUsage is the memory held by entries on their way through the
+// ingester, the heap figure covers everything else too.
+type memoryUsage struct {
+	DecodeBuffers int64  `json:"decode_buffer_bytes"` // record data buffered by decoders
+	DecodeQueue   int64  `json:"decode_queue_bytes"`  // decoded batches waiting for the writer
+	Batched       int64  `json:"batch_bytes"`         // entries gathered into the next write
+	RetryQueue    int64  `json:"retry_queue_bytes"`   // entries waiting to be retried
+	Heap          uint64 `json:"heap_inuse_bytes"`    // Go heap in use
+}
+
+// tracked is the total the soft limit applies to.
+func (mu memoryUsage) tracked() int64 {
+	return mu.DecodeBuffers + mu.DecodeQueue + mu.Batched + mu.RetryQueue
+}
+
+func currentMemoryUsage(pl *pipeline) (mu memoryUsage) {
+	mu.DecodeBuffers = atomic.LoadInt64(&stats.decodeBytes)
+	mu.DecodeQueue = atomic.LoadInt64(&stats.decodeQueueBytes)
+	mu.Batched = atomic.LoadInt64(&stats.batchedBytes)
+	queued, _ := pl.out.depth()
+	mu.RetryQueue = int64(queued)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mu.Heap = ms.HeapInuse
+	return
+}
+
+// memoryGuard sheds load once the tracked memory passes the soft limit,
+// either by dropping everything but Error and Fault records as they are
+// decoded or by pausing reads so log buffers them instead.  Shedding stops
+// once usage falls back under 90% of the limit.  The limit is soft, the
+// usage is sampled and entries already in flight aren't touched.
+type memoryGuard struct {
+	limit int64
+	mode  string
+	pl    *pipeline
+
+	sync.Mutex
+	resume chan struct{} // closed when shedding stops, nil while not shedding
+}
+
+func newMemoryGuard(limitMB int, mode string, pl *pipeline) (*memoryGuard, error) {
+	if limitMB <= 0 {
+		return nil, nil
+	}
+	mode = strings.ToLower(mode)
+	switch mode {
+	case ``:
+		mode = memoryShedDrop
+	case memoryShedDrop, memoryShedPause:
+	default:
+		return nil, fmt.Errorf("Invalid Memory-Shed-Mode %q, expected drop or pause", mode)
+	}
+	return &memoryGuard{
+		limit: int64(limitMB) * 1024 * 1024,
+		mode:  mode,
+		pl:    pl,
+	}, nil
+}
+
+func (mg *memoryGuard) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(memoryCheckInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			mg.set(false)
+			return
+		case <-tckr.C:
+			mg.check(currentMemoryUsage(mg.pl))
+		}
+	}
+}
+
+func (mg *memoryGuard) check(mu memoryUsage) {
+	used := mu.tracked()
+	if shedding := mg.shedding(); !shedding && used > mg.limit {
+		lg.Warn("Holding %s of entries, above the %s Memory-Soft-Limit, shedding load (%s)\n", humanBytes(used), humanBytes(mg.limit), mg.mode)
+		mg.set(true)
+		// hand what the spike left behind back to the OS
+		debug.FreeOSMemory()
+	} else if shedding && used < mg.limit/10*9 {
+		lg.Info("Holding %s of entries, no longer shedding load\n", humanBytes(used))
+		mg.set(false)
+	}
+}
+
+func (mg *memoryGuard) set(shed bool) {
+	mg.Lock()
+	defer mg.Unlock()
+	if shed && mg.resume == nil {
+		mg.resume = make(chan struct{})
+		atomic.StoreInt32(&stats.shedding, 1)
+	} else if !shed && mg.resume != nil {
+		close(mg.resume)
+		mg.resume = nil
+		atomic.StoreInt32(&stats.shedding, 0)
+	}
+}
+
+func (mg *memoryGuard) shedding() bool {
+	if mg == nil {
+		return false
+	}
+	return atomic.LoadInt32(&stats.shedding) != 0
+}
+
+// pause blocks a decoder while the guard is shedding by pausing, returning
+// false if stop closed first.
+func (mg *memoryGuard) pause(dec *decoder, stop <-chan struct{}) bool {
+	if mg == nil || mg.mode != memoryShedPause {
+		return true
+	}
+	mg.Lock()
+	resume := mg.resume
+	mg.Unlock()
+	if resume == nil {
+		return true
+	}
+	dec.hold()
+	defer dec.release()
+	select {
+	case <-resume:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// shed drops everything but Error and Fault records from a decoded batch
+// while the guard is shedding by dropping.
+func (mg *memoryGuard) shed(ents []*entry.Entry) []*entry.Entry {
+	if mg == nil || mg.mode != memoryShedDrop || !mg.shedding() {
+		return ents
+	}
+	out := ents[:0]
+	for _, ent := range ents {
+		if keepWhileShedding(ent.Data) {
+			out = append(out, ent)
+		} else {
+			putEntry(ent)
+		}
+	}
+	stats.shed(len(ents) - len(out))
+	return out
+}
+
+func keepWhileShedding(b []byte) bool {
+	for _, k := range shedKeep {
+		if bytes.Contains(b, k) {
+			return true
+		}
+	}
+	return false
+}
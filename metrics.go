@@ -0,0 +1,127 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	metricsPrefix     = `gravwell_macoslog_`
+	httpServerTimeout = 10 * time.Second
+)
+
+// startHTTPServer serves the ingester's HTTP endpoints on addr until the
+// context is cancelled.
+func startHTTPServer(ctx context.Context, wg *sync.WaitGroup, network, addr string, h http.Handler) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:      h,
+		ReadTimeout:  httpServerTimeout,
+		WriteTimeout: httpServerTimeout,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			lg.Error("HTTP server on %s failed: %v\n", addr, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	return nil
+}
+
+// metricsHandler exposes the ingester statistics in the Prometheus text
+// exposition format.
+func metricsHandler(pl *pipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ss := stats.snapshot()
+		queued, spooled := pl.out.depth()
+		var hot int
+		if h, err := igst.Hot(); err == nil {
+			hot = h
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		counter := func(name, help string, v uint64) {
+			fmt.Fprintf(bw, "# HELP %s%s %s\n# TYPE %s%s counter\n%s%s %d\n", metricsPrefix, name, help, metricsPrefix, name, metricsPrefix, name, v)
+		}
+		gauge := func(name, help string, v float64) {
+			fmt.Fprintf(bw, "# HELP %s%s %s\n# TYPE %s%s gauge\n%s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, metricsPrefix, name, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		counter(`entries_read_total`, `Entries read from log children.`, ss.EntriesRead)
+		counter(`bytes_read_total`, `Bytes of entry data read from log children.`, ss.BytesRead)
+		counter(`entries_ingested_total`, `Entries written to the ingest muxer.`, ss.EntriesIngested)
+		counter(`bytes_ingested_total`, `Bytes of entry data written to the ingest muxer.`, ss.BytesIngested)
+		counter(`parse_errors_total`, `Records that could not be decoded.`, ss.ParseErrors)
+		counter(`batch_failures_total`, `Failed attempts to write a batch of entries.`, ss.BatchFailures)
+		counter(`child_restarts_total`, `Times the log stream child exited or failed to start.`, ss.Restarts)
+		fmt.Fprintf(bw, "# HELP %sthrottled_seconds_total Time writes waited on Rate-Limit-EPS.\n# TYPE %sthrottled_seconds_total counter\n%sthrottled_seconds_total %s\n",
+			metricsPrefix, metricsPrefix, metricsPrefix, strconv.FormatFloat(ss.Throttled.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "# HELP %sbacklog_paced_seconds_total Time backlog writes waited on Backlog-Rate-EPS.\n# TYPE %sbacklog_paced_seconds_total counter\n%sbacklog_paced_seconds_total %s\n",
+			metricsPrefix, metricsPrefix, metricsPrefix, strconv.FormatFloat(ss.Paced.Seconds(), 'g', -1, 64))
+		if ss.BacklogEPS > 0 {
+			gauge(`backlog_rate_eps`, `Entries per second backlogs are currently flushed at.`, float64(ss.BacklogEPS))
+		}
+		gauge(`retry_queue_bytes`, `Bytes of entries waiting to be retried.`, float64(queued))
+		gauge(`spool_bytes`, `Bytes of entries in the on disk spool.`, float64(spooled))
+		gauge(`decode_queue_batches`, `Batches decoded and waiting to be written.`, float64(ss.DecodeQueue))
+		mu := currentMemoryUsage(pl)
+		gauge(`memory_decode_buffer_bytes`, `Bytes held by decoder buffers.`, float64(mu.DecodeBuffers))
+		gauge(`memory_decode_queue_bytes`, `Bytes of decoded entries waiting to be written.`, float64(mu.DecodeQueue))
+		gauge(`memory_batch_bytes`, `Bytes of entries gathered into the next write.`, float64(mu.Batched))
+		gauge(`memory_tracked_bytes`, `Bytes of entries held in memory, what Memory-Soft-Limit applies to.`, float64(mu.tracked()))
+		gauge(`memory_heap_inuse_bytes`, `Bytes of Go heap in use.`, float64(mu.Heap))
+		if memGuard != nil {
+			gauge(`memory_soft_limit_bytes`, `Memory-Soft-Limit in bytes.`, float64(memGuard.limit))
+		}
+		shedding := 0.0
+		if ss.Shedding {
+			shedding = 1
+		}
+		gauge(`memory_shedding`, `1 while over Memory-Soft-Limit and shedding load.`, shedding)
+		counter(`shed_entries_total`, `Entries dropped while over Memory-Soft-Limit.`, ss.Shed)
+		counter(`spool_dropped_total`, `Spooled records too large to forward.`, ss.SpoolDropped)
+		counter(`compression_sampled_bytes_total`, `Bytes of batches sampled to estimate the compression ratio.`, ss.SampledRaw)
+		counter(`compression_sampled_compressed_bytes_total`, `What the sampled batches compressed to.`, ss.SampledDeflated)
+		if ss.SampledDeflated > 0 {
+			gauge(`compression_ratio`, `Estimated ratio of raw to compressed entry data.`, float64(ss.SampledRaw)/float64(ss.SampledDeflated))
+		}
+		gauge(`hot_connections`, `Connected indexers.`, float64(hot))
+		if !ss.LastEntry.IsZero() {
+			gauge(`last_entry_timestamp_seconds`, `Unix time the last entry was read.`, float64(ss.LastEntry.UnixNano())/1e9)
+		}
+		gauge(`start_timestamp_seconds`, `Unix time the ingester started.`, float64(ss.Start.UnixNano())/1e9)
+
+		name := metricsPrefix + `ingest_latency_seconds`
+		fmt.Fprintf(bw, "# HELP %s Time from reading an entry to writing it to the ingest muxer.\n# TYPE %s histogram\n", name, name)
+		var cum uint64
+		for i, b := range latencyBounds {
+			cum += ss.LatencyBuckets[i]
+			fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, ss.LatencyCount)
+		fmt.Fprintf(bw, "%s_sum %s\n", name, strconv.FormatFloat(ss.LatencySeconds, 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count %d\n", name, ss.LatencyCount)
+		bw.Flush()
+	}
+}
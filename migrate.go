@@ -0,0 +1,102 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"github.com/gravwell/gravwell/v3/ingest/config"
+)
+
+var (
+	streamSectionRegex  = regexp.MustCompile(`(?mi)^\s*\[\s*stream\s+"`)
+	anySectionRegex     = regexp.MustCompile(`(?m)^\s*\[`)
+	predicateLineRegex  = regexp.MustCompile(`(?mi)^[ \t]*Predicate[ \t]*=.*$`)
+	errAlreadyMigrated  = errors.New("the config already uses Stream blocks")
+	migratedStreamBlock = "\n[Stream \"" + defaultStreamName + "\"]\n" +
+		"# migrated from the single stream options in Global, Tag-Name defaults to the Global Tag-Name\n"
+)
+
+// migrateConfig rewrites a single stream config into the Stream block
+// form.  The Global Predicate moves into a Stream block along with any
+// comment on its line, everything else including comments is left as it
+// was.  The original is kept alongside as path.bak.
+func migrateConfig(w io.Writer, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	nb, err := migrateConfigBytes(b)
+	if err != nil {
+		return err
+	}
+	var c cfgType
+	if err = config.LoadConfigBytes(&c, nb); err != nil {
+		return fmt.Errorf("migrated config does not parse: %v", err)
+	}
+	if err = verifyConfig(&c); err != nil {
+		return fmt.Errorf("migrated config is invalid: %v", err)
+	}
+	if err = writeFileAtomic(path+`.bak`, b, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(path, nb, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Migrated %s, the original was saved to %s.bak\n", path, path)
+	return nil
+}
+
+func migrateConfigBytes(b []byte) ([]byte, error) {
+	if streamSectionRegex.Match(b) {
+		return nil, errAlreadyMigrated
+	}
+	gloc := globalSectionRegex.FindIndex(b)
+	if gloc == nil {
+		return nil, errors.New("Failed to find the Global section")
+	}
+	// the Global section runs to the next section header
+	gend := len(b)
+	if loc := anySectionRegex.FindIndex(b[gloc[1]:]); loc != nil {
+		gend = gloc[1] + loc[0]
+	}
+	var block bytes.Buffer
+	block.WriteString(migratedStreamBlock)
+	global := b[gloc[1]:gend]
+	if loc := predicateLineRegex.FindIndex(global); loc != nil {
+		block.WriteByte('\t')
+		block.Write(bytes.TrimSpace(global[loc[0]:loc[1]]))
+		block.WriteByte('\n')
+		// drop the line along with its newline
+		end := loc[1]
+		if end < len(global) && global[end] == '\n' {
+			end++
+		}
+		global = append(global[:loc[0]:loc[0]], global[end:]...)
+	}
+	var nb bytes.Buffer
+	nb.Write(b[:gloc[1]])
+	nb.Write(global)
+	nb.Write(b[gend:])
+	if nb.Len() > 0 && nb.Bytes()[nb.Len()-1] != '\n' {
+		nb.WriteByte('\n')
+	}
+	nb.Write(block.Bytes())
+	return nb.Bytes(), nil
+}
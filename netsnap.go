@@ -0,0 +1,151 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	defaultNetworkTag      = `macos-network`
+	defaultNetworkInterval = `5m`
+)
+
+type netInterface struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac,omitempty"`
+	MTU       int      `json:"mtu"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+type netRoute struct {
+	Gateway   string `json:"gateway"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// netSnapshot describes the network identity of the host at a point in time.
+type netSnapshot struct {
+	Type           string         `json:"type"`
+	Hostname       string         `json:"hostname"`
+	Interfaces     []netInterface `json:"interfaces"`
+	DefaultRoutes  []netRoute     `json:"defaultRoutes,omitempty"`
+	DNSServers     []string       `json:"dnsServers,omitempty"`
+	SearchDomains  []string       `json:"searchDomains,omitempty"`
+	PrimaryAddress string         `json:"primaryAddress,omitempty"`
+}
+
+func networkSnapshot(ctx context.Context) (interface{}, error) {
+	ns := netSnapshot{
+		Type: `network`,
+	}
+	ns.Hostname, _ = os.Hostname()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifc := range ifaces {
+		ni := netInterface{
+			Name: ifc.Name,
+			MAC:  ifc.HardwareAddr.String(),
+			MTU:  ifc.MTU,
+			Up:   ifc.Flags&net.FlagUp != 0,
+		}
+		if addrs, err := ifc.Addrs(); err == nil {
+			for _, a := range addrs {
+				ni.Addresses = append(ni.Addresses, a.String())
+			}
+		}
+		ns.Interfaces = append(ns.Interfaces, ni)
+	}
+	for _, fam := range []string{`-inet`, `-inet6`} {
+		if r, ok := defaultRoute(ctx, fam); ok {
+			ns.DefaultRoutes = append(ns.DefaultRoutes, r)
+		}
+	}
+	ns.DNSServers, ns.SearchDomains = dnsConfig(ctx)
+	if ip, err := primaryAddr(); err == nil {
+		ns.PrimaryAddress = ip.String()
+	}
+	return ns, nil
+}
+
+// defaultRoute asks route(8) for the default route of an address family.
+func defaultRoute(ctx context.Context, family string) (r netRoute, ok bool) {
+	out, err := exec.CommandContext(ctx, "route", "-n", "get", family, "default").Output()
+	if err != nil {
+		return
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		k, v := splitKV(sc.Text(), ":")
+		switch k {
+		case `gateway`:
+			r.Gateway = v
+		case `interface`:
+			r.Interface = v
+		}
+	}
+	ok = r.Gateway != ``
+	return
+}
+
+// dnsConfig returns the resolvers and search domains, scutil is used because
+// resolv.conf on macOS does not reflect scoped or VPN supplied resolvers.
+func dnsConfig(ctx context.Context) (servers, domains []string) {
+	out, err := exec.CommandContext(ctx, "scutil", "--dns").Output()
+	if err != nil {
+		if out, err = os.ReadFile(`/etc/resolv.conf`); err != nil {
+			return
+		}
+	}
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		ln := strings.TrimSpace(sc.Text())
+		var k, v string
+		if strings.HasPrefix(ln, `nameserver `) || strings.HasPrefix(ln, `search `) {
+			// resolv.conf format
+			flds := strings.Fields(ln)
+			k, v = flds[0], strings.Join(flds[1:], " ")
+		} else {
+			k, v = splitKV(ln, ":")
+		}
+		switch {
+		case strings.HasPrefix(k, `nameserver`):
+			if !seen[v] {
+				seen[v] = true
+				servers = append(servers, v)
+			}
+		case strings.HasPrefix(k, `search`):
+			for _, d := range strings.Fields(v) {
+				if !seen[d] {
+					seen[d] = true
+					domains = append(domains, d)
+				}
+			}
+		}
+	}
+	return
+}
+
+// splitKV splits a "key <sep> value" line and trims both halves.
+func splitKV(ln, sep string) (k, v string) {
+	idx := strings.Index(ln, sep)
+	if idx < 0 {
+		return strings.TrimSpace(ln), ``
+	}
+	return strings.TrimSpace(ln[:idx]), strings.TrimSpace(ln[idx+len(sep):])
+}
@@ -0,0 +1,415 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultPanicTag      = `macos-panic`
+	defaultPanicInterval = `5m`
+	defaultPanicStore    = `/opt/gravwell/etc/macosLog.panics`
+	defaultPanicMaxAge   = 30 * 24 * time.Hour
+	nvramPanicVar        = `aapl,panic-info`
+	nvramPanicKey        = `nvram:` + nvramPanicVar // the processed store key for the NVRAM copy
+)
+
+// "panic(cpu 0 caller 0xffffff8012345678): message"
+var panicLineRegex = regexp.MustCompile(`panic\(cpu ([0-9]+) caller (0x[0-9a-fA-F]+)\): ?(.*)`)
+
+// "Panicked task 0xffffff8012345678: 2 threads: pid 0: kernel_task"
+var panickedTaskRegex = regexp.MustCompile(`pid ([0-9]+): (.+)$`)
+
+// panicConfig is the [Kernel-Panics] block.
+type panicConfig struct {
+	Enable          bool
+	Tag_Name        string
+	Interval        string   // how often the report directories and NVRAM are checked
+	Directory       []string // scanned as well as /Library/Logs/DiagnosticReports
+	Max_Age         string   // panics older than this when first found are skipped
+	Check_NVRAM     bool     // also read panic data the firmware has not written out to a report yet
+	Max_Report_Size int      // KB of panic text included, longer text is left out
+	Store_Location  string   // file the processed panics are tracked in
+}
+
+func (pc *panicConfig) verify() error {
+	if !pc.Enable {
+		return nil
+	}
+	if pc.Tag_Name == `` {
+		pc.Tag_Name = defaultPanicTag
+	}
+	if pc.Interval == `` {
+		pc.Interval = defaultPanicInterval
+	}
+	if _, err := (snapshotConfig{Interval: pc.Interval}).interval(); err != nil {
+		return fmt.Errorf("Kernel-Panics: %v", err)
+	}
+	if _, err := pc.maxAge(); err != nil {
+		return err
+	}
+	if pc.Max_Report_Size < 0 {
+		return fmt.Errorf("Kernel-Panics: Invalid Max-Report-Size %d", pc.Max_Report_Size)
+	}
+	return nil
+}
+
+func (pc panicConfig) maxAge() (time.Duration, error) {
+	if pc.Max_Age == `` {
+		return defaultPanicMaxAge, nil
+	}
+	d, err := time.ParseDuration(pc.Max_Age)
+	if err != nil {
+		return 0, fmt.Errorf("Kernel-Panics: Invalid Max-Age %q: %v", pc.Max_Age, err)
+	}
+	return d, nil
+}
+
+func (pc panicConfig) storeLocation() string {
+	if pc.Store_Location == `` {
+		return defaultPanicStore
+	}
+	return pc.Store_Location
+}
+
+// panicReport is the entry written for each kernel panic, whether it came
+// from a .panic report or straight from NVRAM.
+type panicReport struct {
+	Type      string   `json:"type"`
+	Source    string   `json:"source"` // report or nvram
+	File      string   `json:"file,omitempty"`
+	BugType   string   `json:"bug_type,omitempty"`
+	Timestamp string   `json:"timestamp,omitempty"`
+	OSVersion string   `json:"os_version,omitempty"`
+	Build     string   `json:"build,omitempty"`
+	Product   string   `json:"product,omitempty"`
+	Incident  string   `json:"incident_id,omitempty"`
+	Kernel    string   `json:"kernel_version,omitempty"`
+	CPU       *int     `json:"cpu,omitempty"`
+	Caller    string   `json:"caller,omitempty"`
+	Message   string   `json:"message,omitempty"` // the panic message, the rest of the panic line
+	Process   string   `json:"process,omitempty"` // the process running when the kernel panicked
+	PID       *int     `json:"pid,omitempty"`
+	Uptime    float64  `json:"uptime_seconds,omitempty"`
+	Kexts     []string `json:"kexts,omitempty"` // kernel extensions in the backtrace
+	Text      string   `json:"text,omitempty"`
+	Truncated bool     `json:"truncated,omitempty"` // the text was over Max-Report-Size and left out
+}
+
+// panicBody holds the fields of interest from the JSON body of newer
+// .panic reports, the panic text itself is in one of the strings.
+type panicBody struct {
+	Build          string `json:"build"`
+	Product        string `json:"product"`
+	PanicString    string `json:"panicString"`
+	MacOSPanicText string `json:"macOSPanicString"` // Intel Macs with a T2, the bridge OS panic is in panicString
+}
+
+// panicCollector ingests kernel panics once each, from the reports the
+// system writes at the next boot and, optionally, from NVRAM.
+type panicCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	maxAge   time.Duration
+	maxText  int
+	dirs     []string
+	nvram    bool
+	src      *sourceTracker
+	done     *processedFiles
+}
+
+func startPanicCollector(ctx context.Context, wg *sync.WaitGroup, cfg panicConfig, src *sourceTracker, ephemeral bool) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve kernel panic tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	maxAge, err := cfg.maxAge()
+	if err != nil {
+		return err
+	}
+	pc := &panicCollector{
+		tag:      tag,
+		interval: interval,
+		maxAge:   maxAge,
+		maxText:  defaultMaxReportKB * 1024,
+		dirs:     append([]string{systemReportsDir}, cfg.Directory...),
+		nvram:    cfg.Check_NVRAM,
+		src:      src,
+		done:     loadProcessedFiles(cfg.storeLocation(), ephemeral),
+	}
+	if cfg.Max_Report_Size > 0 {
+		pc.maxText = cfg.Max_Report_Size * 1024
+	}
+	wg.Add(1)
+	go pc.run(ctx, wg)
+	return nil
+}
+
+func (pc *panicCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(pc.interval)
+	defer tckr.Stop()
+	for {
+		if err := pc.scan(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to ingest kernel panics: %v\n", err)
+		}
+		if err := pc.done.persist(); err != nil {
+			lg.Warn("Failed to save processed panics: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (pc *panicCollector) scan(ctx context.Context) error {
+	now := time.Now()
+	present := map[string]bool{}
+	for _, dir := range pc.dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				lg.Debug("Failed to read %s: %v\n", dir, err)
+			}
+			continue
+		}
+		for _, fi := range fis {
+			if filepath.Ext(fi.Name()) != `.panic` || !fi.Mode().IsRegular() {
+				continue
+			}
+			p := filepath.Join(dir, fi.Name())
+			present[p] = true
+			if pc.done.done(p, fi.ModTime()) || now.Sub(fi.ModTime()) < reportSettle {
+				continue
+			}
+			if pc.maxAge <= 0 || now.Sub(fi.ModTime()) <= pc.maxAge {
+				if err := pc.ingestFile(ctx, p, fi); err == context.Canceled {
+					return err
+				} else if err != nil {
+					lg.Warn("Failed to ingest panic report %s: %v\n", p, err)
+				}
+			}
+			pc.done.mark(p, fi.ModTime())
+		}
+	}
+	if pc.nvram {
+		present[nvramPanicKey] = true
+		if err := pc.checkNVRAM(ctx); err == context.Canceled {
+			return err
+		} else if err != nil {
+			lg.Warn("Failed to read panic data from NVRAM: %v\n", err)
+		}
+	}
+	pc.done.prune(present)
+	return nil
+}
+
+func (pc *panicCollector) ingestFile(ctx context.Context, p string, fi os.FileInfo) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	pr, ts := parsePanicReport(b)
+	pr.File = p
+	if ts.IsZero() {
+		ts = fi.ModTime()
+	}
+	return pc.emit(ctx, ts, pr)
+}
+
+// checkNVRAM ingests the panic the firmware is holding, if there is one
+// that hasn't been seen.  The store holds a hash of the data for it
+// rather than a modification time.
+func (pc *panicCollector) checkNVRAM(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "nvram", "-x", nvramPanicVar).Output()
+	if ctx.Err() != nil {
+		return context.Canceled
+	} else if err != nil {
+		// nvram fails when the variable isn't set, the usual case
+		return nil
+	}
+	raw, err := nvramData(out)
+	if err != nil || len(raw) == 0 {
+		return err
+	}
+	h := fnv.New64a()
+	h.Write(raw)
+	sum := time.Unix(0, int64(h.Sum64()))
+	if pc.done.done(nvramPanicKey, sum) {
+		return nil
+	}
+	pr := parsePanicText(string(bytes.TrimRight(unpackPanicInfo(raw), "\x00")))
+	pr.Source = `nvram`
+	if err := pc.emit(ctx, time.Now(), pr); err != nil {
+		return err
+	}
+	pc.done.mark(nvramPanicKey, sum)
+	return nil
+}
+
+func (pc *panicCollector) emit(ctx context.Context, ts time.Time, pr panicReport) error {
+	if len(pr.Text) > pc.maxText {
+		pr.Text, pr.Truncated = ``, true
+	}
+	return emitJSON(ctx, pc.tag, pc.src, ts, pr)
+}
+
+// nvramData pulls the value out of nvram -x output, a plist holding the
+// variable as base64 data.
+func nvramData(out []byte) ([]byte, error) {
+	start := bytes.Index(out, []byte(`<data>`))
+	end := bytes.Index(out, []byte(`</data>`))
+	if start < 0 || end < start {
+		return nil, nil
+	}
+	enc := strings.Join(strings.Fields(string(out[start+len(`<data>`):end])), ``)
+	return base64.StdEncoding.DecodeString(enc)
+}
+
+// unpackPanicInfo undoes the kernel's packing of the panic text into
+// NVRAM, 8 seven bit characters in each 7 bytes, least significant first.
+func unpackPanicInfo(b []byte) []byte {
+	out := make([]byte, 0, len(b)*8/7+8)
+	for i := 0; i < len(b); i += 7 {
+		var v uint64
+		for j := 0; j < 7 && i+j < len(b); j++ {
+			v |= uint64(b[i+j]) << (8 * uint(j))
+		}
+		n := 8
+		if rem := len(b) - i; rem < 7 {
+			n = rem * 8 / 7
+		}
+		for k := 0; k < n; k++ {
+			out = append(out, byte(v>>(7*uint(k)))&0x7f)
+		}
+	}
+	return out
+}
+
+// parsePanicReport handles a .panic report.  Current reports are a line of
+// JSON metadata followed by a JSON body holding the panic text, older
+// reports are the text alone.
+func parsePanicReport(b []byte) (pr panicReport, ts time.Time) {
+	line, rest := b, []byte(nil)
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line, rest = b[:i], b[i+1:]
+	}
+	var hdr ipsHeader
+	if json.Unmarshal(line, &hdr) != nil {
+		pr = parsePanicText(string(b))
+		pr.Source = `report`
+		return
+	}
+	var body panicBody
+	if rest = bytes.TrimSpace(rest); json.Unmarshal(rest, &body) == nil {
+		text := body.MacOSPanicText
+		if text == `` {
+			text = body.PanicString
+		}
+		pr = parsePanicText(text)
+		if body.Build != `` {
+			pr.Build = body.Build
+		}
+		pr.Product = body.Product
+	} else {
+		pr = parsePanicText(string(rest))
+	}
+	pr.Source = `report`
+	pr.BugType = strings.Trim(string(hdr.BugType), `"`)
+	pr.Timestamp, pr.OSVersion, pr.Incident = hdr.Timestamp, hdr.OSVersion, hdr.Incident
+	ts = parseReportTime(hdr.Timestamp)
+	return
+}
+
+// parsePanicText pulls the panic line, the running process, the kernel
+// version, and the kernel extensions in the backtrace out of panic text.
+func parsePanicText(text string) panicReport {
+	pr := panicReport{Type: `panic`, Text: text}
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var next *string // a field whose value is on the following line
+	var inKexts bool
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if next != nil {
+			*next, next = line, nil
+			continue
+		}
+		if inKexts {
+			if line == `` {
+				inKexts = false
+			} else if j := strings.IndexAny(line, `([@`); j > 0 {
+				pr.Kexts = append(pr.Kexts, line[:j])
+			} else {
+				pr.Kexts = append(pr.Kexts, line)
+			}
+			continue
+		}
+		switch {
+		case pr.Caller == `` && panicLineRegex.MatchString(line):
+			m := panicLineRegex.FindStringSubmatch(line)
+			if cpu, err := strconv.Atoi(m[1]); err == nil {
+				pr.CPU = &cpu
+			}
+			pr.Caller, pr.Message = m[2], strings.TrimSpace(m[3])
+		case strings.HasPrefix(line, `Panicked task`):
+			if m := panickedTaskRegex.FindStringSubmatch(line); m != nil {
+				pid, _ := strconv.Atoi(m[1])
+				pr.PID, pr.Process = &pid, m[2]
+			}
+		case strings.HasPrefix(line, `BSD process name corresponding to current thread:`):
+			if pr.Process == `` {
+				pr.Process = strings.TrimSpace(strings.TrimPrefix(line, `BSD process name corresponding to current thread:`))
+			}
+		case strings.HasPrefix(line, `Kernel version:`):
+			if pr.Kernel = strings.TrimSpace(strings.TrimPrefix(line, `Kernel version:`)); pr.Kernel == `` {
+				next = &pr.Kernel
+			}
+		case strings.HasPrefix(line, `Mac OS version:`):
+			if pr.Build == `` {
+				if pr.Build = strings.TrimSpace(strings.TrimPrefix(line, `Mac OS version:`)); pr.Build == `` {
+					next = &pr.Build
+				}
+			}
+		case strings.HasPrefix(line, `System uptime in nanoseconds:`):
+			ns, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, `System uptime in nanoseconds:`)), 10, 64)
+			pr.Uptime = float64(ns) / float64(time.Second)
+		case strings.HasPrefix(line, `Kernel Extensions in backtrace:`):
+			inKexts = true
+		}
+	}
+	return pr
+}
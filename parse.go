@@ -0,0 +1,123 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+var errStopped = errors.New("the writer stopped")
+
+// parseJob is a batch of raw records being compacted by a worker, done is
+// closed once ents or err is set.
+type parseJob struct {
+	raw  [][]byte
+	ents []*entry.Entry
+	err  error
+	done chan struct{}
+}
+
+// newParseJob copies the raw records out of the decoder buffer, which is
+// reused by the next split, into a single block.
+func newParseJob(pieces [][]byte) *parseJob {
+	var n int
+	for _, p := range pieces {
+		n += len(p)
+	}
+	block := make([]byte, 0, n)
+	raw := make([][]byte, len(pieces))
+	for i, p := range pieces {
+		block = append(block, p...)
+		raw[i] = block[len(block)-len(p):]
+	}
+	return &parseJob{raw: raw, done: make(chan struct{})}
+}
+
+// decodeParallel splits records as they are read and compacts the batches
+// on up to dec.workers goroutines, batches are handed to the writer in the
+// order they were read.  It is meant for bulk reads like backfills where
+// compaction rather than the pipe is the bottleneck.
+func decodeParallel(dec *decoder, tag entry.EntryTag, src *sourceTracker, batches chan<- []*entry.Entry, stop <-chan struct{}) error {
+	sem := make(chan struct{}, dec.workers)
+	order := make(chan *parseJob, dec.workers)
+	abort := make(chan struct{})
+	collected := make(chan error, 1)
+
+	// the collector waits on each job in turn so order is preserved
+	go func() {
+		var err error
+		for j := range order {
+			if err != nil {
+				continue // drain so the reader never blocks
+			}
+			<-j.done
+			if j.err != nil {
+				err = j.err
+				close(abort)
+				continue
+			}
+			if !sendBatch(dec, j.ents, tag, src, batches, stop) {
+				err = errStopped
+				close(abort)
+			}
+		}
+		collected <- err
+	}()
+
+	var readErr error
+	for {
+		if !memGuard.pause(dec, stop) {
+			break
+		}
+		start := time.Now()
+		pieces, err := dec.split()
+		if err != nil {
+			readErr = err
+			break
+		}
+		j := newParseJob(pieces)
+		dec.tracef("split %d records in %v, %d batches queued\n", len(pieces), time.Since(start), len(order))
+		var acquired, queued bool
+		dec.hold()
+		select {
+		case sem <- struct{}{}:
+			acquired = true
+		case <-abort:
+		}
+		if acquired {
+			select {
+			case order <- j:
+				queued = true
+			case <-abort:
+			}
+		}
+		dec.release()
+		if !queued {
+			if acquired {
+				<-sem
+			}
+			break
+		}
+		go func() {
+			j.ents, j.err = compactRecords(j.raw)
+			close(j.done)
+			<-sem
+		}()
+	}
+	close(order)
+	if err := <-collected; err == errStopped {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return readErr
+}
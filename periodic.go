@@ -0,0 +1,366 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultPeriodicTag   = `macos-periodic`
+	defaultPeriodicStore = `/opt/gravwell/etc/macosLog.periodic`
+	periodicPoll         = 10 * time.Second
+	periodicEndPrefix    = `-- End of `
+)
+
+var defaultPeriodicFiles = []string{`/var/log/daily.out`, `/var/log/weekly.out`, `/var/log/monthly.out`}
+
+// " 3:15  up 10 days,  2:03, 2 users, load averages: 1.20 1.50 1.60"
+var loadAvgRegex = regexp.MustCompile(`load averages?: ([0-9.]+),? ([0-9.]+),? ([0-9.]+)`)
+
+// periodicConfig is the [Periodic] block.
+type periodicConfig struct {
+	Enable         bool
+	Tag_Name       string
+	Log_File       []string // defaults to daily.out, weekly.out, and monthly.out in /var/log
+	Read_Existing  bool     // ingest the runs already in the files on the first start
+	Store_Location string   // file the read positions are tracked in
+}
+
+func (pc *periodicConfig) verify() error {
+	if !pc.Enable {
+		return nil
+	}
+	if pc.Tag_Name == `` {
+		pc.Tag_Name = defaultPeriodicTag
+	}
+	for _, f := range pc.Log_File {
+		if !filepath.IsAbs(f) {
+			return fmt.Errorf("Periodic: Log-File %q is not an absolute path", f)
+		}
+	}
+	return nil
+}
+
+func (pc periodicConfig) logFiles() []string {
+	if len(pc.Log_File) == 0 {
+		return defaultPeriodicFiles
+	}
+	return pc.Log_File
+}
+
+func (pc periodicConfig) storeLocation() string {
+	if pc.Store_Location == `` {
+		return defaultPeriodicStore
+	}
+	return pc.Store_Location
+}
+
+// periodicRun is the entry written for each run of a periodic script, the
+// output split into its sections with the disk, network, and load figures
+// pulled out.
+type periodicRun struct {
+	Type       string              `json:"type"`
+	Period     string              `json:"period"` // daily, weekly, or monthly
+	File       string              `json:"file"`
+	Date       string              `json:"date,omitempty"`
+	Complete   bool                `json:"complete"` // the run reached its end marker
+	Sections   []periodicSection   `json:"sections"`
+	Disks      []map[string]string `json:"disks,omitempty"`
+	Interfaces []periodicInterface `json:"interfaces,omitempty"`
+	Uptime     string              `json:"uptime,omitempty"`
+	Load       []float64           `json:"load_averages,omitempty"`
+}
+
+type periodicSection struct {
+	Title string   `json:"title"`
+	Lines []string `json:"lines,omitempty"`
+}
+
+// periodicInterface is a row of the netstat -i table in the network
+// interface status section.
+type periodicInterface struct {
+	Name    string `json:"name"`
+	MTU     int    `json:"mtu"`
+	Network string `json:"network"`
+	Address string `json:"address,omitempty"`
+	Ipkts   int64  `json:"ipkts"`
+	Ierrs   int64  `json:"ierrs"`
+	Opkts   int64  `json:"opkts"`
+	Oerrs   int64  `json:"oerrs"`
+	Coll    int64  `json:"coll"`
+}
+
+// periodicFile follows one of the output files, collecting the lines of
+// the run being written.
+type periodicFile struct {
+	ff       *fileFollower
+	period   string
+	run      []string
+	runStart followPos // where the run being collected started, resumed from after a restart
+}
+
+// periodicCollector follows the periodic script output files and ingests
+// each run once it is finished.
+type periodicCollector struct {
+	tag       entry.EntryTag
+	src       *sourceTracker
+	files     []*periodicFile
+	store     string
+	pos       map[string]followPos
+	dirty     bool
+	ephemeral bool
+}
+
+func startPeriodicCollector(ctx context.Context, wg *sync.WaitGroup, cfg periodicConfig, src *sourceTracker, ephemeral bool) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve periodic tag %q: %v", cfg.Tag_Name, err)
+	}
+	pc := &periodicCollector{
+		tag:       tag,
+		src:       src,
+		store:     cfg.storeLocation(),
+		ephemeral: ephemeral,
+		pos:       map[string]followPos{},
+	}
+	if b, err := os.ReadFile(pc.store); err == nil {
+		if err = json.Unmarshal(b, &pc.pos); err != nil {
+			lg.Warn("Ignoring unreadable periodic store %s: %v\n", pc.store, err)
+		}
+	}
+	for _, p := range cfg.logFiles() {
+		pc.files = append(pc.files, &periodicFile{
+			ff:     newFileFollower(p, pc.pos[p], !cfg.Read_Existing),
+			period: strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)),
+		})
+	}
+	wg.Add(1)
+	go pc.run(ctx, wg)
+	return nil
+}
+
+func (pc *periodicCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(periodicPoll)
+	defer tckr.Stop()
+	for {
+		for _, pf := range pc.files {
+			if err := pf.ff.poll(func(line []byte) error {
+				return pc.line(ctx, pf, string(line))
+			}); err != nil && err != context.Canceled {
+				lg.Warn("Failed to read %s: %v\n", pf.ff.path, err)
+			}
+			pos := pf.ff.position()
+			if pf.run != nil {
+				pos = pf.runStart
+			}
+			if pos != pc.pos[pf.ff.path] {
+				pc.pos[pf.ff.path], pc.dirty = pos, true
+			}
+		}
+		pc.persist()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (pc *periodicCollector) persist() {
+	if !pc.dirty || pc.ephemeral {
+		return
+	}
+	b, err := json.Marshal(pc.pos)
+	if err == nil {
+		err = writeFileAtomic(pc.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save periodic positions: %v\n", err)
+		return
+	}
+	pc.dirty = false
+}
+
+// line adds a line to the run being collected, a run starts with the date
+// and ends with "-- End of daily output --".  A run that never got its end
+// marker is sent when the next one starts.
+func (pc *periodicCollector) line(ctx context.Context, pf *periodicFile, line string) error {
+	if _, ok := periodicDate(line); ok && pf.run != nil {
+		if err := pc.flush(ctx, pf, false); err != nil {
+			return err
+		}
+	}
+	if pf.run == nil {
+		pf.runStart = pf.ff.position()
+	}
+	pf.run = append(pf.run, line)
+	if strings.HasPrefix(line, periodicEndPrefix) {
+		if err := pc.flush(ctx, pf, true); err != nil {
+			// the follower hands the marker over again
+			pf.run = pf.run[:len(pf.run)-1]
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *periodicCollector) flush(ctx context.Context, pf *periodicFile, complete bool) error {
+	pr, ts := parsePeriodicRun(pf.run)
+	pr.Period, pr.File, pr.Complete = pf.period, pf.ff.path, complete
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if err := emitJSON(ctx, pc.tag, pc.src, ts, pr); err != nil {
+		return err
+	}
+	pf.run = nil
+	return nil
+}
+
+// periodicDate parses the date line that starts a run, date's default
+// format in the local time zone.
+func periodicDate(line string) (time.Time, bool) {
+	t, err := time.ParseInLocation(time.UnixDate, strings.TrimSpace(line), time.Local)
+	return t, err == nil
+}
+
+// parsePeriodicRun splits a run into its sections, an unindented line
+// ending in a colon starts each one.
+func parsePeriodicRun(lines []string) (pr periodicRun, ts time.Time) {
+	pr = periodicRun{Type: `periodic`, Sections: []periodicSection{}}
+	var cur *periodicSection
+	for _, line := range lines {
+		if t, ok := periodicDate(line); ok && pr.Date == `` {
+			pr.Date, ts = strings.TrimSpace(line), t
+			continue
+		}
+		if strings.HasPrefix(line, periodicEndPrefix) {
+			break
+		}
+		if strings.HasSuffix(line, `:`) && !strings.HasPrefix(line, ` `) && !strings.HasPrefix(line, "\t") {
+			pr.Sections = append(pr.Sections, periodicSection{Title: strings.TrimSuffix(line, `:`)})
+			cur = &pr.Sections[len(pr.Sections)-1]
+			continue
+		}
+		if cur == nil {
+			pr.Sections = append(pr.Sections, periodicSection{})
+			cur = &pr.Sections[len(pr.Sections)-1]
+		}
+		cur.Lines = append(cur.Lines, line)
+	}
+	for _, s := range pr.Sections {
+		switch s.Title {
+		case `Disk status`:
+			pr.Disks = parseDfTable(s.Lines)
+		case `Network interface status`:
+			pr.Interfaces = parseNetstatInterfaces(s.Lines)
+		case `Local system status`:
+			for _, l := range s.Lines {
+				m := loadAvgRegex.FindStringSubmatch(l)
+				if m == nil {
+					continue
+				}
+				pr.Uptime = strings.TrimSpace(l)
+				for _, v := range m[1:] {
+					f, _ := strconv.ParseFloat(v, 64)
+					pr.Load = append(pr.Load, f)
+				}
+			}
+		}
+	}
+	return
+}
+
+// parseDfTable reads df output, "Mounted on" is the last column and takes
+// the rest of each row.
+func parseDfTable(lines []string) (disks []map[string]string) {
+	var cols []string
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if cols == nil {
+			if len(f) > 1 && f[0] == `Filesystem` {
+				for _, c := range f {
+					if c == `on` && len(cols) > 0 && cols[len(cols)-1] == `mounted` {
+						cols[len(cols)-1] = `mounted_on`
+						continue
+					}
+					cols = append(cols, strings.ToLower(strings.Replace(c, `%`, `pct_`, 1)))
+				}
+			}
+			continue
+		}
+		if len(f) < len(cols) {
+			continue
+		}
+		disk := map[string]string{}
+		for i, c := range cols[:len(cols)-1] {
+			disk[c] = f[i]
+		}
+		disk[cols[len(cols)-1]] = strings.Join(f[len(cols)-1:], ` `)
+		disks = append(disks, disk)
+	}
+	return
+}
+
+// parseNetstatInterfaces reads netstat -i output, rows without an address
+// are a column short so the counters are taken from the end.  Counters an
+// address row doesn't keep are shown as "-".
+func parseNetstatInterfaces(lines []string) (ifs []periodicInterface) {
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) < 8 || f[0] == `Name` {
+			continue
+		}
+		mtu, err := strconv.Atoi(f[1])
+		if err != nil {
+			continue
+		}
+		n := len(f)
+		var counts [5]int64
+		for i := range counts {
+			if f[n-5+i] == `-` {
+				continue
+			}
+			if counts[i], err = strconv.ParseInt(f[n-5+i], 10, 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		pi := periodicInterface{
+			Name:    f[0],
+			MTU:     mtu,
+			Network: f[2],
+			Ipkts:   counts[0],
+			Ierrs:   counts[1],
+			Opkts:   counts[2],
+			Oerrs:   counts[3],
+			Coll:    counts[4],
+		}
+		if n > 8 {
+			pi.Address = strings.Join(f[3:n-5], ` `)
+		}
+		ifs = append(ifs, pi)
+	}
+	return
+}
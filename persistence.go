@@ -0,0 +1,352 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultPersistenceTag      = `macos-persistence`
+	defaultPersistenceInterval = `1h`
+	defaultPersistenceStore    = `/opt/gravwell/etc/macosLog.persistence`
+)
+
+// persistenceLocation is a set of files that make something run at boot
+// or login.
+type persistenceLocation struct {
+	glob string
+	kind string
+}
+
+var persistenceLocations = []persistenceLocation{
+	{`/Library/LaunchDaemons/*.plist`, `launch_daemon`},
+	{`/Library/LaunchAgents/*.plist`, `launch_agent`},
+	{`/Users/*/Library/LaunchAgents/*.plist`, `user_launch_agent`},
+	// the background task management databases hold the login items
+	{`/private/var/db/com.apple.backgroundtaskmanagement/*.btm`, `login_items`},
+	{`/Users/*/Library/Application Support/com.apple.backgroundtaskmanagementagent/backgrounditems.btm`, `login_items`},
+	{`/Library/StartupItems/*/*`, `startup_item`},
+}
+
+// the sealed system volume's own jobs, only checked with Include-System
+var systemPersistenceLocations = []persistenceLocation{
+	{`/System/Library/LaunchDaemons/*.plist`, `system_launch_daemon`},
+	{`/System/Library/LaunchAgents/*.plist`, `system_launch_agent`},
+}
+
+// persistenceConfig is the [Persistence] block.
+type persistenceConfig struct {
+	Enable         bool
+	Tag_Name       string
+	Interval       string
+	Include_System bool   // also inventory /System/Library/LaunchDaemons and LaunchAgents
+	Store_Location string // file the last inventory is kept in so changes are found across restarts
+}
+
+func (pc *persistenceConfig) verify() error {
+	if !pc.Enable {
+		return nil
+	}
+	if pc.Tag_Name == `` {
+		pc.Tag_Name = defaultPersistenceTag
+	}
+	if pc.Interval == `` {
+		pc.Interval = defaultPersistenceInterval
+	}
+	if _, err := (snapshotConfig{Interval: pc.Interval}).interval(); err != nil {
+		return fmt.Errorf("Persistence: %v", err)
+	}
+	return nil
+}
+
+func (pc persistenceConfig) storeLocation() string {
+	if pc.Store_Location == `` {
+		return defaultPersistenceStore
+	}
+	return pc.Store_Location
+}
+
+// persistenceItem is a single launchd job or login item file.  The job
+// fields come from the plist when it can be read.
+type persistenceItem struct {
+	Path      string   `json:"path"`
+	Kind      string   `json:"kind"`
+	User      string   `json:"user,omitempty"` // owner of the home the item is in
+	SHA256    string   `json:"sha256"`
+	Size      int64    `json:"size"`
+	Mode      string   `json:"mode"`
+	UID       int      `json:"uid"`
+	Modified  string   `json:"modified"`
+	Label     string   `json:"label,omitempty"`
+	Program   string   `json:"program,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+	RunAtLoad bool     `json:"run_at_load,omitempty"`
+	Disabled  bool     `json:"disabled,omitempty"`
+}
+
+// identities lets a Scrub-Profile or the pseudonymizer reach the owner and
+// the paths, per user agents and login items live under the owner's home.
+func (pi *persistenceItem) identities(fn func(name string, kind int, v *string)) {
+	fn(`path`, identityPath, &pi.Path)
+	fn(`user`, identityUser, &pi.User)
+	fn(`program`, identityPath, &pi.Program)
+}
+
+// persistenceSnapshot is the full inventory, written every interval.
+type persistenceSnapshot struct {
+	Type  string            `json:"type"`
+	Count int               `json:"count"`
+	Items []persistenceItem `json:"items"`
+}
+
+// persistenceChange is written for each item added, removed, or modified
+// since the last inventory.
+type persistenceChange struct {
+	Type     string           `json:"type"`
+	Change   string           `json:"change"` // added, removed, or modified
+	Item     persistenceItem  `json:"item"`
+	Previous *persistenceItem `json:"previous,omitempty"`
+}
+
+// launchdJob holds the plist keys of interest.
+type launchdJob struct {
+	Label            string   `json:"Label"`
+	Program          string   `json:"Program"`
+	ProgramArguments []string `json:"ProgramArguments"`
+	RunAtLoad        bool     `json:"RunAtLoad"`
+	Disabled         bool     `json:"Disabled"`
+}
+
+// persistenceCollector inventories the persistence locations every
+// interval, writing the inventory and an entry for each change.  Without a
+// stored inventory the first one is only a baseline.
+type persistenceCollector struct {
+	tag       entry.EntryTag
+	interval  time.Duration
+	locations []persistenceLocation
+	src       *sourceTracker
+	store     string
+	pl        *pipeline
+	last      map[string]persistenceItem // by path, nil until there is a baseline
+}
+
+func startPersistenceCollector(ctx context.Context, wg *sync.WaitGroup, cfg persistenceConfig, src *sourceTracker, pl *pipeline) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve persistence tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	pc := &persistenceCollector{
+		tag:       tag,
+		interval:  interval,
+		locations: persistenceLocations,
+		src:       src,
+		store:     cfg.storeLocation(),
+		pl:        pl,
+	}
+	if cfg.Include_System {
+		pc.locations = append(append([]persistenceLocation{}, persistenceLocations...), systemPersistenceLocations...)
+	}
+	if b, err := os.ReadFile(pc.store); err == nil {
+		if err = json.Unmarshal(b, &pc.last); err != nil {
+			lg.Warn("Ignoring unreadable persistence store %s: %v\n", pc.store, err)
+			pc.last = nil
+		}
+	}
+	wg.Add(1)
+	go pc.run(ctx, wg)
+	return nil
+}
+
+func (pc *persistenceCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(pc.interval)
+	defer tckr.Stop()
+	for {
+		if err := pc.snapshot(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to take persistence snapshot: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (pc *persistenceCollector) snapshot(ctx context.Context) error {
+	items := pc.inventory(ctx)
+	if ctx.Err() != nil {
+		return context.Canceled
+	}
+	now := time.Now()
+	if pc.last != nil {
+		for _, ch := range diffPersistence(pc.last, items) {
+			pc.pl.protect(`persistence`, &ch.Item)
+			if ch.Previous != nil {
+				pc.pl.protect(`persistence`, ch.Previous)
+			}
+			if err := emitJSON(ctx, pc.tag, pc.src, now, ch); err != nil {
+				return err
+			}
+		}
+	}
+	snap := persistenceSnapshot{Type: `persistence_snapshot`, Count: len(items), Items: make([]persistenceItem, 0, len(items))}
+	for _, p := range sortedItemPaths(items) {
+		// the inventory keeps the real paths to compare against
+		it := items[p]
+		pc.pl.protect(`persistence`, &it)
+		snap.Items = append(snap.Items, it)
+	}
+	if err := emitJSON(ctx, pc.tag, pc.src, now, snap); err != nil {
+		return err
+	}
+	pc.last = items
+	if pc.pl.ephemeral {
+		return nil
+	}
+	b, err := json.Marshal(items)
+	if err == nil {
+		err = writeFileAtomic(pc.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save persistence inventory: %v\n", err)
+	}
+	return nil
+}
+
+// inventory hashes every item, plists are only parsed again when their
+// hash changed.
+func (pc *persistenceCollector) inventory(ctx context.Context) map[string]persistenceItem {
+	items := map[string]persistenceItem{}
+	for _, loc := range pc.locations {
+		paths, _ := filepath.Glob(loc.glob)
+		for _, p := range paths {
+			if ctx.Err() != nil {
+				return items
+			}
+			it, err := statPersistenceItem(p, loc.kind)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					lg.Debug("Failed to read %s: %v\n", p, err)
+				}
+				continue
+			}
+			if prev, ok := pc.last[p]; ok && prev.SHA256 == it.SHA256 {
+				it.Label, it.Program, it.Arguments = prev.Label, prev.Program, prev.Arguments
+				it.RunAtLoad, it.Disabled = prev.RunAtLoad, prev.Disabled
+			} else if filepath.Ext(p) == `.plist` {
+				readLaunchdJob(ctx, p, &it)
+			}
+			items[p] = it
+		}
+	}
+	return items
+}
+
+func statPersistenceItem(p, kind string) (it persistenceItem, err error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return
+	} else if !fi.Mode().IsRegular() {
+		return it, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(b)
+	it = persistenceItem{
+		Path:     p,
+		Kind:     kind,
+		User:     reportOwner(p),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Size:     fi.Size(),
+		Mode:     fi.Mode().String(),
+		Modified: fi.ModTime().UTC().Format(time.RFC3339),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		it.UID = int(st.Uid)
+	}
+	return
+}
+
+// readLaunchdJob fills in the job fields, plists plutil can't convert to
+// JSON are left without them.
+func readLaunchdJob(ctx context.Context, p string, it *persistenceItem) {
+	out, err := exec.CommandContext(ctx, "plutil", "-convert", "json", "-o", "-", p).Output()
+	if err != nil {
+		return
+	}
+	var job launchdJob
+	if json.Unmarshal(out, &job) != nil {
+		return
+	}
+	it.Label, it.Program, it.Arguments = job.Label, job.Program, job.ProgramArguments
+	it.RunAtLoad, it.Disabled = job.RunAtLoad, job.Disabled
+	if it.Program == `` && len(it.Arguments) > 0 {
+		it.Program = it.Arguments[0]
+	}
+}
+
+// diffPersistence returns the changes from one inventory to the next in
+// path order.
+func diffPersistence(prev, cur map[string]persistenceItem) (changes []persistenceChange) {
+	all := map[string]persistenceItem{}
+	for p, it := range prev {
+		all[p] = it
+	}
+	for p, it := range cur {
+		all[p] = it
+	}
+	for _, p := range sortedItemPaths(all) {
+		old, had := prev[p]
+		now, has := cur[p]
+		switch {
+		case !had:
+			changes = append(changes, persistenceChange{Type: `persistence_change`, Change: `added`, Item: now})
+		case !has:
+			changes = append(changes, persistenceChange{Type: `persistence_change`, Change: `removed`, Item: old})
+		case old.SHA256 != now.SHA256 || old.Mode != now.Mode || old.UID != now.UID:
+			o := old
+			changes = append(changes, persistenceChange{Type: `persistence_change`, Change: `modified`, Item: now, Previous: &o})
+		}
+	}
+	return
+}
+
+func sortedItemPaths(items map[string]persistenceItem) []string {
+	paths := make([]string, 0, len(items))
+	for p := range items {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
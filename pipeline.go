@@ -0,0 +1,604 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultReportInterval  = time.Minute
+	defaultFlushInterval   = time.Second
+	defaultPersistInterval = 10 * time.Second
+)
+
+var (
+	errBadRecord = errors.New("record is not a JSON object")
+)
+
+// enricher adds fields to an event.
+type enricher interface {
+	enrich(ev *event)
+}
+
+// filter decides whether an event should be ingested.
+type filter interface {
+	keep(ev *event) bool
+}
+
+// holder is implemented by stages that hold events back, e.g. to aggregate
+// them.  add takes ownership of an event and returns the events that are
+// ready to continue down the pipeline, flush releases held events that have
+// aged out (or all of them when force is set).
+type holder interface {
+	add(ev *event) []*event
+	flush(now time.Time, force bool) []*event
+}
+
+// reporter is implemented by stages that periodically log statistics.
+type reporter interface {
+	report()
+}
+
+// persister is implemented by stages that keep state on disk.
+type persister interface {
+	persist() error
+}
+
+// pipeline is the set of transformations applied to decoded entries before
+// they are handed to the muxer.  Filters run first so that enrichments
+// aren't wasted on events that are going to be dropped, then holders, then
+// enrichers.  The stages are rebuilt when the configuration is reloaded,
+// the writer and resume state live for the life of the process.
+type pipeline struct {
+	sync.RWMutex // guards the stages
+	filters      []filter
+	holders      []holder
+	enrichers    []enricher
+	reporters    []reporter
+	persisters   []persister
+	tally        *dropTally
+	exempt       map[entry.EntryTag]bool // preset stream tags the filters skip
+	limiter      *rateLimiter
+	state        *watermark
+	out          *batchWriter
+	wake         *wakeAnnotator
+	compression  *compressionSampler
+	ephemeral    bool // never persist state, e.g. for a dry run
+}
+
+func newPipeline(cfg *cfgType) (*pipeline, error) {
+	p := &pipeline{}
+	rqs, err := cfg.Global.retryQueueSize()
+	if err != nil {
+		return nil, err
+	}
+	p.out = newBatchWriter(rqs, p.delivered)
+	if p.out.pacer, err = cfg.Global.backlogPacer(); err != nil {
+		return nil, err
+	}
+	if sc, ok, err := cfg.Global.spoolConfig(); err != nil {
+		return nil, err
+	} else if ok {
+		if p.out.spool, err = newSpool(sc.dir, sc.max, sc.maxAge, cfg.Global.Tag_Name, p.delivered); err != nil {
+			return nil, err
+		}
+		p.out.spool.pacer = p.out.pacer
+	}
+	if cfg.Global.Deduplicate_Restarts || cfg.Global.Resume_On_Restart || cfg.Global.Gap_Entries {
+		if p.state, err = loadWatermark(cfg.Global.stateStoreLocation(), cfg.Global.Deduplicate_Restarts); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Global.Detect_Sleep {
+		ww, err := cfg.Global.wakeWindow()
+		if err != nil {
+			return nil, err
+		}
+		p.wake = newWakeAnnotator(ww)
+	}
+	if p.compression, err = newCompressionSampler(cfg.Global.Compression_Sample, cfg.Global.Enable_Compression); err != nil {
+		return nil, err
+	}
+	s, err := p.stages(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.swap(s)
+	return p, nil
+}
+
+// stages builds the configurable stages of the pipeline, they are returned
+// in an otherwise empty pipeline ready to be swapped in.
+func (p *pipeline) stages(cfg *cfgType) (*pipeline, error) {
+	s := &pipeline{
+		state:       p.state,
+		out:         p.out,
+		wake:        p.wake,
+		compression: p.compression,
+		ephemeral:   p.ephemeral,
+	}
+	dsi, err := cfg.Global.dropSummaryInterval()
+	if err != nil {
+		return nil, err
+	}
+	s.tally = newDropTally(dsi)
+	s.exempt = map[entry.EntryTag]bool{}
+	for name := range cfg.presetTags() {
+		tag, err := igst.GetTag(name)
+		if err != nil {
+			return nil, err
+		}
+		s.exempt[tag] = true
+	}
+	s.reporters = append(s.reporters, p.out)
+	if p.out.spool != nil {
+		s.reporters = append(s.reporters, p.out.spool)
+	}
+	if p.state != nil {
+		s.reporters = append(s.reporters, p.state)
+		s.persisters = append(s.persisters, p.state)
+	}
+	sf, err := newScheduleFilter(cfg.Global.Capture_Window, cfg.Global.Off_Hours_Minimum_Level)
+	if err != nil {
+		return nil, err
+	} else if sf != nil {
+		s.filters = append(s.filters, sf)
+	}
+	lf, err := newLevelFilter(cfg.Global.Minimum_Level)
+	if err != nil {
+		return nil, err
+	} else if lf != nil {
+		s.filters = append(s.filters, lf)
+	}
+	if err := s.addListFilter(`Subsystems`, cfg.Global.Allow_Subsystems, cfg.Global.Deny_Subsystems, subsystemField); err != nil {
+		return nil, err
+	}
+	if err := s.addListFilter(`Categories`, cfg.Global.Allow_Categories, cfg.Global.Deny_Categories, categoryField); err != nil {
+		return nil, err
+	}
+	if err := s.addListFilter(`Processes`, cfg.Global.Allow_Processes, cfg.Global.Deny_Processes, processField); err != nil {
+		return nil, err
+	}
+	mdf, err := newMessageDropFilter(cfg.Global.Drop_Message)
+	if err != nil {
+		return nil, err
+	} else if mdf != nil {
+		s.filters = append(s.filters, mdf)
+		s.reporters = append(s.reporters, mdf)
+	}
+	// sampling goes last so the rate only applies to records that survived
+	// the other filters
+	smp, err := newSampler(cfg.Global.Sample_Subsystem)
+	if err != nil {
+		return nil, err
+	} else if smp != nil {
+		s.filters = append(s.filters, smp)
+	}
+	if s.limiter, err = newRateLimiter(cfg.Global.Rate_Limit_EPS, cfg.Global.Rate_Limit_Burst); err != nil {
+		return nil, err
+	}
+	cb, err := newStreamBreakers(cfg, s.tally)
+	if err != nil {
+		return nil, err
+	} else if cb != nil {
+		s.holders = append(s.holders, cb)
+	}
+	if ec := newErrorContext(cfg.Global.Error_Context); ec != nil {
+		ec.tally = s.tally
+		s.holders = append(s.holders, presetBypass{holder: ec, exempt: s.exempt})
+	}
+	agg, err := cfg.Global.aggregator()
+	if err != nil {
+		return nil, err
+	} else if agg != nil {
+		s.holders = append(s.holders, agg)
+	}
+	var alertTag entry.EntryTag
+	if cfg.Global.Alert_Tag_Name != `` {
+		if alertTag, err = igst.GetTag(cfg.Global.Alert_Tag_Name); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Global.First_Seen_Alerts {
+		learning, err := cfg.Global.firstSeenLearningPeriod()
+		if err != nil {
+			return nil, err
+		}
+		fs, err := loadFirstSeen(cfg.Global.seenStoreLocation(), learning)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Global.Alert_Tag_Name != `` {
+			fs.setTag(alertTag)
+		}
+		s.holders = append(s.holders, fs)
+		s.persisters = append(s.persisters, fs)
+	}
+	if ra := newRateAnomalies(cfg.Global.Anomaly_Factor, cfg.Global.Anomaly_Min_Rate); ra != nil {
+		if cfg.Global.Alert_Tag_Name != `` {
+			ra.setTag(alertTag)
+		}
+		s.holders = append(s.holders, ra)
+	}
+	if s.tally != nil {
+		s.holders = append(s.holders, s.tally)
+	}
+	// redaction runs ahead of the other enrichers so nothing they derive
+	// from the message can leak what was redacted
+	rd, err := newRedactor(cfg.Redact)
+	if err != nil {
+		return nil, err
+	} else if rd != nil {
+		s.enrichers = append(s.enrichers, rd)
+	}
+	if cfg.XProtect.Enable {
+		s.enrichers = append(s.enrichers, xprotectParser{})
+	}
+	if cfg.Gatekeeper.Enable {
+		s.enrichers = append(s.enrichers, gatekeeperNormalizer{})
+	}
+	if cfg.Extensions.Enable {
+		s.enrichers = append(s.enrichers, extensionNormalizer{})
+	}
+	if cfg.Auth_Events.Enable {
+		s.enrichers = append(s.enrichers, authNormalizer{})
+	}
+	if cfg.Remote_Access.Enable {
+		s.enrichers = append(s.enrichers, remoteAccessNormalizer{})
+	}
+	if cfg.Global.Resolve_UIDs {
+		to, err := cfg.Global.uidCacheTimeout()
+		if err != nil {
+			return nil, err
+		}
+		s.enrichers = append(s.enrichers, newUIDResolver(to))
+	}
+	if p.wake != nil {
+		s.enrichers = append(s.enrichers, p.wake)
+	}
+	if cfg.Global.Annotate_Architecture {
+		s.enrichers = append(s.enrichers, newArchTagger())
+	}
+	if cfg.Global.Normalize_Severity {
+		sm, err := newSeverityMapper(cfg.Global.Severity_Map)
+		if err != nil {
+			return nil, err
+		}
+		s.enrichers = append(s.enrichers, sm)
+	}
+	if st := newSiteTagger(cfg.Site); st != nil {
+		s.enrichers = append(s.enrichers, st)
+	}
+	ps, err := newPseudonymizer(cfg.Global)
+	if err != nil {
+		return nil, err
+	} else if ps != nil {
+		s.enrichers = append(s.enrichers, ps)
+	}
+	sc, err := newScrubber(cfg.Global.Scrub_Profile)
+	if err != nil {
+		return nil, err
+	} else if sc != nil {
+		s.enrichers = append(s.enrichers, sc)
+	}
+	return s, nil
+}
+
+// protect applies the pseudonymizer and scrubber to the identified fields
+// of an entry a collector writes itself, those never pass through the
+// enrichers.
+func (p *pipeline) protect(parent string, id identified) {
+	p.RLock()
+	defer p.RUnlock()
+	for _, e := range p.enrichers {
+		switch e := e.(type) {
+		case *pseudonymizer:
+			e.protect(parent, id)
+		case *scrubber:
+			e.protect(parent, id)
+		}
+	}
+}
+
+// swap installs the stages from s, returning the previous stages in a
+// pipeline of their own.
+func (p *pipeline) swap(s *pipeline) *pipeline {
+	p.Lock()
+	defer p.Unlock()
+	old := &pipeline{
+		filters:     p.filters,
+		holders:     p.holders,
+		enrichers:   p.enrichers,
+		reporters:   p.reporters,
+		persisters:  p.persisters,
+		tally:       p.tally,
+		exempt:      p.exempt,
+		limiter:     p.limiter,
+		state:       p.state,
+		out:         p.out,
+		wake:        p.wake,
+		compression: p.compression,
+		ephemeral:   p.ephemeral,
+	}
+	p.filters, p.holders, p.enrichers = s.filters, s.holders, s.enrichers
+	p.reporters, p.persisters, p.tally = s.reporters, s.persisters, s.tally
+	p.limiter, p.exempt = s.limiter, s.exempt
+	return old
+}
+
+// reload rebuilds the stages from cfg.  Events held by the old stages are
+// flushed through them and their state persisted before the new stages
+// load it, the writer and anything queued or spooled is untouched.
+func (p *pipeline) reload(ctx context.Context, cfg *cfgType) error {
+	p.persist()
+	s, err := p.stages(cfg)
+	if err != nil {
+		return err
+	}
+	old := p.swap(s)
+	ents := old.drain(time.Now(), true)
+	old.report()
+	old.persist()
+	return p.write(ctx, ents)
+}
+
+// run handles the periodic housekeeping of pipeline stages until the
+// context is cancelled, held events are written out as they age out.
+func (p *pipeline) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	wg.Add(1)
+	go p.out.run(ctx, wg)
+	rtckr := time.NewTicker(defaultReportInterval)
+	defer rtckr.Stop()
+	ptckr := time.NewTicker(defaultPersistInterval)
+	defer ptckr.Stop()
+	// a reload can add holders so the flush always runs
+	ftckr := time.NewTicker(defaultFlushInterval)
+	defer ftckr.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ftckr.C:
+			p.write(ctx, p.flush(now, false))
+		case <-rtckr.C:
+			p.report()
+		case <-ptckr.C:
+			p.persist()
+		}
+	}
+}
+
+// close flushes held events and anything waiting to be retried, then
+// persists state.  It must only be called once everything feeding the
+// pipeline has stopped, writes give up when the context expires.
+func (p *pipeline) close(ctx context.Context) {
+	p.out.park(p.flush(time.Now(), true))
+	p.out.close(ctx)
+	if p.state != nil {
+		p.state.markStopped()
+	}
+	p.report()
+	p.persist()
+}
+
+func (p *pipeline) persist() {
+	if p.ephemeral {
+		return
+	}
+	p.RLock()
+	defer p.RUnlock()
+	for _, ps := range p.persisters {
+		if err := ps.persist(); err != nil {
+			lg.Error("Failed to persist state: %v\n", err)
+		}
+	}
+}
+
+func (p *pipeline) report() {
+	p.RLock()
+	defer p.RUnlock()
+	for _, r := range p.reporters {
+		r.report()
+	}
+}
+
+// process runs the entries through the pipeline, returning the entries that
+// should be ingested now.  Entries that can't be decoded are passed through
+// as is.
+func (p *pipeline) process(ents []*entry.Entry) []*entry.Entry {
+	p.RLock()
+	defer p.RUnlock()
+	if p.state == nil && len(p.filters) == 0 && len(p.holders) == 0 && len(p.enrichers) == 0 {
+		return ents
+	}
+	out := make([]*entry.Entry, 0, len(ents))
+	for _, ent := range ents {
+		ev, err := newEvent(ent)
+		if err != nil {
+			lg.Debug("Failed to decode record: %v\n", err)
+			stats.parseError()
+			out = append(out, ent)
+			continue
+		}
+		if !p.keep(ev) {
+			putEntry(ent)
+			continue
+		}
+		out = p.finish(out, p.hold(0, []*event{ev}))
+	}
+	return out
+}
+
+// write hands entries to the muxer, batches that fail are retried.  The
+// entries are still handed over if the rate limit wait is cut short so a
+// shutdown parks them.
+func (p *pipeline) write(ctx context.Context, ents []*entry.Entry) error {
+	p.RLock()
+	rl := p.limiter
+	p.RUnlock()
+	rl.wait(ctx, len(ents))
+	p.compression.sample(ents)
+	return p.out.write(ctx, ents)
+}
+
+// delivered is called with each batch that was written to the muxer, the
+// newest record becomes the checkpoint.
+func (p *pipeline) delivered(ents []*entry.Entry) {
+	stats.ingested(ents)
+	if ts, ok := newestRecordTime(ents); ok {
+		stats.delivered(ts)
+		if p.state != nil {
+			p.state.setCheckpoint(ts)
+		}
+	}
+}
+
+// newestRecordTime returns the newest record timestamp in a batch.  Records
+// are in stream order so the batch is scanned backwards, synthetic entries
+// have no record timestamp.
+func newestRecordTime(ents []*entry.Entry) (time.Time, bool) {
+	for i := len(ents) - 1; i >= 0; i-- {
+		if ts, ok := recordTime(ents[i].Data); ok {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// recordTime parses a record's timestamp, false if it has none.
+func recordTime(data []byte) (time.Time, bool) {
+	var rec struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if json.Unmarshal(data, &rec) != nil || rec.Timestamp == `` {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(logTimestampFormat, rec.Timestamp)
+	return ts, err == nil
+}
+
+// resumePoint returns the checkpoint to backfill from, ok is false if there
+// is no saved state.
+func (p *pipeline) resumePoint() (ts time.Time, ok bool) {
+	if p.state == nil {
+		return
+	}
+	ts = p.state.Checkpoint()
+	ok = !ts.IsZero()
+	return
+}
+
+// downtime returns when capture last stopped, either the clean shutdown
+// time or failing that the checkpoint.  ok is false without saved state.
+func (p *pipeline) downtime() (ts time.Time, ok bool) {
+	if p.state == nil {
+		return
+	}
+	if ts = p.state.Stopped(); ts.IsZero() || ts.Before(p.state.Checkpoint()) {
+		ts = p.state.Checkpoint()
+	}
+	ok = !ts.IsZero()
+	return
+}
+
+// flush drains the current stages.
+func (p *pipeline) flush(now time.Time, force bool) []*entry.Entry {
+	p.RLock()
+	defer p.RUnlock()
+	return p.drain(now, force)
+}
+
+// drain collects aged out events from the holders and finishes them, the
+// caller must hold the lock.
+func (p *pipeline) drain(now time.Time, force bool) (out []*entry.Entry) {
+	for i, h := range p.holders {
+		out = p.finish(out, p.hold(i+1, h.flush(now, force)))
+	}
+	return
+}
+
+// hold passes events through the holders starting at index start.
+func (p *pipeline) hold(start int, evs []*event) []*event {
+	for _, h := range p.holders[start:] {
+		var next []*event
+		for _, ev := range evs {
+			if ev != nil {
+				next = append(next, h.add(ev)...)
+			}
+		}
+		evs = next
+	}
+	return evs
+}
+
+// finish enriches the events and appends their entries to out.
+func (p *pipeline) finish(out []*entry.Entry, evs []*event) []*entry.Entry {
+	for _, ev := range evs {
+		if ev == nil {
+			continue
+		}
+		for _, e := range p.enrichers {
+			e.enrich(ev)
+		}
+		if err := ev.finalize(); err != nil {
+			lg.Warn("Failed to update record: %v\n", err)
+		}
+		out = append(out, ev.ent)
+	}
+	return out
+}
+
+// keep runs the filters, deduplication goes first because it has to see
+// everything that was ingested and its drops aren't counted in the tally.
+func (p *pipeline) keep(ev *event) bool {
+	if p.state != nil && !p.state.keep(ev) {
+		return false
+	} else if p.exempt[ev.ent.Tag] {
+		return true
+	}
+	for _, f := range p.filters {
+		if !f.keep(ev) {
+			p.tally.dropped(ev)
+			return false
+		}
+	}
+	return true
+}
+
+// presetBypass passes the preset streams' events around a holder that
+// would drop them.
+type presetBypass struct {
+	holder
+	exempt map[entry.EntryTag]bool
+}
+
+func (pb presetBypass) add(ev *event) []*event {
+	if pb.exempt[ev.ent.Tag] {
+		return []*event{ev}
+	}
+	return pb.holder.add(ev)
+}
+
+func (p *pipeline) addListFilter(name string, allow, deny []string, field fieldFunc) error {
+	lf, err := newListFilter(name, allow, deny, field)
+	if err != nil {
+		return err
+	} else if lf != nil {
+		p.filters = append(p.filters, lf)
+	}
+	return nil
+}
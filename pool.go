@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	// buffers bigger than this aren't kept, one huge record shouldn't pin
+	// its buffer for the life of the process
+	maxPooledData  = 64 * 1024
+	maxPooledBatch = 4096
+)
+
+// Entries and batches are only recycled where the ingester knows nothing
+// else holds them, i.e. records the filters dropped and batch slices the
+// pipeline has finished with.  Anything handed to the muxer, spool, or a
+// holder is left to the garbage collector since the muxer writes entries
+// asynchronously.
+var (
+	entryPool = sync.Pool{
+		New: func() interface{} { return new(entry.Entry) },
+	}
+	batchPool = sync.Pool{
+		New: func() interface{} { return new([]*entry.Entry) },
+	}
+)
+
+// getEntry returns an empty entry, its Data may have spare capacity.
+func getEntry() *entry.Entry {
+	return entryPool.Get().(*entry.Entry)
+}
+
+// putEntry recycles an entry that nothing else references.
+func putEntry(ent *entry.Entry) {
+	data := ent.Data[:0]
+	if cap(data) > maxPooledData {
+		data = nil
+	}
+	*ent = entry.Entry{Data: data}
+	entryPool.Put(ent)
+}
+
+// getBatch returns an empty batch with room for at least n entries.
+func getBatch(n int) []*entry.Entry {
+	b := *batchPool.Get().(*[]*entry.Entry)
+	if cap(b) < n {
+		return make([]*entry.Entry, 0, n)
+	}
+	return b[:0]
+}
+
+// putBatch recycles a batch slice, the entries in it are not touched.
+func putBatch(b []*entry.Entry) {
+	if cap(b) > maxPooledBatch {
+		return
+	}
+	for i := range b {
+		b[i] = nil // don't keep the entries alive
+	}
+	b = b[:0]
+	batchPool.Put(&b)
+}
+
+// sameBatch reports whether two batches share a backing array, the
+// pipeline hands its input back when it has no stages.
+func sameBatch(a, b []*entry.Entry) bool {
+	return cap(a) > 0 && cap(b) > 0 && &a[:1][0] == &b[:1][0]
+}
@@ -0,0 +1,81 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	defaultPostureTag      = `macos-posture`
+	defaultPostureInterval = `1h`
+
+	socketFilterFW = `/usr/libexec/ApplicationFirewall/socketfilterfw`
+)
+
+// postureCheck is the result of a single security control check, Enabled is
+// nil when the state could not be determined.
+type postureCheck struct {
+	Enabled *bool  `json:"enabled"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type postureSnapshot struct {
+	Type            string       `json:"type"`
+	Hostname        string       `json:"hostname"`
+	SIP             postureCheck `json:"sip"`
+	FileVault       postureCheck `json:"fileVault"`
+	Gatekeeper      postureCheck `json:"gatekeeper"`
+	Firewall        postureCheck `json:"firewall"`
+	FirewallStealth postureCheck `json:"firewallStealth"`
+}
+
+func postureSnapshotFunc(ctx context.Context) (interface{}, error) {
+	ps := postureSnapshot{
+		Type: `posture`,
+	}
+	ps.Hostname, _ = os.Hostname()
+	ps.SIP = runPostureCheck(ctx, []string{"csrutil", "status"}, []string{"status: enabled"}, []string{"status: disabled"})
+	ps.FileVault = runPostureCheck(ctx, []string{"fdesetup", "status"}, []string{"FileVault is On"}, []string{"FileVault is Off"})
+	ps.Gatekeeper = runPostureCheck(ctx, []string{"spctl", "--status"}, []string{"assessments enabled"}, []string{"assessments disabled"})
+	ps.Firewall = runPostureCheck(ctx, []string{socketFilterFW, "--getglobalstate"}, []string{"enabled", "State = 1", "State = 2"}, []string{"disabled", "State = 0"})
+	ps.FirewallStealth = runPostureCheck(ctx, []string{socketFilterFW, "--getstealthmode"}, []string{"stealth mode enabled", "mode is on"}, []string{"stealth mode disabled", "mode is off"})
+	return ps, nil
+}
+
+// runPostureCheck runs a status command and decides whether the control is
+// enabled by looking for known phrases in its output.  Disabled phrases are
+// checked first because some outputs contain both words.
+func runPostureCheck(ctx context.Context, args []string, on, off []string) (pc postureCheck) {
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	pc.Status = strings.TrimSpace(string(out))
+	if err != nil {
+		pc.Error = err.Error()
+		return
+	}
+	lower := strings.ToLower(pc.Status)
+	for _, p := range off {
+		if strings.Contains(lower, strings.ToLower(p)) {
+			pc.Enabled = new(bool)
+			return
+		}
+	}
+	for _, p := range on {
+		if strings.Contains(lower, strings.ToLower(p)) {
+			v := true
+			pc.Enabled = &v
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+//go:build darwin && cgo
+// +build darwin,cgo
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+#include <CoreFoundation/CoreFoundation.h>
+#include <IOKit/IOMessage.h>
+#include <IOKit/pwr_mgt/IOPMLib.h>
+
+#include "power_darwin.h"
+#include "_cgo_export.h"
+
+static io_connect_t gw_power_root;
+static CFRunLoopRef gw_power_loop;
+
+static void gw_power_cb(void *refcon, io_service_t service, natural_t type, void *arg) {
+	switch (type) {
+	case kIOMessageCanSystemSleep:
+		IOAllowPowerChange(gw_power_root, (long)arg);
+		break;
+	case kIOMessageSystemWillSleep:
+		// sleep waits until the change is allowed, or about 30 seconds
+		goPowerWillSleep();
+		IOAllowPowerChange(gw_power_root, (long)arg);
+		break;
+	}
+}
+
+int gw_power_run(void) {
+	IONotificationPortRef port;
+	io_object_t notifier;
+	gw_power_root = IORegisterForSystemPower(NULL, &port, gw_power_cb, &notifier);
+	if (gw_power_root == MACH_PORT_NULL) {
+		return -1;
+	}
+	gw_power_loop = CFRunLoopGetCurrent();
+	CFRunLoopAddSource(gw_power_loop, IONotificationPortGetRunLoopSource(port), kCFRunLoopDefaultMode);
+	CFRunLoopRun();
+	IODeregisterForSystemPower(&notifier);
+	IOServiceClose(gw_power_root);
+	IONotificationPortDestroy(port);
+	return 0;
+}
+
+void gw_power_stop(void) {
+	if (gw_power_loop != NULL) {
+		CFRunLoopStop(gw_power_loop);
+	}
+}
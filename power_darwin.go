@@ -0,0 +1,98 @@
+//go:build darwin && cgo
+// +build darwin,cgo
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+// System sleep notifications from IOKit.  The notifications are delivered
+// on a run loop, which gets an OS thread of its own.
+
+// #cgo LDFLAGS: -framework IOKit -framework CoreFoundation
+// #include "power_darwin.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// sleep is held up at most this long for the flush, IOKit gives up
+// waiting at 30 seconds
+const powerSleepTimeout = 20 * time.Second
+
+// the callback has no way to carry state, there is only ever one watcher
+var (
+	powerMtx   sync.Mutex
+	powerSleep func()
+)
+
+// goPowerWillSleep is called on the run loop thread before the host
+// sleeps, sleep waits for it to return.
+//
+//export goPowerWillSleep
+func goPowerWillSleep() {
+	powerMtx.Lock()
+	fn := powerSleep
+	powerMtx.Unlock()
+	if fn == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(powerSleepTimeout):
+		lg.Warn("Flushing before sleep took longer than %v, letting the host sleep\n", powerSleepTimeout)
+	}
+}
+
+// watchPower calls willSleep each time the host is about to sleep until
+// the context is cancelled.
+func watchPower(ctx context.Context, wg *sync.WaitGroup, willSleep func()) error {
+	powerMtx.Lock()
+	if powerSleep != nil {
+		powerMtx.Unlock()
+		return errors.New("sleep notifications are already registered")
+	}
+	powerSleep = willSleep
+	powerMtx.Unlock()
+	failed := make(chan error, 1)
+	// not waited on, a stop that lands before the run loop starts would
+	// leave it running and it goes away with the process anyway
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if C.gw_power_run() != 0 {
+			failed <- errors.New("IORegisterForSystemPower failed")
+		}
+		powerMtx.Lock()
+		powerSleep = nil
+		powerMtx.Unlock()
+	}()
+	// registration fails right away or not at all
+	select {
+	case err := <-failed:
+		return err
+	case <-time.After(time.Second):
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		C.gw_power_stop()
+	}()
+	return nil
+}
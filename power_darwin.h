@@ -0,0 +1,20 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+#ifndef GW_POWER_DARWIN_H
+#define GW_POWER_DARWIN_H
+
+// gw_power_run registers for system sleep notifications and runs the
+// current thread's run loop until gw_power_stop, goPowerWillSleep is called
+// before each sleep.  It returns -1 if registration failed.
+int gw_power_run(void);
+
+// gw_power_stop stops the run loop gw_power_run is running.
+void gw_power_stop(void);
+
+#endif
@@ -0,0 +1,22 @@
+//go:build !darwin || !cgo
+// +build !darwin !cgo
+
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+func watchPower(ctx context.Context, wg *sync.WaitGroup, willSleep func()) error {
+	return errors.New("sleep notifications need a macOS build with cgo")
+}
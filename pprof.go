@@ -0,0 +1,55 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+const (
+	defaultPprofListen = `127.0.0.1:6060`
+)
+
+// startPprof serves the runtime profiling endpoints, they are only ever
+// bound to loopback as they expose far too much to be on the network.
+func startPprof(ctx context.Context, wg *sync.WaitGroup, addr string) error {
+	if addr == `` {
+		addr = defaultPprofListen
+	}
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	lg.Info("Serving pprof on %s\n", addr)
+	return startHTTPServer(ctx, wg, "tcp", addr, mux)
+}
+
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid Pprof-Listen %q: %v", addr, err)
+	}
+	if host == `localhost` {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Pprof-Listen %q must be a loopback address", addr)
+	}
+	return nil
+}
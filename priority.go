@@ -0,0 +1,87 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+const (
+	// from sys/resource.h, the darwin background band throttles CPU, disk,
+	// and network so the process never competes with interactive work
+	prioDarwinProcess = 4
+	prioDarwinBG      = 0x1000
+
+	qosBackground = `background`
+)
+
+// QoS clamps taskpolicy -c accepts
+var qosClasses = map[string]bool{
+	`utility`:     true,
+	qosBackground: true,
+	`maintenance`: true,
+}
+
+func checkNice(name string, v int) error {
+	if v < -20 || v > 20 {
+		return fmt.Errorf("Invalid %s %d, expected -20 to 20", name, v)
+	}
+	return nil
+}
+
+func checkQoSClass(name, v string) (string, error) {
+	v = strings.ToLower(v)
+	if v != `` && !qosClasses[v] {
+		return ``, fmt.Errorf("Invalid %s %q, expected utility, background, or maintenance", name, v)
+	}
+	return v, nil
+}
+
+// applyPriority sets the ingester's own scheduling priority, log children
+// inherit the nice level.  A background QoS class also moves the ingester
+// into the darwin background band.
+func applyPriority(g global) error {
+	if g.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, g.Nice); err != nil {
+			return fmt.Errorf("Failed to set Nice %d: %v", g.Nice, err)
+		}
+	}
+	if strings.ToLower(g.QoS_Class) == qosBackground && runtime.GOOS == `darwin` {
+		if err := syscall.Setpriority(prioDarwinProcess, 0, prioDarwinBG); err != nil {
+			return fmt.Errorf("Failed to enter the background QoS class: %v", err)
+		}
+	}
+	return nil
+}
+
+// logCommand builds a log child, launched through taskpolicy when it has a
+// QoS clamp.
+func logCommand(ctx context.Context, qos string, args ...string) *exec.Cmd {
+	if qos == `` {
+		return exec.CommandContext(ctx, "log", args...)
+	}
+	return exec.CommandContext(ctx, "taskpolicy", append([]string{"-c", qos, "log"}, args...)...)
+}
+
+// reniceChild sets the nice level of a started child, failures only cost
+// responsiveness so they are just logged.
+func reniceChild(p *os.Process, nice int) {
+	if nice == 0 || p == nil {
+		return
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, p.Pid, nice); err != nil {
+		lg.Warn("Failed to set the nice level of pid %d to %d: %v\n", p.Pid, nice, err)
+	}
+}
@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// processedFiles remembers the files a collector has ingested by path and
+// modification time, so a restart doesn't ingest them again but a file
+// that is replaced is picked up.  It belongs to a single collector
+// goroutine and isn't locked.
+type processedFiles struct {
+	path      string
+	files     map[string]int64 // unix nanos modification time when processed
+	dirty     bool
+	ephemeral bool // never written, e.g. for a dry run
+}
+
+func loadProcessedFiles(path string, ephemeral bool) *processedFiles {
+	pf := &processedFiles{
+		path:      path,
+		ephemeral: ephemeral,
+	}
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &pf.files)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		lg.Warn("Ignoring unreadable processed file store %s: %v\n", path, err)
+	}
+	if pf.files == nil {
+		pf.files = map[string]int64{}
+	}
+	return pf
+}
+
+// done reports whether the file was already processed as of mod.
+func (pf *processedFiles) done(path string, mod time.Time) bool {
+	n, ok := pf.files[path]
+	return ok && n == mod.UnixNano()
+}
+
+func (pf *processedFiles) mark(path string, mod time.Time) {
+	pf.files[path] = mod.UnixNano()
+	pf.dirty = true
+}
+
+// prune forgets files that are gone so the store doesn't grow forever.
+func (pf *processedFiles) prune(present map[string]bool) {
+	for p := range pf.files {
+		if !present[p] {
+			delete(pf.files, p)
+			pf.dirty = true
+		}
+	}
+}
+
+func (pf *processedFiles) persist() error {
+	if !pf.dirty || pf.ephemeral {
+		return nil
+	}
+	b, err := json.Marshal(pf.files)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(pf.path, b, 0640); err == nil {
+		pf.dirty = false
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	errNoSalt = errors.New("Pseudonymize-Salt is required when pseudonymization is enabled")
+)
+
+// pseudonymizer replaces identities with salted hashes so that records can
+// still be correlated with each other without shipping the raw values.  The
+// same value always hashes to the same token for a given salt.
+type pseudonymizer struct {
+	salt      []byte
+	fields    []string
+	hostRegex *regexp.Regexp // local hostnames in messages
+	userRegex *regexp.Regexp // local account names in messages
+	userField bool           // user=... style values in messages
+}
+
+func newPseudonymizer(g global) (*pseudonymizer, error) {
+	if len(g.Pseudonymize_Field) == 0 && !g.Pseudonymize_Hostname && !g.Pseudonymize_Usernames {
+		return nil, nil
+	}
+	if g.Pseudonymize_Salt == `` {
+		return nil, errNoSalt
+	}
+	p := &pseudonymizer{
+		salt:   []byte(g.Pseudonymize_Salt),
+		fields: g.Pseudonymize_Field,
+	}
+	if g.Pseudonymize_Hostname {
+		if h, err := os.Hostname(); err == nil && h != `` {
+			names := []string{regexp.QuoteMeta(h)}
+			if short := strings.SplitN(h, ".", 2)[0]; short != h {
+				names = append(names, regexp.QuoteMeta(short))
+			}
+			p.hostRegex = regexp.MustCompile(`(?i)\b(?:` + strings.Join(names, `|`) + `)\b`)
+		}
+	}
+	if g.Pseudonymize_Usernames {
+		p.userRegex = localUserRegex(localUsers())
+		p.userField = true
+	}
+	return p, nil
+}
+
+func (p *pseudonymizer) hash(v string) string {
+	mac := hmac.New(sha256.New, p.salt)
+	mac.Write([]byte(v))
+	return `h:` + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (p *pseudonymizer) enrich(ev *event) {
+	for _, f := range p.fields {
+		if v, ok := ev.stringField(f); ok && v != `` {
+			ev.Set(f, p.hash(v))
+		}
+	}
+	msg := ev.EventMessage
+	if p.hostRegex != nil {
+		msg = p.hostRegex.ReplaceAllStringFunc(msg, p.hash)
+	}
+	if p.userField {
+		msg = userFieldRegex.ReplaceAllStringFunc(msg, func(m string) string {
+			sm := userFieldRegex.FindStringSubmatch(m)
+			val := strings.TrimLeft(m[len(sm[1]):], `'"`)
+			return sm[1] + p.hash(val)
+		})
+	}
+	if p.userRegex != nil {
+		msg = p.userRegex.ReplaceAllStringFunc(msg, p.hash)
+	}
+	if msg != ev.EventMessage {
+		ev.EventMessage = msg
+		ev.Set("eventMessage", msg)
+	}
+	for k, v := range ev.set {
+		if id, ok := v.(identified); ok {
+			p.protect(k, id)
+		}
+	}
+}
+
+// protect hashes the identified fields of a normalized field set named by
+// Pseudonymize-Field as parent.name, auth.user say, and with
+// Pseudonymize-Usernames every account name but the system ones.
+func (p *pseudonymizer) protect(parent string, id identified) {
+	id.identities(func(name string, kind int, v *string) {
+		if *v == `` {
+			return
+		}
+		hash := p.userField && kind == identityUser && !systemUsers[*v]
+		for _, f := range p.fields {
+			hash = hash || f == parent+`.`+name
+		}
+		if hash {
+			*v = p.hash(*v)
+		}
+	})
+}
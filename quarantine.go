@@ -0,0 +1,309 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultQuarantineTag      = `macos-quarantine`
+	defaultQuarantineInterval = `5m`
+	defaultQuarantineStore    = `/opt/gravwell/etc/macosLog.quarantine`
+	quarantineDBGlob          = `/Users/*/Library/Preferences/com.apple.LaunchServices.QuarantineEventsV2`
+
+	// seconds from the unix epoch to the Mac absolute time epoch, 2001-01-01
+	macEpochOffset = 978307200
+
+	// events this close to the newest one seen are checked again, timestamps
+	// don't survive the trip through sqlite3 exactly
+	quarantineOverlap = 1.0
+
+	quarantineFieldSep = "\x1f"
+	quarantineRowSep   = "\x1e"
+)
+
+const quarantineQuery = `SELECT LSQuarantineEventIdentifier, LSQuarantineTimeStamp, LSQuarantineAgentName, ` +
+	`LSQuarantineAgentBundleIdentifier, LSQuarantineDataURLString, LSQuarantineOriginURLString, ` +
+	`LSQuarantineOriginTitle, LSQuarantineSenderName, LSQuarantineSenderAddress, LSQuarantineTypeNumber ` +
+	`FROM LSQuarantineEvent WHERE LSQuarantineTimeStamp > %s ORDER BY LSQuarantineTimeStamp`
+
+// LSQuarantineType values by number
+var quarantineTypes = []string{`web_download`, `other_download`, `email_attachment`, `message_attachment`, `calendar_attachment`, `other_attachment`}
+
+// quarantineConfig is the [Quarantine-Events] block.
+type quarantineConfig struct {
+	Enable         bool
+	Tag_Name       string
+	Interval       string // how often the databases are checked for new events
+	Read_Existing  bool   // ingest the events already in a database the first time it is seen
+	Store_Location string // file the events seen in each database are tracked in
+}
+
+func (qc *quarantineConfig) verify() error {
+	if !qc.Enable {
+		return nil
+	}
+	if qc.Tag_Name == `` {
+		qc.Tag_Name = defaultQuarantineTag
+	}
+	if qc.Interval == `` {
+		qc.Interval = defaultQuarantineInterval
+	}
+	if _, err := (snapshotConfig{Interval: qc.Interval}).interval(); err != nil {
+		return fmt.Errorf("Quarantine-Events: %v", err)
+	}
+	return nil
+}
+
+func (qc quarantineConfig) storeLocation() string {
+	if qc.Store_Location == `` {
+		return defaultQuarantineStore
+	}
+	return qc.Store_Location
+}
+
+// quarantineEvent is the entry written for each download recorded in a
+// quarantine events database.
+type quarantineEvent struct {
+	Type          string `json:"type"`
+	User          string `json:"user"`
+	EventID       string `json:"event_id"`
+	Agent         string `json:"agent,omitempty"` // the app that downloaded the file
+	AgentBundleID string `json:"agent_bundle_id,omitempty"`
+	DataURL       string `json:"data_url,omitempty"`
+	OriginURL     string `json:"origin_url,omitempty"`
+	OriginTitle   string `json:"origin_title,omitempty"`
+	SenderName    string `json:"sender_name,omitempty"`
+	SenderAddress string `json:"sender_address,omitempty"`
+	Kind          string `json:"kind,omitempty"` // web_download, email_attachment, ...
+}
+
+// identities lets a Scrub-Profile or the pseudonymizer reach the user, the
+// sender, and the URLs, which can hold a home path or an address.
+func (qe *quarantineEvent) identities(fn func(name string, kind int, v *string)) {
+	fn(`user`, identityUser, &qe.User)
+	fn(`data_url`, identityPath, &qe.DataURL)
+	fn(`origin_url`, identityPath, &qe.OriginURL)
+	fn(`sender_name`, identityUser, &qe.SenderName)
+	fn(`sender_address`, identityPath, &qe.SenderAddress)
+}
+
+// quarantinePos is how far a database has been read, the newest event
+// time and the events at or near it.
+type quarantinePos struct {
+	Last float64  `json:"last"` // Mac absolute time
+	Seen []string `json:"seen"`
+}
+
+// quarantineCollector reads each user's quarantine events database with
+// sqlite3 and ingests the events added since the last check.
+type quarantineCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	existing bool
+	src      *sourceTracker
+	store    string
+	pl       *pipeline
+	pos      map[string]quarantinePos
+	dirty    bool
+}
+
+func startQuarantineCollector(ctx context.Context, wg *sync.WaitGroup, cfg quarantineConfig, src *sourceTracker, pl *pipeline) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve quarantine events tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	qc := &quarantineCollector{
+		tag:      tag,
+		interval: interval,
+		existing: cfg.Read_Existing,
+		src:      src,
+		store:    cfg.storeLocation(),
+		pl:       pl,
+		pos:      map[string]quarantinePos{},
+	}
+	if b, err := os.ReadFile(qc.store); err == nil {
+		if err = json.Unmarshal(b, &qc.pos); err != nil {
+			lg.Warn("Ignoring unreadable quarantine events store %s: %v\n", qc.store, err)
+		}
+	}
+	wg.Add(1)
+	go qc.run(ctx, wg)
+	return nil
+}
+
+func (qc *quarantineCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(qc.interval)
+	defer tckr.Stop()
+	for {
+		if err := qc.scan(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to ingest quarantine events: %v\n", err)
+		}
+		qc.persist()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (qc *quarantineCollector) persist() {
+	if !qc.dirty || qc.pl.ephemeral {
+		return
+	}
+	b, err := json.Marshal(qc.pos)
+	if err == nil {
+		err = writeFileAtomic(qc.store, b, 0640)
+	}
+	if err != nil {
+		lg.Warn("Failed to save quarantine event positions: %v\n", err)
+		return
+	}
+	qc.dirty = false
+}
+
+func (qc *quarantineCollector) scan(ctx context.Context) error {
+	dbs, err := filepath.Glob(quarantineDBGlob)
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, p := range dbs {
+		present[p] = true
+		if err := qc.read(ctx, p); err != nil {
+			if ctx.Err() != nil {
+				return context.Canceled
+			}
+			// usually locked while LaunchServices writes, the next check gets it
+			lg.Warn("Failed to read quarantine events from %s: %v\n", p, err)
+		}
+	}
+	for p := range qc.pos {
+		if !present[p] {
+			delete(qc.pos, p)
+			qc.dirty = true
+		}
+	}
+	return nil
+}
+
+// read ingests the events of a database that weren't seen before.  A
+// database seen for the first time only has its position recorded unless
+// Read-Existing is set.
+func (qc *quarantineCollector) read(ctx context.Context, p string) error {
+	pos, known := qc.pos[p]
+	cond := `-1e18`
+	if known {
+		cond = strconv.FormatFloat(pos.Last-quarantineOverlap, 'f', -1, 64)
+	}
+	out, err := exec.CommandContext(ctx, "sqlite3", "-readonly", "-noheader",
+		"-separator", quarantineFieldSep, "-newline", quarantineRowSep,
+		p, fmt.Sprintf(quarantineQuery, cond)).Output()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, id := range pos.Seen {
+		seen[id] = true
+	}
+	user := reportOwner(p)
+	var rows []quarantineEvent
+	var times []float64
+	last := pos.Last
+	for _, row := range strings.Split(string(out), quarantineRowSep) {
+		if qe, ts, ok := parseQuarantineRow(row); ok {
+			qe.User = user
+			rows, times = append(rows, qe), append(times, ts)
+			last = math.Max(last, ts)
+		}
+	}
+	var written []string
+	for i, qe := range rows {
+		if seen[qe.EventID] || (!known && !qc.existing) {
+			continue
+		}
+		qc.pl.protect(`quarantine`, &qe)
+		if err := emitJSON(ctx, qc.tag, qc.src, macAbsoluteTime(times[i]), qe); err != nil {
+			if len(written) > 0 {
+				// what made it is skipped next time
+				qc.pos[p] = quarantinePos{Last: pos.Last, Seen: append(pos.Seen, written...)}
+				qc.dirty = true
+			}
+			return err
+		}
+		written = append(written, qe.EventID)
+	}
+	// the query covered everything the next one can return again
+	next := quarantinePos{Last: last}
+	for i, qe := range rows {
+		if times[i] > last-quarantineOverlap {
+			next.Seen = append(next.Seen, qe.EventID)
+		}
+	}
+	if !known || next.Last != pos.Last || len(written) > 0 || len(next.Seen) != len(pos.Seen) {
+		qc.pos[p] = next
+		qc.dirty = true
+	}
+	return nil
+}
+
+// parseQuarantineRow splits a row of quarantineQuery output.
+func parseQuarantineRow(row string) (qe quarantineEvent, ts float64, ok bool) {
+	f := strings.Split(strings.TrimLeft(row, "\n"), quarantineFieldSep)
+	if len(f) != 10 || f[0] == `` {
+		return
+	}
+	var err error
+	if ts, err = strconv.ParseFloat(f[1], 64); err != nil {
+		return
+	}
+	qe = quarantineEvent{
+		Type:          `quarantine`,
+		EventID:       f[0],
+		Agent:         f[2],
+		AgentBundleID: f[3],
+		DataURL:       f[4],
+		OriginURL:     f[5],
+		OriginTitle:   f[6],
+		SenderName:    f[7],
+		SenderAddress: f[8],
+	}
+	if n, err := strconv.Atoi(f[9]); err == nil && n >= 0 && n < len(quarantineTypes) {
+		qe.Kind = quarantineTypes[n]
+	}
+	return qe, ts, true
+}
+
+// macAbsoluteTime converts seconds since 2001-01-01 UTC.
+func macAbsoluteTime(sec float64) time.Time {
+	whole := math.Floor(sec)
+	return time.Unix(int64(whole)+macEpochOffset, int64((sec-whole)*1e9))
+}
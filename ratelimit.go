@@ -0,0 +1,102 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket counting entries rather than bytes.  It
+// throttles writes to the muxer, unlike the circuit breaker nothing is
+// dropped, backpressure stalls the decoders until the bucket refills.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // entries per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	waited func(time.Duration) // records time spent throttled
+}
+
+// newRateLimiter returns nil when eps is zero, burst defaults to one
+// second's worth of entries.
+func newRateLimiter(eps, burst int) (*rateLimiter, error) {
+	if eps < 0 {
+		return nil, fmt.Errorf("Invalid Rate-Limit-EPS %d", eps)
+	} else if burst < 0 {
+		return nil, fmt.Errorf("Invalid Rate-Limit-Burst %d", burst)
+	} else if eps == 0 {
+		return nil, nil
+	}
+	if burst == 0 {
+		burst = eps
+	}
+	return &rateLimiter{
+		rate:   float64(eps),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		waited: stats.throttled,
+	}, nil
+}
+
+// refill credits tokens earned since the last call, the caller must hold
+// the lock.
+func (rl *rateLimiter) refill(now time.Time) {
+	if rl.tokens += now.Sub(rl.last).Seconds() * rl.rate; rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+}
+
+// setRate changes the rate, tokens earned so far are kept.
+func (rl *rateLimiter) setRate(eps float64) {
+	rl.Lock()
+	rl.refill(time.Now())
+	rl.rate = eps
+	rl.Unlock()
+}
+
+// drain empties the bucket so nothing bursts through.
+func (rl *rateLimiter) drain() {
+	rl.Lock()
+	rl.tokens, rl.last = 0, time.Now()
+	rl.Unlock()
+}
+
+// wait takes n tokens, sleeping until the bucket has paid them back.  A
+// batch larger than the burst is allowed through once the debt is repaid
+// rather than never.
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	if rl == nil || n == 0 {
+		return nil
+	}
+	rl.Lock()
+	rl.refill(time.Now())
+	rl.tokens -= float64(n)
+	debt := -rl.tokens
+	rate := rl.rate
+	rl.Unlock()
+	if debt <= 0 {
+		return nil
+	}
+	d := time.Duration(debt / rate * float64(time.Second))
+	rl.waited(d)
+	tmr := time.NewTimer(d)
+	defer tmr.Stop()
+	select {
+	case <-tmr.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,80 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+type redactConfig struct {
+	Regex       string
+	Replacement string // may reference capture groups, e.g. ${1}
+}
+
+func (rc *redactConfig) compile(name string) (*regexp.Regexp, error) {
+	if rc.Regex == `` {
+		return nil, fmt.Errorf("Redact %q is missing a Regex", name)
+	}
+	re, err := regexp.Compile(rc.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("Redact %q has an invalid Regex: %v", name, err)
+	}
+	return re, nil
+}
+
+type redactRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// redactor rewrites the eventMessage of every event, replacing anything
+// matching the configured expressions.
+type redactor struct {
+	rules []redactRule
+}
+
+// newRedactor builds the rules in name order so the result is deterministic
+// when rules overlap.
+func newRedactor(cfgs map[string]*redactConfig) (*redactor, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(cfgs))
+	for k := range cfgs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	r := &redactor{}
+	for _, n := range names {
+		rc := cfgs[n]
+		if rc == nil {
+			return nil, errors.New("nil Redact config")
+		}
+		re, err := rc.compile(n)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, redactRule{re: re, repl: rc.Replacement})
+	}
+	return r, nil
+}
+
+func (r *redactor) enrich(ev *event) {
+	msg := ev.EventMessage
+	for _, rule := range r.rules {
+		msg = rule.re.ReplaceAllString(msg, rule.repl)
+	}
+	if msg != ev.EventMessage {
+		ev.EventMessage = msg
+		ev.Set("eventMessage", msg)
+	}
+}
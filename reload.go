@@ -0,0 +1,181 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloader applies configuration changes on SIGHUP, or when a remote
+// config changes.  Pipeline stages and stream settings are swapped in
+// place, the ingest connection, spool, and retry queue are left alone so
+// nothing is dropped.  Anything else needs a restart and is only warned
+// about.
+type reloader struct {
+	sync.Mutex
+	path    string
+	remote  *remoteConfig
+	cfg     *cfgType
+	pl      *pipeline
+	streams streamSet
+}
+
+// config returns the configuration currently in effect.
+func (r *reloader) config() *cfgType {
+	r.Lock()
+	defer r.Unlock()
+	return r.cfg
+}
+
+func (r *reloader) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	var refreshC <-chan time.Time
+	if r.remote != nil && r.remote.refresh > 0 {
+		tckr := time.NewTicker(r.remote.refresh)
+		defer tckr.Stop()
+		refreshC = tckr.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			if r.remote != nil {
+				if _, err := r.remote.load(); err != nil {
+					lg.Error("%v\n", err)
+					continue
+				}
+			}
+		case <-refreshC:
+			if changed, err := r.remote.fetch(); err != nil {
+				lg.Warn("Failed to refresh configuration from %s: %v\n", r.remote.url, err)
+				continue
+			} else if !changed {
+				continue
+			}
+		}
+		if err := r.reload(ctx); err != nil {
+			lg.Error("Failed to reload configuration, keeping the current configuration: %v\n", err)
+		}
+	}
+}
+
+func (r *reloader) reload(ctx context.Context) error {
+	lg.Info("Reloading configuration from %s\n", r.path)
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	rc, err := cfg.Global.streamConfig()
+	if err != nil {
+		return err
+	}
+	old := r.config()
+	if cfg.Global.Log_Level != `` && cfg.Global.Log_Level != old.Global.Log_Level {
+		if err = lg.SetLevelString(cfg.Global.Log_Level); err != nil {
+			return err
+		}
+		applyTraceLevel()
+	}
+	if err = r.pl.reload(ctx, cfg); err != nil {
+		return err
+	}
+	r.streams.reconfigure(cfg, rc)
+	if fields := restartRequired(old, cfg); len(fields) > 0 {
+		lg.Warn("Changes to %s only take effect after a restart\n", strings.Join(fields, ", "))
+	}
+	r.Lock()
+	r.cfg = cfg
+	r.Unlock()
+	if err = igst.SetRawConfiguration(currentState(cfg, r.pl)); err != nil {
+		lg.Warn("Failed to update ingester state: %v\n", err)
+	}
+	lg.Info("Configuration reloaded\n")
+	return nil
+}
+
+// fixed returns a copy of the configuration with everything a reload can
+// apply cleared, what's left can only change with a restart.
+func (c cfgType) fixed() cfgType {
+	g := &c.Global
+	g.Log_Level = ``
+	g.Resolve_UIDs, g.UID_Cache_Timeout = false, ``
+	g.Annotate_Architecture, g.Normalize_Severity, g.Severity_Map = false, false, nil
+	g.Minimum_Level, g.Capture_Window, g.Off_Hours_Minimum_Level = ``, nil, ``
+	g.Allow_Subsystems, g.Deny_Subsystems = nil, nil
+	g.Allow_Categories, g.Deny_Categories = nil, nil
+	g.Allow_Processes, g.Deny_Processes = nil, nil
+	g.Drop_Message, g.Sample_Subsystem, g.Aggregate_Window = nil, nil, ``
+	g.Scrub_Profile, g.Error_Context, g.Drop_Summary_Interval = nil, 0, ``
+	g.Circuit_Breaker_EPS, g.Circuit_Breaker_Mode, g.Circuit_Breaker_Sample_Rate = 0, ``, 0
+	g.Pseudonymize_Field, g.Pseudonymize_Salt = nil, ``
+	g.Pseudonymize_Hostname, g.Pseudonymize_Usernames = false, false
+	g.Alert_Tag_Name = ``
+	g.First_Seen_Alerts, g.First_Seen_Learning_Period, g.Seen_Store_Location = false, ``, ``
+	g.Anomaly_Factor, g.Anomaly_Min_Rate = 0, 0
+	g.Max_Restart_Backoff, g.Max_Restart_Attempts, g.Restart_Attempt_Window = ``, 0, ``
+	g.Stream_Idle_Timeout, g.Max_Decode_Buffer, g.Gap_Entries = ``, 0, false
+	g.Read_Buffer_Size, g.Decode_Queue_Depth, g.Parse_Workers = 0, 0, 0
+	g.Batch_Size, g.Batch_Interval = 0, ``
+	g.QoS_Class, g.Backfill_QoS_Class, g.Backfill_Nice = ``, ``, 0
+	g.Rate_Limit_EPS, g.Rate_Limit_Burst = 0, 0
+	g.Predicate = ``
+	c.Site, c.Redact = nil, nil
+	// stream predicates can change, adding or removing streams can't
+	if c.Stream != nil {
+		streams := make(map[string]*streamBlock, len(c.Stream))
+		for k, v := range c.Stream {
+			sb := *v
+			sb.Predicate, sb.Circuit_Breaker_EPS = ``, 0
+			streams[k] = &sb
+		}
+		c.Stream = streams
+	}
+	return c
+}
+
+// restartRequired lists the options that differ between the two
+// configurations but can't be applied by a reload.
+func restartRequired(a, b *cfgType) (names []string) {
+	fa, fb := a.fixed(), b.fixed()
+	va, vb := reflect.ValueOf(fa), reflect.ValueOf(fb)
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if name == `Global` {
+			names = append(names, differingFields(va.Field(i), vb.Field(i))...)
+		} else if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, strings.Replace(name, `_`, `-`, -1))
+		}
+	}
+	return
+}
+
+// differingFields compares two structs field by field, descending into
+// embedded structs.
+func differingFields(a, b reflect.Value) (names []string) {
+	for i := 0; i < a.NumField(); i++ {
+		f := a.Type().Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			names = append(names, differingFields(a.Field(i), b.Field(i))...)
+		} else if f.PkgPath == `` && !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			names = append(names, strings.Replace(f.Name, `_`, `-`, -1))
+		}
+	}
+	return
+}
@@ -0,0 +1,197 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/config"
+)
+
+const (
+	defaultRemoteConfigCache = `/opt/gravwell/etc/macosLog.remote.conf`
+	remoteConfigTimeout      = 30 * time.Second
+	maxRemoteConfigSize      = 1024 * 1024
+)
+
+var (
+	errPinMismatch = errors.New("server public key does not match any configured pin")
+)
+
+// remoteConfig fetches the configuration from a central HTTPS server so a
+// fleet can be reconfigured without pushing files.  Each fetched config is
+// verified and then cached locally, the cache is what actually gets loaded
+// so the ingester still starts when the server can't be reached.
+type remoteConfig struct {
+	url     string
+	pins    [][]byte // SHA-256 hashes of acceptable server public keys
+	cache   string
+	refresh time.Duration // how often to check for changes, zero only fetches at start and on SIGHUP
+}
+
+// newRemoteConfig returns nil when no URL is given.  Pins are comma
+// separated base64 SHA-256 hashes of a certificate's SubjectPublicKeyInfo,
+// the same form curl's --pinnedpubkey takes, any certificate in the chain
+// may match.
+func newRemoteConfig(u, pins, cache, refresh string) (*remoteConfig, error) {
+	if u == `` {
+		return nil, nil
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config URL %q: %v", u, err)
+	} else if pu.Scheme != `https` {
+		return nil, fmt.Errorf("Invalid config URL %q: only https is supported", u)
+	}
+	rc := &remoteConfig{
+		url:   u,
+		cache: cache,
+	}
+	if rc.cache == `` {
+		rc.cache = defaultRemoteConfigCache
+	}
+	for _, p := range strings.Split(pins, `,`) {
+		if p = strings.TrimPrefix(strings.TrimSpace(p), `sha256//`); p == `` {
+			continue
+		}
+		h, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("Invalid config pin %q", p)
+		}
+		rc.pins = append(rc.pins, h)
+	}
+	if refresh != `` {
+		if rc.refresh, err = time.ParseDuration(refresh); err != nil || rc.refresh < 0 {
+			return nil, fmt.Errorf("Invalid config refresh interval %q", refresh)
+		}
+	}
+	return rc, nil
+}
+
+// load fetches the config and returns the path of the cached copy, a
+// failed fetch falls back to the cache from an earlier run.
+func (rc *remoteConfig) load() (string, error) {
+	if _, err := rc.fetch(); err != nil {
+		if _, serr := os.Stat(rc.cache); serr != nil {
+			return ``, fmt.Errorf("Failed to fetch configuration from %s and there is no cached copy: %v", rc.url, err)
+		}
+		lg.Warn("Failed to fetch configuration from %s, using the cached copy: %v\n", rc.url, err)
+	}
+	return rc.cache, nil
+}
+
+// fetch downloads and verifies the config, replacing the cache if it
+// changed.  A config that fails to verify is never cached.
+func (rc *remoteConfig) fetch() (changed bool, err error) {
+	cli := &http.Client{
+		Timeout: remoteConfigTimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				VerifyPeerCertificate: rc.verifyPins,
+			},
+		},
+	}
+	resp, err := cli.Get(rc.url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s returned %s", rc.url, resp.Status)
+		return
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return
+	} else if len(b) > maxRemoteConfigSize {
+		err = fmt.Errorf("configuration is larger than %d bytes", maxRemoteConfigSize)
+		return
+	}
+	var c cfgType
+	if err = config.LoadConfigBytes(&c, b); err != nil {
+		return
+	}
+	if err = applyEnvOverrides(&c); err != nil {
+		return
+	}
+	applyFlagOverrides(&c)
+	if err = verifyConfig(&c); err != nil {
+		return
+	}
+	old, rerr := ioutil.ReadFile(rc.cache)
+	if rerr == nil {
+		// the fleet shares one config, each host keeps its own UUID
+		if line := uuidLineRegex.Find(old); line != nil && !uuidLineRegex.Match(b) {
+			if b, err = putUUIDLine(b, bytes.TrimSpace(line)); err != nil {
+				return
+			}
+		}
+		if bytes.Equal(old, b) {
+			return
+		}
+	}
+	if err = writeFileAtomic(rc.cache, b, 0640); err != nil {
+		return
+	}
+	changed = true
+	return
+}
+
+// verifyPins runs after normal certificate verification, with pins set one
+// of the chain's public keys must match as well.
+func (rc *remoteConfig) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rc.pins) == 0 {
+		return nil
+	}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, p := range rc.pins {
+			if subtle.ConstantTimeCompare(h[:], p) == 1 {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// args returns the flags that reproduce this remote config, e.g. for the
+// launchd service.
+func (rc *remoteConfig) args() []string {
+	args := []string{"-config-url", rc.url, "-config-cache", rc.cache}
+	if len(rc.pins) > 0 {
+		var pins []string
+		for _, p := range rc.pins {
+			pins = append(pins, base64.StdEncoding.EncodeToString(p))
+		}
+		args = append(args, "-config-pin", strings.Join(pins, `,`))
+	}
+	if rc.refresh > 0 {
+		args = append(args, "-config-refresh", rc.refresh.String())
+	}
+	return args
+}
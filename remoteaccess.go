@@ -0,0 +1,195 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultRemoteAccessTag  = `macos-remote-access`
+	remoteAccessStreamName  = `remote-access`
+	screenSharingSubsystem  = `com.apple.screensharing`
+	remoteDesktopSubsystem  = `com.apple.RemoteDesktop`
+	remoteAccessSSH         = `ssh`
+	remoteAccessScreenShare = `screen_sharing`
+	remoteAccessARD         = `remote_desktop`
+)
+
+// the records of sshd, the Screen Sharing daemons, and the Apple Remote
+// Desktop agent
+const remoteAccessPredicate = `process == "sshd" OR process == "sshd-session" OR process == "screensharingd" OR ` +
+	`process == "ARDAgent" OR process == "AppleVNCServer" OR ` +
+	`subsystem BEGINSWITH "com.apple.screensharing" OR subsystem BEGINSWITH "com.apple.RemoteDesktop"`
+
+// the services by process name
+var remoteAccessProcesses = map[string]string{
+	`sshd`:           remoteAccessSSH,
+	`sshd-session`:   remoteAccessSSH,
+	`screensharingd`: remoteAccessScreenShare,
+	`AppleVNCServer`: remoteAccessScreenShare,
+	`ARDAgent`:       remoteAccessARD,
+}
+
+var (
+	// "Accepted publickey for bob from 10.0.0.5 port 52122 ssh2",
+	// "Failed password for invalid user admin from 10.0.0.9 port 5555 ssh2"
+	sshAuthRegex = regexp.MustCompile(`^(Accepted|Failed|Postponed) (\S+) for (?:invalid user )?(\S*) from (\S+) port ([0-9]+)`)
+
+	// "Invalid user admin from 10.0.0.9 port 5555"
+	sshInvalidRegex = regexp.MustCompile(`^Invalid user (\S*) from (\S+) port ([0-9]+)`)
+
+	// "Disconnected from user bob 10.0.0.5 port 52122",
+	// "Connection closed by authenticating user bob 10.0.0.5 port 52122 [preauth]",
+	// "Received disconnect from 10.0.0.5 port 52122:11: disconnected by user"
+	sshDisconnectRegex = regexp.MustCompile(`^(?:Disconnected from|Connection closed by|Received disconnect from|Connection reset by)(?: (?:invalid|authenticating) user| user)? (?:(\S+) )?(\S+) port ([0-9]+)`)
+
+	// "Authentication: SUCCEEDED :: User Name: bob :: Viewer Address: 10.0.0.8 :: Type: DH"
+	screenSharingRegex = regexp.MustCompile(`(?i)authentication: (SUCCEEDED|FAILED) :: User Name: (.*?) :: Viewer Address: (\S+)`)
+
+	// address candidates in the messages without a fixed layout
+	remoteAddrRegex = regexp.MustCompile(`[0-9a-fA-F.:]*[.:][0-9a-fA-F.:]+`)
+)
+
+// remoteAccessConfig is the [Remote-Access] block, it turns on a stream
+// of the ssh, Screen Sharing, and Remote Desktop records with the source
+// address and result normalized.
+type remoteAccessConfig struct {
+	Enable   bool
+	Tag_Name string
+}
+
+func (rc *remoteAccessConfig) verify() error {
+	if !rc.Enable {
+		return nil
+	}
+	if rc.Tag_Name == `` {
+		rc.Tag_Name = defaultRemoteAccessTag
+	}
+	return nil
+}
+
+// remoteAccessFields is the remote_access field added to the records.
+type remoteAccessFields struct {
+	Service       string `json:"service"`          // ssh, screen_sharing, or remote_desktop
+	Event         string `json:"event,omitempty"`  // authentication, invalid_user, or disconnect
+	Result        string `json:"result,omitempty"` // success or failure
+	Method        string `json:"method,omitempty"` // the ssh authentication method or screen sharing type
+	User          string `json:"user,omitempty"`
+	SourceAddress string `json:"source_address,omitempty"`
+	SourcePort    int    `json:"source_port,omitempty"`
+}
+
+// identities lets a Scrub-Profile or the pseudonymizer reach the user and
+// source address.
+func (rf *remoteAccessFields) identities(fn func(name string, kind int, v *string)) {
+	fn(`user`, identityUser, &rf.User)
+	fn(`source_address`, identityHost, &rf.SourceAddress)
+}
+
+// remoteAccessNormalizer pulls the user, source address, and result out
+// of the remote access daemons' messages into a remote_access field.
+type remoteAccessNormalizer struct{}
+
+func (remoteAccessNormalizer) enrich(ev *event) {
+	svc, ok := remoteAccessProcesses[filepath.Base(ev.ProcessImagePath)]
+	if !ok {
+		switch {
+		case strings.HasPrefix(ev.Subsystem, screenSharingSubsystem):
+			svc = remoteAccessScreenShare
+		case strings.HasPrefix(ev.Subsystem, remoteDesktopSubsystem):
+			svc = remoteAccessARD
+		default:
+			return
+		}
+	}
+	if rf, ok := parseRemoteAccessMessage(svc, ev.EventMessage); ok {
+		ev.Set("remote_access", &rf)
+	}
+}
+
+// parseRemoteAccessMessage returns the fields of a message, false if it
+// doesn't name a source address or an authentication result.
+func parseRemoteAccessMessage(svc, msg string) (rf remoteAccessFields, ok bool) {
+	rf.Service = svc
+	msg = strings.TrimSpace(msg)
+	if svc == remoteAccessSSH {
+		return parseSSHMessage(rf, msg)
+	}
+	if m := screenSharingRegex.FindStringSubmatch(msg); m != nil {
+		rf.Event, rf.Result = `authentication`, `success`
+		if strings.EqualFold(m[1], `FAILED`) {
+			rf.Result = `failure`
+		}
+		rf.User, rf.SourceAddress = strings.TrimSpace(m[2]), m[3]
+		if i := strings.Index(msg, `:: Type: `); i >= 0 {
+			rf.Method = strings.TrimSpace(msg[i+9:])
+		}
+		return rf, true
+	}
+	lower := strings.ToLower(msg)
+	if strings.Contains(lower, `authentication`) || strings.Contains(lower, `login`) {
+		rf.Event = `authentication`
+		switch {
+		case strings.Contains(lower, `fail`) || strings.Contains(lower, `denied`):
+			rf.Result, ok = `failure`, true
+		case strings.Contains(lower, `succe`):
+			rf.Result, ok = `success`, true
+		}
+	}
+	if addr := findRemoteAddr(msg); addr != `` {
+		rf.SourceAddress, ok = addr, true
+	}
+	if !ok {
+		rf.Event = ``
+	}
+	return
+}
+
+func parseSSHMessage(rf remoteAccessFields, msg string) (remoteAccessFields, bool) {
+	if m := sshAuthRegex.FindStringSubmatch(msg); m != nil {
+		rf.Event, rf.Method, rf.User, rf.SourceAddress = `authentication`, m[2], m[3], m[4]
+		rf.SourcePort, _ = strconv.Atoi(m[5])
+		switch m[1] {
+		case `Accepted`:
+			rf.Result = `success`
+		case `Failed`:
+			rf.Result = `failure`
+		}
+		return rf, true
+	}
+	if m := sshInvalidRegex.FindStringSubmatch(msg); m != nil {
+		rf.Event, rf.Result, rf.User, rf.SourceAddress = `invalid_user`, `failure`, m[1], m[2]
+		rf.SourcePort, _ = strconv.Atoi(m[3])
+		return rf, true
+	}
+	if m := sshDisconnectRegex.FindStringSubmatch(msg); m != nil {
+		rf.Event, rf.User, rf.SourceAddress = `disconnect`, m[1], m[2]
+		rf.SourcePort, _ = strconv.Atoi(m[3])
+		return rf, true
+	}
+	return rf, false
+}
+
+// findRemoteAddr returns the first IP address in a message.
+func findRemoteAddr(msg string) string {
+	for _, c := range remoteAddrRegex.FindAllString(msg, -1) {
+		// sentence punctuation trails some of them
+		for _, a := range []string{c, strings.TrimRight(c, `.:`)} {
+			if ip := net.ParseIP(a); ip != nil && !ip.IsUnspecified() {
+				return ip.String()
+			}
+		}
+	}
+	return ``
+}
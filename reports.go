@@ -0,0 +1,541 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultReportsTag      = `macos-crash`
+	defaultReportsInterval = `30s`
+	defaultReportsMaxAge   = 24 * time.Hour
+	defaultReportsStore    = `/opt/gravwell/etc/macosLog.reports`
+	defaultMaxReportKB     = 1024
+	systemReportsDir       = `/Library/Logs/DiagnosticReports`
+	userReportsGlob        = `/Users/*/Library/Logs/DiagnosticReports`
+	reportSettle           = 5 * time.Second // reports this new may still be being written
+)
+
+// time formats used in report headers
+var reportTimeFormats = []string{
+	`2006-01-02 15:04:05.00 -0700`,
+	`2006-01-02 15:04:05.000 -0700`,
+	`2006-01-02 15:04:05 -0700`,
+}
+
+var errNotReport = errors.New("not a recognized report")
+
+// reportsConfig is the [Diagnostic-Reports] block.
+type reportsConfig struct {
+	Enable          bool
+	Tag_Name        string
+	Interval        string   // how often the report directories are scanned
+	Directory       []string // scanned as well as the system and per user DiagnosticReports
+	Max_Age         string   // reports older than this when first found are skipped
+	Store_Location  string   // file the processed reports are tracked in
+	Max_Report_Size int      // KB of report body included, larger bodies are left out
+}
+
+func (rc *reportsConfig) verify() error {
+	if !rc.Enable {
+		return nil
+	}
+	if rc.Tag_Name == `` {
+		rc.Tag_Name = defaultReportsTag
+	}
+	if rc.Interval == `` {
+		rc.Interval = defaultReportsInterval
+	}
+	if _, err := (snapshotConfig{Interval: rc.Interval}).interval(); err != nil {
+		return fmt.Errorf("Diagnostic-Reports: %v", err)
+	}
+	if _, err := rc.maxAge(); err != nil {
+		return err
+	}
+	if rc.Max_Report_Size < 0 {
+		return fmt.Errorf("Diagnostic-Reports: Invalid Max-Report-Size %d", rc.Max_Report_Size)
+	}
+	return nil
+}
+
+func (rc reportsConfig) maxAge() (time.Duration, error) {
+	if rc.Max_Age == `` {
+		return defaultReportsMaxAge, nil
+	}
+	d, err := time.ParseDuration(rc.Max_Age)
+	if err != nil {
+		return 0, fmt.Errorf("Diagnostic-Reports: Invalid Max-Age %q: %v", rc.Max_Age, err)
+	}
+	return d, nil
+}
+
+func (rc reportsConfig) storeLocation() string {
+	if rc.Store_Location == `` {
+		return defaultReportsStore
+	}
+	return rc.Store_Location
+}
+
+// diagReport is the entry written for each report.  The summary fields
+// are pulled out of whichever format the report is in so crashes, hangs,
+// and jetsam kills can be queried the same way, the full report follows as
+// JSON or, for the text formats, as text.
+type diagReport struct {
+	File          string          `json:"file"`
+	Format        string          `json:"format"`
+	Event         string          `json:"event,omitempty"` // crash, hang, spin, jetsam, cpu usage, ...
+	User          string          `json:"user,omitempty"`  // owner of the per user directory it was found in
+	BugType       string          `json:"bug_type,omitempty"`
+	Process       string          `json:"process,omitempty"`
+	PID           int             `json:"pid,omitempty"`
+	ProcessPath   string          `json:"process_path,omitempty"`
+	Parent        string          `json:"parent_process,omitempty"`
+	BundleID      string          `json:"bundle_id,omitempty"`
+	Version       string          `json:"version,omitempty"`
+	OSVersion     string          `json:"os_version,omitempty"`
+	Incident      string          `json:"incident_id,omitempty"`
+	Exception     string          `json:"exception_type,omitempty"`
+	Signal        string          `json:"signal,omitempty"`
+	Termination   string          `json:"termination,omitempty"`
+	CrashedThread *int            `json:"crashed_thread,omitempty"`
+	Duration      float64         `json:"duration_seconds,omitempty"` // how long a hang or spin lasted
+	Reason        string          `json:"reason,omitempty"`           // why a process was killed or reported
+	Killed        []jetsamProcess `json:"killed,omitempty"`
+	Largest       string          `json:"largest_process,omitempty"` // the biggest process at a jetsam event
+	Timestamp     string          `json:"timestamp,omitempty"`
+	Header        json.RawMessage `json:"header,omitempty"`
+	Report        json.RawMessage `json:"report,omitempty"`
+	Text          string          `json:"text,omitempty"`
+	Truncated     bool            `json:"truncated,omitempty"` // the body was over Max-Report-Size and left out
+}
+
+// identities lets a Scrub-Profile or the pseudonymizer reach the owner and
+// the paths, which are under the owner's home for per user reports.
+func (cr *diagReport) identities(fn func(name string, kind int, v *string)) {
+	fn(`file`, identityPath, &cr.File)
+	fn(`user`, identityUser, &cr.User)
+	fn(`process_path`, identityPath, &cr.ProcessPath)
+}
+
+// reportParser fills in a report from the file contents, returning when the
+// report was written if it says.
+type reportParser func(b []byte, cr *diagReport) (time.Time, error)
+
+// parsers by file extension
+var reportParsers = map[string]reportParser{
+	`.ips`:   parseIPSReport,
+	`.crash`: parseCrashReport,
+	`.hang`:  spindumpParser(`hang`),
+	`.spin`:  spindumpParser(`spin`),
+	`.diag`:  spindumpParser(`resource`),
+}
+
+// events by ips bug_type, anything else is named from the file
+var ipsEvents = map[string]string{
+	`109`: `crash`,
+	`309`: `crash`,
+	`298`: `jetsam`,
+	`210`: `panic`,
+}
+
+// file name markers of the resource reports
+var resourceEvents = []string{`cpu_resource`, `wakeups_resource`, `diskwrites_resource`}
+
+// reportCollector scans the DiagnosticReports directories and ingests each
+// new crash, hang, spin, resource, and jetsam report as an entry.
+type reportCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	maxAge   time.Duration
+	maxBody  int
+	dirs     []string
+	src      *sourceTracker
+	pl       *pipeline
+	done     *processedFiles
+}
+
+func startReportCollector(ctx context.Context, wg *sync.WaitGroup, cfg reportsConfig, src *sourceTracker, pl *pipeline) error {
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve diagnostic reports tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	maxAge, err := cfg.maxAge()
+	if err != nil {
+		return err
+	}
+	rc := &reportCollector{
+		tag:      tag,
+		interval: interval,
+		maxAge:   maxAge,
+		maxBody:  defaultMaxReportKB * 1024,
+		dirs:     append([]string{systemReportsDir, userReportsGlob}, cfg.Directory...),
+		src:      src,
+		pl:       pl,
+		done:     loadProcessedFiles(cfg.storeLocation(), pl.ephemeral),
+	}
+	if cfg.Max_Report_Size > 0 {
+		rc.maxBody = cfg.Max_Report_Size * 1024
+	}
+	wg.Add(1)
+	go rc.run(ctx, wg)
+	return nil
+}
+
+func (rc *reportCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(rc.interval)
+	defer tckr.Stop()
+	for {
+		if err := rc.scan(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to ingest diagnostic reports: %v\n", err)
+		}
+		if err := rc.done.persist(); err != nil {
+			lg.Warn("Failed to save processed reports: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+// scan ingests every report that hasn't been seen, reports that are too
+// old when first found are only marked as seen.
+func (rc *reportCollector) scan(ctx context.Context) error {
+	now := time.Now()
+	present := map[string]bool{}
+	for _, pattern := range rc.dirs {
+		dirs, _ := filepath.Glob(pattern)
+		for _, dir := range dirs {
+			fis, err := ioutil.ReadDir(dir)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					lg.Debug("Failed to read %s: %v\n", dir, err)
+				}
+				continue
+			}
+			for _, fi := range fis {
+				parse, ok := reportParsers[filepath.Ext(fi.Name())]
+				if !ok || !fi.Mode().IsRegular() {
+					continue
+				}
+				p := filepath.Join(dir, fi.Name())
+				present[p] = true
+				if rc.done.done(p, fi.ModTime()) || now.Sub(fi.ModTime()) < reportSettle {
+					continue
+				}
+				if rc.maxAge <= 0 || now.Sub(fi.ModTime()) <= rc.maxAge {
+					if err := rc.ingest(ctx, p, fi, parse); err == context.Canceled {
+						return err
+					} else if err != nil {
+						lg.Warn("Failed to ingest report %s: %v\n", p, err)
+					}
+				}
+				rc.done.mark(p, fi.ModTime())
+			}
+		}
+	}
+	rc.done.prune(present)
+	return nil
+}
+
+func (rc *reportCollector) ingest(ctx context.Context, p string, fi os.FileInfo, parse reportParser) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	cr := diagReport{
+		File: p,
+		User: reportOwner(p),
+	}
+	ts, err := parse(b, &cr)
+	if err != nil {
+		return err
+	}
+	if len(cr.Report)+len(cr.Text) > rc.maxBody {
+		cr.Report, cr.Text, cr.Truncated = nil, ``, true
+	}
+	if ts.IsZero() {
+		ts = fi.ModTime()
+	}
+	rc.pl.protect(`report`, &cr)
+	return emitJSON(ctx, rc.tag, rc.src, ts, cr)
+}
+
+// reportOwner returns the user whose home a report was found in.
+func reportOwner(p string) string {
+	if !strings.HasPrefix(p, `/Users/`) {
+		return ``
+	}
+	user := strings.TrimPrefix(p, `/Users/`)
+	if i := strings.IndexByte(user, '/'); i > 0 {
+		return user[:i]
+	}
+	return ``
+}
+
+func parseReportTime(s string) time.Time {
+	for _, f := range reportTimeFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ipsHeader holds the fields of interest from the single line JSON header
+// that starts every .ips report.
+type ipsHeader struct {
+	AppName   string          `json:"app_name"`
+	Name      string          `json:"name"`
+	Timestamp string          `json:"timestamp"`
+	BugType   json.RawMessage `json:"bug_type"` // a string, but not always
+	OSVersion string          `json:"os_version"`
+	Incident  string          `json:"incident_id"`
+	Version   string          `json:"app_version"`
+	BundleID  string          `json:"bundleID"`
+}
+
+// ipsBody holds the fields of interest from a crash report body.
+type ipsBody struct {
+	ProcName   string `json:"procName"`
+	ProcPath   string `json:"procPath"`
+	PID        int    `json:"pid"`
+	ParentProc string `json:"parentProc"`
+	Exception  struct {
+		Type   string `json:"type"`
+		Signal string `json:"signal"`
+	} `json:"exception"`
+	Termination struct {
+		Namespace string `json:"namespace"`
+		Indicator string `json:"indicator"`
+	} `json:"termination"`
+	FaultingThread *int `json:"faultingThread"`
+	BundleInfo     struct {
+		ID      string `json:"CFBundleIdentifier"`
+		Version string `json:"CFBundleShortVersionString"`
+	} `json:"bundleInfo"`
+
+	// jetsam events
+	LargestProcess string          `json:"largestProcess"`
+	Processes      []jetsamProcess `json:"processes"`
+}
+
+// jetsamProcess is a process listed in a jetsam event, the ones that were
+// killed have a reason.
+type jetsamProcess struct {
+	Name   string `json:"name"`
+	PID    int    `json:"pid"`
+	Reason string `json:"reason,omitempty"`
+	Pages  int    `json:"rpages,omitempty"` // resident pages
+}
+
+// parseIPSReport handles the .ips format, a line of JSON metadata followed
+// by the report.  Crash reports carry a JSON body, other report types may
+// be text.
+func parseIPSReport(b []byte, cr *diagReport) (time.Time, error) {
+	cr.Format = `ips`
+	line, rest := b, []byte(nil)
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line, rest = b[:i], b[i+1:]
+	}
+	var hdr ipsHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return time.Time{}, fmt.Errorf("bad report header: %v", err)
+	}
+	cr.Header = json.RawMessage(bytes.TrimSpace(line))
+	cr.Process = hdr.AppName
+	if cr.Process == `` {
+		cr.Process = hdr.Name
+	}
+	cr.BugType = strings.Trim(string(hdr.BugType), `"`)
+	cr.OSVersion, cr.Incident = hdr.OSVersion, hdr.Incident
+	cr.Version, cr.BundleID = hdr.Version, hdr.BundleID
+	cr.Timestamp = hdr.Timestamp
+
+	if rest = bytes.TrimSpace(rest); len(rest) == 0 {
+		return parseReportTime(hdr.Timestamp), nil
+	}
+	var body ipsBody
+	if json.Valid(rest) && json.Unmarshal(rest, &body) == nil {
+		var buf bytes.Buffer
+		if json.Compact(&buf, rest) == nil {
+			cr.Report = buf.Bytes()
+		}
+		if body.ProcName != `` {
+			cr.Process = body.ProcName
+		}
+		cr.ProcessPath, cr.PID, cr.Parent = body.ProcPath, body.PID, body.ParentProc
+		cr.Exception, cr.Signal = body.Exception.Type, body.Exception.Signal
+		if body.Termination.Indicator != `` {
+			cr.Termination = strings.TrimSpace(body.Termination.Namespace + ` ` + body.Termination.Indicator)
+		}
+		cr.CrashedThread = body.FaultingThread
+		if body.BundleInfo.ID != `` {
+			cr.BundleID = body.BundleInfo.ID
+		}
+		if body.BundleInfo.Version != `` {
+			cr.Version = body.BundleInfo.Version
+		}
+		cr.Largest = body.LargestProcess
+		for _, p := range body.Processes {
+			if p.Reason != `` {
+				cr.Killed = append(cr.Killed, p)
+			}
+		}
+		if len(cr.Killed) > 0 {
+			// the first kill stands for the event, the rest are listed
+			cr.Process, cr.PID, cr.Reason = cr.Killed[0].Name, cr.Killed[0].PID, cr.Killed[0].Reason
+		}
+	} else {
+		cr.Text = string(rest)
+	}
+	cr.Event = reportEvent(cr.File, cr.BugType)
+	return parseReportTime(hdr.Timestamp), nil
+}
+
+// reportEvent names the kind of report an .ips file holds.
+func reportEvent(file, bugType string) string {
+	if ev, ok := ipsEvents[bugType]; ok {
+		return ev
+	}
+	base := filepath.Base(file)
+	if strings.HasPrefix(base, `JetsamEvent`) {
+		return `jetsam`
+	}
+	for _, ev := range resourceEvents {
+		if strings.Contains(base, ev) {
+			return ev
+		}
+	}
+	return ``
+}
+
+// parseCrashReport handles the legacy text crash format.
+func parseCrashReport(b []byte, cr *diagReport) (time.Time, error) {
+	cr.Format, cr.Event = `crash`, `crash`
+	return parseTextReport(b, cr, `Thread 0`, `Binary Images:`)
+}
+
+// spindumpParser handles the spindump text format used by hang, spin, and
+// resource (.diag) reports, the event is in the report but defaults to the
+// kind of file.
+func spindumpParser(event string) reportParser {
+	return func(b []byte, cr *diagReport) (time.Time, error) {
+		cr.Format = `spindump`
+		ts, err := parseTextReport(b, cr, `Process:`, `Heaviest stack`, `Thread `, `Binary Images:`)
+		if cr.Event == `` {
+			cr.Event = event
+		}
+		return ts, err
+	}
+}
+
+// parseTextReport pulls the summary out of the "Key: value" lines at the
+// top of a text report, stopping at the first line with one of the stop
+// prefixes.
+func parseTextReport(b []byte, cr *diagReport, stops ...string) (time.Time, error) {
+	cr.Text = string(b)
+	var ts time.Time
+	var found bool
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+scan:
+	for sc.Scan() {
+		line := sc.Text()
+		for _, stop := range stops {
+			if strings.HasPrefix(line, stop) {
+				break scan
+			}
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		key, val := line[:i], strings.TrimSpace(line[i+1:])
+		found = true
+		switch key {
+		case `Process`, `Command`:
+			// "Safari [1234]" in crash reports, just the name in spindumps
+			cr.Process = val
+			if j := strings.LastIndexByte(val, '['); j > 0 && strings.HasSuffix(val, `]`) {
+				cr.Process = strings.TrimSpace(val[:j])
+				cr.PID, _ = strconv.Atoi(val[j+1 : len(val)-1])
+			}
+		case `PID`:
+			cr.PID, _ = strconv.Atoi(val)
+		case `Path`:
+			cr.ProcessPath = val
+		case `Identifier`:
+			cr.BundleID = val
+		case `Version`:
+			cr.Version = val
+		case `Parent Process`:
+			cr.Parent = val
+		case `OS Version`:
+			cr.OSVersion = val
+		case `Incident Identifier`:
+			cr.Incident = val
+		case `Date/Time`:
+			cr.Timestamp = val
+			ts = parseReportTime(val)
+		case `Event`:
+			cr.Event = strings.ToLower(val)
+		case `Duration`:
+			// "5.00s"
+			cr.Duration, _ = strconv.ParseFloat(strings.TrimSuffix(val, `s`), 64)
+		case `Reason`, `CPU`, `Wakeups`, `Writes`:
+			// resource reports describe the limit that was exceeded
+			cr.Reason = val
+		case `Exception Type`:
+			// "EXC_BAD_ACCESS (SIGSEGV)"
+			cr.Exception = val
+			if j := strings.IndexByte(val, '('); j > 0 && strings.HasSuffix(val, `)`) {
+				cr.Exception = strings.TrimSpace(val[:j])
+				cr.Signal = val[j+1 : len(val)-1]
+			}
+		case `Termination Reason`:
+			cr.Termination = val
+		case `Crashed Thread`:
+			// "0  Dispatch queue: com.apple.main-thread"
+			if f := strings.Fields(val); len(f) > 0 {
+				if n, err := strconv.Atoi(f[0]); err == nil {
+					cr.CrashedThread = &n
+				}
+			}
+		}
+	}
+	if !found {
+		return ts, errNotReport
+	}
+	return ts, nil
+}
@@ -0,0 +1,313 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultRetryQueueMB = 16
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// batchWriter hands batches to the muxer, batches that fail to write or
+// arrive while there are no connections are queued and retried with backoff
+// so a transient indexer hiccup doesn't lose entries.  While anything is
+// queued new batches are queued behind it so entries are still written in
+// order.  The queue is bounded, once it is full writers block until it has
+// drained to half its size which stops reading from the log child and lets
+// the pipe buffer absorb the backlog instead of our memory.  The queue's
+// head batch belongs to run while it is running, close stops run and waits
+// for it before touching the queue so a batch is never written twice.
+type batchWriter struct {
+	sync.Mutex
+	queue   [][]*entry.Entry
+	size    int // bytes of entry data queued
+	max     int
+	pauses  uint64
+	resume  chan struct{} // closed once a full queue has drained
+	kick    chan struct{}
+	stop    chan struct{}        // closed by close to stop run
+	done    chan struct{}        // closed once run returns, nil if it never ran
+	spool   *spool               // when set batches go to disk first and are forwarded from there
+	pacer   *backlogPacer        // paces retries, nil when unlimited
+	written func([]*entry.Entry) // called after each successful write
+}
+
+func newBatchWriter(maxBytes int, written func([]*entry.Entry)) *batchWriter {
+	return &batchWriter{
+		max:     maxBytes,
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		written: written,
+	}
+}
+
+// write writes a batch or queues it for retry, blocking while the queue is
+// full.  Only context cancellation is returned, queued entries still get a
+// final attempt when the writer shuts down.
+func (w *batchWriter) write(ctx context.Context, ents []*entry.Entry) error {
+	if len(ents) == 0 {
+		return nil
+	}
+	if w.spool != nil {
+		err := w.spool.append(ents)
+		if err == nil {
+			return nil
+		}
+		lg.Error("Failed to spool %d entries: %v\n", len(ents), err)
+	}
+	w.Lock()
+	pending := len(w.queue) > 0
+	if !pending {
+		if hot, err := igst.Hot(); err == nil && hot == 0 {
+			// don't block on a muxer with nowhere to send
+			pending = true
+			w.pacer.interrupted()
+		}
+	}
+	if pending {
+		w.enqueue(ents)
+		return w.waitForRoom(ctx)
+	}
+	w.Unlock()
+	if err := writeBatch(ctx, ents); err != nil {
+		w.Lock()
+		w.enqueue(ents)
+		if err == context.Canceled {
+			// close gives it one more try
+			w.Unlock()
+			return err
+		}
+		lg.Warn("Failed to write %d entries, queueing for retry: %v\n", len(ents), err)
+		stats.batchFailure(err)
+		w.pacer.interrupted()
+		return w.waitForRoom(ctx)
+	}
+	w.written(ents)
+	return nil
+}
+
+// waitForRoom blocks while the queue is over its limit, the caller must
+// hold the lock which is released on return.
+func (w *batchWriter) waitForRoom(ctx context.Context) error {
+	for w.size > w.max {
+		if w.resume == nil {
+			w.resume = make(chan struct{})
+			w.pauses++
+			lg.Warn("Retry queue is full, pausing reads until it drains\n")
+		}
+		resume := w.resume
+		w.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resume:
+		}
+		w.Lock()
+	}
+	w.Unlock()
+	return nil
+}
+
+// enqueue adds a batch to the retry queue, the caller must hold the lock.
+func (w *batchWriter) enqueue(ents []*entry.Entry) {
+	w.queue = append(w.queue, ents)
+	w.size += batchSize(ents)
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// head returns the oldest queued batch.
+func (w *batchWriter) head() []*entry.Entry {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.queue) == 0 {
+		return nil
+	}
+	return w.queue[0]
+}
+
+// pop removes the oldest queued batch, waking paused writers once the
+// queue has drained to half its limit.
+func (w *batchWriter) pop() {
+	w.Lock()
+	if len(w.queue) > 0 {
+		w.size -= batchSize(w.queue[0])
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+	}
+	if w.resume != nil && w.size <= w.max/2 {
+		lg.Info("Retry queue drained, resuming reads\n")
+		close(w.resume)
+		w.resume = nil
+	}
+	w.Unlock()
+}
+
+// run retries queued batches until the context is cancelled or close stops
+// it, anything still queued is left for close.
+func (w *batchWriter) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	w.Lock()
+	select {
+	case <-w.stop:
+		// closed before it got going
+		w.Unlock()
+		return
+	default:
+	}
+	w.done = make(chan struct{})
+	defer close(w.done)
+	w.Unlock()
+	if w.spool != nil {
+		wg.Add(1)
+		go w.spool.run(ctx, wg)
+	}
+	// stopping cuts short a write or backoff in progress
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	bo := newBackoff(defaultBackoffMin, maxRetryBackoff)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.kick:
+		}
+		for ents := w.head(); ents != nil; ents = w.head() {
+			w.pacer.wait(ctx, len(ents))
+			if err := writeBatch(ctx, ents); err != nil {
+				if err == context.Canceled {
+					break
+				}
+				lg.Debug("Retrying %d entries failed: %v\n", len(ents), err)
+				stats.batchFailure(err)
+				w.pacer.interrupted()
+				if !bo.wait(ctx) {
+					break
+				}
+				continue
+			}
+			bo.reset()
+			w.pop()
+			w.written(ents)
+		}
+	}
+}
+
+// park queues a batch without attempting to write it, it is spooled if
+// there is a spool.
+func (w *batchWriter) park(ents []*entry.Entry) {
+	if len(ents) == 0 {
+		return
+	}
+	if w.spool != nil {
+		if err := w.spool.append(ents); err == nil {
+			return
+		}
+	}
+	w.Lock()
+	w.enqueue(ents)
+	w.Unlock()
+}
+
+// close stops run and waits for it to let go of the head batch, then makes
+// a last attempt at writing anything still queued, giving up when the
+// context expires.  Spooled entries are left on disk for the next start.
+// Nothing may be written once close has been called.
+func (w *batchWriter) close(ctx context.Context) {
+	if w.spool != nil {
+		w.spool.close()
+	}
+	w.Lock()
+	close(w.stop)
+	done := w.done
+	w.Unlock()
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			w.Lock()
+			var lost int
+			for _, ents := range w.queue {
+				lost += len(ents)
+			}
+			w.Unlock()
+			lg.Error("Gave up waiting on the retry writer, %d queued entries were not written\n", lost)
+			return
+		}
+	}
+	w.Lock()
+	queue := w.queue
+	w.queue, w.size = nil, 0
+	if w.resume != nil {
+		close(w.resume)
+		w.resume = nil
+	}
+	w.Unlock()
+	for i, ents := range queue {
+		if err := writeBatch(ctx, ents); err != nil {
+			var lost int
+			for _, ents := range queue[i:] {
+				lost += len(ents)
+			}
+			lg.Error("Failed to write %d queued entries: %v\n", lost, err)
+			return
+		}
+		w.written(ents)
+	}
+}
+
+// depth returns the bytes waiting in the retry queue and the spool.
+func (w *batchWriter) depth() (queued int, spooled int64) {
+	w.Lock()
+	queued = w.size
+	w.Unlock()
+	if w.spool != nil {
+		spooled, _ = w.spool.bytes()
+	}
+	return
+}
+
+func (w *batchWriter) report() {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.queue) > 0 || w.pauses > 0 {
+		lg.Info("Retry queue: %d batches, %d bytes queued, reads paused %d times\n", len(w.queue), w.size, w.pauses)
+	}
+}
+
+// writeBatch is the single path batches take to the muxer.
+func writeBatch(ctx context.Context, ents []*entry.Entry) error {
+	if err := chaosWriteFailure(); err != nil {
+		return err
+	}
+	return igst.WriteBatchContext(ctx, ents)
+}
+
+func batchSize(ents []*entry.Entry) (n int) {
+	for _, ent := range ents {
+		n += len(ent.Data)
+	}
+	return
+}
@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type sampleRule struct {
+	match globList
+	rate  int
+}
+
+// sampler keeps roughly one in N records from matching subsystems.  Kept
+// records are annotated with sampled=true and the rate so counts can be
+// scaled back up at query time.
+type sampler struct {
+	sync.Mutex
+	rules []sampleRule
+	rnd   *rand.Rand
+}
+
+// newSampler parses rules of the form "subsystem-glob:N".
+func newSampler(rules []string) (*sampler, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	s := &sampler{
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, r := range rules {
+		idx := strings.LastIndex(r, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("Invalid Sample-Subsystem %q, expected subsystem:rate", r)
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(r[idx+1:]))
+		if err != nil || rate < 1 {
+			return nil, fmt.Errorf("Invalid Sample-Subsystem %q, rate must be a positive integer", r)
+		}
+		gl, err := newGlobList([]string{strings.TrimSpace(r[:idx])})
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Sample-Subsystem %q: %v", r, err)
+		}
+		s.rules = append(s.rules, sampleRule{match: gl, rate: rate})
+	}
+	return s, nil
+}
+
+// keep applies the first matching rule.
+func (s *sampler) keep(ev *event) bool {
+	for _, r := range s.rules {
+		if !r.match.match(ev.Subsystem) {
+			continue
+		}
+		if r.rate == 1 {
+			return true
+		}
+		s.Lock()
+		hit := s.rnd.Intn(r.rate) == 0
+		s.Unlock()
+		if hit {
+			ev.Set("sampled", true)
+			ev.Set("rate", r.rate)
+		}
+		return hit
+	}
+	return true
+}
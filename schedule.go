@@ -0,0 +1,161 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	weekdays = map[string]time.Weekday{
+		`sun`: time.Sunday,
+		`mon`: time.Monday,
+		`tue`: time.Tuesday,
+		`wed`: time.Wednesday,
+		`thu`: time.Thursday,
+		`fri`: time.Friday,
+		`sat`: time.Saturday,
+	}
+)
+
+// captureWindow is a daily span of local time, optionally restricted to
+// some days of the week.  A window whose end is before its start wraps past
+// midnight and belongs to the day it started on.
+type captureWindow struct {
+	days       [7]bool
+	start, end int // minutes past midnight
+}
+
+// parseCaptureWindow parses "[days ]HH:MM-HH:MM" where days is a comma
+// separated list of days or day ranges, e.g. "Mon-Fri 07:00-19:00".
+func parseCaptureWindow(s string) (cw captureWindow, err error) {
+	flds := strings.Fields(s)
+	var span string
+	switch len(flds) {
+	case 1:
+		span = flds[0]
+		for i := range cw.days {
+			cw.days[i] = true
+		}
+	case 2:
+		span = flds[1]
+		if err = parseDays(flds[0], &cw.days); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("Invalid Capture-Window %q, expected [days ]HH:MM-HH:MM", s)
+		return
+	}
+	parts := strings.Split(span, "-")
+	if len(parts) != 2 {
+		err = fmt.Errorf("Invalid Capture-Window %q, expected [days ]HH:MM-HH:MM", s)
+		return
+	}
+	if cw.start, err = parseClock(parts[0]); err != nil {
+		return
+	}
+	cw.end, err = parseClock(parts[1])
+	return
+}
+
+func parseDays(s string, days *[7]bool) error {
+	for _, d := range strings.Split(strings.ToLower(s), ",") {
+		rng := strings.Split(d, "-")
+		first, ok := weekdays[rng[0]]
+		if !ok {
+			return fmt.Errorf("Invalid day %q", rng[0])
+		}
+		last := first
+		if len(rng) == 2 {
+			if last, ok = weekdays[rng[1]]; !ok {
+				return fmt.Errorf("Invalid day %q", rng[1])
+			}
+		} else if len(rng) > 2 {
+			return fmt.Errorf("Invalid day range %q", d)
+		}
+		for i := first; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (cw captureWindow) contains(t time.Time) bool {
+	min := t.Hour()*60 + t.Minute()
+	if cw.start <= cw.end {
+		return cw.days[t.Weekday()] && min >= cw.start && min < cw.end
+	}
+	// wraps midnight, the early morning part belongs to the previous day
+	if min >= cw.start {
+		return cw.days[t.Weekday()]
+	} else if min < cw.end {
+		return cw.days[(t.Weekday()+6)%7]
+	}
+	return false
+}
+
+// scheduleFilter only passes records inside the capture windows.  If an
+// off hours level is set records at or above it still pass outside the
+// windows, so e.g. debug noise can be suppressed at night while errors
+// still flow.
+type scheduleFilter struct {
+	windows  []captureWindow
+	offHours *levelFilter // nil drops everything outside the windows
+	now      func() time.Time
+}
+
+func newScheduleFilter(windows []string, offHoursLevel string) (*scheduleFilter, error) {
+	if len(windows) == 0 {
+		if offHoursLevel != `` {
+			return nil, fmt.Errorf("Off-Hours-Minimum-Level requires a Capture-Window")
+		}
+		return nil, nil
+	}
+	sf := &scheduleFilter{
+		now: time.Now,
+	}
+	for _, w := range windows {
+		cw, err := parseCaptureWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		sf.windows = append(sf.windows, cw)
+	}
+	var err error
+	if sf.offHours, err = newLevelFilter(offHoursLevel); err != nil {
+		return nil, fmt.Errorf("Off-Hours-Minimum-Level: %v", err)
+	}
+	return sf, nil
+}
+
+func (sf *scheduleFilter) keep(ev *event) bool {
+	now := sf.now()
+	for _, w := range sf.windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	if sf.offHours != nil {
+		return sf.offHours.keep(ev)
+	}
+	return false
+}
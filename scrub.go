@@ -0,0 +1,228 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	scrubHomePaths = `home-paths`
+	scrubUsernames = `usernames`
+	scrubAppleIDs  = `apple-ids`
+	scrubHosts     = `remote-hosts`
+	scrubGDPR      = `gdpr`
+)
+
+var (
+	scrubProfiles = map[string][]string{
+		scrubHomePaths: {scrubHomePaths},
+		scrubUsernames: {scrubUsernames},
+		scrubAppleIDs:  {scrubAppleIDs},
+		scrubHosts:     {scrubHosts},
+		scrubGDPR:      {scrubHomePaths, scrubUsernames, scrubAppleIDs, scrubHosts},
+	}
+
+	// Apple IDs are email addresses
+	appleIDRegex   = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	homePathRegex  = regexp.MustCompile(`/Users/[^/\s'":,;]+`)
+	userFieldRegex = regexp.MustCompile(`(?i)\b(user(?:name)?\s?[=:]\s?|for user\s)['"]?[^\s,;'"]+`)
+
+	// accounts that identify the system rather than a person
+	systemUsers = map[string]bool{
+		`root`:   true,
+		`daemon`: true,
+		`nobody`: true,
+		`Shared`: true,
+		`Guest`:  true,
+	}
+)
+
+// identity kinds of the values in normalized fields
+const (
+	identityUser = iota // an account name
+	identityHost        // a remote host name or address
+	identityPath        // a path or command line that may be in a home directory
+)
+
+// identified is implemented by the normalized fields other enrichers add
+// that carry account names, remote hosts, or paths, the scrubber and
+// pseudonymizer reach them through it.  fn gets each value with its
+// JSON name and kind and may replace it.
+type identified interface {
+	identities(fn func(name string, kind int, v *string))
+}
+
+// scrubber removes personal data from events according to one or more
+// built in profiles.  It runs as the final enrichment so it also covers
+// the identified fields other enrichers added, not just the message and
+// image paths.
+type scrubber struct {
+	homePaths bool
+	usernames bool
+	appleIDs  bool
+	hosts     bool
+	userRegex *regexp.Regexp // local account names, nil if there are none
+}
+
+func newScrubber(profiles []string) (*scrubber, error) {
+	if len(profiles) == 0 {
+		return nil, nil
+	}
+	s := &scrubber{}
+	for _, p := range profiles {
+		cats, ok := scrubProfiles[strings.ToLower(p)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown Scrub-Profile %q", p)
+		}
+		for _, c := range cats {
+			switch c {
+			case scrubHomePaths:
+				s.homePaths = true
+			case scrubUsernames:
+				s.usernames = true
+			case scrubAppleIDs:
+				s.appleIDs = true
+			case scrubHosts:
+				s.hosts = true
+			}
+		}
+	}
+	if s.usernames {
+		s.userRegex = localUserRegex(localUsers())
+	}
+	return s, nil
+}
+
+func (s *scrubber) enrich(ev *event) {
+	if msg := s.scrub(ev.EventMessage); msg != ev.EventMessage {
+		ev.EventMessage = msg
+		ev.Set("eventMessage", msg)
+	}
+	if s.homePaths {
+		if p := s.scrub(ev.ProcessImagePath); p != ev.ProcessImagePath {
+			ev.ProcessImagePath = p
+			ev.Set("processImagePath", p)
+		}
+		if p := s.scrub(ev.SenderImagePath); p != ev.SenderImagePath {
+			ev.SenderImagePath = p
+			ev.Set("senderImagePath", p)
+		}
+	}
+	if s.usernames {
+		// drop anything the uid resolver added
+		delete(ev.set, "userName")
+		delete(ev.set, "messageUsers")
+	}
+	for k, v := range ev.set {
+		if id, ok := v.(identified); ok {
+			s.protect(k, id)
+		}
+	}
+}
+
+// protect scrubs the identified fields of a normalized field set, the
+// parent is the name the set is added under.
+func (s *scrubber) protect(parent string, id identified) {
+	id.identities(func(name string, kind int, v *string) {
+		if *v == `` {
+			return
+		}
+		switch kind {
+		case identityUser:
+			if s.usernames && !systemUsers[*v] {
+				*v = `<user>`
+			}
+		case identityHost:
+			if s.hosts {
+				*v = `<host>`
+			}
+		case identityPath:
+			*v = s.scrub(*v)
+		}
+	})
+}
+
+// scrub applies the enabled profiles to a string.  Apple IDs go first so
+// the user portion of an address isn't mangled by the username rules.
+func (s *scrubber) scrub(v string) string {
+	if v == `` {
+		return v
+	}
+	if s.appleIDs {
+		v = appleIDRegex.ReplaceAllString(v, `<apple-id>`)
+	}
+	if s.homePaths {
+		v = homePathRegex.ReplaceAllString(v, `/Users/<user>`)
+	}
+	if s.hosts {
+		v = scrubAddrs(v)
+	}
+	if s.usernames {
+		v = userFieldRegex.ReplaceAllString(v, `${1}<user>`)
+		if s.userRegex != nil {
+			v = s.userRegex.ReplaceAllString(v, `<user>`)
+		}
+	}
+	return v
+}
+
+// scrubAddrs replaces the IP addresses in a string, keeping any
+// punctuation that trails them.
+func scrubAddrs(v string) string {
+	return remoteAddrRegex.ReplaceAllStringFunc(v, func(c string) string {
+		if net.ParseIP(c) != nil {
+			return `<host>`
+		}
+		if t := strings.TrimRight(c, `.:`); net.ParseIP(t) != nil {
+			return `<host>` + c[len(t):]
+		}
+		return c
+	})
+}
+
+// localUsers lists the local accounts that belong to people, service
+// accounts on macOS start with an underscore.
+func localUsers() (users []string) {
+	out, err := exec.Command("dscl", ".", "-list", "/Users").Output()
+	if err != nil {
+		lg.Warn("Failed to list local users: %v\n", err)
+		return
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		u := strings.TrimSpace(sc.Text())
+		if u == `` || strings.HasPrefix(u, "_") || systemUsers[u] {
+			continue
+		}
+		users = append(users, u)
+	}
+	return
+}
+
+// localUserRegex matches any of the names as whole words, longest first so
+// overlapping names are replaced completely.
+func localUserRegex(users []string) *regexp.Regexp {
+	if len(users) == 0 {
+		return nil
+	}
+	sort.Slice(users, func(i, j int) bool { return len(users[i]) > len(users[j]) })
+	quoted := make([]string, 0, len(users))
+	for _, u := range users {
+		quoted = append(quoted, regexp.QuoteMeta(u))
+	}
+	return regexp.MustCompile(`\b(?:` + strings.Join(quoted, `|`) + `)\b`)
+}
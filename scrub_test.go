@@ -0,0 +1,107 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+)
+
+type scrubCase struct {
+	in   string
+	want string
+}
+
+func runScrubCases(t *testing.T, s *scrubber, cases []scrubCase) {
+	t.Helper()
+	for _, c := range cases {
+		if got := s.scrub(c.in); got != c.want {
+			t.Errorf("scrub(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestScrubAppleIDs(t *testing.T) {
+	runScrubCases(t, &scrubber{appleIDs: true}, []scrubCase{
+		{`signed in as jane.doe@icloud.com`, `signed in as <apple-id>`},
+		{`account: j+test@mail.example.co.uk,`, `account: <apple-id>,`},
+		// not addresses
+		{`user@localhost`, `user@localhost`},
+		{`@icloud.com`, `@icloud.com`},
+	})
+}
+
+func TestScrubHomePaths(t *testing.T) {
+	runScrubCases(t, &scrubber{homePaths: true}, []scrubCase{
+		{`/Users/jane/Library/Caches`, `/Users/<user>/Library/Caches`},
+		{`open "/Users/jane" failed`, `open "/Users/<user>" failed`},
+		{`/Users/jane:/Users/bob`, `/Users/<user>:/Users/<user>`},
+		// other directories are left alone
+		{`/usr/local/Users/`, `/usr/local/Users/`},
+		{`/System/Library/Users.plist`, `/System/Library/Users.plist`},
+	})
+}
+
+func TestScrubUserFields(t *testing.T) {
+	runScrubCases(t, &scrubber{usernames: true}, []scrubCase{
+		{`user=jane logged in`, `user=<user> logged in`},
+		{`username: jane, uid 501`, `username: <user>, uid 501`},
+		{`Authentication failed for user bob`, `Authentication failed for user <user>`},
+		// no user field
+		{`user interface started`, `user interface started`},
+		{`superuser mode`, `superuser mode`},
+	})
+}
+
+func TestScrubLocalUsers(t *testing.T) {
+	s := &scrubber{usernames: true, userRegex: localUserRegex([]string{`jane`, `janet`})}
+	runScrubCases(t, s, []scrubCase{
+		{`jane opened a file`, `<user> opened a file`},
+		{`janet and jane`, `<user> and <user>`},
+		// only whole words
+		{`janes`, `janes`},
+		{`mary-janet2`, `mary-janet2`},
+	})
+	if localUserRegex(nil) != nil {
+		t.Error("a regex was built without any users")
+	}
+}
+
+type testIdentities struct {
+	user, host, path string
+}
+
+func (ti *testIdentities) identities(fn func(name string, kind int, v *string)) {
+	fn(`user`, identityUser, &ti.user)
+	fn(`host`, identityHost, &ti.host)
+	fn(`path`, identityPath, &ti.path)
+}
+
+func TestScrubIdentities(t *testing.T) {
+	s := &scrubber{usernames: true, homePaths: true}
+	ti := &testIdentities{user: `jane`, host: `10.0.0.5`, path: `/Users/jane/bin/tool`}
+	s.protect(`test`, ti)
+	if ti.user != `<user>` || ti.path != `/Users/<user>/bin/tool` {
+		t.Errorf("identities not scrubbed: %+v", ti)
+	}
+	ti = &testIdentities{user: `root`}
+	s.protect(`test`, ti)
+	if ti.user != `root` {
+		t.Errorf("system account scrubbed: %+v", ti)
+	}
+}
+
+func TestScrubRemoteHosts(t *testing.T) {
+	runScrubCases(t, &scrubber{hosts: true}, []scrubCase{
+		{`Accepted publickey for jane from 10.0.0.5 port 52122`, `Accepted publickey for jane from <host> port 52122`},
+		{`viewer at fe80::1.`, `viewer at <host>.`},
+		// times and versions with too few parts aren't addresses
+		{`started at 10:00:00`, `started at 10:00:00`},
+		{`version 14.2.1`, `version 14.2.1`},
+	})
+}
@@ -0,0 +1,198 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+)
+
+var (
+	errNotInstalled = errors.New("the service is not installed")
+)
+
+const (
+	serviceLabel     = `io.gravwell.macoslog`
+	servicePlistPath = `/Library/LaunchDaemons/` + serviceLabel + `.plist`
+	serviceLogDir    = `/opt/gravwell/log`
+)
+
+// KeepAlive only restarts on failure so an Exit-After-Idle run stays down,
+// the throttle keeps a broken config or unreachable indexer from spinning.
+var servicePlist = template.Must(template.New("plist").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .Program}}</string>
+		<string>-config-file</string>
+		<string>{{xml .Config}}</string>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>10</integer>
+	<key>StandardOutPath</key>
+	<string>{{xml .Stdout}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .Stderr}}</string>
+</dict>
+</plist>
+`))
+
+type serviceParams struct {
+	Label   string
+	Program string
+	Config  string
+	Args    []string
+	Stdout  string
+	Stderr  string
+}
+
+func xmlEscape(s string) (string, error) {
+	var bb bytes.Buffer
+	if err := xml.EscapeText(&bb, []byte(s)); err != nil {
+		return ``, err
+	}
+	return bb.String(), nil
+}
+
+// installService writes the LaunchDaemon plist for this binary and config
+// and loads it, a remote config is passed through to the service.
+func installService(confPath string, remote *remoteConfig) error {
+	if os.Geteuid() != 0 {
+		return errors.New("installing the service requires root")
+	}
+	prog, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if prog, err = filepath.EvalSymlinks(prog); err != nil {
+		return err
+	}
+	if confPath, err = filepath.Abs(confPath); err != nil {
+		return err
+	}
+	var args []string
+	if remote != nil {
+		args = remote.args()
+	} else if _, err = os.Stat(confPath); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(serviceLogDir, 0750); err != nil {
+		return err
+	}
+	var bb bytes.Buffer
+	if err = servicePlist.Execute(&bb, serviceParams{
+		Label:   serviceLabel,
+		Program: prog,
+		Config:  confPath,
+		Args:    args,
+		Stdout:  filepath.Join(serviceLogDir, `macosLog.stdout`),
+		Stderr:  filepath.Join(serviceLogDir, `macosLog.stderr`),
+	}); err != nil {
+		return err
+	}
+	// reinstalling replaces a loaded service
+	if _, err = os.Stat(servicePlistPath); err == nil {
+		launchctl("bootout", "system/"+serviceLabel)
+	}
+	// launchd refuses plists that are writable by anyone but root
+	if err = writeFileAtomic(servicePlistPath, bb.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err = os.Chown(servicePlistPath, 0, 0); err != nil {
+		return err
+	}
+	return launchctl("bootstrap", "system", servicePlistPath)
+}
+
+// uninstallService unloads the service and removes its plist.
+func uninstallService() error {
+	if os.Geteuid() != 0 {
+		return errors.New("uninstalling the service requires root")
+	}
+	if _, err := os.Stat(servicePlistPath); err != nil {
+		if os.IsNotExist(err) {
+			return errNotInstalled
+		}
+		return err
+	}
+	if err := launchctl("bootout", "system/"+serviceLabel); err != nil {
+		lg.Warn("%v\n", err)
+	}
+	return os.Remove(servicePlistPath)
+}
+
+// uninstall removes the service and with purge also the cache, spool, and
+// state files named in the config, the config itself is left alone.
+func uninstall(w io.Writer, confPath string, purge bool) error {
+	if err := uninstallService(); err == errNotInstalled {
+		fmt.Fprintf(w, "The service is not installed\n")
+	} else if err != nil {
+		return err
+	} else {
+		fmt.Fprintf(w, "Unloaded and removed %s\n", servicePlistPath)
+	}
+	if !purge {
+		return nil
+	}
+	cfg, err := loadConfig(confPath)
+	if err != nil {
+		return fmt.Errorf("Failed to load %s to find the files to purge: %v", confPath, err)
+	}
+	paths := []string{
+		cfg.Global.Ingest_Cache_Path,
+		cfg.Global.Spool_Location,
+		cfg.Global.stateStoreLocation(),
+		cfg.Global.seenStoreLocation(),
+		cfg.Global.lockFile(),
+		cfg.Global.controlSocket(),
+		cfg.Global.Health_Socket,
+	}
+	for _, p := range paths {
+		if p == `` {
+			continue
+		}
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Removed %s\n", p)
+	}
+	return nil
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %v failed: %v %s", args, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultCleartextPort = `4023`
+	defaultTLSPort       = `4024`
+)
+
+var setupConfig = template.Must(template.New("config").Parse(`[Global]
+Ingest-Secret = {{.Secret}}
+Connection-Timeout = 0
+Insecure-Skip-TLS-Verify=false
+{{.TargetKey}}={{.Target}}
+Log-Level=INFO
+Log-File=/opt/gravwell/log/macos.log
+Tag-Name={{.Tag}}
+{{- if .Level}}
+Minimum-Level={{.Level}}
+{{- end}}
+`))
+
+type setupParams struct {
+	Secret    string
+	TargetKey string
+	Target    string
+	Tag       string
+	Level     string
+}
+
+// runSetup interactively writes a config to path, checks that the indexer
+// can be reached, and optionally installs the launchd service.
+func runSetup(in io.Reader, out io.Writer, path string) error {
+	br := bufio.NewReader(in)
+	ask := func(prompt, def string) (string, error) {
+		if def != `` {
+			fmt.Fprintf(out, "%s [%s]: ", prompt, def)
+		} else {
+			fmt.Fprintf(out, "%s: ", prompt)
+		}
+		s, err := br.ReadString('\n')
+		if err != nil && (err != io.EOF || s == ``) {
+			return ``, err
+		}
+		if s = strings.TrimSpace(s); s == `` {
+			s = def
+		}
+		return s, nil
+	}
+	yes := func(prompt string, def bool) (bool, error) {
+		d := `y/N`
+		if def {
+			d = `Y/n`
+		}
+		s, err := ask(prompt, d)
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(s) {
+		case `y`, `yes`:
+			return true, nil
+		case `n`, `no`:
+			return false, nil
+		}
+		return def, nil
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if ok, err := yes(fmt.Sprintf("%s exists, overwrite it?", path), false); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("setup cancelled")
+		}
+	}
+	var p setupParams
+	addr, err := ask("Indexer address (host[:port], tls://host[:port], or a pipe path)", ``)
+	if err != nil {
+		return err
+	}
+	if p.TargetKey, p.Target, err = setupTarget(addr); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Ingest secret: ")
+	secret, err := readSecret(br)
+	fmt.Fprintln(out)
+	if err != nil {
+		return err
+	} else if secret == `` {
+		return errors.New("an ingest secret is required")
+	}
+	p.Secret = quoteValue(secret)
+	if p.Tag, err = ask("Tag", `macos`); err != nil {
+		return err
+	}
+	if p.Level, err = ask("Minimum level to capture (Debug, Info, Default, Error, Fault)", `Default`); err != nil {
+		return err
+	}
+	if _, err = newLevelFilter(p.Level); err != nil {
+		return err
+	}
+
+	var bb bytes.Buffer
+	if err = setupConfig.Execute(&bb, p); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	// the config holds the ingest secret
+	if err = writeFileAtomic(path, bb.Bytes(), 0640); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("the written config is invalid: %v", err)
+	}
+	fmt.Fprintf(out, "Wrote %s\n", path)
+
+	conns, err := cfg.Global.Targets()
+	if err != nil {
+		return err
+	}
+	for _, c := range conns {
+		if err := checkTarget(c); err != nil {
+			fmt.Fprintf(out, "Warning: %s is unreachable: %v\n", c, err)
+		} else {
+			fmt.Fprintf(out, "%s is reachable\n", c)
+		}
+	}
+
+	if ok, err := yes("Install and start the launchd service?", true); err != nil {
+		return err
+	} else if ok {
+		if err = installService(path, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Installed and loaded %s\n", servicePlistPath)
+	}
+	return nil
+}
+
+// setupTarget works out the target type from an address, ports default to
+// the standard ingest ports.
+func setupTarget(addr string) (key, target string, err error) {
+	switch {
+	case addr == ``:
+		err = errors.New("an indexer address is required")
+	case strings.HasPrefix(addr, `pipe://`):
+		key, target = `Pipe-Backend-Target`, strings.TrimPrefix(addr, `pipe://`)
+	case strings.HasPrefix(addr, `/`):
+		key, target = `Pipe-Backend-Target`, addr
+	case strings.HasPrefix(addr, `tls://`):
+		key, target = `Encrypted-Backend-Target`, withPort(strings.TrimPrefix(addr, `tls://`), defaultTLSPort)
+	default:
+		key, target = `Cleartext-Backend-Target`, withPort(strings.TrimPrefix(addr, `tcp://`), defaultCleartextPort)
+	}
+	return
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, `[]`), port)
+}
+
+// quoteValue quotes a config value so comment characters and quotes in it
+// survive parsing.
+func quoteValue(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// readSecret reads a line with terminal echo turned off when stdin is a
+// terminal.
+func readSecret(br *bufio.Reader) (string, error) {
+	echoOff := exec.Command("stty", "-echo")
+	echoOff.Stdin = os.Stdin
+	if echoOff.Run() == nil {
+		defer func() {
+			echoOn := exec.Command("stty", "echo")
+			echoOn.Stdin = os.Stdin
+			echoOn.Run()
+		}()
+	}
+	s, err := br.ReadString('\n')
+	if err != nil && (err != io.EOF || s == ``) {
+		return ``, err
+	}
+	return strings.TrimSpace(s), nil
+}
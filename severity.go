@@ -0,0 +1,73 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	sevDebug    = `debug`
+	sevInfo     = `info`
+	sevWarn     = `warn`
+	sevError    = `error`
+	sevCritical = `critical`
+)
+
+var (
+	// default mapping of Apple's messageType values, Default is what Apple
+	// calls "notice" so it is treated as info
+	defaultSeverityMap = map[string]string{
+		`debug`:   sevDebug,
+		`info`:    sevInfo,
+		`default`: sevInfo,
+		`error`:   sevError,
+		`fault`:   sevCritical,
+	}
+	validSeverities = map[string]bool{
+		sevDebug:    true,
+		sevInfo:     true,
+		sevWarn:     true,
+		sevError:    true,
+		sevCritical: true,
+	}
+)
+
+// severityMapper adds a normalized severity field based on the messageType.
+type severityMapper struct {
+	m map[string]string
+}
+
+// newSeverityMapper builds a mapper from the defaults plus any overrides,
+// overrides are of the form "messageType:severity", e.g. "Default:warn".
+func newSeverityMapper(overrides []string) (*severityMapper, error) {
+	m := make(map[string]string, len(defaultSeverityMap))
+	for k, v := range defaultSeverityMap {
+		m[k] = v
+	}
+	for _, o := range overrides {
+		k, v := splitKV(o, ":")
+		k, v = strings.ToLower(k), strings.ToLower(v)
+		if k == `` || !validSeverities[v] {
+			return nil, fmt.Errorf("Invalid Severity-Map %q, expected messageType:{debug|info|warn|error|critical}", o)
+		}
+		m[k] = v
+	}
+	return &severityMapper{m: m}, nil
+}
+
+func (sm *severityMapper) enrich(ev *event) {
+	if ev.MessageType == `` {
+		return
+	}
+	if sev, ok := sm.m[strings.ToLower(ev.MessageType)]; ok {
+		ev.Set("severity", sev)
+	}
+}
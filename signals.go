@@ -0,0 +1,44 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// handleFlushSignal flushes and restarts the stream on SIGUSR2, a way to
+// recover a stream that looks stalled without restarting the ingester.
+// Held events are released, the muxer is synced, and the log stream
+// children are replaced.
+func handleFlushSignal(ctx context.Context, wg *sync.WaitGroup, pl *pipeline, streams streamSet, timeout time.Duration) {
+	defer wg.Done()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+		lg.Info("SIGUSR2 received, flushing and restarting log streams\n")
+		if err := pl.write(ctx, pl.flush(time.Now(), true)); err != nil && err != context.Canceled {
+			lg.Error("Failed to write flushed entries: %v\n", err)
+		}
+		if err := igst.Sync(timeout); err != nil {
+			lg.Warn("Failed to sync: %v\n", err)
+		}
+		streams.restart()
+	}
+}
@@ -0,0 +1,123 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// muxer is the part of the ingest muxer the ingester uses, a dry run swaps
+// in something that prints entries instead.
+type muxer interface {
+	Start() error
+	Close() error
+	WaitForHot(time.Duration) error
+	Sync(time.Duration) error
+	Hot() (int, error)
+	GetTag(string) (entry.EntryTag, error)
+	NegotiateTag(string) (entry.EntryTag, error)
+	LookupTag(entry.EntryTag) (string, bool)
+	SetRawConfiguration(interface{}) error
+	WriteBatchContext(context.Context, []*entry.Entry) error
+	WriteEntryContext(context.Context, *entry.Entry) error
+}
+
+// dryRunMuxer prints entries rather than ingesting them so predicates,
+// filters, and enrichments can be iterated on without touching indexers.
+type dryRunMuxer struct {
+	sync.Mutex
+	w     *bufio.Writer
+	tags  map[string]entry.EntryTag
+	names []string
+}
+
+func newDryRunMuxer(w io.Writer) *dryRunMuxer {
+	return &dryRunMuxer{
+		w:    bufio.NewWriter(w),
+		tags: map[string]entry.EntryTag{},
+	}
+}
+
+func (d *dryRunMuxer) Start() error                          { return nil }
+func (d *dryRunMuxer) WaitForHot(time.Duration) error        { return nil }
+func (d *dryRunMuxer) Hot() (int, error)                     { return 1, nil }
+func (d *dryRunMuxer) SetRawConfiguration(interface{}) error { return nil }
+
+func (d *dryRunMuxer) Close() error {
+	return d.Sync(0)
+}
+
+func (d *dryRunMuxer) Sync(time.Duration) error {
+	d.Lock()
+	defer d.Unlock()
+	return d.w.Flush()
+}
+
+func (d *dryRunMuxer) GetTag(name string) (entry.EntryTag, error) {
+	return d.NegotiateTag(name)
+}
+
+func (d *dryRunMuxer) NegotiateTag(name string) (entry.EntryTag, error) {
+	d.Lock()
+	defer d.Unlock()
+	if tag, ok := d.tags[name]; ok {
+		return tag, nil
+	}
+	tag := entry.EntryTag(len(d.names))
+	d.tags[name] = tag
+	d.names = append(d.names, name)
+	return tag, nil
+}
+
+func (d *dryRunMuxer) LookupTag(tag entry.EntryTag) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	if int(tag) < len(d.names) {
+		return d.names[tag], true
+	}
+	return ``, false
+}
+
+func (d *dryRunMuxer) WriteBatchContext(ctx context.Context, ents []*entry.Entry) error {
+	d.Lock()
+	defer d.Unlock()
+	for _, ent := range ents {
+		if err := d.print(ent); err != nil {
+			return err
+		}
+	}
+	return d.w.Flush()
+}
+
+func (d *dryRunMuxer) WriteEntryContext(ctx context.Context, ent *entry.Entry) error {
+	d.Lock()
+	defer d.Unlock()
+	if err := d.print(ent); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// print writes an entry as tag, timestamp, and data separated by tabs, the
+// caller must hold the lock.
+func (d *dryRunMuxer) print(ent *entry.Entry) error {
+	name := `<unknown>`
+	if int(ent.Tag) < len(d.names) {
+		name = d.names[ent.Tag]
+	}
+	_, err := fmt.Fprintf(d.w, "%s\t%s\t%s\n", name, ent.TS.StandardTime().Format(time.RFC3339Nano), ent.Data)
+	return err
+}
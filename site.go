@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type siteConfig struct {
+	Region   string
+	Hostname []string // hostname globs that belong to the site
+	Serial   []string // hardware serial numbers that belong to the site
+}
+
+func (sc *siteConfig) verify(name string) error {
+	if len(sc.Hostname) == 0 && len(sc.Serial) == 0 {
+		return fmt.Errorf("Site %q has no Hostname or Serial entries", name)
+	}
+	for _, h := range sc.Hostname {
+		if _, err := filepath.Match(h, ``); err != nil {
+			return fmt.Errorf("Site %q has invalid Hostname pattern %q: %v", name, h, err)
+		}
+	}
+	return nil
+}
+
+func (sc *siteConfig) matches(hostname, serial string) bool {
+	if serial != `` {
+		for _, s := range sc.Serial {
+			if strings.EqualFold(s, serial) {
+				return true
+			}
+		}
+	}
+	if hostname != `` {
+		hostname = strings.ToLower(hostname)
+		for _, h := range sc.Hostname {
+			if ok, _ := filepath.Match(strings.ToLower(h), hostname); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// siteTagger adds static site and region labels to every event.
+type siteTagger struct {
+	site   string
+	region string
+}
+
+// newSiteTagger resolves which configured site this machine belongs to, nil
+// is returned if no site matches.  Sites are checked in name order so the
+// result is stable when a machine matches more than one.
+func newSiteTagger(sites map[string]*siteConfig) *siteTagger {
+	if len(sites) == 0 {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	serial, err := hostSerial()
+	if err != nil {
+		lg.Warn("Failed to get hardware serial number: %v\n", err)
+	}
+	names := make([]string, 0, len(sites))
+	for k := range sites {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if sites[n].matches(hostname, serial) {
+			return &siteTagger{site: n, region: sites[n].Region}
+		}
+	}
+	lg.Warn("Host %q (serial %q) does not match any configured Site\n", hostname, serial)
+	return nil
+}
+
+func (st *siteTagger) enrich(ev *event) {
+	ev.Set("site", st.site)
+	if st.region != `` {
+		ev.Set("region", st.region)
+	}
+}
+
+// hostSerial returns the hardware serial number from the IO registry.
+func hostSerial() (string, error) {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return ``, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		k, v := splitKV(sc.Text(), "=")
+		if strings.Trim(k, `"`) == `IOPlatformSerialNumber` {
+			return strings.Trim(v, `"`), nil
+		}
+	}
+	return ``, errors.New("IOPlatformSerialNumber not found")
+}
@@ -0,0 +1,205 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	sleepCheckInterval = 5 * time.Second
+	sleepThreshold     = 10 * time.Second
+	defaultWakeWindow  = 30 * time.Second
+	wakeBoundaryField  = `wake_boundary`
+	wakeEntryType      = `wake`
+)
+
+// wakeEvent describes a detected sleep, start is when the sleep
+// notification arrived or, without one, the last time we were seen running.
+type wakeEvent struct {
+	Type       string    `json:"type"`
+	SleepStart time.Time `json:"sleep_start"`
+	Wake       time.Time `json:"wake"`
+	Slept      string    `json:"slept"`
+}
+
+// sleepDetector handles the host sleeping and waking.  IOKit tells us the
+// host is about to sleep so onSleep can flush first, in builds without cgo
+// there is no warning and the resume state persisted regularly has to do.
+// Waking is noticed from the clocks, the monotonic clock stops while the
+// host sleeps and the wall clock does not, so a gap between the two across
+// a short tick means we were asleep.
+type sleepDetector struct {
+	onSleep func()
+	onWake  func(wakeEvent)
+
+	sync.Mutex
+	sleptAt time.Time // when the last sleep notification arrived
+}
+
+// willSleep is called when the host is about to sleep, sleep waits for it
+// up to a limit.
+func (sd *sleepDetector) willSleep() {
+	sd.Lock()
+	sd.sleptAt = time.Now().Round(0)
+	sd.Unlock()
+	lg.Info("Host is going to sleep, flushing\n")
+	sd.onSleep()
+}
+
+func (sd *sleepDetector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if err := watchPower(ctx, wg, sd.willSleep); err != nil {
+		lg.Info("Sleep will only be noticed on wake: %v\n", err)
+	}
+	tckr := time.NewTicker(sleepCheckInterval)
+	defer tckr.Stop()
+	prev := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+		now := time.Now()
+		mono := now.Sub(prev)
+		wall := now.Round(0).Sub(prev.Round(0))
+		if slept := wall - mono; slept > sleepThreshold {
+			ev := wakeEvent{
+				Type:       wakeEntryType,
+				SleepStart: prev.Round(0),
+				Wake:       now.Round(0).Add(-mono),
+				Slept:      slept.Round(time.Second).String(),
+			}
+			sd.Lock()
+			if sd.sleptAt.After(ev.SleepStart) && sd.sleptAt.Before(ev.Wake) {
+				ev.SleepStart = sd.sleptAt
+				ev.Slept = ev.Wake.Sub(ev.SleepStart).Round(time.Second).String()
+			}
+			sd.Unlock()
+			lg.Info("Host woke after sleeping for %s\n", ev.Slept)
+			sd.onWake(ev)
+		}
+		prev = now
+	}
+}
+
+// streamControl lets other goroutines restart the running log stream and
+// change its configuration.
+type streamControl struct {
+	sync.Mutex
+	cmd       *exec.Cmd
+	rc        streamConfig
+	requested bool // the running child was killed deliberately
+}
+
+func (sc *streamControl) config() streamConfig {
+	sc.Lock()
+	defer sc.Unlock()
+	return sc.rc
+}
+
+// reconfigure changes the stream configuration, the stream is restarted to
+// pick it up only if it actually changed.
+func (sc *streamControl) reconfigure(rc streamConfig) bool {
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.rc == rc {
+		return false
+	}
+	sc.rc = rc
+	sc.kill()
+	return true
+}
+
+func (sc *streamControl) set(cmd *exec.Cmd) {
+	if sc == nil {
+		return
+	}
+	sc.Lock()
+	sc.cmd = cmd
+	sc.Unlock()
+}
+
+// restart kills the running child, the run loop starts a new one.
+func (sc *streamControl) restart() {
+	if sc == nil {
+		return
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	sc.kill()
+}
+
+// kill stops the running child, the caller must hold the lock.
+func (sc *streamControl) kill() {
+	if sc.cmd != nil && sc.cmd.Process != nil {
+		sc.requested = true
+		sc.cmd.Process.Kill()
+	}
+}
+
+// restartRequested reports whether the last child was killed deliberately,
+// clearing the request.  Deliberate restarts aren't failures.
+func (sc *streamControl) restartRequested() bool {
+	if sc == nil {
+		return false
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	r := sc.requested
+	sc.requested = false
+	return r
+}
+
+// wakeAnnotator marks records logged around a wake so the gaps and bursts
+// that surround sleep are easy to recognize.
+type wakeAnnotator struct {
+	sync.Mutex
+	window time.Duration
+	start  time.Time // sleep start
+	end    time.Time // end of the annotation window
+}
+
+func newWakeAnnotator(window time.Duration) *wakeAnnotator {
+	if window <= 0 {
+		window = defaultWakeWindow
+	}
+	return &wakeAnnotator{window: window}
+}
+
+func (wa *wakeAnnotator) mark(ev wakeEvent) {
+	if wa == nil {
+		return
+	}
+	wa.Lock()
+	wa.start = ev.SleepStart
+	wa.end = ev.Wake.Add(wa.window)
+	wa.Unlock()
+}
+
+func (wa *wakeAnnotator) enrich(ev *event) {
+	wa.Lock()
+	start, end := wa.start, wa.end
+	wa.Unlock()
+	// records only trickle in for a while after the window closes
+	if end.IsZero() || time.Since(end) > wa.window {
+		return
+	}
+	ts, err := time.Parse(logTimestampFormat, ev.Timestamp)
+	if err != nil {
+		return
+	}
+	if !ts.Before(start) && !ts.After(end) {
+		ev.Set(wakeBoundaryField, true)
+	}
+}
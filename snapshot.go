@@ -0,0 +1,76 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// snapshotFunc gathers a single snapshot, the returned object is encoded
+// as JSON and becomes the entry data.
+type snapshotFunc func(ctx context.Context) (interface{}, error)
+
+// snapshotter is a collector that periodically takes a snapshot of some
+// piece of host state and ingests it as a single entry.
+type snapshotter struct {
+	name     string
+	tag      entry.EntryTag
+	interval time.Duration
+	src      *sourceTracker
+	fn       snapshotFunc
+}
+
+// run takes a snapshot immediately and then every interval until the
+// context is cancelled.
+func (s *snapshotter) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(s.interval)
+	defer tckr.Stop()
+	for {
+		if err := s.snapshot(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to take %s snapshot: %v\n", s.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (s *snapshotter) snapshot(ctx context.Context) error {
+	obj, err := s.fn(ctx)
+	if err != nil {
+		return err
+	}
+	return emitJSON(ctx, s.tag, s.src, time.Now(), obj)
+}
+
+// emitJSON encodes obj and writes it to the muxer as a single entry.
+func emitJSON(ctx context.Context, tag entry.EntryTag, src *sourceTracker, ts time.Time, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	ent := &entry.Entry{
+		TS:   entry.FromStandard(ts),
+		SRC:  src.get(),
+		Tag:  tag,
+		Data: b,
+	}
+	return igst.WriteEntryContext(ctx, ent)
+}
@@ -0,0 +1,171 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSourceRefresh = 30 * time.Second
+)
+
+var (
+	// these are documentation ranges, dialing UDP never sends a packet but
+	// does make the kernel pick the interface holding the default route
+	probeAddrV4 = `192.0.2.1:9`
+	probeAddrV6 = `[2001:db8::1]:9`
+
+	errNoSourceAddr = errors.New("no usable address found")
+)
+
+// sourceTracker provides the SRC value attached to entries.  When an
+// override is configured the value is fixed, otherwise the address of the
+// primary (or configured) interface is detected and periodically refreshed
+// so laptops moving between networks report their current address.
+type sourceTracker struct {
+	sync.RWMutex
+	ip    net.IP
+	fixed bool
+	iface string
+}
+
+func newSourceTracker(override, iface string) (*sourceTracker, error) {
+	st := &sourceTracker{iface: iface}
+	if override != `` {
+		if st.ip = net.ParseIP(override); st.ip == nil {
+			return nil, fmt.Errorf("Source-Override %q is invalid", override)
+		}
+		st.fixed = true
+		return st, nil
+	}
+	if iface != `` {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("Source-Interface %q is invalid: %v", iface, err)
+		}
+	}
+	if err := st.refresh(); err != nil {
+		lg.Warn("Failed to detect source address: %v\n", err)
+	}
+	return st, nil
+}
+
+// get returns the current source address, nil is returned if none could be
+// determined, in which case the muxer falls back to the connection address.
+func (st *sourceTracker) get() net.IP {
+	st.RLock()
+	defer st.RUnlock()
+	return st.ip
+}
+
+// run refreshes the detected address every interval until the context is
+// cancelled.
+func (st *sourceTracker) run(ctx context.Context, interval time.Duration) {
+	if st.fixed {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultSourceRefresh
+	}
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+			if err := st.refresh(); err != nil {
+				lg.Debug("Failed to refresh source address: %v\n", err)
+			}
+		}
+	}
+}
+
+func (st *sourceTracker) refresh() (err error) {
+	var ip net.IP
+	if st.iface != `` {
+		ip, err = interfaceAddr(st.iface)
+	} else {
+		ip, err = primaryAddr()
+	}
+	if err != nil {
+		return
+	}
+	st.Lock()
+	if !ip.Equal(st.ip) {
+		lg.Info("Source address is now %v\n", ip)
+		st.ip = ip
+	}
+	st.Unlock()
+	return
+}
+
+// primaryAddr returns the local address used to reach the default route,
+// preferring IPv4.  If there is no default route the first global unicast
+// address on an up interface is used.
+func primaryAddr() (net.IP, error) {
+	for _, a := range []string{probeAddrV4, probeAddrV6} {
+		conn, err := net.Dial("udp", a)
+		if err != nil {
+			continue
+		}
+		ua, ok := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+		if ok && ua.IP.IsGlobalUnicast() {
+			return ua.IP, nil
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if ip, err := interfaceAddr(ifc.Name); err == nil {
+			return ip, nil
+		}
+	}
+	return nil, errNoSourceAddr
+}
+
+// interfaceAddr returns the first global unicast address on the named
+// interface, preferring IPv4.
+func interfaceAddr(name string) (net.IP, error) {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || !ipn.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipn.IP.To4() != nil {
+			return ipn.IP, nil
+		} else if v6 == nil {
+			v6 = ipn.IP
+		}
+	}
+	if v6 == nil {
+		return nil, fmt.Errorf("%s: %w", name, errNoSourceAddr)
+	}
+	return v6, nil
+}
@@ -0,0 +1,435 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultSpoolMB       = 1024
+	defaultMaxSpoolAge   = 72 * time.Hour
+	spoolSegmentSize     = 4 * 1024 * 1024
+	spoolForwardInterval = time.Second
+	spoolForwardBatch    = 512
+	spoolSuffix          = `.spool`
+	spoolOpenSuffix      = `.open`
+	maxSpoolRecord       = 16 * 1024 * 1024
+)
+
+// spoolRecord is an entry as stored on disk, tags are stored by name as
+// the numeric value is only meaningful to the muxer that handed it out.
+type spoolRecord struct {
+	TS   entry.Timestamp `json:"ts"`
+	SRC  net.IP          `json:"src,omitempty"`
+	Tag  string          `json:"tag"`
+	Data []byte          `json:"data"`
+}
+
+// spool is an on disk store and forward queue.  Entries are appended to
+// the open segment, segments are closed once they are large or old enough
+// and forwarded to the muxer oldest first, a segment is only removed once
+// everything in it was written.  The spool is capped by size and age, the
+// oldest segments are evicted first.  Anything left over when the ingester
+// stops is forwarded when it starts again.  Segments are synced to disk as
+// they are closed, which happens every forward interval, so a crash or
+// power loss can lose up to that last second of spooled entries.
+type spool struct {
+	sync.Mutex
+	dir     string
+	max     int64
+	maxAge  time.Duration
+	seq     uint64
+	cur     *os.File
+	curW    *bufio.Writer
+	curSize int64
+	evicted uint64
+	capped  int64  // reduced size limit while the disk is low on space, zero when not capped
+	full    bool   // the disk filled up, entries stay in memory until space is freed
+	defTag  string // tag name used when a tag can't be looked up
+	written func([]*entry.Entry)
+	pacer   *backlogPacer // paces forwarding, nil when unlimited
+}
+
+func newSpool(dir string, max int64, maxAge time.Duration, defTag string, written func([]*entry.Entry)) (*spool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:     dir,
+		max:     max,
+		maxAge:  maxAge,
+		defTag:  defTag,
+		written: written,
+	}
+	segs, err := s.segments(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segs {
+		// segments left open by a crash are as good as closed
+		if strings.HasSuffix(seg.name, spoolOpenSuffix) {
+			if err := os.Rename(s.path(seg.name), s.path(segmentName(seg.seq))); err != nil {
+				return nil, err
+			}
+		}
+		if seg.seq >= s.seq {
+			s.seq = seg.seq + 1
+		}
+	}
+	return s, nil
+}
+
+type spoolSegment struct {
+	name    string
+	seq     uint64
+	size    int64
+	modTime time.Time
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, spoolSuffix)
+}
+
+func openSegmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, spoolOpenSuffix)
+}
+
+func (s *spool) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// segments lists segments oldest first, open segments are only included
+// when asked for.
+func (s *spool) segments(open bool) (segs []spoolSegment, err error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		ext := filepath.Ext(name)
+		if ext != spoolSuffix && (!open || ext != spoolOpenSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, spoolSegment{name: name, seq: seq, size: fi.Size(), modTime: fi.ModTime()})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+	return
+}
+
+// append writes a batch to the open segment.
+func (s *spool) append(ents []*entry.Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.full {
+		return errDiskFull
+	}
+	err := s.appendLocked(ents)
+	if err != nil && isDiskFull(err) {
+		// the segment may end in a partial record which forwarding skips
+		lg.Error("Disk is full, spooling to memory until space is freed\n")
+		s.full = true
+		s.rotate()
+		return errDiskFull
+	}
+	return err
+}
+
+func (s *spool) appendLocked(ents []*entry.Entry) error {
+	if s.cur == nil {
+		fout, err := os.OpenFile(s.path(openSegmentName(s.seq)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+		if err != nil {
+			return err
+		}
+		s.cur = fout
+		s.curW = bufio.NewWriter(fout)
+		s.curSize = 0
+	}
+	for _, ent := range ents {
+		rec := spoolRecord{
+			TS:   ent.TS,
+			SRC:  ent.SRC,
+			Data: ent.Data,
+		}
+		var ok bool
+		if rec.Tag, ok = igst.LookupTag(ent.Tag); !ok {
+			rec.Tag = s.defTag
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if _, err = s.curW.Write(b); err != nil {
+			return err
+		}
+		s.curSize += int64(len(b))
+	}
+	if s.curSize >= spoolSegmentSize {
+		return s.rotate()
+	}
+	return nil
+}
+
+// rotate syncs and closes the open segment so it can be forwarded, the
+// caller must hold the lock.
+func (s *spool) rotate() error {
+	if s.cur == nil {
+		return nil
+	}
+	name := s.cur.Name()
+	err := s.curW.Flush()
+	if err == nil {
+		err = s.cur.Sync()
+	}
+	if cerr := s.cur.Close(); err == nil {
+		err = cerr
+	}
+	s.cur, s.curW = nil, nil
+	if err == nil {
+		err = os.Rename(name, s.path(segmentName(s.seq)))
+	}
+	s.seq++
+	return err
+}
+
+// limit returns the current size limit.
+func (s *spool) limit() int64 {
+	s.Lock()
+	defer s.Unlock()
+	if s.capped > 0 && s.capped < s.max {
+		return s.capped
+	}
+	return s.max
+}
+
+// pressure adjusts the spool to the free space on its disk.  When free
+// space drops below the reserve the limit is shrunk by the shortfall so the
+// oldest entries are evicted rather than the disk filling, it is restored
+// once space is available again.
+func (s *spool) pressure(free, reserve uint64) {
+	total, _ := s.bytes()
+	s.Lock()
+	defer s.Unlock()
+	if free >= reserve {
+		if s.capped > 0 || s.full {
+			lg.Info("Spool disk space recovered, restoring the spool limit\n")
+		}
+		s.capped = 0
+		s.full = false
+		return
+	}
+	capped := total - int64(reserve-free)
+	if capped < 1 {
+		capped = 1
+	}
+	if s.capped == 0 || capped < s.capped {
+		lg.Warn("Spool disk is low on space, limiting the spool to %d bytes\n", capped)
+		s.capped = capped
+	}
+}
+
+// close closes the open segment so it is picked up on the next start.
+func (s *spool) close() {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.rotate(); err != nil {
+		lg.Error("Failed to close spool segment: %v\n", err)
+	}
+}
+
+// evict removes the oldest segments until the spool is within its size
+// limit, along with any segments that are too old.
+func (s *spool) evict(segs []spoolSegment) []spoolSegment {
+	var total int64
+	for _, seg := range segs {
+		total += seg.size
+	}
+	now := time.Now()
+	max := s.limit()
+	for len(segs) > 0 && (total > max || (s.maxAge > 0 && now.Sub(segs[0].modTime) > s.maxAge)) {
+		lg.Warn("Evicting spool segment %s\n", segs[0].name)
+		if err := os.Remove(s.path(segs[0].name)); err != nil {
+			lg.Error("Failed to remove spool segment %s: %v\n", segs[0].name, err)
+		}
+		total -= segs[0].size
+		s.Lock()
+		s.evicted++
+		s.Unlock()
+		segs = segs[1:]
+	}
+	return segs
+}
+
+// run forwards closed segments to the muxer until the context is cancelled.
+func (s *spool) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	bo := newBackoff(defaultBackoffMin, maxRetryBackoff)
+	tckr := time.NewTicker(spoolForwardInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+		s.Lock()
+		err := s.rotate()
+		s.Unlock()
+		if err != nil {
+			lg.Error("Failed to close spool segment: %v\n", err)
+		}
+		segs, err := s.segments(false)
+		if err != nil {
+			lg.Error("Failed to list spool segments: %v\n", err)
+			continue
+		}
+		for _, seg := range s.evict(segs) {
+			if err = s.forward(ctx, seg); err != nil {
+				break
+			}
+			bo.reset()
+		}
+		if err != nil && err != context.Canceled {
+			lg.Warn("Failed to forward spooled entries: %v\n", err)
+			stats.batchFailure(err)
+			s.pacer.interrupted()
+			bo.wait(ctx)
+		}
+	}
+}
+
+// forward writes a segment to the muxer and removes it.  A segment that
+// fails part way through is sent again from the start, duplicates are
+// preferable to loss.
+func (s *spool) forward(ctx context.Context, seg spoolSegment) error {
+	fin, err := os.Open(s.path(seg.name))
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	tags := map[string]entry.EntryTag{}
+	rdr := bufio.NewReaderSize(fin, 64*1024)
+	var batch []*entry.Entry
+	var line []byte
+	for {
+		var n int
+		var err error
+		line, n, err = readSpoolRecord(rdr, line)
+		if n > maxSpoolRecord {
+			lg.Warn("Dropping a %d byte record from spool segment %s, the limit is %d bytes\n", n, seg.name, maxSpoolRecord)
+			stats.spoolDrop()
+		} else if len(line) > 0 {
+			var rec spoolRecord
+			if jerr := json.Unmarshal(line, &rec); jerr != nil {
+				lg.Warn("Skipping corrupt record in spool segment %s: %v\n", seg.name, jerr)
+			} else if ent, terr := rec.entry(tags); terr != nil {
+				return terr
+			} else {
+				batch = append(batch, ent)
+			}
+		}
+		if len(batch) >= spoolForwardBatch || (err != nil && len(batch) > 0) {
+			s.pacer.wait(ctx, len(batch))
+			if werr := writeBatch(ctx, batch); werr != nil {
+				return werr
+			}
+			s.written(batch)
+			batch = nil
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return os.Remove(s.path(seg.name))
+}
+
+// readSpoolRecord reads the next line into buf, returning it and its
+// length.  A line over maxSpoolRecord is read through to its end without
+// being kept so a corrupt segment can't exhaust memory, only its length is
+// returned.
+func readSpoolRecord(rdr *bufio.Reader, buf []byte) ([]byte, int, error) {
+	buf = buf[:0]
+	var n int
+	for {
+		frag, err := rdr.ReadSlice('\n')
+		n += len(frag)
+		if n <= maxSpoolRecord {
+			buf = append(buf, frag...)
+		}
+		if err != bufio.ErrBufferFull {
+			if n > maxSpoolRecord {
+				return buf[:0], n, err
+			}
+			return buf, n, err
+		}
+	}
+}
+
+func (rec *spoolRecord) entry(tags map[string]entry.EntryTag) (*entry.Entry, error) {
+	tag, ok := tags[rec.Tag]
+	if !ok {
+		var err error
+		if tag, err = igst.NegotiateTag(rec.Tag); err != nil {
+			return nil, err
+		}
+		tags[rec.Tag] = tag
+	}
+	return &entry.Entry{
+		TS:   rec.TS,
+		SRC:  rec.SRC,
+		Tag:  tag,
+		Data: rec.Data,
+	}, nil
+}
+
+// bytes returns the size of the spool on disk and the number of segments.
+func (s *spool) bytes() (total int64, segments int) {
+	segs, err := s.segments(true)
+	if err != nil {
+		return
+	}
+	for _, seg := range segs {
+		total += seg.size
+	}
+	segments = len(segs)
+	return
+}
+
+func (s *spool) report() {
+	total, segs := s.bytes()
+	s.Lock()
+	evicted := s.evicted
+	s.Unlock()
+	if total > 0 || evicted > 0 {
+		lg.Info("Spool: %d segments, %d bytes, %d segments evicted\n", segs, total, evicted)
+	}
+}
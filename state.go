@@ -0,0 +1,95 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statePublishInterval = 30 * time.Second
+)
+
+// ingesterState is what we hand to the muxer for ingester state messages,
+// the configuration along with live stream status so the ingester page in
+// Gravwell shows whether each stream is actually flowing.
+type ingesterState struct {
+	Config  *cfgType
+	Streams []streamStatus
+}
+
+type streamStatus struct {
+	Name            string
+	Running         bool
+	Restarts        uint64
+	EntriesRead     uint64
+	EntriesIngested uint64     // handed to the writer, which may still be retrying them
+	LastEntry       *time.Time `json:",omitempty"`
+	LastRecord      *time.Time `json:",omitempty"`
+	Lag             string     `json:",omitempty"`
+	LastError       string     `json:",omitempty"`
+	QueuedBytes     int
+	SpoolBytes      int64
+}
+
+// currentState reports a row for each configured stream, the queue and
+// spool are shared so every row shows the same depth.
+func currentState(cfg *cfgType, pl *pipeline) ingesterState {
+	state := ingesterState{Config: cfg}
+	queued, spooled := pl.out.depth()
+	for _, st := range stats.streamList() {
+		row := st.status()
+		row.QueuedBytes, row.SpoolBytes = queued, spooled
+		state.Streams = append(state.Streams, row)
+	}
+	return state
+}
+
+func (st *streamStats) status() streamStatus {
+	row := streamStatus{
+		Name:            st.name,
+		Running:         st.isRunning(),
+		Restarts:        atomic.LoadUint64(&st.restarts),
+		EntriesRead:     atomic.LoadUint64(&st.read),
+		EntriesIngested: atomic.LoadUint64(&st.written),
+	}
+	st.Lock()
+	defer st.Unlock()
+	row.LastError = st.lastErr
+	if !st.lastEntry.IsZero() {
+		last := st.lastEntry
+		row.LastEntry = &last
+	}
+	if !st.lastRec.IsZero() {
+		rec := st.lastRec
+		row.LastRecord = &rec
+		row.Lag = st.lastRecAt.Sub(st.lastRec).Round(time.Millisecond).String()
+	}
+	return row
+}
+
+// publishState refreshes the ingester state until the context is cancelled.
+func publishState(ctx context.Context, wg *sync.WaitGroup, cfg func() *cfgType, pl *pipeline) {
+	defer wg.Done()
+	tckr := time.NewTicker(statePublishInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+			if err := igst.SetRawConfiguration(currentState(cfg(), pl)); err != nil {
+				lg.Warn("Failed to update ingester state: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+var (
+	stats = &ingestStats{start: time.Now()}
+
+	// upper bounds in seconds of the ingest latency histogram buckets
+	latencyBounds = [...]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60, 300, 3600}
+)
+
+// ingestStats are the ingester wide counters used for self monitoring.
+// The counters are only ever incremented, consumers take deltas.
+type ingestStats struct {
+	// 64 bit counters first so they are aligned for atomic access
+	entriesRead      uint64
+	bytesRead        uint64
+	entriesIngested  uint64
+	bytesIngested    uint64
+	parseErrors      uint64
+	batchFailures    uint64
+	restarts         uint64
+	latencyCount     uint64
+	latencyMicros    uint64 // sum of ingest latencies
+	latencyBuckets   [len(latencyBounds)]uint64
+	decodeQueue      int64 // batches decoded and waiting for the writer
+	decodeQueueBytes int64
+	decodeBytes      int64 // decoder buffers
+	batchedBytes     int64 // entries gathered into the next write
+	throttledNanos   uint64
+	shedEntries      uint64 // dropped under Memory-Soft-Limit
+	spoolDropped     uint64 // spooled records too large to forward
+	sampledRaw       uint64 // bytes of batches sampled for compression
+	sampledDeflated  uint64 // and what they compressed to
+	pacedNanos       uint64 // backlog writes waiting on Backlog-Rate-EPS
+	backlogEPS       int64  // the current backlog rate while ramping
+	streaming        int32  // number of log stream children running
+	shedding         int32  // non-zero while over Memory-Soft-Limit
+
+	sync.Mutex
+	start     time.Time
+	lastEntry time.Time
+	lastErr   string
+	lastErrTS time.Time
+	lastRec   time.Time // timestamp of the newest delivered record
+	lastRecAt time.Time // when it was delivered
+	streams   []*streamStats
+}
+
+// streamStats are a single log stream's counters, kept alongside the
+// ingester wide ones so status can show which stream is down.  Entries are
+// counted as written once they are handed to the writer, they may still be
+// queued for retry.  The methods do nothing on nil for streams that aren't
+// reported.
+type streamStats struct {
+	restarts uint64
+	read     uint64
+	written  uint64
+	running  int32
+
+	sync.Mutex
+	name      string
+	lastEntry time.Time
+	lastErr   string
+	lastRec   time.Time // timestamp of the newest record written
+	lastRecAt time.Time // when it was written
+}
+
+// stream returns the counters for a stream, registering it the first time
+// so streams are reported in the order they were configured.
+func (s *ingestStats) stream(name string) *streamStats {
+	s.Lock()
+	defer s.Unlock()
+	for _, st := range s.streams {
+		if st.name == name {
+			return st
+		}
+	}
+	st := &streamStats{name: name}
+	s.streams = append(s.streams, st)
+	return st
+}
+
+// streamList returns the registered streams.
+func (s *ingestStats) streamList() []*streamStats {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*streamStats(nil), s.streams...)
+}
+
+// streamsDown names the streams that have no log child running.
+func (s *ingestStats) streamsDown() (down []string) {
+	for _, st := range s.streamList() {
+		if !st.isRunning() {
+			down = append(down, st.name)
+		}
+	}
+	return
+}
+
+func (st *streamStats) readEntries(ents []*entry.Entry) {
+	if st == nil || len(ents) == 0 {
+		return
+	}
+	atomic.AddUint64(&st.read, uint64(len(ents)))
+	st.Lock()
+	st.lastEntry = time.Now()
+	st.Unlock()
+}
+
+func (st *streamStats) wrote(ents []*entry.Entry) {
+	if st == nil || len(ents) == 0 {
+		return
+	}
+	atomic.AddUint64(&st.written, uint64(len(ents)))
+	if rec, ok := newestRecordTime(ents); ok {
+		st.Lock()
+		if rec.After(st.lastRec) {
+			st.lastRec = rec
+			st.lastRecAt = time.Now()
+		}
+		st.Unlock()
+	}
+}
+
+func (st *streamStats) setRunning(up bool) {
+	if st == nil {
+		return
+	}
+	if up {
+		atomic.AddInt32(&st.running, 1)
+	} else {
+		atomic.AddInt32(&st.running, -1)
+	}
+}
+
+func (st *streamStats) isRunning() bool {
+	return st != nil && atomic.LoadInt32(&st.running) != 0
+}
+
+func (st *streamStats) restart(err error) {
+	if st == nil {
+		return
+	}
+	atomic.AddUint64(&st.restarts, 1)
+	if err != nil {
+		st.Lock()
+		st.lastErr = err.Error()
+		st.Unlock()
+	}
+}
+
+func (s *ingestStats) read(ents []*entry.Entry) {
+	atomic.AddUint64(&s.entriesRead, uint64(len(ents)))
+	atomic.AddUint64(&s.bytesRead, uint64(batchSize(ents)))
+	if len(ents) > 0 {
+		s.Lock()
+		s.lastEntry = time.Now()
+		s.Unlock()
+	}
+}
+
+// ingested counts delivered entries, latency is measured from the entry
+// timestamp which is stamped as records are read.
+func (s *ingestStats) ingested(ents []*entry.Entry) {
+	atomic.AddUint64(&s.entriesIngested, uint64(len(ents)))
+	atomic.AddUint64(&s.bytesIngested, uint64(batchSize(ents)))
+	now := time.Now()
+	for _, ent := range ents {
+		lat := now.Sub(ent.TS.StandardTime())
+		if lat < 0 {
+			lat = 0
+		}
+		atomic.AddUint64(&s.latencyCount, 1)
+		atomic.AddUint64(&s.latencyMicros, uint64(lat/time.Microsecond))
+		secs := lat.Seconds()
+		for i, b := range latencyBounds {
+			if secs <= b {
+				atomic.AddUint64(&s.latencyBuckets[i], 1)
+				break
+			}
+		}
+	}
+}
+
+func (s *ingestStats) setStreaming(up bool) {
+	if up {
+		atomic.AddInt32(&s.streaming, 1)
+	} else {
+		atomic.AddInt32(&s.streaming, -1)
+	}
+}
+
+func (s *ingestStats) throttled(d time.Duration) {
+	atomic.AddUint64(&s.throttledNanos, uint64(d))
+}
+
+func (s *ingestStats) paced(d time.Duration) {
+	atomic.AddUint64(&s.pacedNanos, uint64(d))
+}
+
+func (s *ingestStats) setBacklogRate(eps float64) {
+	atomic.StoreInt64(&s.backlogEPS, int64(eps))
+}
+
+func (s *ingestStats) queued(ents []*entry.Entry) {
+	atomic.AddInt64(&s.decodeQueue, 1)
+	atomic.AddInt64(&s.decodeQueueBytes, int64(batchSize(ents)))
+}
+
+func (s *ingestStats) dequeued(ents []*entry.Entry) {
+	atomic.AddInt64(&s.decodeQueue, -1)
+	atomic.AddInt64(&s.decodeQueueBytes, -int64(batchSize(ents)))
+}
+
+func (s *ingestStats) decodeBuffers(delta int64) {
+	atomic.AddInt64(&s.decodeBytes, delta)
+}
+
+func (s *ingestStats) batched(delta int) {
+	atomic.AddInt64(&s.batchedBytes, int64(delta))
+}
+
+func (s *ingestStats) compressed(raw, deflated int) {
+	atomic.AddUint64(&s.sampledRaw, uint64(raw))
+	atomic.AddUint64(&s.sampledDeflated, uint64(deflated))
+}
+
+func (s *ingestStats) shed(n int) {
+	atomic.AddUint64(&s.shedEntries, uint64(n))
+}
+
+func (s *ingestStats) spoolDrop() {
+	atomic.AddUint64(&s.spoolDropped, 1)
+}
+
+func (s *ingestStats) delivered(rec time.Time) {
+	s.Lock()
+	if rec.After(s.lastRec) {
+		s.lastRec = rec
+		s.lastRecAt = time.Now()
+	}
+	s.Unlock()
+}
+
+func (s *ingestStats) parseError() {
+	atomic.AddUint64(&s.parseErrors, 1)
+}
+
+func (s *ingestStats) batchFailure(err error) {
+	atomic.AddUint64(&s.batchFailures, 1)
+	s.setError(err)
+}
+
+func (s *ingestStats) restart(err error) {
+	atomic.AddUint64(&s.restarts, 1)
+	if err != nil {
+		s.setError(err)
+	}
+}
+
+func (s *ingestStats) setError(err error) {
+	s.Lock()
+	s.lastErr = err.Error()
+	s.lastErrTS = time.Now()
+	s.Unlock()
+}
+
+// statsSnapshot is a point in time copy of the counters.
+type statsSnapshot struct {
+	TS              time.Time
+	Start           time.Time
+	EntriesRead     uint64
+	BytesRead       uint64
+	EntriesIngested uint64
+	BytesIngested   uint64
+	ParseErrors     uint64
+	BatchFailures   uint64
+	Restarts        uint64
+	Streaming       bool
+	DecodeQueue     int64
+	Throttled       time.Duration // time spent waiting on the entry rate limit
+	Paced           time.Duration // time backlog writes spent waiting on Backlog-Rate-EPS
+	BacklogEPS      int64
+	Shed            uint64 // entries dropped under Memory-Soft-Limit
+	Shedding        bool
+	SpoolDropped    uint64 // spooled records too large to forward
+	SampledRaw      uint64 // bytes sampled for the compression ratio
+	SampledDeflated uint64
+	LatencyCount    uint64
+	LatencySeconds  float64
+	LatencyBuckets  [len(latencyBounds)]uint64 // not cumulative
+	LastEntry       time.Time
+	LastError       string
+	LastErrorTS     time.Time
+	LastRecord      time.Time
+	Lag             time.Duration // record time to delivery for the newest record
+}
+
+func (s *ingestStats) snapshot() (ss statsSnapshot) {
+	ss.TS = time.Now()
+	ss.EntriesRead = atomic.LoadUint64(&s.entriesRead)
+	ss.BytesRead = atomic.LoadUint64(&s.bytesRead)
+	ss.EntriesIngested = atomic.LoadUint64(&s.entriesIngested)
+	ss.BytesIngested = atomic.LoadUint64(&s.bytesIngested)
+	ss.ParseErrors = atomic.LoadUint64(&s.parseErrors)
+	ss.BatchFailures = atomic.LoadUint64(&s.batchFailures)
+	ss.Restarts = atomic.LoadUint64(&s.restarts)
+	ss.Streaming = atomic.LoadInt32(&s.streaming) != 0
+	ss.DecodeQueue = atomic.LoadInt64(&s.decodeQueue)
+	ss.Throttled = time.Duration(atomic.LoadUint64(&s.throttledNanos))
+	ss.Paced = time.Duration(atomic.LoadUint64(&s.pacedNanos))
+	ss.BacklogEPS = atomic.LoadInt64(&s.backlogEPS)
+	ss.Shed = atomic.LoadUint64(&s.shedEntries)
+	ss.Shedding = atomic.LoadInt32(&s.shedding) != 0
+	ss.SpoolDropped = atomic.LoadUint64(&s.spoolDropped)
+	ss.SampledRaw = atomic.LoadUint64(&s.sampledRaw)
+	ss.SampledDeflated = atomic.LoadUint64(&s.sampledDeflated)
+	ss.LatencyCount = atomic.LoadUint64(&s.latencyCount)
+	ss.LatencySeconds = float64(atomic.LoadUint64(&s.latencyMicros)) / 1e6
+	for i := range s.latencyBuckets {
+		ss.LatencyBuckets[i] = atomic.LoadUint64(&s.latencyBuckets[i])
+	}
+	s.Lock()
+	ss.Start = s.start
+	ss.LastEntry = s.lastEntry
+	ss.LastError = s.lastErr
+	ss.LastErrorTS = s.lastErrTS
+	ss.LastRecord = s.lastRec
+	if !s.lastRec.IsZero() {
+		ss.Lag = s.lastRecAt.Sub(s.lastRec)
+	}
+	s.Unlock()
+	return
+}
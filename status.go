@@ -0,0 +1,273 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/version"
+)
+
+const (
+	defaultControlSocket = `/var/run/gravwell_macosLog.ctl`
+	rateSampleInterval   = 10 * time.Second
+	rateSamples          = 7 // a minute of history
+	statusTimeout        = 5 * time.Second
+)
+
+// statusReport is what -status prints, served by the running instance on
+// its control socket.
+type statusReport struct {
+	Version           string         `json:"version"`
+	PID               int            `json:"pid"`
+	Uptime            string         `json:"uptime"`
+	HotConnections    int            `json:"hot_connections"`
+	EntriesPerSecond  float64        `json:"entries_per_second"`
+	IngestedPerSecond float64        `json:"ingested_per_second"`
+	BytesPerSecond    float64        `json:"bytes_per_second"`
+	RateWindow        string         `json:"rate_window"`
+	EntriesRead       uint64         `json:"entries_read"`
+	EntriesIngested   uint64         `json:"entries_ingested"`
+	ParseErrors       uint64         `json:"parse_errors"`
+	BatchFailures     uint64         `json:"batch_failures"`
+	QueuedBytes       int            `json:"queued_bytes"`
+	SpoolBytes        int64          `json:"spool_bytes"`
+	DecodeQueue       int64          `json:"decode_queue_batches"`
+	Memory            memoryUsage    `json:"memory"`
+	MemoryLimit       int64          `json:"memory_soft_limit,omitempty"`
+	Shedding          bool           `json:"shedding"`
+	ShedEntries       uint64         `json:"shed_entries"`
+	Compression       bool           `json:"compression_enabled"`
+	SampledBytes      uint64         `json:"compression_sampled_bytes"`
+	SampledCompressed uint64         `json:"compression_sampled_compressed_bytes"`
+	Streams           []streamStatus `json:"streams"`
+	LastError         string         `json:"last_error,omitempty"`
+	LastErrorTime     *time.Time     `json:"last_error_time,omitempty"`
+}
+
+// rateTracker keeps a short history of the counters so rates reflect the
+// last minute rather than the whole run.
+type rateTracker struct {
+	sync.Mutex
+	samples []statsSnapshot
+}
+
+func (rt *rateTracker) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(rateSampleInterval)
+	defer tckr.Stop()
+	rt.sample()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+			rt.sample()
+		}
+	}
+}
+
+func (rt *rateTracker) sample() {
+	ss := stats.snapshot()
+	rt.Lock()
+	if rt.samples = append(rt.samples, ss); len(rt.samples) > rateSamples {
+		rt.samples = rt.samples[1:]
+	}
+	rt.Unlock()
+}
+
+// oldest returns the oldest sample, or the start of the run without one.
+func (rt *rateTracker) oldest(cur statsSnapshot) statsSnapshot {
+	rt.Lock()
+	defer rt.Unlock()
+	if len(rt.samples) > 0 {
+		return rt.samples[0]
+	}
+	return statsSnapshot{TS: cur.Start}
+}
+
+func (rt *rateTracker) report(pl *pipeline) (sr statusReport) {
+	cur := stats.snapshot()
+	prev := rt.oldest(cur)
+	window := cur.TS.Sub(prev.TS)
+	if secs := window.Seconds(); secs > 0 {
+		sr.EntriesPerSecond = float64(cur.EntriesRead-prev.EntriesRead) / secs
+		sr.IngestedPerSecond = float64(cur.EntriesIngested-prev.EntriesIngested) / secs
+		sr.BytesPerSecond = float64(cur.BytesRead-prev.BytesRead) / secs
+	}
+	sr.Version = version.GetVersion()
+	sr.PID = os.Getpid()
+	sr.Uptime = cur.TS.Sub(cur.Start).Round(time.Second).String()
+	sr.RateWindow = window.Round(time.Second).String()
+	sr.EntriesRead = cur.EntriesRead
+	sr.EntriesIngested = cur.EntriesIngested
+	sr.ParseErrors = cur.ParseErrors
+	sr.BatchFailures = cur.BatchFailures
+	if hot, err := igst.Hot(); err == nil {
+		sr.HotConnections = hot
+	}
+	sr.QueuedBytes, sr.SpoolBytes = pl.out.depth()
+	sr.DecodeQueue = cur.DecodeQueue
+	sr.Memory = currentMemoryUsage(pl)
+	if memGuard != nil {
+		sr.MemoryLimit = memGuard.limit
+	}
+	sr.Shedding, sr.ShedEntries = cur.Shedding, cur.Shed
+	if pl.compression != nil {
+		sr.Compression = pl.compression.enabled
+	}
+	sr.SampledBytes, sr.SampledCompressed = cur.SampledRaw, cur.SampledDeflated
+	sr.Streams = currentState(nil, pl).Streams
+	sr.LastError = cur.LastError
+	if !cur.LastErrorTS.IsZero() {
+		sr.LastErrorTime = &cur.LastErrorTS
+	}
+	return
+}
+
+// startControlSocket serves the status report on a unix socket for -status.
+func startControlSocket(ctx context.Context, wg *sync.WaitGroup, path string, pl *pipeline) error {
+	// only a stale socket may be removed, not one a live instance is using
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("another instance is serving %s", path)
+	}
+	os.Remove(path)
+	rt := &rateTracker{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rt.report(pl))
+	})
+	if err := startHTTPServer(ctx, wg, "unix", path, mux); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		return err
+	}
+	wg.Add(1)
+	go rt.run(ctx, wg)
+	return nil
+}
+
+// controlSocketFor returns the control socket named in the config at path,
+// the default is used if it can't be loaded.
+func controlSocketFor(path string) string {
+	if cfg, err := loadConfig(path); err == nil {
+		return cfg.Global.controlSocket()
+	}
+	return defaultControlSocket
+}
+
+// printStatus queries a running instance and writes its status to w.
+func printStatus(w io.Writer, sock string, asJSON bool) error {
+	cli := &http.Client{
+		Timeout: statusTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	resp, err := cli.Get("http://localhost/status")
+	if err != nil {
+		return fmt.Errorf("Failed to query %s, is the ingester running? %v", sock, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", sock, resp.Status)
+	}
+	var sr statusReport
+	if err = json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent(``, `  `)
+		return enc.Encode(sr)
+	}
+	fmt.Fprintf(w, "%s %s (pid %d), up %s\n", ingesterName, sr.Version, sr.PID, sr.Uptime)
+	fmt.Fprintf(w, "Backend connections: %d hot\n", sr.HotConnections)
+	fmt.Fprintf(w, "Rates over %s: %.1f entries/s read, %.1f entries/s ingested, %s/s\n",
+		sr.RateWindow, sr.EntriesPerSecond, sr.IngestedPerSecond, humanBytes(int64(sr.BytesPerSecond)))
+	fmt.Fprintf(w, "Totals: %d read, %d ingested, %d parse errors, %d failed batches\n",
+		sr.EntriesRead, sr.EntriesIngested, sr.ParseErrors, sr.BatchFailures)
+	fmt.Fprintf(w, "Backlog: %d batches decoded, %s queued in memory, %s spooled\n", sr.DecodeQueue, humanBytes(int64(sr.QueuedBytes)), humanBytes(sr.SpoolBytes))
+	mem := fmt.Sprintf("Memory: %s of entries (%s decode buffers, %s decoded, %s batched, %s retrying), %s heap",
+		humanBytes(sr.Memory.tracked()), humanBytes(sr.Memory.DecodeBuffers), humanBytes(sr.Memory.DecodeQueue),
+		humanBytes(sr.Memory.Batched), humanBytes(sr.Memory.RetryQueue), humanBytes(int64(sr.Memory.Heap)))
+	if sr.MemoryLimit > 0 {
+		mem += fmt.Sprintf(", soft limit %s", humanBytes(sr.MemoryLimit))
+	}
+	if sr.Shedding {
+		mem += `, shedding`
+	}
+	if sr.ShedEntries > 0 {
+		mem += fmt.Sprintf(", %d entries shed", sr.ShedEntries)
+	}
+	fmt.Fprintf(w, "%s\n", mem)
+	if sr.SampledCompressed > 0 {
+		verb := `would compress`
+		if sr.Compression {
+			verb = `compress`
+		}
+		fmt.Fprintf(w, "Compression: sampled batches %s about %s\n", verb, compressionRatio(sr.SampledBytes, sr.SampledCompressed))
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tSTATE\tRESTARTS\tREAD\tINGESTED\tLAST ENTRY\tLAG")
+	for _, st := range sr.Streams {
+		state := `stopped`
+		if st.Running {
+			state = `running`
+		}
+		last := `-`
+		if st.LastEntry != nil {
+			last = time.Since(*st.LastEntry).Round(time.Second).String() + ` ago`
+		}
+		lag := st.Lag
+		if lag == `` {
+			lag = `-`
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", st.Name, state, st.Restarts, st.EntriesRead, st.EntriesIngested, last, lag)
+	}
+	tw.Flush()
+	if sr.LastError != `` {
+		fmt.Fprintf(w, "\nLast error")
+		if sr.LastErrorTime != nil {
+			fmt.Fprintf(w, " (%s)", sr.LastErrorTime.Local().Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, ": %s\n", sr.LastError)
+	}
+	return nil
+}
+
+// humanBytes formats a byte count with a binary unit.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,81 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	maxStderrLine = 64 * 1024
+)
+
+// stderrCapture relays whatever the log child writes to stderr, predicate
+// syntax errors and permission problems only ever show up there.
+type stderrCapture struct {
+	ingest bool // also ingest each line under the diagnostics tag
+	tag    entry.EntryTag
+	src    *sourceTracker
+}
+
+type stderrLine struct {
+	Type    string `json:"type"`
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+func newStderrCapture(cfg *cfgType, src *sourceTracker) (*stderrCapture, error) {
+	sc := &stderrCapture{
+		src: src,
+	}
+	if cfg.Global.Diagnostics_Tag_Name != `` {
+		tag, err := igst.GetTag(cfg.Global.Diagnostics_Tag_Name)
+		if err != nil {
+			return nil, err
+		}
+		sc.ingest = true
+		sc.tag = tag
+	}
+	return sc, nil
+}
+
+// consume reads lines from r until it is closed, logging each one and
+// optionally ingesting it.
+func (sc *stderrCapture) consume(ctx context.Context, name string, r io.Reader) {
+	scnr := bufio.NewScanner(r)
+	scnr.Buffer(make([]byte, 4096), maxStderrLine)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == `` {
+			continue
+		}
+		lg.Warn("%s stderr: %s\n", name, line)
+		if !sc.ingest {
+			continue
+		}
+		obj := stderrLine{
+			Type:    `stderr`,
+			Command: name,
+			Message: line,
+		}
+		if err := emitJSON(ctx, sc.tag, sc.src, time.Now(), obj); err != nil && err != context.Canceled {
+			lg.Error("Failed to ingest %s stderr: %v\n", name, err)
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		lg.Error("Failed to read %s stderr: %v\n", name, err)
+		io.Copy(io.Discard, r)
+	}
+}
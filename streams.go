@@ -0,0 +1,224 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	// the stream a config without Stream blocks runs
+	defaultStreamName = `default`
+)
+
+// streamBlock is a [Stream "name"] section, each runs its own log stream
+// child with its own predicate and tag.  The Tag-Name defaults to the
+// Global Tag-Name.
+type streamBlock struct {
+	Tag_Name            string
+	Predicate           string // log predicate applied to this stream and its backfills
+	Circuit_Breaker_EPS int    // this stream's circuit breaker ceiling, defaults to the Global one
+}
+
+// presetStream is a built in stream that a collector block turns on, it
+// runs with a fixed predicate under the block's tag.
+type presetStream struct {
+	name      string
+	predicate string
+	block     func(c *cfgType) (enabled bool, tag string)
+}
+
+var presetStreams = []presetStream{
+	{
+		name:      xprotectStreamName,
+		predicate: xprotectPredicate,
+		block:     func(c *cfgType) (bool, string) { return c.XProtect.Enable, c.XProtect.Tag_Name },
+	},
+	{
+		name:      gatekeeperStreamName,
+		predicate: gatekeeperPredicate,
+		block:     func(c *cfgType) (bool, string) { return c.Gatekeeper.Enable, c.Gatekeeper.Tag_Name },
+	},
+	{
+		name:      extensionsStreamName,
+		predicate: extensionsPredicate,
+		block:     func(c *cfgType) (bool, string) { return c.Extensions.Enable, c.Extensions.Tag_Name },
+	},
+	{
+		name:      authStreamName,
+		predicate: authPredicate,
+		block:     func(c *cfgType) (bool, string) { return c.Auth_Events.Enable, c.Auth_Events.Tag_Name },
+	},
+	{
+		name:      remoteAccessStreamName,
+		predicate: remoteAccessPredicate,
+		block:     func(c *cfgType) (bool, string) { return c.Remote_Access.Enable, c.Remote_Access.Tag_Name },
+	},
+	{
+		name:      mdmStreamName,
+		predicate: mdmPredicate,
+		block:     func(c *cfgType) (bool, string) { return c.MDM.Enable, c.MDM.Tag_Name },
+	},
+}
+
+// verifyPresetStreams makes sure no Stream block takes the name of an
+// enabled preset stream, and that a preset stream the Global filters
+// would otherwise reach has a tag of its own.
+func (c *cfgType) verifyPresetStreams() error {
+	exempt := c.presetTags()
+	for _, ps := range presetStreams {
+		enabled, tag := ps.block(c)
+		if !enabled {
+			continue
+		}
+		if _, ok := c.Stream[ps.name]; ok {
+			return fmt.Errorf("The %q stream name is taken by a built in stream, rename the Stream block", ps.name)
+		}
+		if !exempt[tag] && c.Global.filtersRecords() {
+			return fmt.Errorf("The %q stream shares tag %q with another stream, so the Global filters and Error-Context would drop its records, give it a tag of its own", ps.name, tag)
+		}
+	}
+	return nil
+}
+
+// presetTags returns the tags only preset streams write to.  The operator
+// turned those streams on explicitly so the Global filters and
+// Error-Context don't apply to them.
+func (c *cfgType) presetTags() map[string]bool {
+	tags := map[string]bool{}
+	for _, ps := range presetStreams {
+		if enabled, tag := ps.block(c); enabled {
+			tags[tag] = true
+		}
+	}
+	for _, def := range c.streamDefs() {
+		if !isPresetStream(def.name) {
+			delete(tags, def.tagName)
+		}
+	}
+	return tags
+}
+
+func isPresetStream(name string) bool {
+	for _, ps := range presetStreams {
+		if ps.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// streamDef is a stream as configured, from a Stream block or the legacy
+// single stream form in Global.
+type streamDef struct {
+	name      string
+	tagName   string
+	predicate string
+}
+
+// streamDefs returns the configured and preset streams sorted by name.
+func (c *cfgType) streamDefs() (defs []streamDef) {
+	if len(c.Stream) == 0 {
+		defs = append(defs, streamDef{
+			name:      defaultStreamName,
+			tagName:   c.Global.Tag_Name,
+			predicate: c.Global.Predicate,
+		})
+	}
+	for name, sb := range c.Stream {
+		defs = append(defs, streamDef{
+			name:      name,
+			tagName:   sb.Tag_Name,
+			predicate: sb.Predicate,
+		})
+	}
+	for _, ps := range presetStreams {
+		if enabled, tag := ps.block(c); enabled {
+			defs = append(defs, streamDef{
+				name:      ps.name,
+				tagName:   tag,
+				predicate: ps.predicate,
+			})
+		}
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].name < defs[j].name })
+	return
+}
+
+func (sb *streamBlock) verify(name string, g global) error {
+	if name == `` {
+		return fmt.Errorf("Stream blocks must be named")
+	} else if g.Predicate != `` {
+		return fmt.Errorf("Global Predicate can't be combined with Stream blocks, move it into a Stream block (see -migrate-config)")
+	}
+	if sb.Tag_Name == `` {
+		sb.Tag_Name = g.Tag_Name
+	}
+	if sb.Circuit_Breaker_EPS < 0 {
+		return fmt.Errorf("Stream %q has a negative Circuit-Breaker-EPS", name)
+	}
+	return nil
+}
+
+// logStream is a running log stream child and its settings.
+type logStream struct {
+	name     string
+	tag      entry.EntryTag
+	ctl      *streamControl
+	counters *streamStats // nil when the stream isn't reported
+}
+
+type streamSet []*logStream
+
+// newStreamSet resolves the tag for each configured stream, base holds the
+// settings shared by all of them.
+func newStreamSet(cfg *cfgType, base streamConfig) (ss streamSet, err error) {
+	for _, def := range cfg.streamDefs() {
+		ls := &logStream{name: def.name, counters: stats.stream(def.name)}
+		if ls.tag, err = igst.GetTag(def.tagName); err != nil {
+			return nil, fmt.Errorf("Failed to resolve tag %q for stream %s: %v", def.tagName, def.name, err)
+		}
+		rc := base
+		rc.predicate = def.predicate
+		ls.ctl = &streamControl{rc: rc}
+		ss = append(ss, ls)
+	}
+	return
+}
+
+// restart restarts every stream.
+func (ss streamSet) restart() {
+	for _, ls := range ss {
+		ls.ctl.restart()
+	}
+}
+
+// reconfigure applies new settings to the running streams, only streams
+// whose settings changed are restarted.  Streams can't be added or removed
+// without a restart.
+func (ss streamSet) reconfigure(cfg *cfgType, base streamConfig) {
+	defs := map[string]streamDef{}
+	for _, def := range cfg.streamDefs() {
+		defs[def.name] = def
+	}
+	for _, ls := range ss {
+		def, ok := defs[ls.name]
+		if !ok {
+			continue
+		}
+		rc := base
+		rc.predicate = def.predicate
+		if ls.ctl.reconfigure(rc) {
+			lg.Info("Settings for stream %s changed, restarting it\n", ls.name)
+		}
+	}
+}
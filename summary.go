@@ -0,0 +1,110 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	// caps the number of distinct subsystems and processes in a summary
+	maxSummaryKeys = 1000
+	summaryOther   = `<other>`
+)
+
+type dropSummary struct {
+	Type       string            `json:"type"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Total      uint64            `json:"total"`
+	Subsystems map[string]uint64 `json:"subsystems"`
+	Processes  map[string]uint64 `json:"processes"`
+}
+
+// dropTally counts what the filters, sampler, and circuit breaker threw
+// away and periodically emits a summary entry so analysts know what they
+// are not seeing.  A nil tally ignores everything so stages can call it
+// unconditionally.
+type dropTally struct {
+	sync.Mutex
+	interval time.Duration
+	start    time.Time
+	total    uint64
+	subs     map[string]uint64
+	procs    map[string]uint64
+	tmpl     entry.Entry // source and tag of the last drop, not its data
+}
+
+func newDropTally(interval time.Duration) *dropTally {
+	if interval <= 0 {
+		return nil
+	}
+	dt := &dropTally{interval: interval}
+	dt.reset(time.Now())
+	return dt
+}
+
+func (dt *dropTally) reset(now time.Time) {
+	dt.start = now
+	dt.total = 0
+	dt.subs = map[string]uint64{}
+	dt.procs = map[string]uint64{}
+}
+
+// dropped records a discarded event.
+func (dt *dropTally) dropped(ev *event) {
+	if dt == nil {
+		return
+	}
+	dt.Lock()
+	defer dt.Unlock()
+	// the dropped entry is recycled so only what the summary needs is kept
+	dt.tmpl = entry.Entry{SRC: ev.ent.SRC, Tag: ev.ent.Tag}
+	dt.total++
+	countCapped(dt.subs, ev.Subsystem)
+	countCapped(dt.procs, path.Base(ev.ProcessImagePath))
+}
+
+func countCapped(m map[string]uint64, k string) {
+	if _, ok := m[k]; !ok && len(m) >= maxSummaryKeys {
+		k = summaryOther
+	}
+	m[k]++
+}
+
+// add passes everything through, the tally sits in the holder chain so it
+// gets flushed on the pipeline's schedule.
+func (dt *dropTally) add(ev *event) []*event {
+	return []*event{ev}
+}
+
+func (dt *dropTally) flush(now time.Time, force bool) []*event {
+	dt.Lock()
+	defer dt.Unlock()
+	if !force && now.Sub(dt.start) < dt.interval {
+		return nil
+	}
+	var out []*event
+	if dt.total > 0 {
+		out = append(out, newSyntheticEvent(&dt.tmpl, dropSummary{
+			Type:       `dropSummary`,
+			Start:      dt.start,
+			End:        now,
+			Total:      dt.total,
+			Subsystems: dt.subs,
+			Processes:  dt.procs,
+		}))
+	}
+	dt.reset(now)
+	return out
+}
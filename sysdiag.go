@@ -0,0 +1,437 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	sysdiagLogTag      = `macos-sysdiagnose-log`
+	sysdiagSpindumpTag = `macos-sysdiagnose-spindump`
+	sysdiagPsTag       = `macos-sysdiagnose-ps`
+	sysdiagNetstatTag  = `macos-sysdiagnose-netstat`
+
+	defaultSysdiagLast = time.Hour
+)
+
+var sysdiagTags = []string{sysdiagLogTag, sysdiagSpindumpTag, sysdiagPsTag, sysdiagNetstatTag}
+
+// psProcess is the entry written for each row of the ps snapshot, the
+// columns are named by the ps header.
+type psProcess map[string]string
+
+// netstatConn is the entry written for each connection in the netstat
+// snapshot.
+type netstatConn struct {
+	Type    string `json:"type"`
+	Proto   string `json:"proto"`
+	RecvQ   int    `json:"recv_q"`
+	SendQ   int    `json:"send_q"`
+	Local   string `json:"local"`
+	Foreign string `json:"foreign"`
+	State   string `json:"state,omitempty"`
+}
+
+// sysdiagIngester writes the components of an unpacked sysdiagnose.
+type sysdiagIngester struct {
+	w      io.Writer
+	src    *sourceTracker
+	tags   map[string]entry.EntryTag
+	last   time.Duration
+	counts map[string]int // entries by tag
+}
+
+// runSysdiagnose takes a sysdiagnose, or uses the given archive, unpacks
+// it, and ingests the unified log, spindumps, and the ps and netstat
+// snapshots, each under its own tag.  Progress is written to w.
+func runSysdiagnose(w io.Writer, cfg *cfgType, archive string, last time.Duration, dry bool) error {
+	tmp, err := ioutil.TempDir(``, `macosLog-sysdiagnose`)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	ctx := context.Background()
+	if archive == `` {
+		fmt.Fprintf(w, "Taking a sysdiagnose, this takes several minutes\n")
+		if archive, err = takeSysdiagnose(ctx, tmp); err != nil {
+			return err
+		}
+	}
+	root := archive
+	if fi, err := os.Stat(archive); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		fmt.Fprintf(w, "Unpacking %s\n", archive)
+		if root, err = unpackTarGz(archive, filepath.Join(tmp, `unpacked`)); err != nil {
+			return fmt.Errorf("Failed to unpack %s: %v", archive, err)
+		}
+	}
+
+	if dry {
+		igst = newDryRunMuxer(w)
+	} else {
+		igCfg, err := muxerConfig(cfg)
+		if err != nil {
+			return err
+		}
+		igCfg.Tags = sysdiagTags
+		if igst, err = ingest.NewUniformMuxer(igCfg); err != nil {
+			return err
+		}
+	}
+	if err := igst.Start(); err != nil {
+		return err
+	}
+	defer igst.Close()
+	if err := igst.WaitForHot(cfg.Global.Timeout()); err != nil {
+		return err
+	}
+	src, err := newSourceTracker(cfg.Global.Source_Override, cfg.Global.Source_Interface)
+	if err != nil {
+		return err
+	}
+	si := &sysdiagIngester{
+		w:      w,
+		src:    src,
+		tags:   map[string]entry.EntryTag{},
+		last:   last,
+		counts: map[string]int{},
+	}
+	for _, name := range sysdiagTags {
+		if si.tags[name], err = igst.GetTag(name); err != nil {
+			return err
+		}
+	}
+	if err := si.ingest(ctx, root); err != nil {
+		return err
+	}
+	if err := igst.Sync(cfg.Global.Timeout()); err != nil {
+		return fmt.Errorf("Failed to flush the entries: %v", err)
+	}
+	for _, name := range sysdiagTags {
+		fmt.Fprintf(w, "%-28s %d entries\n", name, si.counts[name])
+	}
+	return nil
+}
+
+// takeSysdiagnose runs sysdiagnose without any UI and returns the archive.
+func takeSysdiagnose(ctx context.Context, dir string) (string, error) {
+	name := `sysdiagnose-` + time.Now().Format(`20060102-150405`)
+	cmd := exec.CommandContext(ctx, "sysdiagnose", "-u", "-b", "-f", dir, "-A", name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return ``, fmt.Errorf("sysdiagnose failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, name+`*.tar.gz`))
+	if len(matches) == 0 {
+		return ``, fmt.Errorf("sysdiagnose left no archive in %s", dir)
+	}
+	return matches[0], nil
+}
+
+// unpackTarGz unpacks the archive into dir and returns the directory the
+// sysdiagnose is in, the archive holds a single top level directory.
+func unpackTarGz(archive, dir string) (string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return ``, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	top := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ``, err
+		}
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == `..` || strings.HasPrefix(name, `../`) {
+			// never write outside dir
+			continue
+		}
+		top[strings.SplitN(name, `/`, 2)[0]] = true
+		p := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0700)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(p), 0700); err == nil {
+				err = writeTarFile(p, tr)
+			}
+		}
+		if err != nil {
+			return ``, err
+		}
+	}
+	if len(top) == 1 {
+		for t := range top {
+			return filepath.Join(dir, t), nil
+		}
+	}
+	return dir, nil
+}
+
+func writeTarFile(p string, r io.Reader) error {
+	out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ingest finds the components by name anywhere in the sysdiagnose.
+func (si *sysdiagIngester) ingest(ctx context.Context, root string) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := fi.Name()
+		if fi.IsDir() {
+			if filepath.Ext(name) == `.logarchive` {
+				fmt.Fprintf(si.w, "Ingesting the unified log from %s\n", name)
+				if err := si.logArchive(ctx, p); err != nil {
+					fmt.Fprintf(si.w, "  %v\n", err)
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var err2 error
+		switch {
+		case name == `ps.txt`:
+			err2 = si.ps(ctx, p)
+		case name == `netstat.txt`:
+			err2 = si.netstat(ctx, p)
+		case name == `spindump.txt` || filepath.Ext(name) == `.spin` || filepath.Ext(name) == `.hang`:
+			err2 = si.spindump(ctx, p)
+		default:
+			return nil
+		}
+		if err2 != nil {
+			fmt.Fprintf(si.w, "Failed to ingest %s: %v\n", p, err2)
+		}
+		return nil
+	})
+}
+
+func (si *sysdiagIngester) write(ctx context.Context, tag string, ts time.Time, data []byte) error {
+	si.counts[tag]++
+	return igst.WriteEntryContext(ctx, &entry.Entry{
+		TS:   entry.FromStandard(ts),
+		SRC:  si.src.get(),
+		Tag:  si.tags[tag],
+		Data: data,
+	})
+}
+
+func (si *sysdiagIngester) writeJSON(ctx context.Context, tag string, ts time.Time, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return si.write(ctx, tag, ts, b)
+}
+
+// logArchive ingests the archived unified log with log show, as ndjson so
+// each record is a line.
+func (si *sysdiagIngester) logArchive(ctx context.Context, p string) error {
+	args := []string{"show", "--archive", p, "--style", "ndjson", "--info", "--debug"}
+	if si.last > 0 {
+		args = append(args, "--last", fmt.Sprintf("%ds", int(si.last.Seconds())))
+	}
+	cmd := exec.CommandContext(ctx, "log", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(out, 256*1024)
+	for {
+		line, rerr := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var ev struct {
+				Timestamp string `json:"timestamp"`
+			}
+			// the closing summary has no timestamp
+			if json.Unmarshal(line, &ev) == nil && ev.Timestamp != `` {
+				ts, terr := time.Parse(logTimestampFormat, ev.Timestamp)
+				if terr != nil {
+					ts = time.Now()
+				}
+				if err = si.write(ctx, sysdiagLogTag, ts, line); err != nil {
+					break
+				}
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		io.Copy(io.Discard, out)
+	}
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// spindump ingests a spindump as a single report entry.
+func (si *sysdiagIngester) spindump(ctx context.Context, p string) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	dr := diagReport{File: strings.TrimPrefix(p, filepath.Dir(filepath.Dir(p))+`/`)}
+	ts, err := spindumpParser(`spindump`)(b, &dr)
+	if err != nil {
+		return err
+	}
+	if len(dr.Text) > defaultMaxReportKB*1024 {
+		dr.Text, dr.Truncated = ``, true
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return si.writeJSON(ctx, sysdiagSpindumpTag, ts, dr)
+}
+
+// ps ingests each process in the ps snapshot.
+func (si *sysdiagIngester) ps(ctx context.Context, p string) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	procs := parsePsTable(b)
+	ts := fileTime(p)
+	for _, proc := range procs {
+		if err := si.writeJSON(ctx, sysdiagPsTag, ts, proc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// netstat ingests each connection in the netstat snapshot.
+func (si *sysdiagIngester) netstat(ctx context.Context, p string) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	ts := fileTime(p)
+	for _, c := range parseNetstatConns(b) {
+		if err := si.writeJSON(ctx, sysdiagNetstatTag, ts, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileTime(p string) time.Time {
+	if fi, err := os.Stat(p); err == nil {
+		return fi.ModTime()
+	}
+	return time.Now()
+}
+
+// parsePsTable reads ps output, the first line that starts with USER is the
+// header and the last column, the command, takes the rest of each row.
+func parsePsTable(b []byte) (procs []psProcess) {
+	var cols []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if cols == nil {
+			if f := strings.Fields(line); len(f) > 1 && f[0] == `USER` {
+				cols = make([]string, len(f))
+				for i, c := range f {
+					cols[i] = strings.ToLower(strings.TrimPrefix(c, `%`))
+				}
+			}
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < len(cols) {
+			continue
+		}
+		proc := psProcess{`type`: `ps`}
+		for i, c := range cols[:len(cols)-1] {
+			proc[c] = f[i]
+		}
+		proc[cols[len(cols)-1]] = strings.Join(f[len(cols)-1:], ` `)
+		procs = append(procs, proc)
+	}
+	return
+}
+
+// parseNetstatConns reads the tcp and udp rows of netstat output,
+// "tcp4  0  0  10.0.0.2.52000  17.0.0.1.443  ESTABLISHED ...".
+func parseNetstatConns(b []byte) (conns []netstatConn) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 5 || !(strings.HasPrefix(f[0], `tcp`) || strings.HasPrefix(f[0], `udp`)) {
+			continue
+		}
+		rq, err1 := strconv.Atoi(f[1])
+		sq, err2 := strconv.Atoi(f[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		c := netstatConn{
+			Type:    `netstat`,
+			Proto:   f[0],
+			RecvQ:   rq,
+			SendQ:   sq,
+			Local:   f[3],
+			Foreign: f[4],
+		}
+		if strings.HasPrefix(f[0], `tcp`) && len(f) > 5 {
+			c.State = f[5]
+		}
+		conns = append(conns, c)
+	}
+	return
+}
@@ -0,0 +1,200 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	testConnTimeout = 10 * time.Second
+	testEntryType   = `connection_test`
+)
+
+type testEntry struct {
+	Type     string    `json:"type"`
+	Hostname string    `json:"hostname"`
+	Target   string    `json:"target"`
+	Time     time.Time `json:"time"`
+}
+
+// testConnections checks each backend target in turn: name resolution,
+// the network connection, the TLS session, and then a full ingest
+// handshake with tag negotiation and a test entry.  Results are written to
+// w, it returns false if any target failed.
+func testConnections(w io.Writer, cfg *cfgType) bool {
+	conns, err := cfg.Global.Targets()
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return false
+	} else if len(conns) == 0 {
+		fmt.Fprintf(w, "No backend targets are configured\n")
+		return false
+	}
+	// a test shouldn't need the config to have been run before
+	if _, ok := cfg.Global.IngesterUUID(); !ok {
+		cfg.Global.Ingester_UUID = uuid.New().String()
+	}
+	ok := true
+	for _, c := range conns {
+		fmt.Fprintf(w, "%s\n", c)
+		if err := testTarget(w, cfg, c); err != nil {
+			fmt.Fprintf(w, "  FAILED: %v\n", err)
+			ok = false
+		} else {
+			fmt.Fprintf(w, "  OK\n")
+		}
+	}
+	return ok
+}
+
+func testTarget(w io.Writer, cfg *cfgType, target string) error {
+	var network, addr string
+	var useTLS bool
+	switch {
+	case strings.HasPrefix(target, `tcp://`):
+		network, addr = `tcp`, strings.TrimPrefix(target, `tcp://`)
+	case strings.HasPrefix(target, `tls://`):
+		network, addr, useTLS = `tcp`, strings.TrimPrefix(target, `tls://`), true
+	case strings.HasPrefix(target, `pipe://`):
+		network, addr = `unix`, strings.TrimPrefix(target, `pipe://`)
+	default:
+		return fmt.Errorf("unknown target type")
+	}
+
+	if network == `tcp` {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupHost(context.Background(), host)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %v", host, err)
+		}
+		fmt.Fprintf(w, "  resolved %s to %s in %v\n", host, strings.Join(addrs, ", "), roundLatency(time.Since(start)))
+		addr = net.JoinHostPort(addrs[0], port)
+		if useTLS {
+			if err = testTLS(w, addr, host, !cfg.Global.InsecureSkipTLSVerification()); err != nil {
+				return err
+			}
+		}
+	}
+	start := time.Now()
+	c, err := net.DialTimeout(network, addr, testConnTimeout)
+	if err != nil {
+		return fmt.Errorf("connecting: %v", err)
+	}
+	c.Close()
+	fmt.Fprintf(w, "  connected in %v\n", roundLatency(time.Since(start)))
+
+	igCfg, err := muxerConfig(cfg)
+	if err != nil {
+		return err
+	}
+	igCfg.Destinations = []string{target}
+	igCfg.Tags = []string{cfg.Global.Tag_Name}
+	// nothing from a test should linger in the cache
+	igCfg.CachePath = ``
+	igCfg.CacheMode = ``
+	im, err := ingest.NewUniformMuxer(igCfg)
+	if err != nil {
+		return err
+	}
+	defer im.Close()
+	start = time.Now()
+	if err = im.Start(); err != nil {
+		return err
+	}
+	if err = im.WaitForHot(testConnTimeout); err != nil {
+		return fmt.Errorf("ingest handshake: %v", err)
+	}
+	tag, err := im.NegotiateTag(cfg.Global.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("negotiating tag %q: %v", cfg.Global.Tag_Name, err)
+	}
+	fmt.Fprintf(w, "  authenticated and negotiated tag %q in %v\n", cfg.Global.Tag_Name, roundLatency(time.Since(start)))
+
+	te := testEntry{
+		Type:   testEntryType,
+		Target: target,
+		Time:   time.Now(),
+	}
+	te.Hostname, _ = os.Hostname()
+	b, err := json.Marshal(te)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), testConnTimeout)
+	defer cancel()
+	if err = im.WriteEntryContext(ctx, &entry.Entry{TS: entry.FromStandard(te.Time), Tag: tag, Data: b}); err != nil {
+		return fmt.Errorf("sending test entry: %v", err)
+	}
+	if err = im.Sync(testConnTimeout); err != nil {
+		return fmt.Errorf("syncing test entry: %v", err)
+	}
+	fmt.Fprintf(w, "  sent a %s entry in %v\n", testEntryType, roundLatency(time.Since(start)))
+	return nil
+}
+
+// testTLS makes a TLS connection on its own so the session details can be
+// reported, verification failures are the most common deployment problem.
+func testTLS(w io.Writer, addr, serverName string, verify bool) error {
+	start := time.Now()
+	d := &net.Dialer{Timeout: testConnTimeout}
+	c, err := tls.DialWithDialer(d, `tcp`, addr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !verify,
+	})
+	if err != nil {
+		return fmt.Errorf("TLS handshake: %v", err)
+	}
+	defer c.Close()
+	st := c.ConnectionState()
+	fmt.Fprintf(w, "  TLS handshake in %v: %s, %s\n", roundLatency(time.Since(start)), tlsVersionName(st.Version), tls.CipherSuiteName(st.CipherSuite))
+	if len(st.PeerCertificates) > 0 {
+		cert := st.PeerCertificates[0]
+		fmt.Fprintf(w, "  certificate %s issued by %s, expires %s\n", cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	}
+	if !verify {
+		fmt.Fprintf(w, "  certificate NOT verified, Insecure-Skip-TLS-Verify is set\n")
+	}
+	return nil
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return `TLS 1.0`
+	case tls.VersionTLS11:
+		return `TLS 1.1`
+	case tls.VersionTLS12:
+		return `TLS 1.2`
+	case tls.VersionTLS13:
+		return `TLS 1.3`
+	}
+	return fmt.Sprintf("TLS 0x%04x", v)
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
@@ -0,0 +1,141 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUIDCacheTimeout = 10 * time.Minute
+	maxUIDCacheEntries     = 4096
+	maxUIDLookups          = 4 // id(1) lookups running at once
+)
+
+var (
+	// matches things like "uid=501", "euid: 0" and "UID 502" in messages
+	msgUIDRegex = regexp.MustCompile(`(?i)\b[er]?uid[=:]?\s?(\d+)\b`)
+)
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+// uidResolver resolves numeric user IDs to user names.  Lookups go through
+// the system resolver, uids it doesn't know are handed to id(1) in the
+// background so directory (e.g. Active Directory) accounts work without
+// forking on the hot path.  Results, misses included, are cached and the
+// cache is bounded since any number after "uid" in a message is looked up.
+type uidResolver struct {
+	sync.Mutex
+	timeout time.Duration
+	cache   map[int]cachedName
+	pending map[int]bool // uids id(1) is looking up
+}
+
+func newUIDResolver(timeout time.Duration) *uidResolver {
+	if timeout <= 0 {
+		timeout = defaultUIDCacheTimeout
+	}
+	return &uidResolver{
+		timeout: timeout,
+		cache:   map[int]cachedName{},
+		pending: map[int]bool{},
+	}
+}
+
+func (r *uidResolver) enrich(ev *event) {
+	if ev.UserID != nil {
+		if name, ok := r.lookup(*ev.UserID); ok {
+			ev.Set("userName", name)
+		}
+	}
+	if ev.EventMessage == `` {
+		return
+	}
+	var users map[string]string
+	for _, m := range msgUIDRegex.FindAllStringSubmatch(ev.EventMessage, -1) {
+		uid, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		if name, ok := r.lookup(uid); ok {
+			if users == nil {
+				users = map[string]string{}
+			}
+			users[m[1]] = name
+		}
+	}
+	if users != nil {
+		ev.Set("messageUsers", users)
+	}
+}
+
+func (r *uidResolver) lookup(uid int) (name string, ok bool) {
+	now := time.Now()
+	r.Lock()
+	cn, hit := r.cache[uid]
+	r.Unlock()
+	if hit && now.Before(cn.expires) {
+		return cn.name, cn.name != ``
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	r.Lock()
+	r.store(uid, name, now)
+	if name == `` && !r.pending[uid] && len(r.pending) < maxUIDLookups {
+		r.pending[uid] = true
+		go r.resolve(uid)
+	}
+	r.Unlock()
+	return name, name != ``
+}
+
+// resolve asks id(1) for a uid the Go resolver doesn't know, it can see
+// directory services the Go resolver can't in non-cgo builds.  Records
+// with the uid get the name once it is cached.
+func (r *uidResolver) resolve(uid int) {
+	var name string
+	if out, err := exec.Command("id", "-un", strconv.Itoa(uid)).Output(); err == nil {
+		name = strings.TrimSpace(string(out))
+	}
+	r.Lock()
+	delete(r.pending, uid)
+	if name != `` {
+		r.store(uid, name, time.Now())
+	}
+	r.Unlock()
+}
+
+// store caches a result, the caller must hold the lock.  A full cache
+// sheds its expired entries first and then arbitrary ones.
+func (r *uidResolver) store(uid int, name string, now time.Time) {
+	if _, ok := r.cache[uid]; !ok && len(r.cache) >= maxUIDCacheEntries {
+		for k, cn := range r.cache {
+			if !now.Before(cn.expires) {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < maxUIDCacheEntries {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[uid] = cachedName{name: name, expires: now.Add(r.timeout)}
+}
@@ -0,0 +1,77 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	validateDialTimeout = 5 * time.Second
+)
+
+// validateConfig parses and verifies the config without touching it and
+// optionally checks that each backend target can be reached, problems are
+// written to w.  It returns false if anything is wrong.
+func validateConfig(w io.Writer, path string, connect bool) bool {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", path, err)
+		return false
+	}
+	conns, err := cfg.Global.Targets()
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", path, err)
+		return false
+	}
+	ok := true
+	if connect {
+		for _, c := range conns {
+			if err := checkTarget(c); err != nil {
+				fmt.Fprintf(w, "%s: target %s is unreachable: %v\n", path, c, err)
+				ok = false
+			}
+		}
+	}
+	if ok {
+		fmt.Fprintf(w, "%s is valid\n", path)
+	}
+	return ok
+}
+
+// checkTarget makes sure something is listening at a backend target, it
+// doesn't authenticate.
+func checkTarget(target string) error {
+	var network, addr string
+	switch {
+	case strings.HasPrefix(target, `tcp://`):
+		network, addr = `tcp`, strings.TrimPrefix(target, `tcp://`)
+	case strings.HasPrefix(target, `tls://`):
+		network, addr = `tcp`, strings.TrimPrefix(target, `tls://`)
+	case strings.HasPrefix(target, `pipe://`):
+		network, addr = `unix`, strings.TrimPrefix(target, `pipe://`)
+	default:
+		return fmt.Errorf("unknown target type")
+	}
+	if network == `unix` {
+		if _, err := os.Stat(addr); err != nil {
+			return err
+		}
+	}
+	c, err := net.DialTimeout(network, addr, validateDialTimeout)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
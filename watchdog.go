@@ -0,0 +1,49 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultStreamIdleTimeout = 10 * time.Minute
+)
+
+// watchStream kills the log child if it hasn't written anything for the
+// idle timeout, log stream has been seen to wedge without exiting.  Killing
+// the child makes the decoder fail so the normal restart path takes over.
+// A narrow predicate can legitimately be quiet for a long time, so the
+// timeout is configurable and can be disabled.
+func watchStream(ctx context.Context, dec *decoder, cmd *exec.Cmd, idle time.Duration, done <-chan struct{}) {
+	check := idle / 4
+	if check < time.Second {
+		check = time.Second
+	}
+	tckr := time.NewTicker(check)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-tckr.C:
+			if since := time.Since(dec.lastActivity()); since > idle {
+				lg.Warn("log stream has been silent for %v, restarting it\n", since.Round(time.Second))
+				if cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStateStoreLocation = `/opt/gravwell/etc/macosLog.state`
+
+	// format of the timestamp field in log stream records
+	logTimestampFormat = `2006-01-02 15:04:05.000000-0700`
+
+	watermarkHashes = 8192
+	// records can arrive slightly out of order across processes, anything
+	// this far behind the high-water mark during catch up is assumed sent
+	watermarkSlack = 2 * time.Second
+)
+
+// watermarkState is the persisted form of the watermark.
+type watermarkState struct {
+	Timestamp  time.Time // newest record handed to the pipeline
+	Checkpoint time.Time // newest record successfully written to the muxer
+	Stopped    time.Time `json:",omitempty"` // when the ingester last shut down cleanly
+	Hashes     []uint64
+}
+
+// watermark is the ingester's resume state.  It records the timestamp of
+// the last record successfully written so a restart can backfill the gap,
+// and when deduplication is enabled it also tracks the newest record handed
+// to the pipeline along with hashes of the most recent records so records
+// replayed after a restart (e.g. by the backfill) are not ingested twice.
+// Records older than the mark are only dropped while catching up, once a
+// record newer than the mark is seen only exact duplicates are dropped so a
+// clock change can't discard live records.
+type watermark struct {
+	sync.Mutex
+	path     string
+	dedup    bool
+	ckpt     time.Time
+	stopped  time.Time
+	ts       time.Time
+	ring     []uint64
+	idx      int
+	set      map[uint64]struct{}
+	catchup  bool
+	dirty    bool
+	dupCount uint64
+}
+
+// loadWatermark reads the watermark from path, a missing file is not an error.
+func loadWatermark(path string, dedup bool) (*watermark, error) {
+	w := &watermark{
+		path:  path,
+		dedup: dedup,
+		ring:  make([]uint64, 0, watermarkHashes),
+		set:   make(map[uint64]struct{}, watermarkHashes),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return w, nil
+		}
+		return nil, err
+	}
+	var st watermarkState
+	if err = json.Unmarshal(b, &st); err != nil {
+		lg.Warn("Ignoring corrupt state file %s: %v\n", path, err)
+		return w, nil
+	}
+	w.ts = st.Timestamp
+	w.ckpt = st.Checkpoint
+	w.stopped = st.Stopped
+	w.catchup = !w.ts.IsZero()
+	for _, h := range st.Hashes {
+		w.add(h)
+	}
+	return w, nil
+}
+
+// Checkpoint returns the timestamp of the last record known to be written.
+func (w *watermark) Checkpoint() time.Time {
+	w.Lock()
+	defer w.Unlock()
+	return w.ckpt
+}
+
+// Stopped returns when the ingester last shut down cleanly, it is zero
+// after a crash.
+func (w *watermark) Stopped() time.Time {
+	w.Lock()
+	defer w.Unlock()
+	return w.stopped
+}
+
+// markStopped records a clean shutdown, a crash leaves it unset.
+func (w *watermark) markStopped() {
+	w.Lock()
+	w.stopped = time.Now()
+	w.dirty = true
+	w.Unlock()
+}
+
+// setCheckpoint advances the checkpoint, it never moves backwards.
+func (w *watermark) setCheckpoint(ts time.Time) {
+	w.Lock()
+	if ts.After(w.ckpt) {
+		w.ckpt = ts
+		w.dirty = true
+	}
+	w.Unlock()
+}
+
+func (w *watermark) keep(ev *event) bool {
+	if !w.dedup {
+		return true
+	}
+	h := recordHash(ev)
+	ts, tsErr := time.Parse(logTimestampFormat, ev.Timestamp)
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.set[h]; ok {
+		w.dupCount++
+		return false
+	}
+	if tsErr == nil {
+		if w.catchup {
+			if ts.Before(w.ts.Add(-watermarkSlack)) {
+				w.dupCount++
+				return false
+			} else if ts.After(w.ts) {
+				w.catchup = false
+			}
+		}
+		if ts.After(w.ts) {
+			w.ts = ts
+		}
+	}
+	w.add(h)
+	w.dirty = true
+	return true
+}
+
+func (w *watermark) add(h uint64) {
+	if len(w.ring) < cap(w.ring) {
+		w.ring = append(w.ring, h)
+	} else {
+		delete(w.set, w.ring[w.idx])
+		w.ring[w.idx] = h
+		w.idx = (w.idx + 1) % len(w.ring)
+	}
+	w.set[h] = struct{}{}
+}
+
+// persist writes the watermark out if it has changed.
+func (w *watermark) persist() error {
+	w.Lock()
+	if !w.dirty {
+		w.Unlock()
+		return nil
+	}
+	st := watermarkState{
+		Timestamp:  w.ts,
+		Checkpoint: w.ckpt,
+		Stopped:    w.stopped,
+		Hashes:     make([]uint64, 0, len(w.ring)),
+	}
+	// oldest first so a reload keeps the same eviction order
+	st.Hashes = append(st.Hashes, w.ring[w.idx:]...)
+	st.Hashes = append(st.Hashes, w.ring[:w.idx]...)
+	w.dirty = false
+	w.Unlock()
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w.path, b, 0640)
+}
+
+func (w *watermark) report() {
+	w.Lock()
+	n := w.dupCount
+	w.dupCount = 0
+	w.Unlock()
+	if n > 0 {
+		lg.Info("Deduplication dropped %d previously ingested records\n", n)
+	}
+}
+
+// recordHash identifies a record by fields that are the same whether it
+// came from log stream or log show, the rest of the JSON can differ.
+func recordHash(ev *event) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(ev.Timestamp))
+	h.Write([]byte(strconv.FormatUint(ev.MachTimestamp, 10)))
+	h.Write([]byte(strconv.Itoa(ev.ProcessID)))
+	h.Write([]byte(strconv.FormatUint(ev.ThreadID, 10)))
+	h.Write([]byte(ev.EventMessage))
+	return h.Sum64()
+}
@@ -0,0 +1,210 @@
+/*************************************************************************
+ * Copyright 2021 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultXProtectTag      = `macos-xprotect`
+	defaultXProtectInterval = `5m`
+	defaultXProtectStore    = `/opt/gravwell/etc/macosLog.xprotect`
+	xprotectStreamName      = `xprotect`
+
+	// XProtect Remediator logs each scan result as JSON under this
+	// subsystem and category
+	xprotectSubsystem  = `com.apple.XProtectFramework.PluginAPI`
+	xprotectStructured = `XPEvent.structured`
+)
+
+// the records of XProtect, its remediator plugins, and the older MRT
+const xprotectPredicate = `subsystem BEGINSWITH "com.apple.XProtectFramework" OR process BEGINSWITH "XProtect" OR process == "MRT"`
+
+// xprotectConfig is the [XProtect] block.  The unified log records are
+// read by a stream of their own, the plist reports by a collector.
+type xprotectConfig struct {
+	Enable           bool
+	Tag_Name         string
+	Report_Directory []string // directories scanned for XProtect Remediator plist reports
+	Interval         string   // how often the report directories are scanned
+	Store_Location   string   // file the processed reports are tracked in
+}
+
+func (xc *xprotectConfig) verify() error {
+	if !xc.Enable {
+		return nil
+	}
+	if xc.Tag_Name == `` {
+		xc.Tag_Name = defaultXProtectTag
+	}
+	if xc.Interval == `` {
+		xc.Interval = defaultXProtectInterval
+	}
+	if _, err := (snapshotConfig{Interval: xc.Interval}).interval(); err != nil {
+		return fmt.Errorf("XProtect: %v", err)
+	}
+	return nil
+}
+
+func (xc xprotectConfig) storeLocation() string {
+	if xc.Store_Location == `` {
+		return defaultXProtectStore
+	}
+	return xc.Store_Location
+}
+
+// xprotectParser decodes the JSON result payload of XProtect Remediator's
+// structured records into an xprotect field.
+type xprotectParser struct{}
+
+func (xprotectParser) enrich(ev *event) {
+	if ev.Subsystem != xprotectSubsystem || ev.Category != xprotectStructured {
+		return
+	}
+	if payload, ok := xprotectPayload(ev.EventMessage); ok {
+		ev.Set("xprotect", payload)
+	}
+}
+
+// xprotectPayload returns the JSON object in a message, which may follow a
+// short prefix.
+func xprotectPayload(msg string) (map[string]interface{}, bool) {
+	i := strings.IndexByte(msg, '{')
+	if i < 0 {
+		return nil, false
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(msg[i:]), &payload); err != nil {
+		return nil, false
+	}
+	return payload, true
+}
+
+// xprotectReport is the entry written for each plist report, converted to
+// JSON when plutil can, otherwise kept as XML text.
+type xprotectReport struct {
+	Type   string          `json:"type"`
+	File   string          `json:"file"`
+	Report json.RawMessage `json:"report,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+// xprotectCollector ingests new plist reports from the report directories.
+type xprotectCollector struct {
+	tag      entry.EntryTag
+	interval time.Duration
+	dirs     []string
+	src      *sourceTracker
+	done     *processedFiles
+}
+
+func startXProtectCollector(ctx context.Context, wg *sync.WaitGroup, cfg xprotectConfig, src *sourceTracker, ephemeral bool) error {
+	if len(cfg.Report_Directory) == 0 {
+		// just the stream
+		return nil
+	}
+	tag, err := igst.GetTag(cfg.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve XProtect tag %q: %v", cfg.Tag_Name, err)
+	}
+	interval, err := (snapshotConfig{Interval: cfg.Interval}).interval()
+	if err != nil {
+		return err
+	}
+	xc := &xprotectCollector{
+		tag:      tag,
+		interval: interval,
+		dirs:     cfg.Report_Directory,
+		src:      src,
+		done:     loadProcessedFiles(cfg.storeLocation(), ephemeral),
+	}
+	wg.Add(1)
+	go xc.run(ctx, wg)
+	return nil
+}
+
+func (xc *xprotectCollector) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tckr := time.NewTicker(xc.interval)
+	defer tckr.Stop()
+	for {
+		if err := xc.scan(ctx); err != nil {
+			if err == context.Canceled {
+				return
+			}
+			lg.Error("Failed to ingest XProtect reports: %v\n", err)
+		}
+		if err := xc.done.persist(); err != nil {
+			lg.Warn("Failed to save processed XProtect reports: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (xc *xprotectCollector) scan(ctx context.Context) error {
+	now := time.Now()
+	present := map[string]bool{}
+	for _, dir := range xc.dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				lg.Debug("Failed to read %s: %v\n", dir, err)
+			}
+			continue
+		}
+		for _, fi := range fis {
+			if filepath.Ext(fi.Name()) != `.plist` || !fi.Mode().IsRegular() {
+				continue
+			}
+			p := filepath.Join(dir, fi.Name())
+			present[p] = true
+			if xc.done.done(p, fi.ModTime()) || now.Sub(fi.ModTime()) < reportSettle {
+				continue
+			}
+			if err := xc.ingest(ctx, p, fi); ctx.Err() != nil {
+				return context.Canceled
+			} else if err != nil {
+				lg.Warn("Failed to ingest XProtect report %s: %v\n", p, err)
+			}
+			xc.done.mark(p, fi.ModTime())
+		}
+	}
+	xc.done.prune(present)
+	return nil
+}
+
+func (xc *xprotectCollector) ingest(ctx context.Context, p string, fi os.FileInfo) error {
+	xr := xprotectReport{Type: `xprotect_report`, File: p}
+	// plists holding data or dates can't be converted to JSON
+	if out, err := exec.CommandContext(ctx, "plutil", "-convert", "json", "-o", "-", p).Output(); err == nil && json.Valid(out) {
+		xr.Report = json.RawMessage(bytes.TrimSpace(out))
+	} else if out, err = exec.CommandContext(ctx, "plutil", "-convert", "xml1", "-o", "-", p).Output(); err == nil {
+		xr.Text = string(out)
+	} else {
+		return err
+	}
+	return emitJSON(ctx, xc.tag, xc.src, fi.ModTime(), xr)
+}